@@ -5,7 +5,7 @@ SELECT count(DISTINCT machine_id) FROM metrics WHERE time > now() - interval '5
 SELECT count(DISTINCT machine_id) FROM metrics WHERE time > now() - interval '1 minute'
 
 -- Active Alerts (unacknowledged)
-SELECT count(*) FROM alerts WHERE acknowledged = false
+SELECT count(*) FROM alerts WHERE state IN ('active', 'resolved')
 
 -- Metrics per second (last minute)
 SELECT count(*)::float / 60 FROM metrics WHERE time > now() - interval '1 minute'
@@ -86,7 +86,7 @@ SELECT
   a.message
 FROM alerts a
 LEFT JOIN machines m ON m.id = a.machine_id
-WHERE a.acknowledged = false
+WHERE a.state IN ('active', 'resolved')
 ORDER BY a.created_at DESC
 LIMIT 20
 
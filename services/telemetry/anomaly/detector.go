@@ -0,0 +1,276 @@
+package anomaly
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+const (
+	MethodZScore = "zscore"
+	MethodEWMA   = "ewma"
+	MethodMAD    = "mad"
+)
+
+// madScale converts a median absolute deviation into a standard-deviation
+// equivalent for normally distributed data.
+const madScale = 1.4826
+
+// maxScore caps scores against a zero-spread baseline so results stay JSON encodable.
+const maxScore = 1e6
+
+// Config describes how readings of one metric are checked.
+type Config struct {
+	MetricName      string  `json:"metric_name"`
+	Method          string  `json:"method"`
+	WindowSize      int     `json:"window_size"`
+	Threshold       float64 `json:"threshold"`
+	Alpha           float64 `json:"alpha,omitempty"`
+	MinSamples      int     `json:"min_samples"`
+	MinSpread       float64 `json:"min_spread"`
+	CooldownSeconds int     `json:"cooldown_seconds"`
+	Enabled         bool    `json:"enabled"`
+}
+
+func (c Config) Validate() error {
+	switch c.Method {
+	case MethodZScore, MethodMAD, MethodSeasonal:
+	case MethodEWMA:
+		if c.Alpha <= 0 || c.Alpha >= 1 {
+			return fmt.Errorf("alpha must be between 0 and 1 for ewma")
+		}
+	default:
+		return fmt.Errorf("unknown method %q", c.Method)
+	}
+	if c.MetricName == "" {
+		return fmt.Errorf("metric_name is required")
+	}
+	if c.WindowSize < 2 {
+		return fmt.Errorf("window_size must be at least 2")
+	}
+	if c.Threshold <= 0 {
+		return fmt.Errorf("threshold must be positive")
+	}
+	if c.CooldownSeconds < 0 {
+		return fmt.Errorf("cooldown_seconds must not be negative")
+	}
+	if c.MinSamples > c.WindowSize && (c.Method == MethodZScore || c.Method == MethodMAD) {
+		return fmt.Errorf("min_samples must not exceed window_size")
+	}
+	return nil
+}
+
+// Baseline is the learned normal behaviour a reading was compared against.
+type Baseline struct {
+	Method  string  `json:"method"`
+	Center  float64 `json:"center"`
+	Spread  float64 `json:"spread"`
+	Lower   float64 `json:"lower"`
+	Upper   float64 `json:"upper"`
+	Samples int     `json:"samples"`
+}
+
+// Result is the outcome of checking a single reading.
+type Result struct {
+	Value    float64   `json:"value"`
+	Score    float64   `json:"score"`
+	Baseline Baseline  `json:"baseline"`
+	Window   []float64 `json:"window"`
+}
+
+// Anomalous reports whether the reading falls outside the learned bounds.
+func (r Result) Anomalous(threshold float64) bool {
+	return r.Score >= threshold
+}
+
+// Severity grades an anomalous result by how far past the threshold it is.
+func Severity(score, threshold float64) string {
+	if score >= threshold*1.5 {
+		return "critical"
+	}
+	return "warning"
+}
+
+// Detector keeps a baseline for one machine/metric series. Observe scores the
+// reading against the baseline learned so far and then folds it in; ready is
+// false until enough samples have been seen to trust the baseline.
+type Detector interface {
+	Observe(value float64) (result Result, ready bool)
+}
+
+func NewDetector(cfg Config) Detector {
+	switch cfg.Method {
+	case MethodEWMA:
+		return &ewmaDetector{cfg: cfg, recent: newRing(cfg.WindowSize)}
+	case MethodMAD:
+		return &madDetector{cfg: cfg, window: newRing(cfg.WindowSize)}
+	default:
+		return &zscoreDetector{cfg: cfg, window: newRing(cfg.WindowSize)}
+	}
+}
+
+type ring struct {
+	values []float64
+	next   int
+	full   bool
+}
+
+func newRing(size int) *ring {
+	return &ring{values: make([]float64, size)}
+}
+
+func (r *ring) push(v float64) {
+	r.values[r.next] = v
+	r.next = (r.next + 1) % len(r.values)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// snapshot returns the buffered values oldest first.
+func (r *ring) snapshot() []float64 {
+	if !r.full {
+		return append([]float64(nil), r.values[:r.next]...)
+	}
+	out := make([]float64, 0, len(r.values))
+	out = append(out, r.values[r.next:]...)
+	return append(out, r.values[:r.next]...)
+}
+
+func score(value, center, spread, minSpread float64) float64 {
+	spread = math.Max(spread, minSpread)
+	if spread == 0 {
+		if value == center {
+			return 0
+		}
+		return maxScore
+	}
+	return math.Min(math.Abs(value-center)/spread, maxScore)
+}
+
+func bounds(method string, center, spread float64, cfg Config, samples int) Baseline {
+	width := math.Max(spread, cfg.MinSpread) * cfg.Threshold
+	return Baseline{
+		Method:  method,
+		Center:  center,
+		Spread:  spread,
+		Lower:   center - width,
+		Upper:   center + width,
+		Samples: samples,
+	}
+}
+
+type zscoreDetector struct {
+	cfg    Config
+	window *ring
+}
+
+func (d *zscoreDetector) Observe(value float64) (Result, bool) {
+	window := d.window.snapshot()
+	d.window.push(value)
+
+	mean, stddev := meanStddev(window)
+	result := Result{
+		Value:    value,
+		Score:    score(value, mean, stddev, d.cfg.MinSpread),
+		Baseline: bounds(MethodZScore, mean, stddev, d.cfg, len(window)),
+		Window:   window,
+	}
+	return result, len(window) >= d.cfg.MinSamples && len(window) > 1
+}
+
+type ewmaDetector struct {
+	cfg      Config
+	recent   *ring
+	mean     float64
+	variance float64
+	samples  int
+}
+
+func (d *ewmaDetector) Observe(value float64) (Result, bool) {
+	window := d.recent.snapshot()
+	d.recent.push(value)
+
+	stddev := math.Sqrt(d.variance)
+	result := Result{
+		Value:    value,
+		Score:    score(value, d.mean, stddev, d.cfg.MinSpread),
+		Baseline: bounds(MethodEWMA, d.mean, stddev, d.cfg, d.samples),
+		Window:   window,
+	}
+	ready := d.samples >= d.cfg.MinSamples && d.samples > 1
+
+	if d.samples == 0 {
+		d.mean = value
+	} else {
+		diff := value - d.mean
+		incr := d.cfg.Alpha * diff
+		d.mean += incr
+		d.variance = (1 - d.cfg.Alpha) * (d.variance + diff*incr)
+	}
+	d.samples++
+
+	return result, ready
+}
+
+type madDetector struct {
+	cfg    Config
+	window *ring
+}
+
+func (d *madDetector) Observe(value float64) (Result, bool) {
+	window := d.window.snapshot()
+	d.window.push(value)
+
+	median, mad := medianMAD(window)
+	spread := mad * madScale
+	result := Result{
+		Value:    value,
+		Score:    score(value, median, spread, d.cfg.MinSpread),
+		Baseline: bounds(MethodMAD, median, spread, d.cfg, len(window)),
+		Window:   window,
+	}
+	return result, len(window) >= d.cfg.MinSamples && len(window) > 1
+}
+
+func meanStddev(values []float64) (float64, float64) {
+	if len(values) == 0 {
+		return 0, 0
+	}
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(len(values))
+	if len(values) < 2 {
+		return mean, 0
+	}
+
+	var sq float64
+	for _, v := range values {
+		sq += (v - mean) * (v - mean)
+	}
+	return mean, math.Sqrt(sq / float64(len(values)-1))
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+func medianMAD(values []float64) (float64, float64) {
+	med := median(values)
+	deviations := make([]float64, len(values))
+	for i, v := range values {
+		deviations[i] = math.Abs(v - med)
+	}
+	return med, median(deviations)
+}
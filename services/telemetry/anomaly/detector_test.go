@@ -0,0 +1,304 @@
+package anomaly
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// steady returns n readings varying smoothly by up to 0.1 around center.
+func steady(n int, center float64) []float64 {
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = center + 0.1*math.Sin(float64(i)*0.9)
+	}
+	return values
+}
+
+// alternating returns n readings alternating 0.1 either side of center,
+// whose mean and spread are easy to state exactly.
+func alternating(n int, center float64) []float64 {
+	values := make([]float64, n)
+	for i := range values {
+		if i%2 == 0 {
+			values[i] = center - 0.1
+		} else {
+			values[i] = center + 0.1
+		}
+	}
+	return values
+}
+
+func constant(n int, value float64) []float64 {
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = value
+	}
+	return values
+}
+
+func concat(parts ...[]float64) []float64 {
+	var values []float64
+	for _, p := range parts {
+		values = append(values, p...)
+	}
+	return values
+}
+
+// flagged feeds a series through a fresh detector and returns the indexes it
+// flags along with every result.
+func flagged(cfg Config, series []float64) ([]int, []Result) {
+	d := NewDetector(cfg)
+	var indexes []int
+	results := make([]Result, len(series))
+	for i, v := range series {
+		result, ready := d.Observe(v)
+		results[i] = result
+		if ready && result.Anomalous(cfg.Threshold) {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes, results
+}
+
+func testConfigs() []Config {
+	return []Config{
+		{MetricName: "pressure", Method: MethodZScore, WindowSize: 20, Threshold: 3, MinSamples: 10},
+		{MetricName: "pressure", Method: MethodEWMA, WindowSize: 20, Threshold: 3, Alpha: 0.1, MinSamples: 10},
+		{MetricName: "pressure", Method: MethodMAD, WindowSize: 20, Threshold: 3, MinSamples: 10},
+	}
+}
+
+func TestDetectorsFlagSyntheticSeries(t *testing.T) {
+	tests := []struct {
+		name         string
+		series       []float64
+		wantFirst    int // -1 when nothing should be flagged
+		wantSeverity string
+	}{
+		{"steady", steady(100, 10), -1, ""},
+		{"step change", concat(steady(40, 10), constant(5, 20)), 40, "critical"},
+		{"spike", concat(steady(40, 10), []float64{14}, steady(20, 10)), 40, "critical"},
+		{"dip", concat(steady(40, 10), []float64{6}, steady(20, 10)), 40, "critical"},
+		{"spike before min_samples", concat(steady(5, 10), []float64{14}, steady(20, 10)), -1, ""},
+		{"constant", constant(60, 5), -1, ""},
+		{"constant then change", concat(constant(40, 5), []float64{5.01}), 40, "critical"},
+	}
+	for _, cfg := range testConfigs() {
+		if err := cfg.Validate(); err != nil {
+			t.Fatalf("%s config: %v", cfg.Method, err)
+		}
+		for _, tt := range tests {
+			indexes, results := flagged(cfg, tt.series)
+			if tt.wantFirst < 0 {
+				if len(indexes) > 0 {
+					t.Errorf("%s/%s: flagged %v, want none", cfg.Method, tt.name, indexes)
+				}
+				continue
+			}
+			if len(indexes) == 0 || indexes[0] != tt.wantFirst {
+				t.Errorf("%s/%s: flagged %v, want first %d", cfg.Method, tt.name, indexes, tt.wantFirst)
+				continue
+			}
+			if got := Severity(results[tt.wantFirst].Score, cfg.Threshold); got != tt.wantSeverity {
+				t.Errorf("%s/%s: severity %s (score %.2f), want %s", cfg.Method, tt.name, got, results[tt.wantFirst].Score, tt.wantSeverity)
+			}
+		}
+	}
+}
+
+func TestDetectorsReturnAfterSpike(t *testing.T) {
+	// A lone spike must not leave the series flagged once it is back to normal.
+	series := concat(steady(40, 10), []float64{14}, steady(20, 10))
+	for _, cfg := range testConfigs() {
+		indexes, _ := flagged(cfg, series)
+		if !reflect.DeepEqual(indexes, []int{40}) {
+			t.Errorf("%s: flagged %v, want [40]", cfg.Method, indexes)
+		}
+	}
+}
+
+func TestDetectorSeverityGrades(t *testing.T) {
+	// The window before the reading holds ten of 9.9 and ten of 10.1, so the
+	// mean is 10 and the sample standard deviation sqrt(0.2/19).
+	cfg := Config{MetricName: "pressure", Method: MethodZScore, WindowSize: 20, Threshold: 3, MinSamples: 10}
+	stddev := math.Sqrt(0.2 / 19)
+
+	tests := []struct {
+		deviations   float64
+		wantFlagged  bool
+		wantSeverity string
+	}{
+		{2.5, false, ""},
+		{3.5, true, "warning"},
+		{4.4, true, "warning"},
+		{4.6, true, "critical"},
+		{-3.5, true, "warning"},
+	}
+	for _, tt := range tests {
+		series := append(alternating(40, 10), 10+tt.deviations*stddev)
+		indexes, results := flagged(cfg, series)
+		last := results[len(series)-1]
+		if got := len(indexes) == 1 && indexes[0] == 40; got != tt.wantFlagged {
+			t.Errorf("%.1f stddev: flagged %v, want flagged=%v", tt.deviations, indexes, tt.wantFlagged)
+			continue
+		}
+		if math.Abs(last.Score-math.Abs(tt.deviations)) > 1e-6 {
+			t.Errorf("%.1f stddev: score %f", tt.deviations, last.Score)
+		}
+		if tt.wantFlagged {
+			if got := Severity(last.Score, cfg.Threshold); got != tt.wantSeverity {
+				t.Errorf("%.1f stddev: severity %s, want %s", tt.deviations, got, tt.wantSeverity)
+			}
+		}
+	}
+}
+
+func TestDetectorWindowAndBaseline(t *testing.T) {
+	series := concat(alternating(40, 10), []float64{14})
+	// The reading is scored against the window before it, oldest first.
+	wantWindow := series[20:40]
+
+	tests := []struct {
+		cfg         Config
+		wantCenter  float64
+		wantSpread  float64
+		wantSamples int
+	}{
+		{testConfigs()[0], 10, math.Sqrt(0.2 / 19), 20},
+		// Half the window sits 0.1 either side of the 10 median.
+		{testConfigs()[2], 10, 0.1 * madScale, 20},
+	}
+	for _, tt := range tests {
+		_, results := flagged(tt.cfg, series)
+		r := results[40]
+		if r.Value != 14 {
+			t.Errorf("%s: value %v, want 14", tt.cfg.Method, r.Value)
+		}
+		if !reflect.DeepEqual(r.Window, wantWindow) {
+			t.Errorf("%s: window %v, want %v", tt.cfg.Method, r.Window, wantWindow)
+		}
+		b := r.Baseline
+		if b.Method != tt.cfg.Method || b.Samples != tt.wantSamples {
+			t.Errorf("%s: baseline method %s samples %d, want %s %d", tt.cfg.Method, b.Method, b.Samples, tt.cfg.Method, tt.wantSamples)
+		}
+		if math.Abs(b.Center-tt.wantCenter) > 1e-9 || math.Abs(b.Spread-tt.wantSpread) > 1e-9 {
+			t.Errorf("%s: baseline center %v spread %v, want %v %v", tt.cfg.Method, b.Center, b.Spread, tt.wantCenter, tt.wantSpread)
+		}
+		width := tt.wantSpread * tt.cfg.Threshold
+		if math.Abs(b.Lower-(tt.wantCenter-width)) > 1e-9 || math.Abs(b.Upper-(tt.wantCenter+width)) > 1e-9 {
+			t.Errorf("%s: bounds %v..%v, want %v..%v", tt.cfg.Method, b.Lower, b.Upper, tt.wantCenter-width, tt.wantCenter+width)
+		}
+	}
+
+	// The EWMA window is the recent readings; its baseline counts every
+	// reading seen and settles near the series mean.
+	cfg := testConfigs()[1]
+	_, results := flagged(cfg, series)
+	r := results[40]
+	if !reflect.DeepEqual(r.Window, wantWindow) {
+		t.Errorf("ewma: window %v, want %v", r.Window, wantWindow)
+	}
+	if r.Baseline.Method != MethodEWMA || r.Baseline.Samples != 40 {
+		t.Errorf("ewma: baseline method %s samples %d, want ewma 40", r.Baseline.Method, r.Baseline.Samples)
+	}
+	if math.Abs(r.Baseline.Center-10) > 0.1 || r.Baseline.Spread <= 0 || r.Baseline.Spread > 0.2 {
+		t.Errorf("ewma: baseline center %v spread %v, want near 10 and 0.1", r.Baseline.Center, r.Baseline.Spread)
+	}
+}
+
+func TestDetectorWindowBeforeFull(t *testing.T) {
+	cfg := testConfigs()[0]
+	_, results := flagged(cfg, []float64{1, 2, 3, 4})
+	if !reflect.DeepEqual(results[3].Window, []float64{1, 2, 3}) {
+		t.Errorf("window %v, want [1 2 3]", results[3].Window)
+	}
+	if len(results[0].Window) != 0 {
+		t.Errorf("first window %v, want empty", results[0].Window)
+	}
+}
+
+func TestDetectorZeroVariance(t *testing.T) {
+	for _, cfg := range testConfigs() {
+		_, results := flagged(cfg, concat(constant(40, 5), []float64{5, 5.01}))
+		if got := results[40]; got.Score != 0 || got.Baseline.Spread != 0 {
+			t.Errorf("%s: unchanged reading scored %v with spread %v, want 0", cfg.Method, got.Score, got.Baseline.Spread)
+		}
+		// Any change from a zero-spread baseline is capped, not infinite.
+		if got := results[41].Score; got != maxScore {
+			t.Errorf("%s: changed reading scored %v, want %v", cfg.Method, got, maxScore)
+		}
+
+		// min_spread keeps a small change on a flat series from counting.
+		cfg.MinSpread = 0.05
+		indexes, results := flagged(cfg, concat(constant(40, 5), []float64{5.01}))
+		if len(indexes) != 0 {
+			t.Errorf("%s with min_spread: flagged %v, want none", cfg.Method, indexes)
+		}
+		if got := results[40].Score; math.Abs(got-0.2) > 1e-9 {
+			t.Errorf("%s with min_spread: score %v, want 0.2", cfg.Method, got)
+		}
+		if b := results[40].Baseline; math.Abs(b.Upper-5.15) > 1e-9 {
+			t.Errorf("%s with min_spread: upper bound %v, want 5.15", cfg.Method, b.Upper)
+		}
+	}
+}
+
+func TestRawData(t *testing.T) {
+	cfg := testConfigs()[0]
+	_, results := flagged(cfg, concat(alternating(40, 10), []float64{14}))
+	data, err := rawData(cfg, results[40], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var raw struct {
+		Value     float64   `json:"value"`
+		Score     float64   `json:"score"`
+		Threshold float64   `json:"threshold"`
+		Baseline  Baseline  `json:"baseline"`
+		Window    []float64 `json:"window"`
+		Segment   *Segment  `json:"segment"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if raw.Value != 14 || raw.Threshold != 3 || raw.Score != results[40].Score {
+		t.Errorf("raw_data value %v threshold %v score %v", raw.Value, raw.Threshold, raw.Score)
+	}
+	if !reflect.DeepEqual(raw.Baseline, results[40].Baseline) {
+		t.Errorf("raw_data baseline %+v, want %+v", raw.Baseline, results[40].Baseline)
+	}
+	if len(raw.Window) != cfg.WindowSize || raw.Window[0] != 9.9 || raw.Window[cfg.WindowSize-1] != 10.1 {
+		t.Errorf("raw_data window %v", raw.Window)
+	}
+	if raw.Segment != nil {
+		t.Errorf("raw_data segment %+v, want none", raw.Segment)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := Config{MetricName: "pressure", Method: MethodZScore, WindowSize: 20, Threshold: 3, MinSamples: 10}
+	tests := []struct {
+		name   string
+		modify func(*Config)
+		ok     bool
+	}{
+		{"valid", func(*Config) {}, true},
+		{"unknown method", func(c *Config) { c.Method = "iqr" }, false},
+		{"ewma without alpha", func(c *Config) { c.Method = MethodEWMA }, false},
+		{"ewma alpha 1", func(c *Config) { c.Method, c.Alpha = MethodEWMA, 1 }, false},
+		{"window too small", func(c *Config) { c.WindowSize = 1 }, false},
+		{"zero threshold", func(c *Config) { c.Threshold = 0 }, false},
+		{"min_samples over window", func(c *Config) { c.MinSamples = 21 }, false},
+		{"ewma min_samples over window", func(c *Config) { c.Method, c.Alpha, c.MinSamples = MethodEWMA, 0.1, 50 }, true},
+	}
+	for _, tt := range tests {
+		cfg := valid
+		tt.modify(&cfg)
+		if err := cfg.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: Validate() = %v, want ok=%v", tt.name, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,505 @@
+package anomaly
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	HealthScoreMetric = "health_score"
+
+	healthRunningState   = 3
+	healthScoreInterval  = 30 * time.Second
+	healthTrainingPeriod = 24 * time.Hour
+	healthCooldown       = 10 * time.Minute
+	healthTopContributor = 3
+)
+
+// HealthMetrics are the correlated pump signals the health model covers.
+var HealthMetrics = []string{"bearing_wear", "seal_condition", "vibration", "temperature", "current"}
+
+// chiSquare999 holds the 99.9th percentile of the chi-square distribution by
+// degrees of freedom; its square root bounds the Mahalanobis distance of a
+// healthy reading.
+var chiSquare999 = []float64{0, 10.828, 13.816, 16.266, 18.467, 20.515, 22.458, 24.322, 26.124, 27.877, 29.588}
+
+var ErrInsufficientData = errors.New("not enough healthy samples to train a model")
+
+// Reading is a derived metric value the service computes, such as a health
+// score.
+type Reading struct {
+	Time       time.Time
+	MachineID  uuid.UUID
+	MetricName string
+	Value      float64
+	Unit       string
+	Quality    string
+}
+
+// IngestFunc stores a derived reading the way ingested readings are stored,
+// so it also reaches the latest-value cache, live streams and alerting.
+type IngestFunc func(ctx context.Context, r Reading) error
+
+// HealthModel is the mean and covariance of a pump's metrics over a period
+// when it was known to be healthy.
+type HealthModel struct {
+	MachineID   uuid.UUID   `json:"machine_id"`
+	Metrics     []string    `json:"metrics"`
+	Mean        []float64   `json:"mean"`
+	Covariance  [][]float64 `json:"covariance"`
+	Samples     int         `json:"samples"`
+	Threshold   float64     `json:"threshold"`
+	TrainedFrom time.Time   `json:"trained_from"`
+	TrainedTo   time.Time   `json:"trained_to"`
+	TrainedAt   time.Time   `json:"trained_at"`
+
+	inverse [][]float64
+}
+
+// Contribution is one metric's share of the squared distance.
+type Contribution struct {
+	MetricName string  `json:"metric_name"`
+	Value      float64 `json:"value"`
+	Expected   float64 `json:"expected"`
+	Share      float64 `json:"share"`
+}
+
+// FitHealthModel builds a model from complete observation vectors ordered as metrics.
+func FitHealthModel(metrics []string, samples [][]float64) (*HealthModel, error) {
+	d := len(metrics)
+	if len(samples) < 10*d {
+		return nil, ErrInsufficientData
+	}
+
+	mean := make([]float64, d)
+	for _, x := range samples {
+		for i := range x {
+			mean[i] += x[i]
+		}
+	}
+	for i := range mean {
+		mean[i] /= float64(len(samples))
+	}
+
+	cov := make([][]float64, d)
+	for i := range cov {
+		cov[i] = make([]float64, d)
+	}
+	for _, x := range samples {
+		for i := 0; i < d; i++ {
+			for j := 0; j < d; j++ {
+				cov[i][j] += (x[i] - mean[i]) * (x[j] - mean[j])
+			}
+		}
+	}
+
+	// A small ridge keeps metrics that barely moved during training (e.g. a
+	// new pump's bearing wear) from making the matrix singular.
+	var trace float64
+	for i := 0; i < d; i++ {
+		for j := 0; j < d; j++ {
+			cov[i][j] /= float64(len(samples) - 1)
+		}
+		trace += cov[i][i]
+	}
+	ridge := math.Max(trace/float64(d)*1e-3, 1e-6)
+	for i := 0; i < d; i++ {
+		cov[i][i] += ridge
+	}
+
+	inverse, err := invert(cov)
+	if err != nil {
+		return nil, err
+	}
+
+	threshold := math.Sqrt(chiSquare999[len(chiSquare999)-1])
+	if d < len(chiSquare999) {
+		threshold = math.Sqrt(chiSquare999[d])
+	}
+
+	return &HealthModel{
+		Metrics:    metrics,
+		Mean:       mean,
+		Covariance: cov,
+		Samples:    len(samples),
+		Threshold:  threshold,
+		inverse:    inverse,
+	}, nil
+}
+
+// Score returns the Mahalanobis distance of x from the healthy mean and each
+// metric's contribution, largest first.
+func (m *HealthModel) Score(x []float64) (float64, []Contribution) {
+	d := len(m.Metrics)
+	diff := make([]float64, d)
+	for i := range diff {
+		diff[i] = x[i] - m.Mean[i]
+	}
+
+	weighted := make([]float64, d)
+	for i := 0; i < d; i++ {
+		for j := 0; j < d; j++ {
+			weighted[i] += m.inverse[i][j] * diff[j]
+		}
+	}
+
+	var sq float64
+	terms := make([]float64, d)
+	for i := range diff {
+		terms[i] = diff[i] * weighted[i]
+		sq += terms[i]
+	}
+	sq = math.Max(sq, 0)
+
+	contributions := make([]Contribution, d)
+	for i, name := range m.Metrics {
+		share := 0.0
+		if sq > 0 {
+			share = terms[i] / sq
+		}
+		contributions[i] = Contribution{MetricName: name, Value: x[i], Expected: m.Mean[i], Share: share}
+	}
+	sort.Slice(contributions, func(a, b int) bool { return contributions[a].Share > contributions[b].Share })
+
+	return math.Sqrt(sq), contributions
+}
+
+func invert(a [][]float64) ([][]float64, error) {
+	n := len(a)
+	aug := make([][]float64, n)
+	for i := range a {
+		aug[i] = make([]float64, 2*n)
+		copy(aug[i], a[i])
+		aug[i][n+i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(aug[row][col]) > math.Abs(aug[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(aug[pivot][col]) < 1e-12 {
+			return nil, fmt.Errorf("covariance matrix is singular")
+		}
+		aug[col], aug[pivot] = aug[pivot], aug[col]
+
+		p := aug[col][col]
+		for j := range aug[col] {
+			aug[col][j] /= p
+		}
+		for row := 0; row < n; row++ {
+			if row == col {
+				continue
+			}
+			factor := aug[row][col]
+			for j := range aug[row] {
+				aug[row][j] -= factor * aug[col][j]
+			}
+		}
+	}
+
+	inverse := make([][]float64, n)
+	for i := range aug {
+		inverse[i] = append([]float64(nil), aug[i][n:]...)
+	}
+	return inverse, nil
+}
+
+// TrainHealthModel fits and stores a model from minute averages recorded
+// between from and to while the pump was running.
+func TrainHealthModel(ctx context.Context, pool *pgxpool.Pool, machineID uuid.UUID, from, to time.Time) (*HealthModel, error) {
+	rows, err := pool.Query(ctx,
+		`SELECT time_bucket('1 minute', time) AS bucket, metric_name, avg(value)
+		 FROM metrics
+		 WHERE machine_id = $1 AND metric_name = ANY($2) AND time >= $3 AND time < $4
+		 GROUP BY bucket, metric_name
+		 ORDER BY bucket`,
+		machineID, append([]string{operatingStateMetric}, HealthMetrics...), from, to,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := make(map[time.Time]map[string]float64)
+	var order []time.Time
+	for rows.Next() {
+		var bucket time.Time
+		var name string
+		var value float64
+		if err := rows.Scan(&bucket, &name, &value); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if _, ok := buckets[bucket]; !ok {
+			buckets[bucket] = make(map[string]float64)
+			order = append(order, bucket)
+		}
+		buckets[bucket][name] = value
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var samples [][]float64
+	for _, bucket := range order {
+		if x, ok := healthVector(HealthMetrics, buckets[bucket]); ok {
+			samples = append(samples, x)
+		}
+	}
+
+	model, err := FitHealthModel(HealthMetrics, samples)
+	if err != nil {
+		return nil, err
+	}
+	model.MachineID = machineID
+	model.TrainedFrom = from
+	model.TrainedTo = to
+	model.TrainedAt = time.Now()
+
+	if err := saveHealthModel(ctx, pool, model); err != nil {
+		return nil, err
+	}
+	return model, nil
+}
+
+// healthVector orders values as metrics, rejecting incomplete readings and
+// readings taken while the pump wasn't running.
+func healthVector(metrics []string, values map[string]float64) ([]float64, bool) {
+	if state, ok := values[operatingStateMetric]; !ok || math.Round(state) != healthRunningState {
+		return nil, false
+	}
+	x := make([]float64, len(metrics))
+	for i, name := range metrics {
+		v, ok := values[name]
+		if !ok {
+			return nil, false
+		}
+		x[i] = v
+	}
+	return x, true
+}
+
+func saveHealthModel(ctx context.Context, pool *pgxpool.Pool, m *HealthModel) error {
+	mean, err := json.Marshal(m.Mean)
+	if err != nil {
+		return err
+	}
+	cov, err := json.Marshal(m.Covariance)
+	if err != nil {
+		return err
+	}
+	_, err = pool.Exec(ctx,
+		`INSERT INTO health_models (machine_id, metrics, mean, covariance, samples, threshold, trained_from, trained_to, trained_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		 ON CONFLICT (machine_id) DO UPDATE SET
+			metrics = EXCLUDED.metrics, mean = EXCLUDED.mean, covariance = EXCLUDED.covariance,
+			samples = EXCLUDED.samples, threshold = EXCLUDED.threshold,
+			trained_from = EXCLUDED.trained_from, trained_to = EXCLUDED.trained_to, trained_at = EXCLUDED.trained_at`,
+		m.MachineID, m.Metrics, mean, cov, m.Samples, m.Threshold, m.TrainedFrom, m.TrainedTo, m.TrainedAt,
+	)
+	return err
+}
+
+// GetHealthModel loads the stored model for a machine, or nil if none has been trained.
+func GetHealthModel(ctx context.Context, pool *pgxpool.Pool, machineID uuid.UUID) (*HealthModel, error) {
+	models, err := listHealthModels(ctx, pool, &machineID)
+	if err != nil || len(models) == 0 {
+		return nil, err
+	}
+	return models[0], nil
+}
+
+func listHealthModels(ctx context.Context, pool *pgxpool.Pool, machineID *uuid.UUID) ([]*HealthModel, error) {
+	rows, err := pool.Query(ctx,
+		`SELECT machine_id, metrics, mean, covariance, samples, threshold, trained_from, trained_to, trained_at
+		 FROM health_models WHERE $1::uuid IS NULL OR machine_id = $1`,
+		machineID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var models []*HealthModel
+	for rows.Next() {
+		var m HealthModel
+		if err := rows.Scan(&m.MachineID, &m.Metrics, &m.Mean, &m.Covariance, &m.Samples, &m.Threshold, &m.TrainedFrom, &m.TrainedTo, &m.TrainedAt); err != nil {
+			return nil, err
+		}
+		if m.inverse, err = invert(m.Covariance); err != nil {
+			log.Printf("Skipping health model for machine %s: %v", m.MachineID, err)
+			continue
+		}
+		models = append(models, &m)
+	}
+	return models, rows.Err()
+}
+
+// StartHealthScoring scores every trained pump against its health model,
+// records the distance as the health_score metric and raises an anomaly
+// naming the top contributing metrics when it exceeds the model threshold.
+// Pumps without a model are trained on their first day of data. Scores are
+// stored through ingest.
+func (s *Service) StartHealthScoring(ctx context.Context, ingest IngestFunc) {
+	ticker := time.NewTicker(healthScoreInterval)
+	defer ticker.Stop()
+
+	log.Println("Starting pump health scoring")
+	lastAnomaly := make(map[uuid.UUID]time.Time)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.trainMissingHealthModels(ctx)
+
+			models, err := listHealthModels(ctx, s.db, nil)
+			if err != nil {
+				log.Printf("Failed to load health models: %v", err)
+				continue
+			}
+			for _, model := range models {
+				if err := s.scoreHealth(ctx, model, lastAnomaly, ingest); err != nil {
+					log.Printf("Failed to score health for machine %s: %v", model.MachineID, err)
+				}
+			}
+		}
+	}
+}
+
+func (s *Service) trainMissingHealthModels(ctx context.Context) {
+	rows, err := s.db.Query(ctx,
+		`SELECT m.id, (SELECT min(time) FROM metrics WHERE machine_id = m.id) AS first_seen
+		 FROM machines m
+		 WHERE NOT EXISTS (SELECT 1 FROM health_models h WHERE h.machine_id = m.id)`)
+	if err != nil {
+		log.Printf("Failed to find untrained machines: %v", err)
+		return
+	}
+	type candidate struct {
+		id        uuid.UUID
+		firstSeen *time.Time
+	}
+	var candidates []candidate
+	for rows.Next() {
+		var c candidate
+		if err := rows.Scan(&c.id, &c.firstSeen); err == nil {
+			candidates = append(candidates, c)
+		}
+	}
+	rows.Close()
+
+	for _, c := range candidates {
+		if c.firstSeen == nil || time.Since(*c.firstSeen) < healthTrainingPeriod {
+			continue
+		}
+		s.mu.Lock()
+		attempted := s.healthAttempted[c.id]
+		s.healthAttempted[c.id] = time.Now()
+		s.mu.Unlock()
+		if time.Since(attempted) < healthTrainingPeriod {
+			continue
+		}
+
+		from := *c.firstSeen
+		model, err := TrainHealthModel(ctx, s.db, c.id, from, from.Add(healthTrainingPeriod))
+		if err != nil {
+			log.Printf("Failed to train health model for machine %s: %v", c.id, err)
+			continue
+		}
+		log.Printf("Trained health model for machine %s on %d samples", c.id, model.Samples)
+	}
+}
+
+func (s *Service) scoreHealth(ctx context.Context, model *HealthModel, lastAnomaly map[uuid.UUID]time.Time, ingest IngestFunc) error {
+	rows, err := s.db.Query(ctx,
+		`SELECT metric_name, avg(value)
+		 FROM metrics
+		 WHERE machine_id = $1 AND metric_name = ANY($2) AND time > NOW() - interval '1 minute'
+		 GROUP BY metric_name`,
+		model.MachineID, append([]string{operatingStateMetric}, model.Metrics...),
+	)
+	if err != nil {
+		return err
+	}
+	values := make(map[string]float64)
+	for rows.Next() {
+		var name string
+		var value float64
+		if err := rows.Scan(&name, &value); err != nil {
+			rows.Close()
+			return err
+		}
+		values[name] = value
+	}
+	rows.Close()
+
+	x, ok := healthVector(model.Metrics, values)
+	if !ok {
+		return nil
+	}
+
+	now := time.Now()
+	distance, contributions := model.Score(x)
+	err = ingest(ctx, Reading{
+		Time:       now,
+		MachineID:  model.MachineID,
+		MetricName: HealthScoreMetric,
+		Value:      distance,
+		Unit:       "mahalanobis",
+		Quality:    "derived",
+	})
+	if err != nil {
+		return err
+	}
+
+	if distance < model.Threshold || now.Sub(lastAnomaly[model.MachineID]) < healthCooldown {
+		return nil
+	}
+	lastAnomaly[model.MachineID] = now
+
+	top := contributions
+	if len(top) > healthTopContributor {
+		top = top[:healthTopContributor]
+	}
+	names := make([]string, len(top))
+	for i, c := range top {
+		names[i] = fmt.Sprintf("%s %.2f (expected %.2f, %.0f%%)", c.MetricName, c.Value, c.Expected, c.Share*100)
+	}
+
+	severity := Severity(distance, model.Threshold)
+	description := fmt.Sprintf("Health score %.2f exceeds %.2f; top contributors: %s", distance, model.Threshold, strings.Join(names, ", "))
+	rawData, err := json.Marshal(map[string]interface{}{
+		"score":         distance,
+		"threshold":     model.Threshold,
+		"contributions": contributions,
+		"trained_from":  model.TrainedFrom,
+		"trained_to":    model.TrainedTo,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(ctx,
+		"INSERT INTO anomalies (machine_id, metric_name, detected_at, severity, description, raw_data) VALUES ($1, $2, $3, $4, $5, $6)",
+		model.MachineID, HealthScoreMetric, now, severity, description, rawData,
+	)
+	if err != nil {
+		return err
+	}
+	log.Printf("ANOMALY [%s] machine %s: %s", severity, model.MachineID, description)
+	return nil
+}
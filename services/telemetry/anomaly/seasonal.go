@@ -0,0 +1,241 @@
+package anomaly
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	MethodSeasonal = "seasonal"
+
+	// operatingStateMetric is reported by the pumps as 0=stopped, 1=stopping,
+	// 2=starting, 3=running.
+	operatingStateMetric = "operating_state"
+
+	// anySegment marks a coarser baseline that spans every value of a dimension.
+	anySegment = -1
+
+	baselineLookback = 28 * 24 * time.Hour
+	baselineRelearn  = 24 * time.Hour
+)
+
+// Segment identifies the operating regime and time slot a reading belongs to.
+type Segment struct {
+	OperatingState int `json:"operating_state"`
+	DayOfWeek      int `json:"day_of_week"`
+	HourOfDay      int `json:"hour_of_day"`
+}
+
+// SegmentBaseline is a learned distribution for one machine, metric and segment.
+type SegmentBaseline struct {
+	MachineID    uuid.UUID `json:"machine_id"`
+	MetricName   string    `json:"metric_name"`
+	Segment      Segment   `json:"segment"`
+	Samples      int       `json:"samples"`
+	Mean         float64   `json:"mean"`
+	Stddev       float64   `json:"stddev"`
+	Median       float64   `json:"median"`
+	RobustSpread float64   `json:"robust_spread"`
+	LearnedAt    time.Time `json:"learned_at"`
+}
+
+type baselineKey struct {
+	machineID  uuid.UUID
+	metricName string
+	segment    Segment
+}
+
+// segmentFor places a reading in its most specific segment.
+func segmentFor(state int, at time.Time, loc *time.Location) Segment {
+	local := at.In(loc)
+	return Segment{OperatingState: state, DayOfWeek: int(local.Weekday()), HourOfDay: local.Hour()}
+}
+
+// fallbacks lists the segments to try, most specific first: the exact hour of
+// the week, the hour of any day, the operating state alone, then everything.
+func (seg Segment) fallbacks() []Segment {
+	return []Segment{
+		seg,
+		{seg.OperatingState, anySegment, seg.HourOfDay},
+		{seg.OperatingState, anySegment, anySegment},
+		{anySegment, anySegment, anySegment},
+	}
+}
+
+// lookupBaseline returns the most specific baseline with enough samples.
+func lookupBaseline(baselines map[baselineKey]SegmentBaseline, machineID uuid.UUID, metricName string, seg Segment, minSamples int) (SegmentBaseline, bool) {
+	for _, candidate := range seg.fallbacks() {
+		b, ok := baselines[baselineKey{machineID, metricName, candidate}]
+		if ok && b.Samples >= minSamples {
+			return b, true
+		}
+	}
+	return SegmentBaseline{}, false
+}
+
+func scoreSeasonal(value float64, b SegmentBaseline, cfg Config) Result {
+	return Result{
+		Value: value,
+		Score: score(value, b.Mean, b.Stddev, cfg.MinSpread),
+		Baseline: Baseline{
+			Method:  MethodSeasonal,
+			Center:  b.Mean,
+			Spread:  b.Stddev,
+			Lower:   b.Mean - math.Max(b.Stddev, cfg.MinSpread)*cfg.Threshold,
+			Upper:   b.Mean + math.Max(b.Stddev, cfg.MinSpread)*cfg.Threshold,
+			Samples: b.Samples,
+		},
+	}
+}
+
+// LearnBaselines recomputes segmented baselines for the given metrics from
+// historical readings and stores them in anomaly_baselines. Each reading is
+// tagged with the machine's operating state for the same minute.
+func LearnBaselines(ctx context.Context, pool *pgxpool.Pool, metrics []string, loc *time.Location, since time.Time) (int, error) {
+	if len(metrics) == 0 {
+		return 0, nil
+	}
+
+	tag, err := pool.Exec(ctx,
+		`WITH states AS (
+			SELECT machine_id, time_bucket('1 minute', time) AS bucket, round(last(value, time))::int AS state
+			FROM metrics
+			WHERE metric_name = $4 AND time > $1
+			GROUP BY machine_id, bucket
+		), readings AS (
+			SELECT m.machine_id, m.metric_name, m.value, s.state,
+			       EXTRACT(DOW FROM m.time AT TIME ZONE $3)::int AS dow,
+			       EXTRACT(HOUR FROM m.time AT TIME ZONE $3)::int AS hour
+			FROM metrics m
+			JOIN states s ON s.machine_id = m.machine_id AND s.bucket = time_bucket('1 minute', m.time)
+			WHERE m.metric_name = ANY($2) AND m.time > $1
+		)
+		INSERT INTO anomaly_baselines (machine_id, metric_name, operating_state, day_of_week, hour_of_day,
+			samples, mean, stddev, median, robust_spread, learned_from, learned_at)
+		SELECT machine_id, metric_name, COALESCE(state, -1), COALESCE(dow, -1), COALESCE(hour, -1),
+		       count(*), avg(value), COALESCE(stddev_samp(value), 0),
+		       percentile_cont(0.5) WITHIN GROUP (ORDER BY value),
+		       (percentile_cont(0.75) WITHIN GROUP (ORDER BY value) - percentile_cont(0.25) WITHIN GROUP (ORDER BY value)) / 1.349,
+		       $1, NOW()
+		FROM readings
+		GROUP BY GROUPING SETS (
+			(machine_id, metric_name, state, dow, hour),
+			(machine_id, metric_name, state, hour),
+			(machine_id, metric_name, state),
+			(machine_id, metric_name)
+		)
+		ON CONFLICT (machine_id, metric_name, operating_state, day_of_week, hour_of_day) DO UPDATE SET
+			samples = EXCLUDED.samples, mean = EXCLUDED.mean, stddev = EXCLUDED.stddev,
+			median = EXCLUDED.median, robust_spread = EXCLUDED.robust_spread,
+			learned_from = EXCLUDED.learned_from, learned_at = EXCLUDED.learned_at`,
+		since, metrics, loc.String(), operatingStateMetric,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("failed to learn baselines: %w", err)
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// ListBaselines reads persisted baselines, optionally narrowed to one machine or metric.
+func ListBaselines(ctx context.Context, pool *pgxpool.Pool, machineID *uuid.UUID, metricName string) ([]SegmentBaseline, error) {
+	rows, err := pool.Query(ctx,
+		`SELECT machine_id, metric_name, operating_state, day_of_week, hour_of_day, samples, mean, stddev, median, robust_spread, learned_at
+		 FROM anomaly_baselines
+		 WHERE ($1::uuid IS NULL OR machine_id = $1) AND ($2 = '' OR metric_name = $2)
+		 ORDER BY machine_id, metric_name, operating_state, day_of_week, hour_of_day`,
+		machineID, metricName,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var baselines []SegmentBaseline
+	for rows.Next() {
+		var b SegmentBaseline
+		if err := rows.Scan(&b.MachineID, &b.MetricName, &b.Segment.OperatingState, &b.Segment.DayOfWeek, &b.Segment.HourOfDay,
+			&b.Samples, &b.Mean, &b.Stddev, &b.Median, &b.RobustSpread, &b.LearnedAt); err != nil {
+			return nil, err
+		}
+		baselines = append(baselines, b)
+	}
+	return baselines, rows.Err()
+}
+
+// LoadBaselines replaces the in-memory seasonal baselines with the persisted set.
+func (s *Service) LoadBaselines(ctx context.Context) error {
+	baselines, err := ListBaselines(ctx, s.db, nil, "")
+	if err != nil {
+		return err
+	}
+
+	loaded := make(map[baselineKey]SegmentBaseline, len(baselines))
+	var newest time.Time
+	for _, b := range baselines {
+		loaded[baselineKey{b.MachineID, b.MetricName, b.Segment}] = b
+		if b.LearnedAt.After(newest) {
+			newest = b.LearnedAt
+		}
+	}
+
+	s.mu.Lock()
+	s.baselines = loaded
+	s.baselinesLearnedAt = newest
+	s.mu.Unlock()
+	log.Printf("Loaded %d seasonal baselines", len(loaded))
+	return nil
+}
+
+// RelearnBaselines learns baselines for every seasonal detector and reloads them.
+func (s *Service) RelearnBaselines(ctx context.Context) error {
+	s.mu.Lock()
+	var metrics []string
+	for name, cfg := range s.configs {
+		if cfg.Method == MethodSeasonal {
+			metrics = append(metrics, name)
+		}
+	}
+	s.mu.Unlock()
+
+	n, err := LearnBaselines(ctx, s.db, metrics, s.loc, time.Now().Add(-baselineLookback))
+	if err != nil {
+		return err
+	}
+	log.Printf("Learned %d seasonal baselines for %v", n, metrics)
+	return s.LoadBaselines(ctx)
+}
+
+// StartBaselineLearning loads persisted baselines and relearns them whenever
+// they are missing or older than a day.
+func (s *Service) StartBaselineLearning(ctx context.Context) {
+	if err := s.LoadBaselines(ctx); err != nil {
+		log.Printf("Failed to load seasonal baselines: %v", err)
+	}
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		s.mu.Lock()
+		stale := time.Since(s.baselinesLearnedAt) > baselineRelearn
+		s.mu.Unlock()
+
+		if stale {
+			if err := s.RelearnBaselines(ctx); err != nil {
+				log.Printf("Failed to relearn seasonal baselines: %v", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
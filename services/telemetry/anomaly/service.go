@@ -0,0 +1,230 @@
+package anomaly
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"telemetry/config"
+)
+
+type Service struct {
+	db      *pgxpool.Pool
+	loc     *time.Location
+	mu      sync.Mutex
+	configs map[string]Config
+	series  map[seriesKey]*series
+
+	states             map[uuid.UUID]int
+	baselines          map[baselineKey]SegmentBaseline
+	baselinesLearnedAt time.Time
+
+	healthAttempted map[uuid.UUID]time.Time
+}
+
+type seriesKey struct {
+	machineID  uuid.UUID
+	metricName string
+}
+
+type series struct {
+	detector    Detector
+	recent      *ring
+	lastAnomaly time.Time
+}
+
+func NewService(pool *pgxpool.Pool, cfg *config.Config) *Service {
+	loc, err := time.LoadLocation(cfg.Timezone)
+	if err != nil {
+		log.Printf("Unknown timezone %q, using UTC: %v", cfg.Timezone, err)
+		loc = time.UTC
+	}
+
+	s := &Service{
+		db:        pool,
+		loc:       loc,
+		series:    make(map[seriesKey]*series),
+		states:    make(map[uuid.UUID]int),
+		baselines: make(map[baselineKey]SegmentBaseline),
+
+		healthAttempted: make(map[uuid.UUID]time.Time),
+	}
+	s.LoadConfigs(context.Background())
+	return s
+}
+
+// LoadConfigs reads detector settings from anomaly_detectors. Series whose
+// configuration changed start learning a fresh baseline.
+func (s *Service) LoadConfigs(ctx context.Context) {
+	configs, err := ListConfigs(ctx, s.db)
+	if err != nil {
+		log.Printf("Failed to load anomaly detectors: %v", err)
+		return
+	}
+
+	enabled := make(map[string]Config)
+	for _, cfg := range configs {
+		if !cfg.Enabled {
+			continue
+		}
+		if err := cfg.Validate(); err != nil {
+			log.Printf("Skipping anomaly detector for %s: %v", cfg.MetricName, err)
+			continue
+		}
+		enabled[cfg.MetricName] = cfg
+	}
+
+	s.mu.Lock()
+	for key := range s.series {
+		if old, ok := s.configs[key.metricName]; !ok || old != enabled[key.metricName] {
+			delete(s.series, key)
+		}
+	}
+	s.configs = enabled
+	s.mu.Unlock()
+	log.Printf("Loaded %d anomaly detectors", len(enabled))
+}
+
+// Observe feeds a reading into the machine/metric baseline and records an
+// anomaly when it falls outside the learned bounds.
+func (s *Service) Observe(machineID uuid.UUID, metricName string, value float64, at time.Time) {
+	s.mu.Lock()
+	if metricName == operatingStateMetric {
+		s.states[machineID] = int(math.Round(value))
+	}
+
+	cfg, ok := s.configs[metricName]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+
+	key := seriesKey{machineID, metricName}
+	sr, ok := s.series[key]
+	if !ok {
+		sr = &series{recent: newRing(cfg.WindowSize)}
+		if cfg.Method != MethodSeasonal {
+			sr.detector = NewDetector(cfg)
+		}
+		s.series[key] = sr
+	}
+
+	var result Result
+	var ready bool
+	var segment *Segment
+	if cfg.Method == MethodSeasonal {
+		result, ready, segment = s.observeSeasonal(sr, machineID, metricName, value, at, cfg)
+	} else {
+		result, ready = sr.detector.Observe(value)
+	}
+
+	if !ready || !result.Anomalous(cfg.Threshold) || at.Sub(sr.lastAnomaly) < time.Duration(cfg.CooldownSeconds)*time.Second {
+		s.mu.Unlock()
+		return
+	}
+	sr.lastAnomaly = at
+	s.mu.Unlock()
+
+	if err := s.record(context.Background(), machineID, metricName, at, cfg, result, segment); err != nil {
+		log.Printf("Failed to record anomaly for machine %s: %v", machineID, err)
+	}
+}
+
+// observeSeasonal scores a reading against the persisted baseline for the
+// machine's current operating state and time slot. Callers hold s.mu.
+func (s *Service) observeSeasonal(sr *series, machineID uuid.UUID, metricName string, value float64, at time.Time, cfg Config) (Result, bool, *Segment) {
+	window := sr.recent.snapshot()
+	sr.recent.push(value)
+
+	state, ok := s.states[machineID]
+	if !ok {
+		return Result{}, false, nil
+	}
+
+	seg := segmentFor(state, at, s.loc)
+	b, ok := lookupBaseline(s.baselines, machineID, metricName, seg, cfg.MinSamples)
+	if !ok {
+		return Result{}, false, nil
+	}
+
+	result := scoreSeasonal(value, b, cfg)
+	result.Window = window
+	return result, true, &b.Segment
+}
+
+func (s *Service) record(ctx context.Context, machineID uuid.UUID, metricName string, at time.Time, cfg Config, result Result, segment *Segment) error {
+	severity := Severity(result.Score, cfg.Threshold)
+	description := fmt.Sprintf("%s %.2f outside expected range %.2f to %.2f (%s score %.1f)",
+		metricName, result.Value, result.Baseline.Lower, result.Baseline.Upper, cfg.Method, result.Score)
+
+	rawData, err := rawData(cfg, result, segment)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(ctx,
+		"INSERT INTO anomalies (machine_id, metric_name, detected_at, severity, description, raw_data) VALUES ($1, $2, $3, $4, $5, $6)",
+		machineID, metricName, at, severity, description, rawData,
+	)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("ANOMALY [%s] machine %s: %s", severity, machineID, description)
+	return nil
+}
+
+// rawData encodes what an anomaly was judged on, stored in its raw_data.
+func rawData(cfg Config, result Result, segment *Segment) ([]byte, error) {
+	raw := map[string]interface{}{
+		"value":     result.Value,
+		"score":     result.Score,
+		"threshold": cfg.Threshold,
+		"baseline":  result.Baseline,
+		"window":    result.Window,
+	}
+	if segment != nil {
+		raw["segment"] = segment
+	}
+	return json.Marshal(raw)
+}
+
+func ListConfigs(ctx context.Context, pool *pgxpool.Pool) ([]Config, error) {
+	rows, err := pool.Query(ctx,
+		`SELECT metric_name, method, window_size, threshold, COALESCE(alpha, 0), min_samples, min_spread, cooldown_seconds, enabled
+		 FROM anomaly_detectors ORDER BY metric_name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var configs []Config
+	for rows.Next() {
+		var c Config
+		if err := rows.Scan(&c.MetricName, &c.Method, &c.WindowSize, &c.Threshold, &c.Alpha, &c.MinSamples, &c.MinSpread, &c.CooldownSeconds, &c.Enabled); err != nil {
+			return nil, err
+		}
+		configs = append(configs, c)
+	}
+	return configs, rows.Err()
+}
+
+func SaveConfig(ctx context.Context, pool *pgxpool.Pool, c Config) error {
+	_, err := pool.Exec(ctx,
+		`INSERT INTO anomaly_detectors (metric_name, method, window_size, threshold, alpha, min_samples, min_spread, cooldown_seconds, enabled)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		 ON CONFLICT (metric_name) DO UPDATE SET
+			method = EXCLUDED.method, window_size = EXCLUDED.window_size, threshold = EXCLUDED.threshold,
+			alpha = EXCLUDED.alpha, min_samples = EXCLUDED.min_samples, min_spread = EXCLUDED.min_spread,
+			cooldown_seconds = EXCLUDED.cooldown_seconds, enabled = EXCLUDED.enabled, updated_at = NOW()`,
+		c.MetricName, c.Method, c.WindowSize, c.Threshold, c.Alpha, c.MinSamples, c.MinSpread, c.CooldownSeconds, c.Enabled,
+	)
+	return err
+}
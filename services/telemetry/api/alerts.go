@@ -0,0 +1,218 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"telemetry/processing"
+)
+
+func (s *Server) alertRoutes(r *mux.Router) {
+	r.HandleFunc("/api/v1/alerts", handle(s.listAlerts)).Methods("GET")
+	// Acknowledging predates the other alert endpoints and has always
+	// accepted any method.
+	r.HandleFunc("/api/v1/alerts/{id}/acknowledge", handle(s.acknowledgeAlert))
+	r.HandleFunc("/api/v1/alerts/{id}/close", handle(s.closeAlert)).Methods("POST")
+	r.HandleFunc("/api/v1/alerts/{id}/oncall", handle(s.alertOnCall)).Methods("GET")
+	r.HandleFunc("/api/v1/alerts/{id}/severity-history", handle(s.severityHistory)).Methods("GET")
+	r.HandleFunc("/api/v1/alerts/{id}/shelve", handle(s.shelveAlert)).Methods("POST")
+	r.HandleFunc("/api/v1/alerts/{id}/unshelve", handle(s.unshelveAlert)).Methods("POST")
+	r.HandleFunc("/api/v1/shelves", handle(s.listShelves)).Methods("GET")
+	r.HandleFunc("/api/v1/alarm-analytics/{report}", handle(s.alarmAnalytics)).Methods("GET")
+}
+
+func (s *Server) listAlerts(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+	var f AlertFilter
+	var err error
+
+	if v := query.Get("state"); v != "" {
+		f.States = strings.Split(v, ",")
+		for _, state := range f.States {
+			if !contains(processing.AlertStates, state) {
+				return errorf(http.StatusBadRequest, "invalid state %q", state)
+			}
+		}
+	}
+	if f.Acknowledged, err = queryBool(r, "acknowledged"); err != nil {
+		return err
+	}
+	if f.Cleared, err = queryBool(r, "cleared"); err != nil {
+		return err
+	}
+	f.Severity = query.Get("severity")
+	if f.Suppressed, err = queryBool(r, "suppressed"); err != nil {
+		return err
+	}
+	if f.MachineID, err = queryUUID(r, "machine_id"); err != nil {
+		return err
+	}
+
+	alerts, err := s.Alerts.ListAlerts(r.Context(), f)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, alerts)
+	return nil
+}
+
+func (s *Server) acknowledgeAlert(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "alert")
+	if err != nil {
+		return err
+	}
+	// Clients written before acknowledgements were attributed send no user;
+	// they are recorded as "api", as rule changes are.
+	user := requestUser(r)
+	if user == "" {
+		user = "api"
+	}
+
+	state, err := s.Alerts.Acknowledge(r.Context(), id, user)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, statusResponse{Status: "acknowledged", State: state})
+	return nil
+}
+
+func (s *Server) closeAlert(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "alert")
+	if err != nil {
+		return err
+	}
+	user, err := requireUser(r)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Alerts.Close(r.Context(), id, user); err != nil {
+		return err
+	}
+	writeJSON(w, statusResponse{Status: "closed", State: processing.AlertStateClosed})
+	return nil
+}
+
+// ShelveRequest takes an alert out of notifications for a while. The user
+// may come from X-User instead.
+type ShelveRequest struct {
+	User            string  `json:"user"`
+	Reason          string  `json:"reason"`
+	DurationMinutes float64 `json:"duration_minutes"`
+}
+
+func (s *Server) shelveAlert(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "alert")
+	if err != nil {
+		return err
+	}
+
+	input := ShelveRequest{DurationMinutes: processing.DefaultShelveDuration.Minutes()}
+	if err := decode(r, &input); err != nil {
+		return err
+	}
+	user := strings.TrimSpace(r.Header.Get("X-User"))
+	if user == "" {
+		user = strings.TrimSpace(input.User)
+	}
+	if user == "" {
+		return errorf(http.StatusBadRequest, "user required")
+	}
+	reason := strings.TrimSpace(input.Reason)
+	if reason == "" {
+		return errorf(http.StatusBadRequest, "reason required")
+	}
+	duration := time.Duration(input.DurationMinutes * float64(time.Minute))
+	if duration < time.Minute || duration > processing.MaxShelveDuration {
+		return errorf(http.StatusBadRequest, "duration_minutes must be between 1 and %.0f", processing.MaxShelveDuration.Minutes())
+	}
+
+	shelf, err := s.Alerts.Shelve(r.Context(), id, user, reason, duration)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, shelf)
+	return nil
+}
+
+func (s *Server) unshelveAlert(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "alert")
+	if err != nil {
+		return err
+	}
+	user, err := requireUser(r)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Alerts.Unshelve(r.Context(), id, user); err != nil {
+		return err
+	}
+	writeJSON(w, statusResponse{Status: "unshelved"})
+	return nil
+}
+
+func (s *Server) listShelves(w http.ResponseWriter, r *http.Request) error {
+	shelves, err := s.Alerts.ListShelves(r.Context(), r.URL.Query().Get("active") == "true")
+	if err != nil {
+		return err
+	}
+	writeJSON(w, shelves)
+	return nil
+}
+
+func (s *Server) alertOnCall(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "alert")
+	if err != nil {
+		return err
+	}
+
+	pages, err := s.Alerts.PreviewOnCall(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, pages)
+	return nil
+}
+
+// severityHistory lists the severities an alert has passed through as the
+// tiers of its rule family came and went.
+func (s *Server) severityHistory(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "alert")
+	if err != nil {
+		return err
+	}
+
+	changes, err := s.Alerts.SeverityHistory(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, changes)
+	return nil
+}
+
+// alarmAnalytics serves the ISA-18.2 alarm reports (rate, floods,
+// bad-actors, chattering) over ?from=&to= (RFC3339, default the last 7 days).
+func (s *Server) alarmAnalytics(w http.ResponseWriter, r *http.Request) error {
+	to, err := queryTime(r, "to", time.Now())
+	if err != nil {
+		return err
+	}
+	from, err := queryTime(r, "from", to.Add(-7*24*time.Hour))
+	if err != nil {
+		return err
+	}
+	if !to.After(from) {
+		return errorf(http.StatusBadRequest, "to must be after from")
+	}
+
+	result, err := s.Alerts.AlarmReport(r.Context(), mux.Vars(r)["report"], from, to)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, result)
+	return nil
+}
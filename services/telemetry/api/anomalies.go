@@ -0,0 +1,73 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"telemetry/anomaly"
+)
+
+func (s *Server) anomalyRoutes(r *mux.Router) {
+	r.HandleFunc("/api/v1/anomalies", handle(s.listAnomalies)).Methods("GET")
+	r.HandleFunc("/api/v1/anomalies/detectors", handle(s.listDetectors)).Methods("GET")
+	r.HandleFunc("/api/v1/anomalies/detectors", handle(s.saveDetector)).Methods("PUT")
+	r.HandleFunc("/api/v1/anomalies/baselines", handle(s.listBaselines)).Methods("GET")
+	r.HandleFunc("/api/v1/anomalies/baselines", handle(s.relearnBaselines)).Methods("POST")
+}
+
+func (s *Server) listAnomalies(w http.ResponseWriter, r *http.Request) error {
+	anomalies, err := s.Anomalies.ListAnomalies(r.Context())
+	if err != nil {
+		return err
+	}
+	writeJSON(w, anomalies)
+	return nil
+}
+
+func (s *Server) listDetectors(w http.ResponseWriter, r *http.Request) error {
+	configs, err := s.Anomalies.ListDetectors(r.Context())
+	if err != nil {
+		return err
+	}
+	writeJSON(w, configs)
+	return nil
+}
+
+func (s *Server) saveDetector(w http.ResponseWriter, r *http.Request) error {
+	config := anomaly.Config{Enabled: true, CooldownSeconds: 300}
+	if err := decode(r, &config); err != nil {
+		return err
+	}
+	if err := config.Validate(); err != nil {
+		return withStatus(http.StatusBadRequest, err)
+	}
+
+	if err := s.Anomalies.SaveDetector(r.Context(), config); err != nil {
+		return err
+	}
+	writeJSON(w, config)
+	return nil
+}
+
+func (s *Server) listBaselines(w http.ResponseWriter, r *http.Request) error {
+	machineID, err := queryUUID(r, "machine_id")
+	if err != nil {
+		return err
+	}
+
+	baselines, err := s.Anomalies.ListBaselines(r.Context(), machineID, r.URL.Query().Get("metric_name"))
+	if err != nil {
+		return err
+	}
+	writeJSON(w, baselines)
+	return nil
+}
+
+func (s *Server) relearnBaselines(w http.ResponseWriter, r *http.Request) error {
+	if err := s.Anomalies.RelearnBaselines(r.Context()); err != nil {
+		return err
+	}
+	writeJSON(w, statusResponse{Status: "learned"})
+	return nil
+}
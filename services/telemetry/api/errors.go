@@ -0,0 +1,98 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"telemetry/anomaly"
+	"telemetry/export"
+	"telemetry/notify"
+	"telemetry/oncall"
+	"telemetry/processing"
+	"telemetry/ruleset"
+)
+
+var (
+	// ErrMachineNotFound is returned for a machine that does not exist.
+	ErrMachineNotFound = errors.New("machine not found")
+	// ErrUnknownReport is returned for an alarm analytics report that does
+	// not exist.
+	ErrUnknownReport = errors.New("unknown report")
+)
+
+// statusError is an error that should be answered with a particular status
+// rather than the one writeError would pick for it.
+type statusError struct {
+	status int
+	err    error
+}
+
+func (e *statusError) Error() string { return e.err.Error() }
+func (e *statusError) Unwrap() error { return e.err }
+
+func withStatus(status int, err error) error {
+	return &statusError{status: status, err: err}
+}
+
+func errorf(status int, format string, args ...interface{}) error {
+	return withStatus(status, fmt.Errorf(format, args...))
+}
+
+// errorStatuses maps the services' sentinel errors to the status they are
+// answered with.
+var errorStatuses = []struct {
+	err    error
+	status int
+}{
+	{processing.ErrAlertNotFound, http.StatusNotFound},
+	{processing.ErrRuleNotFound, http.StatusNotFound},
+	{processing.ErrIncidentNotFound, http.StatusNotFound},
+	{processing.ErrRelationNotFound, http.StatusNotFound},
+	{processing.ErrSilenceNotFound, http.StatusNotFound},
+	{processing.ErrWindowNotFound, http.StatusNotFound},
+	{notify.ErrRecipientNotFound, http.StatusNotFound},
+	{notify.ErrWebhookNotFound, http.StatusNotFound},
+	{notify.ErrDeadLetterNotFound, http.StatusNotFound},
+	{notify.ErrRouteNotFound, http.StatusNotFound},
+	{notify.ErrPolicyNotFound, http.StatusNotFound},
+	{oncall.ErrTeamNotFound, http.StatusNotFound},
+	{oncall.ErrOverrideNotFound, http.StatusNotFound},
+	{export.ErrJobNotFound, http.StatusNotFound},
+	{ErrMachineNotFound, http.StatusNotFound},
+	{ErrUnknownReport, http.StatusNotFound},
+	{processing.ErrRuleConflict, http.StatusConflict},
+	{processing.ErrInvalidTransition, http.StatusConflict},
+	{processing.ErrAlreadyShelved, http.StatusConflict},
+	{processing.ErrNotShelved, http.StatusConflict},
+	{export.ErrJobNotReady, http.StatusConflict},
+	{export.ErrJobUnfinished, http.StatusConflict},
+	{processing.ErrInvalidFamily, http.StatusBadRequest},
+	{anomaly.ErrInsufficientData, http.StatusUnprocessableEntity},
+}
+
+// writeError answers a failed request. Rule set validation failures list
+// every problem as JSON; everything else is answered in plain text with the
+// status of its sentinel error, or 500.
+func writeError(w http.ResponseWriter, err error) {
+	var invalid *ruleset.ValidationError
+	if errors.As(err, &invalid) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, validationResult{Valid: false, Problems: invalid.Problems})
+		return
+	}
+
+	var se *statusError
+	if errors.As(err, &se) {
+		http.Error(w, err.Error(), se.status)
+		return
+	}
+	for _, s := range errorStatuses {
+		if errors.Is(err, s.err) {
+			http.Error(w, err.Error(), s.status)
+			return
+		}
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
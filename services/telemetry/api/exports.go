@@ -0,0 +1,355 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"telemetry/export"
+)
+
+func (s *Server) exportRoutes(r *mux.Router) {
+	r.HandleFunc("/api/v1/export", handle(s.exportMetrics)).Methods("GET")
+	r.HandleFunc("/api/v1/exports", handle(s.listExports)).Methods("GET")
+	r.HandleFunc("/api/v1/exports", handle(s.startExport)).Methods("POST")
+	r.HandleFunc("/api/v1/exports/{id}", handle(s.getExport)).Methods("GET")
+	r.HandleFunc("/api/v1/exports/{id}", handle(s.deleteExport)).Methods("DELETE")
+	r.HandleFunc("/api/v1/exports/{id}/download", handle(s.downloadExport)).Methods("GET")
+}
+
+// exportQuery reads format (csv or parquet; default csv), layout (long or
+// wide; default long) and [from, to), default the last 24 hours. Readings
+// are filtered as in listMetrics, with machine_id repeatable, and are
+// aggregated when bucket is given, by agg as in aggregateMetrics.
+func exportQuery(r *http.Request) (ExportQuery, error) {
+	query := r.URL.Query()
+	q := ExportQuery{
+		Format:      query.Get("format"),
+		Layout:      query.Get("layout"),
+		MetricNames: queryList(r, "metric_name"),
+		Qualities:   queryList(r, "quality"),
+		Location:    query.Get("location"),
+		Type:        query.Get("type"),
+	}
+	var err error
+
+	if q.Format == "" {
+		q.Format = export.FormatCSV
+	}
+	if !contains(export.Formats, q.Format) {
+		return q, errorf(http.StatusBadRequest, "format must be csv or parquet")
+	}
+	switch q.Layout {
+	case "":
+		q.Layout = "long"
+	case "long", "wide":
+	default:
+		return q, errorf(http.StatusBadRequest, "layout must be long or wide")
+	}
+
+	if q.To, err = queryTime(r, "to", time.Now()); err != nil {
+		return q, err
+	}
+	if q.From, err = queryTime(r, "from", q.To.Add(-24*time.Hour)); err != nil {
+		return q, err
+	}
+	if !q.To.After(q.From) {
+		return q, errorf(http.StatusBadRequest, "to must be after from")
+	}
+
+	for _, v := range queryList(r, "machine_id") {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			return q, errorf(http.StatusBadRequest, "invalid machine_id")
+		}
+		q.MachineIDs = append(q.MachineIDs, id)
+	}
+
+	functions := queryList(r, "agg")
+	if bucket := query.Get("bucket"); bucket != "" {
+		if q.Bucket, err = parseBucket(bucket); err != nil {
+			return q, err
+		}
+		if len(functions) == 0 {
+			functions = []string{"avg"}
+		}
+	} else if len(functions) > 0 {
+		return q, errorf(http.StatusBadRequest, "agg requires bucket")
+	}
+	var labels []string
+	for _, name := range functions {
+		f, err := parseAggregation(name)
+		if err != nil {
+			return q, err
+		}
+		if contains(labels, f.Label()) {
+			return q, errorf(http.StatusBadRequest, "duplicate agg %q", name)
+		}
+		q.Functions = append(q.Functions, f)
+		labels = append(labels, f.Label())
+	}
+	return q, nil
+}
+
+// exportRecord is one row of an export query: a reading, or one metric's
+// aggregates over a bucket, one value per function.
+type exportRecord struct {
+	Time       time.Time
+	MachineID  string
+	MetricName string
+	Value      float64
+	Unit       string
+	Quality    string
+	Values     []*float64
+}
+
+// exportTable lays records out in an export's layout: a row per record in
+// the long layout, or in the wide layout a row per time and machine with a
+// column per metric, or per metric and function when aggregated. Records
+// must come ordered by time and machine, so a wide row is complete as soon
+// as the next time or machine starts.
+type exportTable struct {
+	enc     export.Encoder
+	wide    bool
+	bucket  bool
+	offsets map[string]int
+	row     []interface{}
+	// pending says whether row holds a wide row still being filled in.
+	pending bool
+	written int64
+}
+
+// newExportTable starts an export of q in its format; metrics are the wide
+// layout's metric columns.
+func newExportTable(q ExportQuery, metrics []string, w io.Writer) (*exportTable, error) {
+	t := &exportTable{wide: q.Layout == "wide", bucket: q.Bucket > 0, offsets: map[string]int{}}
+
+	columns := []export.Column{{Name: "time", Kind: export.Time}, {Name: "machine_id", Kind: export.String}}
+	switch {
+	case t.wide && t.bucket:
+		for _, metric := range metrics {
+			t.offsets[metric] = len(columns)
+			for _, f := range q.Functions {
+				columns = append(columns, export.Column{Name: metric + "_" + f.Label(), Kind: export.Float})
+			}
+		}
+	case t.wide:
+		for _, metric := range metrics {
+			t.offsets[metric] = len(columns)
+			columns = append(columns, export.Column{Name: metric, Kind: export.Float})
+		}
+	case t.bucket:
+		columns = append(columns, export.Column{Name: "metric_name", Kind: export.String})
+		for _, f := range q.Functions {
+			columns = append(columns, export.Column{Name: f.Label(), Kind: export.Float})
+		}
+	default:
+		columns = append(columns,
+			export.Column{Name: "metric_name", Kind: export.String},
+			export.Column{Name: "value", Kind: export.Float},
+			export.Column{Name: "unit", Kind: export.String},
+			export.Column{Name: "quality", Kind: export.String},
+		)
+	}
+
+	enc, err := export.NewEncoder(q.Format, w, columns)
+	if err != nil {
+		return nil, err
+	}
+	t.enc = enc
+	t.row = make([]interface{}, len(columns))
+	return t, nil
+}
+
+func (t *exportTable) add(rec exportRecord) error {
+	row := t.row
+	if !t.wide {
+		row[0], row[1], row[2] = rec.Time, rec.MachineID, rec.MetricName
+		if t.bucket {
+			for i, v := range rec.Values {
+				row[3+i] = floatOrNil(v)
+			}
+		} else {
+			row[3], row[4], row[5] = rec.Value, rec.Unit, rec.Quality
+		}
+		if err := t.enc.Write(row); err != nil {
+			return err
+		}
+		t.written++
+		return nil
+	}
+
+	if t.pending && (!rec.Time.Equal(row[0].(time.Time)) || rec.MachineID != row[1].(string)) {
+		if err := t.flush(); err != nil {
+			return err
+		}
+	}
+	if !t.pending {
+		row[0], row[1] = rec.Time, rec.MachineID
+		for i := 2; i < len(row); i++ {
+			row[i] = nil
+		}
+		t.pending = true
+	}
+	offset, ok := t.offsets[rec.MetricName]
+	if !ok {
+		return nil
+	}
+	if t.bucket {
+		for i, v := range rec.Values {
+			row[offset+i] = floatOrNil(v)
+		}
+	} else {
+		row[offset] = rec.Value
+	}
+	return nil
+}
+
+func (t *exportTable) flush() error {
+	if !t.pending {
+		return nil
+	}
+	t.pending = false
+	t.written++
+	return t.enc.Write(t.row)
+}
+
+// close writes the last wide row and finishes the file. It returns how many
+// rows were written.
+func (t *exportTable) close() (int64, error) {
+	if err := t.flush(); err != nil {
+		return t.written, err
+	}
+	return t.written, t.enc.Close()
+}
+
+func floatOrNil(v *float64) interface{} {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
+
+// exportWriter streams an export to the client. Each write gets a deadline
+// of its own in place of the server's WriteTimeout, which a long export
+// would outlive.
+type exportWriter struct {
+	http.ResponseWriter
+	rc      *http.ResponseController
+	written bool
+}
+
+func newExportWriter(w http.ResponseWriter) *exportWriter {
+	return &exportWriter{ResponseWriter: w, rc: http.NewResponseController(w)}
+}
+
+func (w *exportWriter) Write(b []byte) (int, error) {
+	if err := w.rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout)); err != nil {
+		return 0, err
+	}
+	w.written = true
+	return w.ResponseWriter.Write(b)
+}
+
+// exportMetrics streams an export as it is read from the database.
+func (s *Server) exportMetrics(w http.ResponseWriter, r *http.Request) error {
+	q, err := exportQuery(r)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("metrics-%s-%s%s", q.From.UTC().Format("20060102T150405Z"), q.To.UTC().Format("20060102T150405Z"), export.Extension(q.Format))
+	w.Header().Set("Content-Type", export.ContentType(q.Format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+
+	out := newExportWriter(w)
+	if err := s.Exports.Export(r.Context(), q, out); err != nil {
+		if !out.written {
+			w.Header().Del("Content-Disposition")
+			return err
+		}
+		// The status has gone out; breaking the connection is the only
+		// way left to tell the client the file is incomplete.
+		log.Printf("Export of %s failed after streaming started: %v", r.URL.RawQuery, err)
+		panic(http.ErrAbortHandler)
+	}
+	return nil
+}
+
+// startExport runs an export, with the same parameters as exportMetrics, as
+// a background job for ranges too large to stream in one request.
+func (s *Server) startExport(w http.ResponseWriter, r *http.Request) error {
+	q, err := exportQuery(r)
+	if err != nil {
+		return err
+	}
+
+	job, err := s.Exports.StartExport(r.Context(), q, r.URL.RawQuery, requestUser(r))
+	if err != nil {
+		return err
+	}
+	writeJSON(w, job)
+	return nil
+}
+
+func (s *Server) listExports(w http.ResponseWriter, r *http.Request) error {
+	jobs, err := s.Exports.ListExportJobs(r.Context())
+	if err != nil {
+		return err
+	}
+	writeJSON(w, jobs)
+	return nil
+}
+
+func (s *Server) getExport(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "export")
+	if err != nil {
+		return err
+	}
+
+	job, err := s.Exports.ExportJob(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, job)
+	return nil
+}
+
+func (s *Server) deleteExport(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "export")
+	if err != nil {
+		return err
+	}
+
+	if err := s.Exports.DeleteExport(r.Context(), id); err != nil {
+		return err
+	}
+	writeJSON(w, statusResponse{Status: "deleted"})
+	return nil
+}
+
+// downloadExport serves a finished job's file, with range requests so an
+// interrupted download of a large file can resume.
+func (s *Server) downloadExport(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "export")
+	if err != nil {
+		return err
+	}
+
+	f, job, err := s.Exports.OpenExport(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	name := "metrics-" + job.ID.String() + export.Extension(job.Format)
+	w.Header().Set("Content-Type", export.ContentType(job.Format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	http.ServeContent(newExportWriter(w), r, name, *job.FinishedAt, f)
+	return nil
+}
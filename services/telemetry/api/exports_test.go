@@ -0,0 +1,121 @@
+package api
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"telemetry/export"
+)
+
+func exportCSV(t *testing.T, q ExportQuery, metrics []string, records []exportRecord) (string, int64) {
+	t.Helper()
+	q.Format = export.FormatCSV
+	var b strings.Builder
+	table, err := newExportTable(q, metrics, &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range records {
+		if err := table.add(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	written, err := table.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.String(), written
+}
+
+func floatPtr(v float64) *float64 { return &v }
+
+var (
+	exportT0 = time.Date(2026, 3, 1, 8, 0, 0, 0, time.FixedZone("CET", 3600))
+	exportT1 = exportT0.Add(1500 * time.Millisecond)
+)
+
+// exportReadings are ordered by time, machine and metric, as the export query
+// returns them.
+var exportReadings = []exportRecord{
+	{Time: exportT0, MachineID: "lathe-12", MetricName: "temperature", Value: 71.5, Unit: "celsius", Quality: "good"},
+	{Time: exportT0, MachineID: "press-1", MetricName: "pressure", Value: 2.25, Unit: "bar", Quality: "good"},
+	{Time: exportT0, MachineID: "press-1", MetricName: "temperature", Value: 64, Unit: "celsius", Quality: "uncertain"},
+	{Time: exportT0, MachineID: "press-1", MetricName: "vibration", Value: 0.3, Unit: "mm/s", Quality: "good"},
+	{Time: exportT1, MachineID: "press-1", MetricName: "pressure", Value: 1e-7, Unit: "bar", Quality: "bad"},
+}
+
+func TestExportLong(t *testing.T) {
+	got, written := exportCSV(t, ExportQuery{Layout: "long"}, nil, exportReadings)
+	want := `time,machine_id,metric_name,value,unit,quality
+2026-03-01T07:00:00Z,lathe-12,temperature,71.5,celsius,good
+2026-03-01T07:00:00Z,press-1,pressure,2.25,bar,good
+2026-03-01T07:00:00Z,press-1,temperature,64,celsius,uncertain
+2026-03-01T07:00:00Z,press-1,vibration,0.3,mm/s,good
+2026-03-01T07:00:01.5Z,press-1,pressure,1e-07,bar,bad
+`
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	if written != 5 {
+		t.Errorf("written = %d, want 5", written)
+	}
+}
+
+func TestExportWide(t *testing.T) {
+	// vibration was not asked for and humidity has no readings.
+	got, written := exportCSV(t, ExportQuery{Layout: "wide"}, []string{"humidity", "pressure", "temperature"}, exportReadings)
+	want := `time,machine_id,humidity,pressure,temperature
+2026-03-01T07:00:00Z,lathe-12,,,71.5
+2026-03-01T07:00:00Z,press-1,,2.25,64
+2026-03-01T07:00:01.5Z,press-1,,1e-07,
+`
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	if written != 3 {
+		t.Errorf("written = %d, want 3", written)
+	}
+}
+
+func TestExportAggregated(t *testing.T) {
+	q := ExportQuery{Bucket: time.Hour, Functions: []Aggregation{{Name: "avg"}, {Name: "percentile", Percentile: 0.95}}}
+	records := []exportRecord{
+		{Time: exportT0, MachineID: "press-1", MetricName: "pressure", Values: []*float64{floatPtr(2.5), floatPtr(3)}},
+		{Time: exportT0, MachineID: "press-1", MetricName: "temperature", Values: []*float64{floatPtr(60), nil}},
+		{Time: exportT0.Add(time.Hour), MachineID: "press-1", MetricName: "temperature", Values: []*float64{nil, nil}},
+	}
+
+	q.Layout = "long"
+	got, _ := exportCSV(t, q, nil, records)
+	want := `time,machine_id,metric_name,avg,p95
+2026-03-01T07:00:00Z,press-1,pressure,2.5,3
+2026-03-01T07:00:00Z,press-1,temperature,60,
+2026-03-01T08:00:00Z,press-1,temperature,,
+`
+	if got != want {
+		t.Errorf("long: got\n%s\nwant\n%s", got, want)
+	}
+
+	q.Layout = "wide"
+	got, written := exportCSV(t, q, []string{"pressure", "temperature"}, records)
+	want = `time,machine_id,pressure_avg,pressure_p95,temperature_avg,temperature_p95
+2026-03-01T07:00:00Z,press-1,2.5,3,60,
+2026-03-01T08:00:00Z,press-1,,,,
+`
+	if got != want {
+		t.Errorf("wide: got\n%s\nwant\n%s", got, want)
+	}
+	if written != 2 {
+		t.Errorf("wide: written = %d, want 2", written)
+	}
+}
+
+func TestExportEmpty(t *testing.T) {
+	for _, layout := range []string{"long", "wide"} {
+		got, written := exportCSV(t, ExportQuery{Layout: layout}, []string{"pressure"}, nil)
+		if !strings.HasPrefix(got, "time,machine_id,") || strings.Count(got, "\n") != 1 || written != 0 {
+			t.Errorf("%s: got %q (%d rows), want only a header", layout, got, written)
+		}
+	}
+}
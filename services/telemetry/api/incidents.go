@@ -0,0 +1,117 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"telemetry/processing"
+)
+
+func (s *Server) incidentRoutes(r *mux.Router) {
+	r.HandleFunc("/api/v1/incidents", handle(s.listIncidents)).Methods("GET")
+	r.HandleFunc("/api/v1/incidents/{id}", handle(s.getIncident)).Methods("GET")
+	r.HandleFunc("/api/v1/incidents/{id}/acknowledge", handle(s.acknowledgeIncident)).Methods("POST")
+	r.HandleFunc("/api/v1/rule-relations", handle(s.listRuleRelations)).Methods("GET")
+	r.HandleFunc("/api/v1/rule-relations", handle(s.createRuleRelation)).Methods("POST")
+	r.HandleFunc("/api/v1/rule-relations/{id}", handle(s.deleteRuleRelation)).Methods("DELETE")
+}
+
+func (s *Server) listIncidents(w http.ResponseWriter, r *http.Request) error {
+	state := r.URL.Query().Get("state")
+	if state != "" && state != processing.IncidentStateOpen && state != processing.IncidentStateResolved {
+		return errorf(http.StatusBadRequest, "invalid state")
+	}
+
+	incidents, err := s.Incidents.ListIncidents(r.Context(), state)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, incidents)
+	return nil
+}
+
+func (s *Server) getIncident(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "incident")
+	if err != nil {
+		return err
+	}
+
+	incident, err := s.Incidents.GetIncident(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, incident)
+	return nil
+}
+
+func (s *Server) acknowledgeIncident(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "incident")
+	if err != nil {
+		return err
+	}
+	user, err := requireUser(r)
+	if err != nil {
+		return err
+	}
+
+	acknowledged, err := s.Incidents.AcknowledgeIncident(r.Context(), id, user)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, struct {
+		Status string `json:"status"`
+		Alerts int    `json:"alerts"`
+	}{"acknowledged", acknowledged})
+	return nil
+}
+
+func (s *Server) listRuleRelations(w http.ResponseWriter, r *http.Request) error {
+	relations, err := s.Incidents.ListRuleRelations(r.Context())
+	if err != nil {
+		return err
+	}
+	writeJSON(w, relations)
+	return nil
+}
+
+// RuleRelationRequest declares that alerts of the effect rule are caused by
+// alerts of the cause rule and should join its incident.
+type RuleRelationRequest struct {
+	CauseRuleID  uuid.UUID `json:"cause_rule_id"`
+	EffectRuleID uuid.UUID `json:"effect_rule_id"`
+}
+
+func (s *Server) createRuleRelation(w http.ResponseWriter, r *http.Request) error {
+	var input RuleRelationRequest
+	if err := decode(r, &input); err != nil {
+		return err
+	}
+	if input.CauseRuleID == uuid.Nil || input.EffectRuleID == uuid.Nil {
+		return errorf(http.StatusBadRequest, "cause_rule_id and effect_rule_id are required")
+	}
+	if input.CauseRuleID == input.EffectRuleID {
+		return errorf(http.StatusBadRequest, "a rule cannot cause itself")
+	}
+
+	id, err := s.Incidents.CreateRuleRelation(r.Context(), input.CauseRuleID, input.EffectRuleID)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, createdResponse{ID: id})
+	return nil
+}
+
+func (s *Server) deleteRuleRelation(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "relation")
+	if err != nil {
+		return err
+	}
+
+	if err := s.Incidents.DeleteRuleRelation(r.Context(), id); err != nil {
+		return err
+	}
+	writeJSON(w, statusResponse{Status: "deleted"})
+	return nil
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+func (s *Server) machineRoutes(r *mux.Router) {
+	r.HandleFunc("/api/v1/machines", handle(s.listMachines)).Methods("GET")
+	r.HandleFunc("/api/v1/machines", handle(s.createMachine)).Methods("POST")
+	r.HandleFunc("/api/v1/machines/{id}/health-model", handle(s.getHealthModel)).Methods("GET")
+	r.HandleFunc("/api/v1/machines/{id}/health-model", handle(s.trainHealthModel)).Methods("POST")
+	r.HandleFunc("/api/v1/machines/{id}/latest", handle(s.machineLatest)).Methods("GET")
+}
+
+func (s *Server) listMachines(w http.ResponseWriter, r *http.Request) error {
+	machines, err := s.Machines.ListMachines(r.Context())
+	if err != nil {
+		return err
+	}
+	writeJSON(w, machines)
+	return nil
+}
+
+func (s *Server) createMachine(w http.ResponseWriter, r *http.Request) error {
+	var input NewMachine
+	if err := decode(r, &input); err != nil {
+		return err
+	}
+	if input.Name == "" {
+		return errorf(http.StatusBadRequest, "name required")
+	}
+
+	id, err := s.Machines.CreateMachine(r.Context(), input)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, struct {
+		ID   uuid.UUID `json:"id"`
+		Name string    `json:"name"`
+	}{id, input.Name})
+	return nil
+}
+
+func (s *Server) getHealthModel(w http.ResponseWriter, r *http.Request) error {
+	machineID, err := pathID(r, "machine")
+	if err != nil {
+		return err
+	}
+
+	model, err := s.Machines.HealthModel(r.Context(), machineID)
+	if err != nil {
+		return err
+	}
+	if model == nil {
+		return errorf(http.StatusNotFound, "no health model trained")
+	}
+	writeJSON(w, model)
+	return nil
+}
+
+// trainHealthModel fits a machine's health model to a period it is known
+// to have run healthily.
+func (s *Server) trainHealthModel(w http.ResponseWriter, r *http.Request) error {
+	machineID, err := pathID(r, "machine")
+	if err != nil {
+		return err
+	}
+
+	var input struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	}
+	if err := decode(r, &input); err != nil {
+		return err
+	}
+	if input.From.IsZero() || !input.To.After(input.From) {
+		return errorf(http.StatusBadRequest, "from and to must describe a healthy period")
+	}
+
+	model, err := s.Machines.TrainHealthModel(r.Context(), machineID, input.From, input.To)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, model)
+	return nil
+}
+
+// machineLatest returns a machine's current value of each metric, or of
+// the ?metric_name= ones, from the latest-value cache.
+func (s *Server) machineLatest(w http.ResponseWriter, r *http.Request) error {
+	machineID, err := pathID(r, "machine")
+	if err != nil {
+		return err
+	}
+
+	values, err := s.Metrics.Latest(r.Context(), &machineID)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, filterLatest(values, queryList(r, "metric_name")))
+	return nil
+}
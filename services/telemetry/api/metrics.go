@@ -0,0 +1,312 @@
+package api
+
+import (
+	"encoding/base64"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"telemetry/latest"
+)
+
+const (
+	defaultMetricLimit = 100
+	maxMetricLimit     = 10000
+
+	// maxAggregateBuckets bounds the buckets per series an aggregate query
+	// may ask for.
+	maxAggregateBuckets = 10000
+	maxBucket           = 366 * 24 * time.Hour
+)
+
+// aggregateFunctions are the aggregations besides percentiles, which are
+// asked for as p<percent>, e.g. p95 or p99.9.
+var aggregateFunctions = []string{"avg", "min", "max", "sum", "count", "stddev", "first", "last"}
+
+var bucketUnits = map[byte]time.Duration{'s': time.Second, 'm': time.Minute, 'h': time.Hour, 'd': 24 * time.Hour}
+
+func (s *Server) metricRoutes(r *mux.Router) {
+	r.HandleFunc("/api/v1/metrics", handle(s.listMetrics)).Methods("GET")
+	r.HandleFunc("/api/v1/metrics/aggregate", handle(s.aggregateMetrics)).Methods("GET")
+	r.HandleFunc("/api/v1/metrics/ingest", handle(s.ingest)).Methods("POST")
+	r.HandleFunc("/api/v1/latest", handle(s.fleetLatest)).Methods("GET")
+}
+
+// listMetrics returns readings filtered by machine_id, metric_name and
+// quality (both repeatable or comma-separated), the machine's location and
+// type, and a [from, to) range, newest first unless order=asc. When more
+// readings match than limit, the X-Next-Cursor header carries a cursor to
+// pass back as ?cursor= for the next page.
+func (s *Server) listMetrics(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+	q := MetricQuery{
+		MetricNames: queryList(r, "metric_name"),
+		Qualities:   queryList(r, "quality"),
+		Location:    query.Get("location"),
+		Type:        query.Get("type"),
+		Limit:       defaultMetricLimit,
+	}
+	var err error
+	if q.MachineID, err = queryUUID(r, "machine_id"); err != nil {
+		return err
+	}
+	if q.From, err = queryOptionalTime(r, "from"); err != nil {
+		return err
+	}
+	if q.To, err = queryOptionalTime(r, "to"); err != nil {
+		return err
+	}
+	if q.From != nil && q.To != nil && !q.To.After(*q.From) {
+		return errorf(http.StatusBadRequest, "to must be after from")
+	}
+	switch query.Get("order") {
+	case "", "desc":
+	case "asc":
+		q.Ascending = true
+	default:
+		return errorf(http.StatusBadRequest, "order must be asc or desc")
+	}
+	if v := query.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 1 || q.Limit > maxMetricLimit {
+			return errorf(http.StatusBadRequest, "limit must be an integer between 1 and %d", maxMetricLimit)
+		}
+	}
+	if v := query.Get("cursor"); v != "" {
+		if q.After, err = parseMetricCursor(v); err != nil {
+			return err
+		}
+	}
+
+	page, err := s.Metrics.QueryMetrics(r.Context(), q)
+	if err != nil {
+		return err
+	}
+	if page.Next != nil {
+		w.Header().Set("X-Next-Cursor", page.Next.String())
+	}
+	writeJSON(w, page.Metrics)
+	return nil
+}
+
+// String encodes the cursor as an opaque URL-safe token.
+func (c MetricCursor) String() string {
+	raw := c.Time.UTC().Format(time.RFC3339Nano) + "|" + c.MachineID.String() + "|" + c.MetricName
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parseMetricCursor(s string) (*MetricCursor, error) {
+	invalid := errorf(http.StatusBadRequest, "invalid cursor")
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, invalid
+	}
+	parts := strings.SplitN(string(raw), "|", 3)
+	if len(parts) != 3 {
+		return nil, invalid
+	}
+	var c MetricCursor
+	if c.Time, err = time.Parse(time.RFC3339Nano, parts[0]); err != nil {
+		return nil, invalid
+	}
+	if c.MachineID, err = uuid.Parse(parts[1]); err != nil {
+		return nil, invalid
+	}
+	c.MetricName = parts[2]
+	return &c, nil
+}
+
+type AggregateResponse struct {
+	Bucket    string    `json:"bucket"`
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	Fill      string    `json:"fill"`
+	Functions []string  `json:"functions"`
+	Series    []Series  `json:"series"`
+}
+
+// aggregateMetrics summarises readings into time buckets: bucket (e.g. 1m,
+// 1h, 1d; default 1h), agg (default avg), group_by (machine, location, type
+// or none; default machine) and fill (none, null or locf) over [from, to),
+// default the last 24 hours. Readings are filtered as in listMetrics.
+func (s *Server) aggregateMetrics(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+	q := AggregateQuery{
+		MetricNames: queryList(r, "metric_name"),
+		Qualities:   queryList(r, "quality"),
+		Location:    query.Get("location"),
+		Type:        query.Get("type"),
+	}
+	var err error
+
+	bucket := query.Get("bucket")
+	if bucket == "" {
+		bucket = "1h"
+	}
+	if q.Bucket, err = parseBucket(bucket); err != nil {
+		return err
+	}
+	if q.To, err = queryTime(r, "to", time.Now()); err != nil {
+		return err
+	}
+	if q.From, err = queryTime(r, "from", q.To.Add(-24*time.Hour)); err != nil {
+		return err
+	}
+	if !q.To.After(q.From) {
+		return errorf(http.StatusBadRequest, "to must be after from")
+	}
+	if q.To.Sub(q.From)/q.Bucket > maxAggregateBuckets {
+		return errorf(http.StatusBadRequest, "from and to span more than %d buckets of %s", maxAggregateBuckets, bucket)
+	}
+
+	response := AggregateResponse{Bucket: bucket, From: q.From, To: q.To, Fill: "none"}
+	functions := queryList(r, "agg")
+	if len(functions) == 0 {
+		functions = []string{"avg"}
+	}
+	for _, name := range functions {
+		f, err := parseAggregation(name)
+		if err != nil {
+			return err
+		}
+		if contains(response.Functions, f.Label()) {
+			return errorf(http.StatusBadRequest, "duplicate agg %q", name)
+		}
+		q.Functions = append(q.Functions, f)
+		response.Functions = append(response.Functions, f.Label())
+	}
+
+	groupBy := queryList(r, "group_by")
+	if len(groupBy) == 0 {
+		groupBy = []string{"machine"}
+	}
+	for _, g := range groupBy {
+		switch {
+		case g == "none" && len(groupBy) == 1:
+		case contains([]string{"machine", "location", "type"}, g) && !contains(q.GroupBy, g):
+			q.GroupBy = append(q.GroupBy, g)
+		default:
+			return errorf(http.StatusBadRequest, "invalid group_by %q", g)
+		}
+	}
+
+	switch fill := query.Get("fill"); fill {
+	case "", "none":
+	case "null", "locf":
+		q.Fill, response.Fill = fill, fill
+	default:
+		return errorf(http.StatusBadRequest, "fill must be none, null or locf")
+	}
+
+	for _, v := range queryList(r, "machine_id") {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			return errorf(http.StatusBadRequest, "invalid machine_id")
+		}
+		q.MachineIDs = append(q.MachineIDs, id)
+	}
+
+	if response.Series, err = s.Metrics.Aggregate(r.Context(), q); err != nil {
+		return err
+	}
+	if response.Series == nil {
+		response.Series = []Series{}
+	}
+	writeJSON(w, response)
+	return nil
+}
+
+// parseBucket reads a bucket width such as 30s, 5m, 1h or 1d.
+func parseBucket(s string) (time.Duration, error) {
+	invalid := errorf(http.StatusBadRequest, "invalid bucket %q", s)
+	if len(s) < 2 {
+		return 0, invalid
+	}
+	unit, ok := bucketUnits[s[len(s)-1]]
+	n, err := strconv.Atoi(s[:len(s)-1])
+	if !ok || err != nil || n < 1 || time.Duration(n) > maxBucket/unit {
+		return 0, invalid
+	}
+	return time.Duration(n) * unit, nil
+}
+
+func parseAggregation(name string) (Aggregation, error) {
+	if contains(aggregateFunctions, name) {
+		return Aggregation{Name: name}, nil
+	}
+	if strings.HasPrefix(name, "p") {
+		if percent, err := strconv.ParseFloat(name[1:], 64); err == nil && percent > 0 && percent < 100 {
+			return Aggregation{Name: "percentile", Percentile: math.Round(percent*1e4) / 1e6}, nil
+		}
+	}
+	return Aggregation{}, errorf(http.StatusBadRequest, "invalid agg %q", name)
+}
+
+// Label names the aggregation's column in a Series.
+func (a Aggregation) Label() string {
+	if a.Name != "percentile" {
+		return a.Name
+	}
+	return "p" + strconv.FormatFloat(math.Round(a.Percentile*1e6)/1e4, 'f', -1, 64)
+}
+
+// fleetLatest returns the current value of every machine's metrics, or of
+// the ?metric_name= ones, from the latest-value cache.
+func (s *Server) fleetLatest(w http.ResponseWriter, r *http.Request) error {
+	values, err := s.Metrics.Latest(r.Context(), nil)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, filterLatest(values, queryList(r, "metric_name")))
+	return nil
+}
+
+func filterLatest(values []latest.Value, metricNames []string) []latest.Value {
+	if len(metricNames) == 0 {
+		return values
+	}
+	filtered := []latest.Value{}
+	for _, v := range values {
+		if contains(metricNames, v.MetricName) {
+			filtered = append(filtered, v)
+		}
+	}
+	return filtered
+}
+
+func (s *Server) ingest(w http.ResponseWriter, r *http.Request) error {
+	var input IngestRequest
+	if err := decode(r, &input); err != nil {
+		return err
+	}
+
+	reading := Reading{
+		Time:       time.Now(),
+		MetricName: input.MetricName,
+		Value:      input.Value,
+		Unit:       input.Unit,
+		Quality:    input.Quality,
+	}
+	var err error
+	if reading.MachineID, err = uuid.Parse(input.MachineID); err != nil {
+		return errorf(http.StatusBadRequest, "invalid machine_id")
+	}
+	if input.Timestamp != "" {
+		if reading.Time, err = time.Parse(time.RFC3339, input.Timestamp); err != nil {
+			return errorf(http.StatusBadRequest, "invalid timestamp")
+		}
+	}
+	if reading.Quality == "" {
+		reading.Quality = "good"
+	}
+
+	if err := s.Metrics.Ingest(r.Context(), reading); err != nil {
+		return err
+	}
+	writeJSON(w, statusResponse{Status: "ok"})
+	return nil
+}
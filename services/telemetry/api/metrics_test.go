@@ -0,0 +1,94 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestIngest(t *testing.T) {
+	id := uuid.New()
+	s, f := newTestServer()
+	w := serve(s, "POST", "/api/v1/metrics/ingest",
+		`{"machine_id": "`+id.String()+`", "metric_name": "temperature", "value": 71.5, "unit": "celsius", "timestamp": "2026-03-01T08:30:00+01:00"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	if len(f.metrics.readings) != 1 {
+		t.Fatalf("readings = %d, want 1", len(f.metrics.readings))
+	}
+	want := Reading{
+		Time:       time.Date(2026, 3, 1, 7, 30, 0, 0, time.UTC),
+		MachineID:  id,
+		MetricName: "temperature",
+		Value:      71.5,
+		Unit:       "celsius",
+		Quality:    "good",
+	}
+	got := f.metrics.readings[0]
+	if !got.Time.Equal(want.Time) {
+		t.Errorf("time = %v, want %v", got.Time, want.Time)
+	}
+	got.Time = want.Time
+	if got != want {
+		t.Errorf("reading = %+v, want %+v", got, want)
+	}
+}
+
+func TestIngestDefaultsToNow(t *testing.T) {
+	s, f := newTestServer()
+	before := time.Now()
+	w := serve(s, "POST", "/api/v1/metrics/ingest",
+		`{"machine_id": "`+uuid.NewString()+`", "metric_name": "pressure", "value": 2, "quality": "uncertain"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	got := f.metrics.readings[0]
+	if got.Time.Before(before) || got.Time.After(time.Now()) {
+		t.Errorf("time = %v, want the time of the request", got.Time)
+	}
+	if got.Quality != "uncertain" {
+		t.Errorf("quality = %q, want uncertain", got.Quality)
+	}
+}
+
+func TestIngestInvalid(t *testing.T) {
+	id := uuid.NewString()
+	tests := []struct {
+		name, body, want string
+	}{
+		{"timestamp without zone", `{"machine_id": "` + id + `", "metric_name": "temperature", "value": 1, "timestamp": "2026-03-01T08:30:00"}`, "invalid timestamp"},
+		{"unix timestamp", `{"machine_id": "` + id + `", "metric_name": "temperature", "value": 1, "timestamp": "1772350200"}`, "invalid timestamp"},
+		{"date only", `{"machine_id": "` + id + `", "metric_name": "temperature", "value": 1, "timestamp": "2026-03-01"}`, "invalid timestamp"},
+		{"machine id", `{"machine_id": "press-1", "metric_name": "temperature", "value": 1}`, "invalid machine_id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, f := newTestServer()
+			w := serve(s, "POST", "/api/v1/metrics/ingest", tt.body)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want 400", w.Code)
+			}
+			if got := strings.TrimSpace(w.Body.String()); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+			if len(f.metrics.readings) > 0 {
+				t.Errorf("ingested %+v", f.metrics.readings)
+			}
+		})
+	}
+}
+
+func TestIngestMalformedBody(t *testing.T) {
+	s, f := newTestServer()
+	w := serve(s, "POST", "/api/v1/metrics/ingest", `{"machine_id": `)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", w.Code)
+	}
+	if len(f.metrics.readings) > 0 {
+		t.Errorf("ingested %+v", f.metrics.readings)
+	}
+}
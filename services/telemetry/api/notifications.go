@@ -0,0 +1,284 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/mail"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"telemetry/notify"
+)
+
+func (s *Server) notificationRoutes(r *mux.Router) {
+	r.HandleFunc("/api/v1/notifications/deliveries", handle(s.listDeliveries)).Methods("GET")
+	r.HandleFunc("/api/v1/notifications/email-recipients", handle(s.listEmailRecipients)).Methods("GET")
+	r.HandleFunc("/api/v1/notifications/email-recipients", handle(s.createEmailRecipient)).Methods("POST")
+	r.HandleFunc("/api/v1/notifications/email-recipients/{id}", handle(s.deleteEmailRecipient)).Methods("DELETE")
+	r.HandleFunc("/api/v1/notifications/webhooks", handle(s.listWebhooks)).Methods("GET")
+	r.HandleFunc("/api/v1/notifications/webhooks", handle(s.createWebhook)).Methods("POST")
+	r.HandleFunc("/api/v1/notifications/webhooks/dead-letters", handle(s.listDeadLetters)).Methods("GET")
+	r.HandleFunc("/api/v1/notifications/webhooks/dead-letters/{id}/replay", handle(s.replayDeadLetter)).Methods("POST")
+	r.HandleFunc("/api/v1/notifications/webhooks/{id}", handle(s.deleteWebhook)).Methods("DELETE")
+	r.HandleFunc("/api/v1/notifications/routes", handle(s.listRoutes)).Methods("GET")
+	r.HandleFunc("/api/v1/notifications/routes", handle(s.createRoute)).Methods("POST")
+	r.HandleFunc("/api/v1/notifications/routes/{id}", handle(s.replaceRoute)).Methods("PUT")
+	r.HandleFunc("/api/v1/notifications/routes/{id}", handle(s.deleteRoute)).Methods("DELETE")
+	r.HandleFunc("/api/v1/notifications/escalation-policies", handle(s.listEscalationPolicies)).Methods("GET")
+	r.HandleFunc("/api/v1/notifications/escalation-policies", handle(s.createEscalationPolicy)).Methods("POST")
+	r.HandleFunc("/api/v1/notifications/escalation-policies/{id}", handle(s.replaceEscalationPolicy)).Methods("PUT")
+	r.HandleFunc("/api/v1/notifications/escalation-policies/{id}", handle(s.deleteEscalationPolicy)).Methods("DELETE")
+}
+
+func (s *Server) listDeliveries(w http.ResponseWriter, r *http.Request) error {
+	alertID, err := queryUUID(r, "alert_id")
+	if err != nil {
+		return err
+	}
+
+	deliveries, err := s.Notifications.ListDeliveries(r.Context(), alertID)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, deliveries)
+	return nil
+}
+
+func (s *Server) listEmailRecipients(w http.ResponseWriter, r *http.Request) error {
+	recipients, err := s.Notifications.ListEmailRecipients(r.Context())
+	if err != nil {
+		return err
+	}
+	writeJSON(w, recipients)
+	return nil
+}
+
+// EmailRecipientRequest subscribes an address to alert email. Recipients
+// default to critical alerts only; an explicit empty severity subscribes
+// them to every severity.
+type EmailRecipientRequest struct {
+	Address  string  `json:"address"`
+	Severity *string `json:"severity"`
+	Location *string `json:"location"`
+}
+
+func (s *Server) createEmailRecipient(w http.ResponseWriter, r *http.Request) error {
+	critical := "critical"
+	input := EmailRecipientRequest{Severity: &critical}
+	if err := decode(r, &input); err != nil {
+		return err
+	}
+	// Only the bare address is kept: RCPT TO takes no display name.
+	addr, err := mail.ParseAddress(input.Address)
+	if err != nil {
+		return errorf(http.StatusBadRequest, "invalid address")
+	}
+	if severity := input.Severity; severity != nil && *severity != "" && !contains([]string{"info", "warning", "critical"}, *severity) {
+		return errorf(http.StatusBadRequest, "invalid severity: %s", *severity)
+	}
+
+	id, err := s.Notifications.SaveEmailRecipient(r.Context(), notify.EmailRecipient{
+		Address:  addr.Address,
+		Severity: input.Severity,
+		Location: input.Location,
+		Enabled:  true,
+	})
+	if err != nil {
+		return err
+	}
+	writeJSON(w, createdResponse{ID: id})
+	return nil
+}
+
+func (s *Server) deleteEmailRecipient(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "recipient")
+	if err != nil {
+		return err
+	}
+
+	if err := s.Notifications.DeleteEmailRecipient(r.Context(), id); err != nil {
+		return err
+	}
+	writeJSON(w, statusResponse{Status: "deleted"})
+	return nil
+}
+
+// listWebhooks lists webhooks without their signing secrets.
+func (s *Server) listWebhooks(w http.ResponseWriter, r *http.Request) error {
+	webhooks, err := s.Notifications.ListWebhooks(r.Context())
+	if err != nil {
+		return err
+	}
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+	writeJSON(w, webhooks)
+	return nil
+}
+
+func (s *Server) createWebhook(w http.ResponseWriter, r *http.Request) error {
+	input := notify.WebhookConfig{MaxAttempts: notify.DefaultRetryPolicy.MaxAttempts, Enabled: true}
+	if err := decode(r, &input); err != nil {
+		return err
+	}
+	for _, severity := range input.Severities {
+		if !contains([]string{"info", "warning", "critical"}, severity) {
+			return errorf(http.StatusBadRequest, "invalid severity: %s", severity)
+		}
+	}
+	if err := input.Validate(); err != nil {
+		return withStatus(http.StatusBadRequest, err)
+	}
+
+	id, err := s.Notifications.CreateWebhook(r.Context(), input)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, createdResponse{ID: id})
+	return nil
+}
+
+func (s *Server) deleteWebhook(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "webhook")
+	if err != nil {
+		return err
+	}
+
+	if err := s.Notifications.DeleteWebhook(r.Context(), id); err != nil {
+		return err
+	}
+	writeJSON(w, statusResponse{Status: "deleted"})
+	return nil
+}
+
+func (s *Server) listDeadLetters(w http.ResponseWriter, r *http.Request) error {
+	letters, err := s.Notifications.ListDeadLetters(r.Context(), r.URL.Query().Get("include_replayed") == "true")
+	if err != nil {
+		return err
+	}
+	writeJSON(w, letters)
+	return nil
+}
+
+// replayDeadLetter sends a dead letter again. A webhook that still fails is
+// reported as a bad gateway.
+func (s *Server) replayDeadLetter(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "dead letter")
+	if err != nil {
+		return err
+	}
+
+	if err := s.Notifications.ReplayDeadLetter(r.Context(), id); err != nil {
+		if errors.Is(err, notify.ErrDeadLetterNotFound) {
+			return err
+		}
+		return withStatus(http.StatusBadGateway, err)
+	}
+	writeJSON(w, statusResponse{Status: "replayed"})
+	return nil
+}
+
+func (s *Server) listRoutes(w http.ResponseWriter, r *http.Request) error {
+	routes, err := s.Notifications.ListRoutes(r.Context())
+	if err != nil {
+		return err
+	}
+	writeJSON(w, routes)
+	return nil
+}
+
+func (s *Server) createRoute(w http.ResponseWriter, r *http.Request) error {
+	return s.saveRoute(w, r, uuid.Nil)
+}
+
+func (s *Server) replaceRoute(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "route")
+	if err != nil {
+		return err
+	}
+	return s.saveRoute(w, r, id)
+}
+
+func (s *Server) saveRoute(w http.ResponseWriter, r *http.Request, id uuid.UUID) error {
+	route := notify.Route{Priority: 100, Enabled: true}
+	if err := decode(r, &route); err != nil {
+		return err
+	}
+	route.ID = id
+	if err := route.Validate(); err != nil {
+		return withStatus(http.StatusBadRequest, err)
+	}
+
+	id, err := s.Notifications.SaveRoute(r.Context(), route)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, createdResponse{ID: id})
+	return nil
+}
+
+func (s *Server) deleteRoute(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "route")
+	if err != nil {
+		return err
+	}
+
+	if err := s.Notifications.DeleteRoute(r.Context(), id); err != nil {
+		return err
+	}
+	writeJSON(w, statusResponse{Status: "deleted"})
+	return nil
+}
+
+func (s *Server) listEscalationPolicies(w http.ResponseWriter, r *http.Request) error {
+	policies, err := s.Notifications.ListEscalationPolicies(r.Context())
+	if err != nil {
+		return err
+	}
+	writeJSON(w, policies)
+	return nil
+}
+
+func (s *Server) createEscalationPolicy(w http.ResponseWriter, r *http.Request) error {
+	return s.saveEscalationPolicy(w, r, uuid.Nil)
+}
+
+func (s *Server) replaceEscalationPolicy(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "policy")
+	if err != nil {
+		return err
+	}
+	return s.saveEscalationPolicy(w, r, id)
+}
+
+func (s *Server) saveEscalationPolicy(w http.ResponseWriter, r *http.Request, id uuid.UUID) error {
+	policy := notify.EscalationPolicy{Priority: 100, Enabled: true}
+	if err := decode(r, &policy); err != nil {
+		return err
+	}
+	policy.ID = id
+	if err := policy.Validate(); err != nil {
+		return withStatus(http.StatusBadRequest, err)
+	}
+
+	id, err := s.Notifications.SaveEscalationPolicy(r.Context(), policy)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, createdResponse{ID: id})
+	return nil
+}
+
+func (s *Server) deleteEscalationPolicy(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "policy")
+	if err != nil {
+		return err
+	}
+
+	if err := s.Notifications.DeleteEscalationPolicy(r.Context(), id); err != nil {
+		return err
+	}
+	writeJSON(w, statusResponse{Status: "deleted"})
+	return nil
+}
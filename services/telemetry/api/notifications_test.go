@@ -0,0 +1,57 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCreateEmailRecipient(t *testing.T) {
+	tests := []struct {
+		name, body string
+		status     int
+		address    string
+		severity   string // "-" for none
+	}{
+		{"default severity", `{"address": "ops@example.com"}`, http.StatusOK, "ops@example.com", "critical"},
+		{"display name", `{"address": "Ops <ops@example.com>", "severity": "warning"}`, http.StatusOK, "ops@example.com", "warning"},
+		{"every severity", `{"address": "ops@example.com", "severity": ""}`, http.StatusOK, "ops@example.com", ""},
+		{"null severity", `{"address": "ops@example.com", "severity": null}`, http.StatusOK, "ops@example.com", "-"},
+		{"unknown severity", `{"address": "ops@example.com", "severity": "crit"}`, http.StatusBadRequest, "", ""},
+		{"wrong case", `{"address": "ops@example.com", "severity": "Critical"}`, http.StatusBadRequest, "", ""},
+		{"invalid address", `{"address": "ops"}`, http.StatusBadRequest, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, f := newTestServer()
+			w := serve(s, "POST", "/api/v1/notifications/email-recipients", tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			saved := f.notifications.recipients
+			if tt.status != http.StatusOK {
+				if len(saved) > 0 {
+					t.Errorf("saved %+v", saved)
+				}
+				if !strings.HasPrefix(w.Body.String(), "invalid ") {
+					t.Errorf("body = %q", w.Body)
+				}
+				return
+			}
+			if len(saved) != 1 {
+				t.Fatalf("saved %d recipients, want 1", len(saved))
+			}
+			r := saved[0]
+			if r.Address != tt.address || !r.Enabled {
+				t.Errorf("saved %+v, want enabled %s", r, tt.address)
+			}
+			severity := "-"
+			if r.Severity != nil {
+				severity = *r.Severity
+			}
+			if severity != tt.severity {
+				t.Errorf("severity = %q, want %q", severity, tt.severity)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"telemetry/oncall"
+)
+
+func (s *Server) onCallRoutes(r *mux.Router) {
+	r.HandleFunc("/api/v1/oncall", handle(s.currentOnCall)).Methods("GET")
+	r.HandleFunc("/api/v1/oncall/teams", handle(s.listTeams)).Methods("GET")
+	r.HandleFunc("/api/v1/oncall/teams", handle(s.createTeam)).Methods("POST")
+	r.HandleFunc("/api/v1/oncall/teams/{id}", handle(s.replaceTeam)).Methods("PUT")
+	r.HandleFunc("/api/v1/oncall/teams/{id}", handle(s.deleteTeam)).Methods("DELETE")
+	r.HandleFunc("/api/v1/oncall/teams/{id}/overrides", handle(s.listOverrides)).Methods("GET")
+	r.HandleFunc("/api/v1/oncall/teams/{id}/overrides", handle(s.createOverride)).Methods("POST")
+	r.HandleFunc("/api/v1/oncall/overrides/{id}", handle(s.deleteOverride)).Methods("DELETE")
+}
+
+// currentOnCall reports who is on call now, or at ?at=<RFC3339>, optionally
+// for one ?location=.
+func (s *Server) currentOnCall(w http.ResponseWriter, r *http.Request) error {
+	at, err := queryTime(r, "at", time.Now())
+	if err != nil {
+		return err
+	}
+
+	shifts, err := s.OnCall.CurrentOnCall(r.Context(), at)
+	if err != nil {
+		return err
+	}
+
+	location := r.URL.Query().Get("location")
+	filtered := []oncall.Shift{}
+	for _, shift := range shifts {
+		if location == "" || shift.Location == location {
+			filtered = append(filtered, shift)
+		}
+	}
+	writeJSON(w, filtered)
+	return nil
+}
+
+func (s *Server) listTeams(w http.ResponseWriter, r *http.Request) error {
+	teams, err := s.OnCall.ListTeams(r.Context())
+	if err != nil {
+		return err
+	}
+	writeJSON(w, teams)
+	return nil
+}
+
+func (s *Server) createTeam(w http.ResponseWriter, r *http.Request) error {
+	return s.saveTeam(w, r, uuid.Nil)
+}
+
+func (s *Server) replaceTeam(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "team")
+	if err != nil {
+		return err
+	}
+	return s.saveTeam(w, r, id)
+}
+
+func (s *Server) saveTeam(w http.ResponseWriter, r *http.Request, id uuid.UUID) error {
+	var team oncall.Team
+	if err := decode(r, &team); err != nil {
+		return err
+	}
+	team.ID = id
+	if err := team.Validate(); err != nil {
+		return withStatus(http.StatusBadRequest, err)
+	}
+
+	id, err := s.OnCall.SaveTeam(r.Context(), team)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, createdResponse{ID: id})
+	return nil
+}
+
+func (s *Server) deleteTeam(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "team")
+	if err != nil {
+		return err
+	}
+
+	if err := s.OnCall.DeleteTeam(r.Context(), id); err != nil {
+		return err
+	}
+	writeJSON(w, statusResponse{Status: "deleted"})
+	return nil
+}
+
+// overrideTeam resolves the team in an overrides route, which must exist.
+func (s *Server) overrideTeam(r *http.Request) (uuid.UUID, error) {
+	teamID, err := pathID(r, "team")
+	if err != nil {
+		return uuid.Nil, err
+	}
+	exists, err := s.OnCall.TeamExists(r.Context(), teamID)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if !exists {
+		return uuid.Nil, oncall.ErrTeamNotFound
+	}
+	return teamID, nil
+}
+
+// listOverrides lists a team's overrides ending after ?from= (default now).
+func (s *Server) listOverrides(w http.ResponseWriter, r *http.Request) error {
+	teamID, err := s.overrideTeam(r)
+	if err != nil {
+		return err
+	}
+	from, err := queryTime(r, "from", time.Now())
+	if err != nil {
+		return err
+	}
+
+	overrides, err := s.OnCall.ListOverrides(r.Context(), teamID, from)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, overrides)
+	return nil
+}
+
+func (s *Server) createOverride(w http.ResponseWriter, r *http.Request) error {
+	teamID, err := s.overrideTeam(r)
+	if err != nil {
+		return err
+	}
+
+	var override oncall.Override
+	if err := decode(r, &override); err != nil {
+		return err
+	}
+	override.TeamID = teamID
+	if err := override.Validate(); err != nil {
+		return withStatus(http.StatusBadRequest, err)
+	}
+
+	id, err := s.OnCall.CreateOverride(r.Context(), override)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, createdResponse{ID: id})
+	return nil
+}
+
+func (s *Server) deleteOverride(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "override")
+	if err != nil {
+		return err
+	}
+
+	if err := s.OnCall.DeleteOverride(r.Context(), id); err != nil {
+		return err
+	}
+	writeJSON(w, statusResponse{Status: "deleted"})
+	return nil
+}
@@ -0,0 +1,833 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"telemetry/anomaly"
+	"telemetry/export"
+	"telemetry/latest"
+	"telemetry/notify"
+	"telemetry/oncall"
+	"telemetry/processing"
+	"telemetry/ruleset"
+	"telemetry/stream"
+)
+
+// postgres implements every service on TimescaleDB, the running alert and
+// anomaly services, the latest-value cache and the export jobs. Live
+// streams are served by the hub directly.
+type postgres struct {
+	db        *pgxpool.Pool
+	alerts    *processing.AlertService
+	anomalies *anomaly.Service
+	latest    *latest.Cache
+	stream    *stream.Hub
+	exports   *export.Jobs
+}
+
+// NewPostgres returns the services backed by the database.
+func NewPostgres(pool *pgxpool.Pool, alertService *processing.AlertService, anomalyService *anomaly.Service, cache *latest.Cache, hub *stream.Hub, exports *export.Jobs) Services {
+	p := &postgres{db: pool, alerts: alertService, anomalies: anomalyService, latest: cache, stream: hub, exports: exports}
+	return Services{
+		Machines:      p,
+		Metrics:       p,
+		Alerts:        p,
+		Incidents:     p,
+		Rules:         p,
+		RuleSets:      p,
+		Notifications: p,
+		Suppression:   p,
+		OnCall:        p,
+		Anomalies:     p,
+		Stream:        hub,
+		Exports:       p,
+	}
+}
+
+func (p *postgres) ListMachines(ctx context.Context) ([]Machine, error) {
+	rows, err := p.db.Query(ctx,
+		`SELECT id, name, COALESCE(type, ''), COALESCE(location, ''), metadata, COALESCE(status, ''), created_at
+		 FROM machines ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var machines []Machine
+	for rows.Next() {
+		var m Machine
+		if err := rows.Scan(&m.ID, &m.Name, &m.Type, &m.Location, &m.Metadata, &m.Status, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		machines = append(machines, m)
+	}
+	return machines, rows.Err()
+}
+
+func (p *postgres) CreateMachine(ctx context.Context, m NewMachine) (uuid.UUID, error) {
+	var id uuid.UUID
+	err := p.db.QueryRow(ctx,
+		"INSERT INTO machines (name, type, location, metadata) VALUES ($1, $2, $3, $4) RETURNING id",
+		m.Name, m.Type, m.Location, m.Metadata,
+	).Scan(&id)
+	return id, err
+}
+
+func (p *postgres) HealthModel(ctx context.Context, machineID uuid.UUID) (*anomaly.HealthModel, error) {
+	return anomaly.GetHealthModel(ctx, p.db, machineID)
+}
+
+func (p *postgres) TrainHealthModel(ctx context.Context, machineID uuid.UUID, from, to time.Time) (*anomaly.HealthModel, error) {
+	return anomaly.TrainHealthModel(ctx, p.db, machineID, from, to)
+}
+
+func (p *postgres) QueryMetrics(ctx context.Context, q MetricQuery) (MetricPage, error) {
+	var conditions []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if q.MachineID != nil {
+		conditions = append(conditions, "m.machine_id = "+arg(*q.MachineID))
+	}
+	if len(q.MetricNames) > 0 {
+		conditions = append(conditions, "m.metric_name = ANY("+arg(q.MetricNames)+")")
+	}
+	if len(q.Qualities) > 0 {
+		conditions = append(conditions, "m.quality = ANY("+arg(q.Qualities)+")")
+	}
+	if q.Location != "" {
+		conditions = append(conditions, "mc.location = "+arg(q.Location))
+	}
+	if q.Type != "" {
+		conditions = append(conditions, "mc.type = "+arg(q.Type))
+	}
+	if q.From != nil {
+		conditions = append(conditions, "m.time >= "+arg(*q.From))
+	}
+	if q.To != nil {
+		conditions = append(conditions, "m.time < "+arg(*q.To))
+	}
+	order, after := "DESC", "<"
+	if q.Ascending {
+		order, after = "ASC", ">"
+	}
+	if q.After != nil {
+		conditions = append(conditions, fmt.Sprintf("(m.time, m.machine_id, m.metric_name) %s (%s, %s, %s)",
+			after, arg(q.After.Time), arg(q.After.MachineID), arg(q.After.MetricName)))
+	}
+
+	sql := "SELECT m.time, m.machine_id, m.metric_name, m.value, COALESCE(m.unit, ''), COALESCE(m.quality, '') FROM metrics m"
+	if q.Location != "" || q.Type != "" {
+		sql += " JOIN machines mc ON mc.id = m.machine_id"
+	}
+	if len(conditions) > 0 {
+		sql += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	// One row past the page tells whether there is another.
+	sql += fmt.Sprintf(" ORDER BY m.time %[1]s, m.machine_id %[1]s, m.metric_name %[1]s LIMIT %[2]s", order, arg(q.Limit+1))
+
+	rows, err := p.db.Query(ctx, sql, args...)
+	if err != nil {
+		return MetricPage{}, err
+	}
+	defer rows.Close()
+
+	var page MetricPage
+	for rows.Next() {
+		var m Metric
+		if err := rows.Scan(&m.Time, &m.MachineID, &m.MetricName, &m.Value, &m.Unit, &m.Quality); err != nil {
+			return MetricPage{}, err
+		}
+		page.Metrics = append(page.Metrics, m)
+	}
+	if err := rows.Err(); err != nil {
+		return MetricPage{}, err
+	}
+	if len(page.Metrics) > q.Limit {
+		page.Metrics = page.Metrics[:q.Limit]
+		last := page.Metrics[len(page.Metrics)-1]
+		page.Next = &MetricCursor{Time: last.Time, MachineID: last.MachineID, MetricName: last.MetricName}
+	}
+	return page, nil
+}
+
+// aggregateColumns are the SQL expressions of the aggregate functions.
+var aggregateColumns = map[string]string{
+	"avg":    "avg(m.value)",
+	"min":    "min(m.value)",
+	"max":    "max(m.value)",
+	"sum":    "sum(m.value)",
+	"count":  "count(m.value)::float8",
+	"stddev": "stddev(m.value)",
+	"first":  "first(m.value, m.time)",
+	"last":   "last(m.value, m.time)",
+}
+
+func aggregateExpr(f Aggregation) string {
+	if f.Name == "percentile" {
+		return fmt.Sprintf("percentile_cont(%s) WITHIN GROUP (ORDER BY m.value)", strconv.FormatFloat(f.Percentile, 'f', -1, 64))
+	}
+	return aggregateColumns[f.Name]
+}
+
+// groupColumns are the SQL expressions of the group-by dimensions.
+var groupColumns = map[string]string{
+	"machine":  "m.machine_id::text",
+	"location": "COALESCE(mc.location, '')",
+	"type":     "COALESCE(mc.type, '')",
+}
+
+func (p *postgres) Aggregate(ctx context.Context, q AggregateQuery) ([]Series, error) {
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	// Gap filling needs the bucket width and bounds as constants, so they
+	// are written into the query; none of them come from client text.
+	bucket := fmt.Sprintf("INTERVAL '%d seconds'", int64(q.Bucket/time.Second))
+	columns := []string{fmt.Sprintf("time_bucket(%s, m.time)", bucket)}
+	if q.Fill != "" {
+		columns[0] = fmt.Sprintf("time_bucket_gapfill(%s, m.time, '%s'::timestamptz, '%s'::timestamptz)",
+			bucket, q.From.UTC().Format(time.RFC3339Nano), q.To.UTC().Format(time.RFC3339Nano))
+	}
+	columns = append(columns, "m.metric_name")
+	join := false
+	for _, g := range q.GroupBy {
+		columns = append(columns, groupColumns[g])
+		join = join || g != "machine"
+	}
+	groups := len(columns)
+	for _, f := range q.Functions {
+		expr := aggregateExpr(f)
+		switch {
+		case q.Fill != "" && f.Name == "count":
+			expr = "COALESCE(" + expr + ", 0)"
+		case q.Fill == "locf":
+			expr = "locf(" + expr + ")"
+		}
+		columns = append(columns, expr)
+	}
+
+	conditions := []string{"m.time >= " + arg(q.From), "m.time < " + arg(q.To)}
+	if len(q.MachineIDs) > 0 {
+		conditions = append(conditions, "m.machine_id = ANY("+arg(q.MachineIDs)+")")
+	}
+	if len(q.MetricNames) > 0 {
+		conditions = append(conditions, "m.metric_name = ANY("+arg(q.MetricNames)+")")
+	}
+	if len(q.Qualities) > 0 {
+		conditions = append(conditions, "m.quality = ANY("+arg(q.Qualities)+")")
+	}
+	if q.Location != "" {
+		conditions = append(conditions, "mc.location = "+arg(q.Location))
+		join = true
+	}
+	if q.Type != "" {
+		conditions = append(conditions, "mc.type = "+arg(q.Type))
+		join = true
+	}
+
+	positions := make([]string, groups)
+	for i := range positions {
+		positions[i] = strconv.Itoa(i + 1)
+	}
+	sql := "SELECT " + strings.Join(columns, ", ") + " FROM metrics m"
+	if join {
+		sql += " JOIN machines mc ON mc.id = m.machine_id"
+	}
+	sql += " WHERE " + strings.Join(conditions, " AND ") +
+		" GROUP BY " + strings.Join(positions, ", ") +
+		" ORDER BY " + strings.Join(positions[1:], ", ") + ", 1"
+
+	rows, err := p.db.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var series []Series
+	var current *Series
+	var currentKey string
+	for rows.Next() {
+		var at time.Time
+		keys := make([]string, groups-1)
+		values := make([]*float64, len(q.Functions))
+		dest := []interface{}{&at}
+		for i := range keys {
+			dest = append(dest, &keys[i])
+		}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		// Rows arrive ordered by group, so a new key starts a new series.
+		key := strings.Join(keys, "\x00")
+		if current == nil || key != currentKey {
+			s := Series{Group: map[string]string{"metric_name": keys[0]}, Values: map[string][]*float64{}}
+			for i, g := range q.GroupBy {
+				if g == "machine" {
+					g = "machine_id"
+				}
+				s.Group[g] = keys[i+1]
+			}
+			series = append(series, s)
+			current, currentKey = &series[len(series)-1], key
+		}
+		current.Time = append(current.Time, at)
+		for i, f := range q.Functions {
+			label := f.Label()
+			current.Values[label] = append(current.Values[label], values[i])
+		}
+	}
+	return series, rows.Err()
+}
+
+func (p *postgres) Export(ctx context.Context, q ExportQuery, w io.Writer) error {
+	_, err := p.export(ctx, q, w)
+	return err
+}
+
+func (p *postgres) StartExport(ctx context.Context, q ExportQuery, query, user string) (export.Job, error) {
+	return p.exports.Start(ctx, q.Format, query, user, func(ctx context.Context, w io.Writer) (int64, error) {
+		return p.export(ctx, q, w)
+	})
+}
+
+func (p *postgres) ExportJob(ctx context.Context, id uuid.UUID) (export.Job, error) {
+	return p.exports.Get(ctx, id)
+}
+
+func (p *postgres) ListExportJobs(ctx context.Context) ([]export.Job, error) {
+	return p.exports.List(ctx)
+}
+
+func (p *postgres) OpenExport(ctx context.Context, id uuid.UUID) (*os.File, export.Job, error) {
+	return p.exports.Open(ctx, id)
+}
+
+func (p *postgres) DeleteExport(ctx context.Context, id uuid.UUID) error {
+	return p.exports.Delete(ctx, id)
+}
+
+// export streams the readings q selects through an encoder and returns how
+// many rows it wrote.
+func (p *postgres) export(ctx context.Context, q ExportQuery, w io.Writer) (int64, error) {
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	join := q.Location != "" || q.Type != ""
+	conditions := []string{"m.time >= " + arg(q.From), "m.time < " + arg(q.To)}
+	if len(q.MachineIDs) > 0 {
+		conditions = append(conditions, "m.machine_id = ANY("+arg(q.MachineIDs)+")")
+	}
+	if len(q.MetricNames) > 0 {
+		conditions = append(conditions, "m.metric_name = ANY("+arg(q.MetricNames)+")")
+	}
+	if len(q.Qualities) > 0 {
+		conditions = append(conditions, "m.quality = ANY("+arg(q.Qualities)+")")
+	}
+	if q.Location != "" {
+		conditions = append(conditions, "mc.location = "+arg(q.Location))
+	}
+	if q.Type != "" {
+		conditions = append(conditions, "mc.type = "+arg(q.Type))
+	}
+	from := " FROM metrics m"
+	if join {
+		from += " JOIN machines mc ON mc.id = m.machine_id"
+	}
+	from += " WHERE " + strings.Join(conditions, " AND ")
+
+	// Rows come ordered by time and machine, as exportTable needs.
+	var sql string
+	if q.Bucket > 0 {
+		selects := []string{fmt.Sprintf("time_bucket(INTERVAL '%d seconds', m.time)", int64(q.Bucket/time.Second)), "m.machine_id::text", "m.metric_name"}
+		for _, f := range q.Functions {
+			selects = append(selects, aggregateExpr(f))
+		}
+		sql = "SELECT " + strings.Join(selects, ", ") + from + " GROUP BY 1, 2, 3 ORDER BY 1, 2, 3"
+	} else {
+		sql = "SELECT m.time, m.machine_id::text, m.metric_name, m.value, COALESCE(m.unit, ''), COALESCE(m.quality, '')" + from +
+			" ORDER BY m.time, m.machine_id, m.metric_name"
+	}
+
+	// Wide exports need their columns up front: the metrics asked for, or
+	// every metric in range.
+	metrics := q.MetricNames
+	if q.Layout == "wide" && len(metrics) == 0 {
+		rows, err := p.db.Query(ctx, "SELECT DISTINCT m.metric_name"+from+" ORDER BY 1", args...)
+		if err != nil {
+			return 0, err
+		}
+		for rows.Next() {
+			var metric string
+			if err := rows.Scan(&metric); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			metrics = append(metrics, metric)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+	}
+
+	table, err := newExportTable(q, metrics, w)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := p.db.Query(ctx, sql, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	rec := exportRecord{Values: make([]*float64, len(q.Functions))}
+	dest := []interface{}{&rec.Time, &rec.MachineID, &rec.MetricName}
+	if q.Bucket > 0 {
+		for i := range rec.Values {
+			dest = append(dest, &rec.Values[i])
+		}
+	} else {
+		dest = append(dest, &rec.Value, &rec.Unit, &rec.Quality)
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return table.written, err
+		}
+		if err := table.add(rec); err != nil {
+			return table.written, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return table.written, err
+	}
+	return table.close()
+}
+
+func (p *postgres) Ingest(ctx context.Context, r Reading) error {
+	_, err := p.db.Exec(ctx,
+		"INSERT INTO metrics (time, machine_id, metric_name, value, unit, quality) VALUES ($1, $2, $3, $4, $5, $6)",
+		r.Time, r.MachineID, r.MetricName, r.Value, r.Unit, r.Quality,
+	)
+	if err != nil {
+		return err
+	}
+
+	p.latest.Update(latest.Value{
+		MachineID:  r.MachineID,
+		MetricName: r.MetricName,
+		Value:      r.Value,
+		Unit:       r.Unit,
+		Quality:    r.Quality,
+		Time:       r.Time,
+	})
+	p.stream.PublishReading(ctx, stream.Reading{
+		MachineID:  r.MachineID,
+		MetricName: r.MetricName,
+		Value:      r.Value,
+		Unit:       r.Unit,
+		Quality:    r.Quality,
+		Time:       r.Time,
+	})
+	go p.alerts.CheckMetric(r.MachineID, r.MetricName, r.Value)
+	go p.anomalies.Observe(r.MachineID, r.MetricName, r.Value, r.Time)
+	return nil
+}
+
+func (p *postgres) Latest(ctx context.Context, machineID *uuid.UUID) ([]latest.Value, error) {
+	if machineID == nil {
+		return p.latest.All(), nil
+	}
+	values := p.latest.Machine(*machineID)
+	if len(values) == 0 {
+		var exists bool
+		if err := p.db.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM machines WHERE id = $1)", *machineID).Scan(&exists); err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, ErrMachineNotFound
+		}
+	}
+	return values, nil
+}
+
+func (p *postgres) ListAlerts(ctx context.Context, f AlertFilter) ([]Alert, error) {
+	var conditions []string
+	var args []interface{}
+	if len(f.States) > 0 {
+		args = append(args, f.States)
+		conditions = append(conditions, fmt.Sprintf("state = ANY($%d)", len(args)))
+	}
+	if f.Acknowledged != nil {
+		args = append(args, *f.Acknowledged)
+		conditions = append(conditions, fmt.Sprintf("acknowledged = $%d", len(args)))
+	}
+	if f.Cleared != nil {
+		if *f.Cleared {
+			conditions = append(conditions, "cleared_at IS NOT NULL")
+		} else {
+			conditions = append(conditions, "cleared_at IS NULL")
+		}
+	}
+	if f.Severity != "" {
+		args = append(args, f.Severity)
+		conditions = append(conditions, fmt.Sprintf("severity = $%d", len(args)))
+	}
+	if f.Suppressed != nil {
+		args = append(args, *f.Suppressed)
+		conditions = append(conditions, fmt.Sprintf("suppressed = $%d", len(args)))
+	}
+	if f.MachineID != nil {
+		args = append(args, *f.MachineID)
+		conditions = append(conditions, fmt.Sprintf("machine_id = $%d", len(args)))
+	}
+
+	sql := `SELECT id, machine_id, rule_id, rule_revision, severity, message, state, acknowledged, acknowledged_by, acknowledged_at,
+	               cleared_at, closed_at, closed_by, evaluated_values, suppressed, suppressed_by, fingerprint, occurrences,
+	               last_value, last_seen_at, created_at
+	        FROM alerts`
+	if len(conditions) > 0 {
+		sql += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	sql += " ORDER BY created_at DESC LIMIT 100"
+
+	rows, err := p.db.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var alerts []Alert
+	for rows.Next() {
+		var a Alert
+		if err := rows.Scan(&a.ID, &a.MachineID, &a.RuleID, &a.RuleRevision, &a.Severity, &a.Message, &a.State, &a.Acknowledged, &a.AcknowledgedBy, &a.AcknowledgedAt,
+			&a.ClearedAt, &a.ClosedAt, &a.ClosedBy, &a.EvaluatedValues, &a.Suppressed, &a.SuppressedBy, &a.Fingerprint, &a.Occurrences,
+			&a.LastValue, &a.LastSeenAt, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, a)
+	}
+	return alerts, rows.Err()
+}
+
+func (p *postgres) Acknowledge(ctx context.Context, id uuid.UUID, user string) (string, error) {
+	return p.alerts.Acknowledge(ctx, id, user)
+}
+
+func (p *postgres) Close(ctx context.Context, id uuid.UUID, user string) error {
+	return p.alerts.Close(ctx, id, user)
+}
+
+func (p *postgres) Shelve(ctx context.Context, id uuid.UUID, user, reason string, duration time.Duration) (processing.Shelf, error) {
+	return p.alerts.Shelve(ctx, id, user, reason, duration)
+}
+
+func (p *postgres) Unshelve(ctx context.Context, id uuid.UUID, user string) error {
+	return p.alerts.Unshelve(ctx, id, user)
+}
+
+func (p *postgres) ListShelves(ctx context.Context, activeOnly bool) ([]processing.Shelf, error) {
+	return processing.ListShelves(ctx, p.db, activeOnly)
+}
+
+func (p *postgres) PreviewOnCall(ctx context.Context, id uuid.UUID) ([]notify.Page, error) {
+	return p.alerts.PreviewOnCall(ctx, id)
+}
+
+func (p *postgres) SeverityHistory(ctx context.Context, id uuid.UUID) ([]processing.SeverityChange, error) {
+	return processing.ListSeverityChanges(ctx, p.db, id)
+}
+
+func (p *postgres) AlarmReport(ctx context.Context, report string, from, to time.Time) (interface{}, error) {
+	switch report {
+	case "rate":
+		return processing.AlarmRate(ctx, p.db, from, to)
+	case "floods":
+		return processing.AlarmFloods(ctx, p.db, from, to)
+	case "bad-actors":
+		return processing.BadActors(ctx, p.db, from, to)
+	case "chattering":
+		return processing.ChatteringAlarms(ctx, p.db, from, to)
+	}
+	return nil, ErrUnknownReport
+}
+
+func (p *postgres) ListIncidents(ctx context.Context, state string) ([]processing.Incident, error) {
+	return processing.ListIncidents(ctx, p.db, state)
+}
+
+func (p *postgres) GetIncident(ctx context.Context, id uuid.UUID) (processing.IncidentDetail, error) {
+	return processing.GetIncident(ctx, p.db, id)
+}
+
+func (p *postgres) AcknowledgeIncident(ctx context.Context, id uuid.UUID, user string) (int, error) {
+	return p.alerts.AcknowledgeIncident(ctx, id, user)
+}
+
+func (p *postgres) ListRuleRelations(ctx context.Context) ([]processing.RuleRelation, error) {
+	return processing.ListRuleRelations(ctx, p.db)
+}
+
+func (p *postgres) CreateRuleRelation(ctx context.Context, causeRuleID, effectRuleID uuid.UUID) (uuid.UUID, error) {
+	return processing.CreateRuleRelation(ctx, p.db, causeRuleID, effectRuleID)
+}
+
+func (p *postgres) DeleteRuleRelation(ctx context.Context, id uuid.UUID) error {
+	return processing.DeleteRuleRelation(ctx, p.db, id)
+}
+
+func (p *postgres) ListRules(ctx context.Context, includeDeleted bool) ([]processing.AlertRule, error) {
+	return processing.ListRules(ctx, p.db, includeDeleted)
+}
+
+func (p *postgres) GetRule(ctx context.Context, id uuid.UUID) (processing.AlertRule, error) {
+	return processing.GetRule(ctx, p.db, id)
+}
+
+func (p *postgres) CreateRule(ctx context.Context, rule processing.AlertRule, user string) (processing.AlertRule, error) {
+	created, err := processing.CreateRule(ctx, p.db, rule, user)
+	if err == nil {
+		p.reloadRules(ctx)
+	}
+	return created, err
+}
+
+func (p *postgres) UpdateRule(ctx context.Context, rule processing.AlertRule, user string) (processing.AlertRule, error) {
+	updated, err := processing.UpdateRule(ctx, p.db, rule, user)
+	if err == nil {
+		p.reloadRules(ctx)
+	}
+	return updated, err
+}
+
+func (p *postgres) DeleteRule(ctx context.Context, id uuid.UUID, user string) error {
+	err := processing.DeleteRule(ctx, p.db, id, user)
+	if err == nil {
+		p.reloadRules(ctx)
+	}
+	return err
+}
+
+// reloadRules applies a rule change right away rather than on the next
+// change notification. A failed reload leaves the change to that.
+func (p *postgres) reloadRules(ctx context.Context) {
+	if err := p.alerts.ReloadRules(ctx); err != nil {
+		log.Printf("Failed to reload alert rules: %v", err)
+	}
+}
+
+func (p *postgres) ListRuleRevisions(ctx context.Context, id uuid.UUID) ([]processing.RuleRevision, error) {
+	return processing.ListRuleRevisions(ctx, p.db, id)
+}
+
+func (p *postgres) Backtest(ctx context.Context, rules []processing.AlertRule, from, to time.Time, machineID *uuid.UUID) ([]processing.BacktestResult, error) {
+	return processing.Backtest(ctx, p.db, rules, from, to, machineID)
+}
+
+func (p *postgres) RulesVersion(ctx context.Context) (RulesVersion, error) {
+	var v RulesVersion
+	err := p.db.QueryRow(ctx, "SELECT version, updated_at FROM alert_rules_version").Scan(&v.LatestVersion, &v.LatestAt)
+	if err != nil {
+		return v, err
+	}
+	loaded := p.alerts.RulesVersion()
+	v.Version, v.LoadedAt, v.Rules = loaded.Version, loaded.LoadedAt, loaded.Rules
+	v.Current = loaded.Version == v.LatestVersion
+	return v, nil
+}
+
+func (p *postgres) ExportRuleSet(ctx context.Context) (ruleset.Document, error) {
+	return ruleset.Export(ctx, p.db)
+}
+
+func (p *postgres) PlanRuleSet(ctx context.Context, doc ruleset.Document, prune bool, user string) (ruleset.Plan, error) {
+	return ruleset.MakePlan(ctx, p.db, doc, prune, user)
+}
+
+func (p *postgres) ApplyRuleSet(ctx context.Context, doc ruleset.Document, prune bool, user string) (ruleset.Plan, error) {
+	plan, err := ruleset.Apply(ctx, p.db, doc, prune, user)
+	// A failed apply may have made some of its changes.
+	if len(plan.Changes) > 0 {
+		p.reloadRules(ctx)
+	}
+	return plan, err
+}
+
+func (p *postgres) ListDeliveries(ctx context.Context, alertID *uuid.UUID) ([]notify.Delivery, error) {
+	return notify.ListDeliveries(ctx, p.db, alertID)
+}
+
+func (p *postgres) ListEmailRecipients(ctx context.Context) ([]notify.EmailRecipient, error) {
+	return notify.ListEmailRecipients(ctx, p.db)
+}
+
+func (p *postgres) SaveEmailRecipient(ctx context.Context, r notify.EmailRecipient) (uuid.UUID, error) {
+	return notify.SaveEmailRecipient(ctx, p.db, r)
+}
+
+func (p *postgres) DeleteEmailRecipient(ctx context.Context, id uuid.UUID) error {
+	return notify.DeleteEmailRecipient(ctx, p.db, id)
+}
+
+func (p *postgres) ListWebhooks(ctx context.Context) ([]notify.WebhookConfig, error) {
+	return notify.ListWebhooks(ctx, p.db, false)
+}
+
+func (p *postgres) CreateWebhook(ctx context.Context, c notify.WebhookConfig) (uuid.UUID, error) {
+	return notify.CreateWebhook(ctx, p.db, c)
+}
+
+func (p *postgres) DeleteWebhook(ctx context.Context, id uuid.UUID) error {
+	return notify.DeleteWebhook(ctx, p.db, id)
+}
+
+func (p *postgres) ListDeadLetters(ctx context.Context, includeReplayed bool) ([]notify.DeadLetter, error) {
+	return notify.ListDeadLetters(ctx, p.db, includeReplayed)
+}
+
+func (p *postgres) ReplayDeadLetter(ctx context.Context, id uuid.UUID) error {
+	return notify.ReplayDeadLetter(ctx, p.db, id)
+}
+
+func (p *postgres) ListRoutes(ctx context.Context) ([]notify.Route, error) {
+	return notify.ListRoutes(ctx, p.db, false)
+}
+
+func (p *postgres) SaveRoute(ctx context.Context, r notify.Route) (uuid.UUID, error) {
+	return notify.SaveRoute(ctx, p.db, r)
+}
+
+func (p *postgres) DeleteRoute(ctx context.Context, id uuid.UUID) error {
+	return notify.DeleteRoute(ctx, p.db, id)
+}
+
+func (p *postgres) ListEscalationPolicies(ctx context.Context) ([]notify.EscalationPolicy, error) {
+	return notify.ListEscalationPolicies(ctx, p.db, false)
+}
+
+func (p *postgres) SaveEscalationPolicy(ctx context.Context, policy notify.EscalationPolicy) (uuid.UUID, error) {
+	return notify.SaveEscalationPolicy(ctx, p.db, policy)
+}
+
+func (p *postgres) DeleteEscalationPolicy(ctx context.Context, id uuid.UUID) error {
+	return notify.DeleteEscalationPolicy(ctx, p.db, id)
+}
+
+func (p *postgres) ListSilences(ctx context.Context, activeOnly bool) ([]processing.Silence, error) {
+	return processing.ListSilences(ctx, p.db, activeOnly)
+}
+
+func (p *postgres) CreateSilence(ctx context.Context, s processing.Silence) (uuid.UUID, error) {
+	return processing.CreateSilence(ctx, p.db, s)
+}
+
+func (p *postgres) ExpireSilence(ctx context.Context, id uuid.UUID) error {
+	return processing.ExpireSilence(ctx, p.db, id)
+}
+
+func (p *postgres) ListMaintenanceWindows(ctx context.Context) ([]processing.MaintenanceWindow, error) {
+	return processing.ListMaintenanceWindows(ctx, p.db, false)
+}
+
+func (p *postgres) SaveMaintenanceWindow(ctx context.Context, w processing.MaintenanceWindow) (uuid.UUID, error) {
+	return processing.SaveMaintenanceWindow(ctx, p.db, w)
+}
+
+func (p *postgres) DeleteMaintenanceWindow(ctx context.Context, id uuid.UUID) error {
+	return processing.DeleteMaintenanceWindow(ctx, p.db, id)
+}
+
+func (p *postgres) CurrentOnCall(ctx context.Context, at time.Time) ([]oncall.Shift, error) {
+	return oncall.Current(ctx, p.db, at)
+}
+
+func (p *postgres) ListTeams(ctx context.Context) ([]oncall.Team, error) {
+	return oncall.ListTeams(ctx, p.db)
+}
+
+func (p *postgres) TeamExists(ctx context.Context, id uuid.UUID) (bool, error) {
+	return oncall.TeamExists(ctx, p.db, id)
+}
+
+func (p *postgres) SaveTeam(ctx context.Context, t oncall.Team) (uuid.UUID, error) {
+	return oncall.SaveTeam(ctx, p.db, t)
+}
+
+func (p *postgres) DeleteTeam(ctx context.Context, id uuid.UUID) error {
+	return oncall.DeleteTeam(ctx, p.db, id)
+}
+
+func (p *postgres) ListOverrides(ctx context.Context, teamID uuid.UUID, from time.Time) ([]oncall.Override, error) {
+	return oncall.ListOverrides(ctx, p.db, &teamID, from, time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC))
+}
+
+func (p *postgres) CreateOverride(ctx context.Context, o oncall.Override) (uuid.UUID, error) {
+	return oncall.CreateOverride(ctx, p.db, o)
+}
+
+func (p *postgres) DeleteOverride(ctx context.Context, id uuid.UUID) error {
+	return oncall.DeleteOverride(ctx, p.db, id)
+}
+
+func (p *postgres) ListAnomalies(ctx context.Context) ([]Anomaly, error) {
+	rows, err := p.db.Query(ctx,
+		`SELECT id, machine_id, COALESCE(metric_name, ''), detected_at, severity, COALESCE(description, '')
+		 FROM anomalies ORDER BY detected_at DESC LIMIT 100`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var anomalies []Anomaly
+	for rows.Next() {
+		var a Anomaly
+		if err := rows.Scan(&a.ID, &a.MachineID, &a.MetricName, &a.DetectedAt, &a.Severity, &a.Description); err != nil {
+			return nil, err
+		}
+		anomalies = append(anomalies, a)
+	}
+	return anomalies, rows.Err()
+}
+
+func (p *postgres) ListDetectors(ctx context.Context) ([]anomaly.Config, error) {
+	return anomaly.ListConfigs(ctx, p.db)
+}
+
+func (p *postgres) SaveDetector(ctx context.Context, c anomaly.Config) error {
+	if err := anomaly.SaveConfig(ctx, p.db, c); err != nil {
+		return err
+	}
+	p.anomalies.LoadConfigs(ctx)
+	return nil
+}
+
+func (p *postgres) ListBaselines(ctx context.Context, machineID *uuid.UUID, metricName string) ([]anomaly.SegmentBaseline, error) {
+	return anomaly.ListBaselines(ctx, p.db, machineID, metricName)
+}
+
+func (p *postgres) RelearnBaselines(ctx context.Context) error {
+	return p.anomalies.RelearnBaselines(ctx)
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// handle adapts a handler that reports failure by returning an error.
+func handle(h func(http.ResponseWriter, *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := h(w, r); err != nil {
+			writeError(w, err)
+		}
+	}
+}
+
+// writeJSON encodes v as the response body. Nil slices are written as empty
+// arrays so clients never see null for a list.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Slice && rv.IsNil() {
+		v = []struct{}{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// decode reads a JSON request body into v, which may carry defaults.
+func decode(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return withStatus(http.StatusBadRequest, err)
+	}
+	return nil
+}
+
+// pathID parses the {id} route variable; what names the resource in the
+// error.
+func pathID(r *http.Request, what string) (uuid.UUID, error) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		return uuid.Nil, errorf(http.StatusBadRequest, "invalid %s id", what)
+	}
+	return id, nil
+}
+
+// queryUUID parses an optional UUID query parameter.
+func queryUUID(r *http.Request, name string) (*uuid.UUID, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return nil, nil
+	}
+	id, err := uuid.Parse(v)
+	if err != nil {
+		return nil, errorf(http.StatusBadRequest, "invalid %s", name)
+	}
+	return &id, nil
+}
+
+// queryBool parses an optional boolean query parameter.
+func queryBool(r *http.Request, name string) (*bool, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return nil, errorf(http.StatusBadRequest, "invalid %s", name)
+	}
+	return &b, nil
+}
+
+// queryTime parses an optional RFC3339 query parameter.
+func queryTime(r *http.Request, name string, def time.Time) (time.Time, error) {
+	t, err := queryOptionalTime(r, name)
+	if err != nil || t == nil {
+		return def, err
+	}
+	return *t, nil
+}
+
+func queryOptionalTime(r *http.Request, name string) (*time.Time, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return nil, errorf(http.StatusBadRequest, "invalid %s", name)
+	}
+	return &t, nil
+}
+
+// queryList collects a multi-valued query parameter, given either repeated
+// or comma-separated.
+func queryList(r *http.Request, name string) []string {
+	var values []string
+	for _, v := range r.URL.Query()[name] {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				values = append(values, part)
+			}
+		}
+	}
+	return values
+}
+
+// requestUser identifies the operator behind a request from the X-User
+// header, falling back to a "user" field in a JSON body.
+func requestUser(r *http.Request) string {
+	if user := strings.TrimSpace(r.Header.Get("X-User")); user != "" {
+		return user
+	}
+	var body struct {
+		User string `json:"user"`
+	}
+	if r.Body != nil {
+		json.NewDecoder(r.Body).Decode(&body)
+	}
+	return strings.TrimSpace(body.User)
+}
+
+// requireUser is requestUser for the operations that must be attributed.
+func requireUser(r *http.Request) (string, error) {
+	user := requestUser(r)
+	if user == "" {
+		return "", errorf(http.StatusBadRequest, "user required")
+	}
+	return user, nil
+}
+
+// ruleAuthor is who a configuration change is recorded against: the X-User
+// header, or "api" for clients that do not send one.
+func ruleAuthor(r *http.Request) string {
+	if user := strings.TrimSpace(r.Header.Get("X-User")); user != "" {
+		return user
+	}
+	return "api"
+}
+
+func contains(values []string, v string) bool {
+	for _, candidate := range values {
+		if candidate == v {
+			return true
+		}
+	}
+	return false
+}
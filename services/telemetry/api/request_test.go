@@ -0,0 +1,173 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestPathIDInvalid(t *testing.T) {
+	tests := []struct {
+		method, target, want string
+	}{
+		{"POST", "/api/v1/alerts/42/acknowledge", "invalid alert id"},
+		{"POST", "/api/v1/alerts/not-a-uuid/close", "invalid alert id"},
+		{"GET", "/api/v1/incidents/1234", "invalid incident id"},
+		{"POST", "/api/v1/incidents/x/acknowledge", "invalid incident id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			s, f := newTestServer()
+			w := serve(s, tt.method, tt.target, "", "X-User", "alice")
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want 400", w.Code)
+			}
+			if got := strings.TrimSpace(w.Body.String()); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+			if len(f.alerts.calls)+len(f.incidents.calls) > 0 {
+				t.Errorf("services called: %v %v", f.alerts.calls, f.incidents.calls)
+			}
+		})
+	}
+}
+
+func TestRequireUser(t *testing.T) {
+	id := uuid.NewString()
+	tests := []struct {
+		name   string
+		body   string
+		header []string
+		status int
+		user   string
+	}{
+		{"missing", "", nil, http.StatusBadRequest, ""},
+		{"blank header", "", []string{"X-User", "  "}, http.StatusBadRequest, ""},
+		{"blank body", `{"user": " "}`, nil, http.StatusBadRequest, ""},
+		{"header", "", []string{"X-User", " alice "}, http.StatusOK, "alice"},
+		{"body", `{"user": "bob"}`, nil, http.StatusOK, "bob"},
+		{"header over body", `{"user": "bob"}`, []string{"X-User", "alice"}, http.StatusOK, "alice"},
+	}
+	for _, target := range []string{"/api/v1/alerts/" + id + "/close", "/api/v1/incidents/" + id + "/acknowledge"} {
+		for _, tt := range tests {
+			t.Run(target+"/"+tt.name, func(t *testing.T) {
+				s, f := newTestServer()
+				w := serve(s, "POST", target, tt.body, tt.header...)
+				if w.Code != tt.status {
+					t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+				}
+				calls := append(f.alerts.calls, f.incidents.calls...)
+				if tt.status != http.StatusOK {
+					if got := strings.TrimSpace(w.Body.String()); got != "user required" {
+						t.Errorf("body = %q, want user required", got)
+					}
+					if len(calls) > 0 {
+						t.Errorf("services called: %v", calls)
+					}
+					return
+				}
+				if len(calls) != 1 || !strings.HasSuffix(calls[0], id+" "+tt.user) {
+					t.Errorf("calls = %v, want one by %s", calls, tt.user)
+				}
+			})
+		}
+	}
+}
+
+func TestAcknowledgeAlertWithoutUser(t *testing.T) {
+	id := uuid.NewString()
+	for _, method := range []string{"GET", "POST", "PUT"} {
+		s, f := newTestServer()
+		w := serve(s, method, "/api/v1/alerts/"+id+"/acknowledge", "")
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status = %d, want 200", method, w.Code)
+		}
+		if want := []string{"acknowledge " + id + " api"}; !reflect.DeepEqual(f.alerts.calls, want) {
+			t.Errorf("%s: calls = %v, want %v", method, f.alerts.calls, want)
+		}
+	}
+}
+
+func TestQueryList(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", nil},
+		{"agg=avg", []string{"avg"}},
+		{"agg=avg,max", []string{"avg", "max"}},
+		{"agg=avg&agg=p95,%20min%20", []string{"avg", "p95", "min"}},
+		{"agg=,avg,,&agg=", []string{"avg"}},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/?"+tt.query, nil)
+		if got := queryList(r, "agg"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("queryList(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestQueryListInvalid(t *testing.T) {
+	id := uuid.NewString()
+	tests := []struct {
+		target, want string
+	}{
+		{"/api/v1/metrics/aggregate?agg=avg,median", `invalid agg "median"`},
+		{"/api/v1/metrics/aggregate?agg=p100", `invalid agg "p100"`},
+		{"/api/v1/metrics/aggregate?agg=avg&agg=max,avg", `duplicate agg "avg"`},
+		{"/api/v1/metrics/aggregate?group_by=machine,site", `invalid group_by "site"`},
+		{"/api/v1/metrics/aggregate?group_by=machine&group_by=machine", `invalid group_by "machine"`},
+		{"/api/v1/metrics/aggregate?group_by=none,type", `invalid group_by "none"`},
+		{"/api/v1/metrics/aggregate?machine_id=" + id + ",42", "invalid machine_id"},
+		{"/api/v1/export?machine_id=" + id + "&machine_id=42", "invalid machine_id"},
+		{"/api/v1/export?bucket=1h&agg=avg,mode", `invalid agg "mode"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			s, f := newTestServer()
+			w := serve(s, "GET", tt.target, "")
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("status = %d, want 400", w.Code)
+			}
+			if got := strings.TrimSpace(w.Body.String()); got != tt.want {
+				t.Errorf("body = %q, want %q", got, tt.want)
+			}
+			if len(f.metrics.aggregates)+len(f.exports.queries) > 0 {
+				t.Error("query reached the service")
+			}
+		})
+	}
+}
+
+func TestQueryListValues(t *testing.T) {
+	a, b := uuid.New(), uuid.New()
+	s, f := newTestServer()
+	w := serve(s, "GET", "/api/v1/metrics/aggregate?agg=avg,p99.5&agg=max&group_by=location,type&machine_id="+a.String()+","+b.String()+"&metric_name=temperature,vibration", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	if len(f.metrics.aggregates) != 1 {
+		t.Fatalf("aggregates = %d, want 1", len(f.metrics.aggregates))
+	}
+	q := f.metrics.aggregates[0]
+	var labels []string
+	for _, fn := range q.Functions {
+		labels = append(labels, fn.Label())
+	}
+	if want := []string{"avg", "p99.5", "max"}; !reflect.DeepEqual(labels, want) {
+		t.Errorf("functions = %v, want %v", labels, want)
+	}
+	if want := []string{"location", "type"}; !reflect.DeepEqual(q.GroupBy, want) {
+		t.Errorf("group by = %v, want %v", q.GroupBy, want)
+	}
+	if want := []uuid.UUID{a, b}; !reflect.DeepEqual(q.MachineIDs, want) {
+		t.Errorf("machine ids = %v, want %v", q.MachineIDs, want)
+	}
+	if want := []string{"temperature", "vibration"}; !reflect.DeepEqual(q.MetricNames, want) {
+		t.Errorf("metric names = %v, want %v", q.MetricNames, want)
+	}
+}
@@ -0,0 +1,316 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"telemetry/processing"
+	"telemetry/ruleset"
+)
+
+func (s *Server) ruleRoutes(r *mux.Router) {
+	r.HandleFunc("/api/v1/rules", handle(s.listRules)).Methods("GET")
+	r.HandleFunc("/api/v1/rules", handle(s.createRule)).Methods("POST")
+	r.HandleFunc("/api/v1/rules/version", handle(s.rulesVersion)).Methods("GET")
+	r.HandleFunc("/api/v1/rules/backtest", handle(s.backtest)).Methods("POST")
+	r.HandleFunc("/api/v1/rules/{id}", handle(s.getRule)).Methods("GET")
+	r.HandleFunc("/api/v1/rules/{id}", handle(s.replaceRule)).Methods("PUT")
+	r.HandleFunc("/api/v1/rules/{id}", handle(s.patchRule)).Methods("PATCH")
+	r.HandleFunc("/api/v1/rules/{id}", handle(s.deleteRule)).Methods("DELETE")
+	r.HandleFunc("/api/v1/rules/{id}/revisions", handle(s.ruleRevisions)).Methods("GET")
+	r.HandleFunc("/api/v1/config/export", handle(s.exportConfig)).Methods("GET")
+	r.HandleFunc("/api/v1/config/validate", s.validateConfig).Methods("POST")
+	r.HandleFunc("/api/v1/config/plan", handle(s.planConfig)).Methods("POST")
+	r.HandleFunc("/api/v1/config/apply", handle(s.applyConfig)).Methods("POST")
+}
+
+func (s *Server) listRules(w http.ResponseWriter, r *http.Request) error {
+	rules, err := s.Rules.ListRules(r.Context(), r.URL.Query().Get("include_deleted") == "true")
+	if err != nil {
+		return err
+	}
+	writeJSON(w, rules)
+	return nil
+}
+
+func (s *Server) createRule(w http.ResponseWriter, r *http.Request) error {
+	rule := processing.AlertRule{Enabled: true}
+	if err := decode(r, &rule); err != nil {
+		return err
+	}
+	if err := processing.ValidateRule(&rule); err != nil {
+		return withStatus(http.StatusBadRequest, err)
+	}
+
+	created, err := s.Rules.CreateRule(r.Context(), rule, ruleAuthor(r))
+	if err != nil {
+		return err
+	}
+	writeJSON(w, struct {
+		ID       uuid.UUID `json:"id"`
+		Revision int       `json:"revision"`
+	}{created.ID, created.Revision})
+	return nil
+}
+
+func (s *Server) getRule(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "rule")
+	if err != nil {
+		return err
+	}
+
+	rule, err := s.Rules.GetRule(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, rule)
+	return nil
+}
+
+// replaceRule replaces a rule. The body may carry the revision it was based
+// on, and the write fails with 409 if the rule has changed since.
+func (s *Server) replaceRule(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "rule")
+	if err != nil {
+		return err
+	}
+
+	rule := processing.AlertRule{Enabled: true}
+	if err := decode(r, &rule); err != nil {
+		return err
+	}
+	rule.ID = id
+	return s.saveRule(w, r, rule)
+}
+
+// patchRule updates the fields present in the body, with the same revision
+// check as replaceRule.
+func (s *Server) patchRule(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "rule")
+	if err != nil {
+		return err
+	}
+
+	var patch processing.RulePatch
+	if err := decode(r, &patch); err != nil {
+		return err
+	}
+	rule, err := s.Rules.GetRule(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	if rule.DeletedAt != nil {
+		return processing.ErrRuleNotFound
+	}
+	rule.Revision = 0
+	patch.Apply(&rule)
+	return s.saveRule(w, r, rule)
+}
+
+func (s *Server) saveRule(w http.ResponseWriter, r *http.Request, rule processing.AlertRule) error {
+	if err := processing.ValidateRule(&rule); err != nil {
+		return withStatus(http.StatusBadRequest, err)
+	}
+
+	updated, err := s.Rules.UpdateRule(r.Context(), rule, ruleAuthor(r))
+	if err != nil {
+		return err
+	}
+	writeJSON(w, updated)
+	return nil
+}
+
+// deleteRule soft-deletes a rule; its revisions stay readable.
+func (s *Server) deleteRule(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "rule")
+	if err != nil {
+		return err
+	}
+
+	if err := s.Rules.DeleteRule(r.Context(), id, ruleAuthor(r)); err != nil {
+		return err
+	}
+	writeJSON(w, statusResponse{Status: "deleted"})
+	return nil
+}
+
+func (s *Server) ruleRevisions(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "rule")
+	if err != nil {
+		return err
+	}
+
+	revisions, err := s.Rules.ListRuleRevisions(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, revisions)
+	return nil
+}
+
+func (s *Server) rulesVersion(w http.ResponseWriter, r *http.Request) error {
+	version, err := s.Rules.RulesVersion(r.Context())
+	if err != nil {
+		return err
+	}
+	writeJSON(w, version)
+	return nil
+}
+
+// BacktestRequest names the candidate rule to replay stored metrics
+// through. Given a rule_id the candidate defaults to that rule with changes
+// applied and is compared with the rule as it is in force; otherwise rule is
+// required. The range defaults to the last 30 days.
+type BacktestRequest struct {
+	RuleID    *uuid.UUID            `json:"rule_id"`
+	Rule      *processing.AlertRule `json:"rule"`
+	Changes   processing.RulePatch  `json:"changes"`
+	From      *time.Time            `json:"from"`
+	To        *time.Time            `json:"to"`
+	MachineID *uuid.UUID            `json:"machine_id"`
+}
+
+type BacktestResponse struct {
+	From       time.Time                  `json:"from"`
+	To         time.Time                  `json:"to"`
+	Candidate  processing.BacktestResult  `json:"candidate"`
+	Current    *processing.BacktestResult `json:"current,omitempty"`
+	Difference *BacktestDifference        `json:"difference,omitempty"`
+}
+
+// BacktestDifference is how many more alerts the candidate would have
+// raised than the rule in force.
+type BacktestDifference struct {
+	Alerts int `json:"alerts"`
+}
+
+func (s *Server) backtest(w http.ResponseWriter, r *http.Request) error {
+	var input BacktestRequest
+	if err := decode(r, &input); err != nil {
+		return err
+	}
+
+	to := time.Now()
+	if input.To != nil {
+		to = *input.To
+	}
+	from := to.Add(-30 * 24 * time.Hour)
+	if input.From != nil {
+		from = *input.From
+	}
+	if !to.After(from) || to.Sub(from) > processing.MaxBacktestRange {
+		return errorf(http.StatusBadRequest, "to must be after from and within 92 days of it")
+	}
+
+	var rules []processing.AlertRule
+	var candidate processing.AlertRule
+	if input.RuleID != nil {
+		current, err := s.Rules.GetRule(r.Context(), *input.RuleID)
+		if err != nil {
+			return err
+		}
+		candidate = current
+		if input.Rule != nil {
+			candidate = *input.Rule
+			candidate.ID = current.ID
+		}
+		input.Changes.Apply(&candidate)
+		if err := processing.ValidateRule(&current); err != nil {
+			return errorf(http.StatusBadRequest, "rule in force is invalid: %v", err)
+		}
+		rules = append(rules, current)
+	} else {
+		if input.Rule == nil {
+			return errorf(http.StatusBadRequest, "rule or rule_id is required")
+		}
+		candidate = *input.Rule
+		input.Changes.Apply(&candidate)
+	}
+	if err := processing.ValidateRule(&candidate); err != nil {
+		return withStatus(http.StatusBadRequest, err)
+	}
+	rules = append([]processing.AlertRule{candidate}, rules...)
+
+	results, err := s.Rules.Backtest(r.Context(), rules, from, to, input.MachineID)
+	if err != nil {
+		return err
+	}
+
+	response := BacktestResponse{From: from, To: to, Candidate: results[0]}
+	if len(results) > 1 {
+		response.Current = &results[1]
+		response.Difference = &BacktestDifference{Alerts: results[0].Total - results[1].Total}
+	}
+	writeJSON(w, response)
+	return nil
+}
+
+// exportConfig returns the rules, notification channels and silences as a
+// YAML rule set that plan and apply accept.
+func (s *Server) exportConfig(w http.ResponseWriter, r *http.Request) error {
+	doc, err := s.RuleSets.ExportRuleSet(r.Context())
+	if err != nil {
+		return err
+	}
+	out, err := doc.Marshal()
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Header().Set("Content-Disposition", `attachment; filename="rules.yaml"`)
+	w.Write(out)
+	return nil
+}
+
+// validateConfig checks a rule set without touching the database. An
+// invalid file is still a successful request.
+func (s *Server) validateConfig(w http.ResponseWriter, r *http.Request) {
+	result := validationResult{Problems: []string{}}
+	doc, err := ruleset.Parse(r.Body)
+	if err == nil {
+		err = doc.Validate()
+	}
+	var invalid *ruleset.ValidationError
+	switch {
+	case errors.As(err, &invalid):
+		result.Problems = invalid.Problems
+	case err != nil:
+		result.Problems = append(result.Problems, err.Error())
+	}
+	result.Valid = len(result.Problems) == 0
+	writeJSON(w, result)
+}
+
+// planConfig shows what applying a rule set would change without changing
+// anything.
+func (s *Server) planConfig(w http.ResponseWriter, r *http.Request) error {
+	doc, err := ruleset.Parse(r.Body)
+	if err != nil {
+		return withStatus(http.StatusBadRequest, err)
+	}
+	plan, err := s.RuleSets.PlanRuleSet(r.Context(), doc, r.URL.Query().Get("prune") == "true", ruleAuthor(r))
+	if err != nil {
+		return err
+	}
+	writeJSON(w, plan)
+	return nil
+}
+
+// applyConfig makes the database match a rule set. Applying the same file
+// twice changes nothing the second time.
+func (s *Server) applyConfig(w http.ResponseWriter, r *http.Request) error {
+	doc, err := ruleset.Parse(r.Body)
+	if err != nil {
+		return withStatus(http.StatusBadRequest, err)
+	}
+	plan, err := s.RuleSets.ApplyRuleSet(r.Context(), doc, r.URL.Query().Get("prune") == "true", ruleAuthor(r))
+	if err != nil {
+		return err
+	}
+	writeJSON(w, plan)
+	return nil
+}
@@ -0,0 +1,49 @@
+// Package api serves the telemetry HTTP API. Handlers only talk to the
+// service interfaces in services.go, so they run the same against the
+// TimescaleDB-backed implementation from NewPostgres and against fakes.
+package api
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Server routes API requests to the services behind them.
+type Server struct {
+	Services
+	handler http.Handler
+}
+
+func NewServer(services Services) *Server {
+	s := &Server{Services: services}
+
+	r := mux.NewRouter()
+	r.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	})
+
+	r.HandleFunc("/health", s.health).Methods("GET")
+	s.machineRoutes(r)
+	s.metricRoutes(r)
+	s.alertRoutes(r)
+	s.incidentRoutes(r)
+	s.ruleRoutes(r)
+	s.notificationRoutes(r)
+	s.suppressionRoutes(r)
+	s.onCallRoutes(r)
+	s.anomalyRoutes(r)
+	s.streamRoutes(r)
+	s.exportRoutes(r)
+
+	s.handler = recoverPanics(logServerErrors(r))
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+func (s *Server) health(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, statusResponse{Status: "ok"})
+}
@@ -0,0 +1,209 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"telemetry/notify"
+	"telemetry/processing"
+	"telemetry/ruleset"
+)
+
+// The fakes embed their service interface, so calling a method a test did
+// not expect panics, which the server answers with a 500.
+
+type fakeAlerts struct {
+	AlertService
+	err   error
+	calls []string
+}
+
+func (f *fakeAlerts) Acknowledge(ctx context.Context, id uuid.UUID, user string) (string, error) {
+	f.calls = append(f.calls, "acknowledge "+id.String()+" "+user)
+	return processing.AlertStateAcknowledged, f.err
+}
+
+func (f *fakeAlerts) Close(ctx context.Context, id uuid.UUID, user string) error {
+	f.calls = append(f.calls, "close "+id.String()+" "+user)
+	return f.err
+}
+
+type fakeIncidents struct {
+	IncidentService
+	err   error
+	calls []string
+}
+
+func (f *fakeIncidents) GetIncident(ctx context.Context, id uuid.UUID) (processing.IncidentDetail, error) {
+	f.calls = append(f.calls, "get "+id.String())
+	return processing.IncidentDetail{}, f.err
+}
+
+func (f *fakeIncidents) AcknowledgeIncident(ctx context.Context, id uuid.UUID, user string) (int, error) {
+	f.calls = append(f.calls, "acknowledge "+id.String()+" "+user)
+	return 2, f.err
+}
+
+type fakeMetrics struct {
+	MetricService
+	readings   []Reading
+	aggregates []AggregateQuery
+}
+
+func (f *fakeMetrics) Ingest(ctx context.Context, r Reading) error {
+	f.readings = append(f.readings, r)
+	return nil
+}
+
+func (f *fakeMetrics) Aggregate(ctx context.Context, q AggregateQuery) ([]Series, error) {
+	f.aggregates = append(f.aggregates, q)
+	return nil, nil
+}
+
+type fakeExports struct {
+	ExportService
+	queries []ExportQuery
+}
+
+func (f *fakeExports) Export(ctx context.Context, q ExportQuery, w io.Writer) error {
+	f.queries = append(f.queries, q)
+	return nil
+}
+
+type fakeNotifications struct {
+	NotificationService
+	recipients []notify.EmailRecipient
+}
+
+func (f *fakeNotifications) SaveEmailRecipient(ctx context.Context, r notify.EmailRecipient) (uuid.UUID, error) {
+	f.recipients = append(f.recipients, r)
+	return uuid.New(), nil
+}
+
+type fakes struct {
+	alerts        *fakeAlerts
+	incidents     *fakeIncidents
+	metrics       *fakeMetrics
+	exports       *fakeExports
+	notifications *fakeNotifications
+}
+
+func newTestServer() (*Server, *fakes) {
+	f := &fakes{
+		alerts:        &fakeAlerts{},
+		incidents:     &fakeIncidents{},
+		metrics:       &fakeMetrics{},
+		exports:       &fakeExports{},
+		notifications: &fakeNotifications{},
+	}
+	return NewServer(Services{
+		Alerts:        f.alerts,
+		Incidents:     f.incidents,
+		Metrics:       f.metrics,
+		Exports:       f.exports,
+		Notifications: f.notifications,
+	}), f
+}
+
+// serve sends a request through s; header is alternating names and values.
+func serve(s *Server, method, target, body string, header ...string) *httptest.ResponseRecorder {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, target, r)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	return w
+}
+
+func TestWriteErrorSentinels(t *testing.T) {
+	for _, e := range errorStatuses {
+		t.Run(e.err.Error(), func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeError(w, fmt.Errorf("loading thing: %w", e.err))
+			if w.Code != e.status {
+				t.Errorf("status = %d, want %d", w.Code, e.status)
+			}
+			if want := "loading thing: " + e.err.Error(); strings.TrimSpace(w.Body.String()) != want {
+				t.Errorf("body = %q, want %q", w.Body.String(), want)
+			}
+		})
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{"unknown", errors.New("connection refused"), http.StatusInternalServerError},
+		{"explicit status", errorf(http.StatusBadRequest, "invalid limit"), http.StatusBadRequest},
+		{"status overrides sentinel", withStatus(http.StatusGone, processing.ErrAlertNotFound), http.StatusGone},
+		{"wrapped explicit status", fmt.Errorf("create: %w", errorf(http.StatusTeapot, "short and stout")), http.StatusTeapot},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeError(w, tt.err)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+				t.Errorf("Content-Type = %q, want text/plain", ct)
+			}
+		})
+	}
+}
+
+func TestWriteErrorValidation(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeError(w, fmt.Errorf("apply: %w", &ruleset.ValidationError{Problems: []string{"rule \"a\": no metric", "rule \"b\": defined more than once"}}))
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	var got validationResult
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Valid || len(got.Problems) != 2 || got.Problems[1] != "rule \"b\": defined more than once" {
+		t.Errorf("body = %+v", got)
+	}
+}
+
+func TestServiceErrorStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{nil, http.StatusOK},
+		{processing.ErrAlertNotFound, http.StatusNotFound},
+		{processing.ErrInvalidTransition, http.StatusConflict},
+		{errors.New("database is down"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		s, f := newTestServer()
+		f.alerts.err = tt.err
+		w := serve(s, "POST", "/api/v1/alerts/"+uuid.NewString()+"/close", "", "X-User", "alice")
+		if w.Code != tt.status {
+			t.Errorf("close with %v: status = %d, want %d", tt.err, w.Code, tt.status)
+		}
+	}
+}
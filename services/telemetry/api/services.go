@@ -0,0 +1,169 @@
+package api
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+
+	"telemetry/anomaly"
+	"telemetry/export"
+	"telemetry/latest"
+	"telemetry/notify"
+	"telemetry/oncall"
+	"telemetry/processing"
+	"telemetry/ruleset"
+	"telemetry/stream"
+)
+
+// Services are everything the API serves. Not-found and conflict failures
+// are reported with the sentinel errors of the package that owns the
+// resource, which writeError maps to a status.
+type Services struct {
+	Machines      MachineService
+	Metrics       MetricService
+	Alerts        AlertService
+	Incidents     IncidentService
+	Rules         RuleService
+	RuleSets      RuleSetService
+	Notifications NotificationService
+	Suppression   SuppressionService
+	OnCall        OnCallService
+	Anomalies     AnomalyService
+	Stream        StreamService
+	Exports       ExportService
+}
+
+type MachineService interface {
+	ListMachines(ctx context.Context) ([]Machine, error)
+	CreateMachine(ctx context.Context, m NewMachine) (uuid.UUID, error)
+	// HealthModel returns nil when no model has been trained.
+	HealthModel(ctx context.Context, machineID uuid.UUID) (*anomaly.HealthModel, error)
+	TrainHealthModel(ctx context.Context, machineID uuid.UUID, from, to time.Time) (*anomaly.HealthModel, error)
+}
+
+type MetricService interface {
+	QueryMetrics(ctx context.Context, q MetricQuery) (MetricPage, error)
+	Aggregate(ctx context.Context, q AggregateQuery) ([]Series, error)
+	// Latest returns the latest value of every metric, or of one machine's
+	// metrics, ordered by machine and metric.
+	Latest(ctx context.Context, machineID *uuid.UUID) ([]latest.Value, error)
+	// Ingest stores a reading and hands it to alerting, anomaly detection
+	// and live streams.
+	Ingest(ctx context.Context, r Reading) error
+}
+
+// StreamService feeds live readings and alert lifecycle events to
+// streaming clients.
+type StreamService interface {
+	Subscribe(f stream.Filter) (*stream.Subscription, error)
+	Unsubscribe(s *stream.Subscription)
+}
+
+type ExportService interface {
+	// Export writes the readings q selects to w as they are read, so that
+	// an export of any size streams in bounded memory.
+	Export(ctx context.Context, q ExportQuery, w io.Writer) error
+	// StartExport runs q as a background job writing to the export
+	// directory. query is the request's parameters, kept with the job.
+	StartExport(ctx context.Context, q ExportQuery, query, user string) (export.Job, error)
+	ExportJob(ctx context.Context, id uuid.UUID) (export.Job, error)
+	ListExportJobs(ctx context.Context) ([]export.Job, error)
+	// OpenExport opens the file of a job that succeeded.
+	OpenExport(ctx context.Context, id uuid.UUID) (*os.File, export.Job, error)
+	DeleteExport(ctx context.Context, id uuid.UUID) error
+}
+
+type AlertService interface {
+	ListAlerts(ctx context.Context, f AlertFilter) ([]Alert, error)
+	// Acknowledge returns the state the alert is left in.
+	Acknowledge(ctx context.Context, id uuid.UUID, user string) (string, error)
+	Close(ctx context.Context, id uuid.UUID, user string) error
+	Shelve(ctx context.Context, id uuid.UUID, user, reason string, duration time.Duration) (processing.Shelf, error)
+	Unshelve(ctx context.Context, id uuid.UUID, user string) error
+	ListShelves(ctx context.Context, activeOnly bool) ([]processing.Shelf, error)
+	PreviewOnCall(ctx context.Context, id uuid.UUID) ([]notify.Page, error)
+	SeverityHistory(ctx context.Context, id uuid.UUID) ([]processing.SeverityChange, error)
+	// AlarmReport runs one of the ISA-18.2 reports: rate, floods,
+	// bad-actors or chattering.
+	AlarmReport(ctx context.Context, report string, from, to time.Time) (interface{}, error)
+}
+
+type IncidentService interface {
+	ListIncidents(ctx context.Context, state string) ([]processing.Incident, error)
+	GetIncident(ctx context.Context, id uuid.UUID) (processing.IncidentDetail, error)
+	// AcknowledgeIncident returns how many alerts it acknowledged.
+	AcknowledgeIncident(ctx context.Context, id uuid.UUID, user string) (int, error)
+	ListRuleRelations(ctx context.Context) ([]processing.RuleRelation, error)
+	CreateRuleRelation(ctx context.Context, causeRuleID, effectRuleID uuid.UUID) (uuid.UUID, error)
+	DeleteRuleRelation(ctx context.Context, id uuid.UUID) error
+}
+
+// RuleService stores alert rules. Writes take effect in the running
+// evaluator before they return.
+type RuleService interface {
+	ListRules(ctx context.Context, includeDeleted bool) ([]processing.AlertRule, error)
+	GetRule(ctx context.Context, id uuid.UUID) (processing.AlertRule, error)
+	CreateRule(ctx context.Context, rule processing.AlertRule, user string) (processing.AlertRule, error)
+	UpdateRule(ctx context.Context, rule processing.AlertRule, user string) (processing.AlertRule, error)
+	DeleteRule(ctx context.Context, id uuid.UUID, user string) error
+	ListRuleRevisions(ctx context.Context, id uuid.UUID) ([]processing.RuleRevision, error)
+	Backtest(ctx context.Context, rules []processing.AlertRule, from, to time.Time, machineID *uuid.UUID) ([]processing.BacktestResult, error)
+	RulesVersion(ctx context.Context) (RulesVersion, error)
+}
+
+type RuleSetService interface {
+	ExportRuleSet(ctx context.Context) (ruleset.Document, error)
+	PlanRuleSet(ctx context.Context, doc ruleset.Document, prune bool, user string) (ruleset.Plan, error)
+	ApplyRuleSet(ctx context.Context, doc ruleset.Document, prune bool, user string) (ruleset.Plan, error)
+}
+
+type NotificationService interface {
+	ListDeliveries(ctx context.Context, alertID *uuid.UUID) ([]notify.Delivery, error)
+	ListEmailRecipients(ctx context.Context) ([]notify.EmailRecipient, error)
+	SaveEmailRecipient(ctx context.Context, r notify.EmailRecipient) (uuid.UUID, error)
+	DeleteEmailRecipient(ctx context.Context, id uuid.UUID) error
+	ListWebhooks(ctx context.Context) ([]notify.WebhookConfig, error)
+	CreateWebhook(ctx context.Context, c notify.WebhookConfig) (uuid.UUID, error)
+	DeleteWebhook(ctx context.Context, id uuid.UUID) error
+	ListDeadLetters(ctx context.Context, includeReplayed bool) ([]notify.DeadLetter, error)
+	ReplayDeadLetter(ctx context.Context, id uuid.UUID) error
+	ListRoutes(ctx context.Context) ([]notify.Route, error)
+	SaveRoute(ctx context.Context, r notify.Route) (uuid.UUID, error)
+	DeleteRoute(ctx context.Context, id uuid.UUID) error
+	ListEscalationPolicies(ctx context.Context) ([]notify.EscalationPolicy, error)
+	SaveEscalationPolicy(ctx context.Context, p notify.EscalationPolicy) (uuid.UUID, error)
+	DeleteEscalationPolicy(ctx context.Context, id uuid.UUID) error
+}
+
+type SuppressionService interface {
+	ListSilences(ctx context.Context, activeOnly bool) ([]processing.Silence, error)
+	CreateSilence(ctx context.Context, s processing.Silence) (uuid.UUID, error)
+	ExpireSilence(ctx context.Context, id uuid.UUID) error
+	ListMaintenanceWindows(ctx context.Context) ([]processing.MaintenanceWindow, error)
+	SaveMaintenanceWindow(ctx context.Context, w processing.MaintenanceWindow) (uuid.UUID, error)
+	DeleteMaintenanceWindow(ctx context.Context, id uuid.UUID) error
+}
+
+type OnCallService interface {
+	CurrentOnCall(ctx context.Context, at time.Time) ([]oncall.Shift, error)
+	ListTeams(ctx context.Context) ([]oncall.Team, error)
+	TeamExists(ctx context.Context, id uuid.UUID) (bool, error)
+	SaveTeam(ctx context.Context, t oncall.Team) (uuid.UUID, error)
+	DeleteTeam(ctx context.Context, id uuid.UUID) error
+	// ListOverrides returns the team's overrides ending after from.
+	ListOverrides(ctx context.Context, teamID uuid.UUID, from time.Time) ([]oncall.Override, error)
+	CreateOverride(ctx context.Context, o oncall.Override) (uuid.UUID, error)
+	DeleteOverride(ctx context.Context, id uuid.UUID) error
+}
+
+type AnomalyService interface {
+	ListAnomalies(ctx context.Context) ([]Anomaly, error)
+	ListDetectors(ctx context.Context) ([]anomaly.Config, error)
+	// SaveDetector stores a detector and reloads the running ones.
+	SaveDetector(ctx context.Context, c anomaly.Config) error
+	ListBaselines(ctx context.Context, machineID *uuid.UUID, metricName string) ([]anomaly.SegmentBaseline, error)
+	RelearnBaselines(ctx context.Context) error
+}
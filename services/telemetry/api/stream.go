@@ -0,0 +1,212 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+
+	"telemetry/stream"
+)
+
+const (
+	// heartbeatInterval is how often a stream sends a heartbeat frame so
+	// clients and proxies can tell an idle stream from a dead one.
+	heartbeatInterval = 15 * time.Second
+	// streamWriteTimeout bounds each write to a streaming client. It takes
+	// over from the server's WriteTimeout, which would cut every stream off.
+	streamWriteTimeout = 10 * time.Second
+)
+
+var upgrader = websocket.Upgrader{HandshakeTimeout: 10 * time.Second}
+
+// heartbeat is the frame sent every heartbeatInterval.
+type heartbeat struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+}
+
+// streamClosed is the last Server-Sent Event of a stream the server ended.
+type streamClosed struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+func (s *Server) streamRoutes(r *mux.Router) {
+	r.HandleFunc("/api/v1/stream", handle(s.streamEvents)).Methods("GET")
+	r.HandleFunc("/api/v1/stream/ws", handle(s.streamWebSocket)).Methods("GET")
+}
+
+// streamFilter reads a subscription from the repeatable or comma-separated
+// type (reading, alert), machine_id, metric_name, location and severity
+// parameters. Severity only narrows alert events.
+func streamFilter(r *http.Request) (stream.Filter, error) {
+	f := stream.Filter{
+		Types:      queryList(r, "type"),
+		Metrics:    queryList(r, "metric_name"),
+		Locations:  queryList(r, "location"),
+		Severities: queryList(r, "severity"),
+	}
+	for _, t := range f.Types {
+		if !contains(stream.EventTypes, t) {
+			return f, errorf(http.StatusBadRequest, "invalid type %q", t)
+		}
+	}
+	for _, severity := range f.Severities {
+		if !contains([]string{"info", "warning", "critical"}, severity) {
+			return f, errorf(http.StatusBadRequest, "invalid severity %q", severity)
+		}
+	}
+	for _, v := range queryList(r, "machine_id") {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			return f, errorf(http.StatusBadRequest, "invalid machine_id")
+		}
+		f.Machines = append(f.Machines, id)
+	}
+	return f, nil
+}
+
+func (s *Server) subscribe(r *http.Request) (*stream.Subscription, error) {
+	f, err := streamFilter(r)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := s.Stream.Subscribe(f)
+	if errors.Is(err, stream.ErrClosed) {
+		return nil, withStatus(http.StatusServiceUnavailable, err)
+	}
+	return sub, err
+}
+
+// streamEvents streams matching events as Server-Sent Events named after
+// their type, with a heartbeat event when idle. When the server drops the
+// subscriber, for falling behind or shutting down, a final close event
+// carries the reason.
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request) error {
+	sub, err := s.subscribe(r)
+	if err != nil {
+		return err
+	}
+	defer s.Stream.Unsubscribe(sub)
+
+	rc := http.NewResponseController(w)
+	send := func(event string, v interface{}) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if err := rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout)); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keeps nginx from buffering the stream.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return nil
+	}
+
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		// A failed write means the client went away; there is no one left
+		// to answer.
+		select {
+		case e := <-sub.Events():
+			if send(e.Type, e) != nil {
+				return nil
+			}
+		case t := <-ticker.C:
+			if send("heartbeat", heartbeat{Type: "heartbeat", Time: t}) != nil {
+				return nil
+			}
+		case <-sub.Done():
+			send("close", streamClosed{Type: "close", Reason: sub.Err().Error()})
+			return nil
+		case <-r.Context().Done():
+			return nil
+		}
+	}
+}
+
+// streamWebSocket streams matching events as JSON text messages, with a
+// heartbeat message and a ping when idle. When the server drops the
+// subscriber the connection is closed with 1013 (try again later) for
+// falling behind or 1001 (going away) for shutting down.
+func (s *Server) streamWebSocket(w http.ResponseWriter, r *http.Request) error {
+	sub, err := s.subscribe(r)
+	if err != nil {
+		return err
+	}
+	defer s.Stream.Unsubscribe(sub)
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already answered the request.
+		return nil
+	}
+	defer conn.Close()
+
+	// Clients only send control frames, but reading is what handles pongs
+	// and notices the client closing or vanishing.
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		conn.SetReadLimit(512)
+		conn.SetReadDeadline(time.Now().Add(2 * heartbeatInterval))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(2 * heartbeatInterval))
+		})
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(v interface{}) error {
+		conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		return conn.WriteJSON(v)
+	}
+
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case e := <-sub.Events():
+			if send(e) != nil {
+				return nil
+			}
+		case t := <-ticker.C:
+			if send(heartbeat{Type: "heartbeat", Time: t}) != nil {
+				return nil
+			}
+			if conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteTimeout)) != nil {
+				return nil
+			}
+		case <-sub.Done():
+			code := websocket.CloseGoingAway
+			if errors.Is(sub.Err(), stream.ErrSlowConsumer) {
+				code = websocket.CloseTryAgainLater
+			}
+			message := websocket.FormatCloseMessage(code, sub.Err().Error())
+			conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(streamWriteTimeout))
+			return nil
+		case <-gone:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+
+	"telemetry/processing"
+)
+
+func (s *Server) suppressionRoutes(r *mux.Router) {
+	r.HandleFunc("/api/v1/silences", handle(s.listSilences)).Methods("GET")
+	r.HandleFunc("/api/v1/silences", handle(s.createSilence)).Methods("POST")
+	r.HandleFunc("/api/v1/silences/{id}", handle(s.expireSilence)).Methods("DELETE")
+	r.HandleFunc("/api/v1/maintenance-windows", handle(s.listMaintenanceWindows)).Methods("GET")
+	r.HandleFunc("/api/v1/maintenance-windows", handle(s.createMaintenanceWindow)).Methods("POST")
+	r.HandleFunc("/api/v1/maintenance-windows/{id}", handle(s.replaceMaintenanceWindow)).Methods("PUT")
+	r.HandleFunc("/api/v1/maintenance-windows/{id}", handle(s.deleteMaintenanceWindow)).Methods("DELETE")
+}
+
+// listSilences lists silences, with ?active=true only those in effect now.
+func (s *Server) listSilences(w http.ResponseWriter, r *http.Request) error {
+	silences, err := s.Suppression.ListSilences(r.Context(), r.URL.Query().Get("active") == "true")
+	if err != nil {
+		return err
+	}
+	writeJSON(w, silences)
+	return nil
+}
+
+// createSilence creates a silence starting now unless it says otherwise.
+// The creator comes from X-User or created_by.
+func (s *Server) createSilence(w http.ResponseWriter, r *http.Request) error {
+	silence := processing.Silence{StartsAt: time.Now()}
+	if err := decode(r, &silence); err != nil {
+		return err
+	}
+	if user := strings.TrimSpace(r.Header.Get("X-User")); user != "" {
+		silence.CreatedBy = user
+	}
+	if silence.CreatedBy == "" {
+		return errorf(http.StatusBadRequest, "user required")
+	}
+	if err := silence.Validate(); err != nil {
+		return withStatus(http.StatusBadRequest, err)
+	}
+
+	id, err := s.Suppression.CreateSilence(r.Context(), silence)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, createdResponse{ID: id})
+	return nil
+}
+
+func (s *Server) expireSilence(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "silence")
+	if err != nil {
+		return err
+	}
+
+	if err := s.Suppression.ExpireSilence(r.Context(), id); err != nil {
+		return err
+	}
+	writeJSON(w, statusResponse{Status: "expired"})
+	return nil
+}
+
+func (s *Server) listMaintenanceWindows(w http.ResponseWriter, r *http.Request) error {
+	windows, err := s.Suppression.ListMaintenanceWindows(r.Context())
+	if err != nil {
+		return err
+	}
+	writeJSON(w, windows)
+	return nil
+}
+
+func (s *Server) createMaintenanceWindow(w http.ResponseWriter, r *http.Request) error {
+	return s.saveMaintenanceWindow(w, r, uuid.Nil)
+}
+
+func (s *Server) replaceMaintenanceWindow(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "window")
+	if err != nil {
+		return err
+	}
+	return s.saveMaintenanceWindow(w, r, id)
+}
+
+func (s *Server) saveMaintenanceWindow(w http.ResponseWriter, r *http.Request, id uuid.UUID) error {
+	window := processing.MaintenanceWindow{Enabled: true}
+	if err := decode(r, &window); err != nil {
+		return err
+	}
+	window.ID = id
+	if err := window.Validate(); err != nil {
+		return withStatus(http.StatusBadRequest, err)
+	}
+
+	id, err := s.Suppression.SaveMaintenanceWindow(r.Context(), window)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, createdResponse{ID: id})
+	return nil
+}
+
+func (s *Server) deleteMaintenanceWindow(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r, "window")
+	if err != nil {
+		return err
+	}
+
+	if err := s.Suppression.DeleteMaintenanceWindow(r.Context(), id); err != nil {
+		return err
+	}
+	writeJSON(w, statusResponse{Status: "deleted"})
+	return nil
+}
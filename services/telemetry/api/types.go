@@ -0,0 +1,203 @@
+package api
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Machine struct {
+	ID        uuid.UUID              `json:"id"`
+	Name      string                 `json:"name"`
+	Type      string                 `json:"type"`
+	Location  string                 `json:"location"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+	Status    string                 `json:"status"`
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+type NewMachine struct {
+	Name     string                 `json:"name"`
+	Type     string                 `json:"type"`
+	Location string                 `json:"location"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+type Metric struct {
+	Time       time.Time `json:"time"`
+	MachineID  uuid.UUID `json:"machine_id"`
+	MetricName string    `json:"metric_name"`
+	Value      float64   `json:"value"`
+	Unit       string    `json:"unit"`
+	Quality    string    `json:"quality"`
+}
+
+// MetricQuery selects readings. Empty filters match everything; From is
+// inclusive and To exclusive. Readings come newest first, or oldest first
+// when Ascending, ordered by time, machine and metric so that After can
+// continue from the last reading of a previous page.
+type MetricQuery struct {
+	MachineID   *uuid.UUID
+	MetricNames []string
+	Qualities   []string
+	Location    string
+	Type        string
+	From        *time.Time
+	To          *time.Time
+	Ascending   bool
+	After       *MetricCursor
+	Limit       int
+}
+
+// MetricCursor is the position of a reading in a metric query's order.
+type MetricCursor struct {
+	Time       time.Time
+	MachineID  uuid.UUID
+	MetricName string
+}
+
+// MetricPage is one page of a metric query. Next is nil on the last page.
+type MetricPage struct {
+	Metrics []Metric
+	Next    *MetricCursor
+}
+
+// AggregateQuery summarises readings in [From, To) into Bucket-wide time
+// buckets, one series per metric and combination of GroupBy dimensions
+// ("machine", "location", "type"). Fill is "" to leave empty buckets out,
+// "null" to include them without values, or "locf" to carry the previous
+// value forward.
+type AggregateQuery struct {
+	Bucket      time.Duration
+	From        time.Time
+	To          time.Time
+	Functions   []Aggregation
+	GroupBy     []string
+	Fill        string
+	MachineIDs  []uuid.UUID
+	MetricNames []string
+	Qualities   []string
+	Location    string
+	Type        string
+}
+
+// Aggregation is an aggregate function over a bucket's values. Percentile
+// is in [0, 1] and only used by "percentile".
+type Aggregation struct {
+	Name       string
+	Percentile float64
+}
+
+// Series is one group's buckets in columnar form: Values holds one column
+// per aggregation, aligned with Time. A nil value is an empty bucket.
+type Series struct {
+	Group  map[string]string     `json:"group"`
+	Time   []time.Time           `json:"time"`
+	Values map[string][]*float64 `json:"values"`
+}
+
+// ExportQuery selects the readings of an export and lays them out. Long
+// exports have a row per reading, or per metric and bucket when Bucket is
+// set; wide exports have a row per machine and time with a column per
+// metric, or per metric and aggregation.
+type ExportQuery struct {
+	Format      string
+	Layout      string
+	From        time.Time
+	To          time.Time
+	MachineIDs  []uuid.UUID
+	MetricNames []string
+	Qualities   []string
+	Location    string
+	Type        string
+	Bucket      time.Duration
+	Functions   []Aggregation
+}
+
+// IngestRequest is one reading as posted to /api/v1/metrics/ingest.
+type IngestRequest struct {
+	MachineID  string  `json:"machine_id"`
+	MetricName string  `json:"metric_name"`
+	Value      float64 `json:"value"`
+	Unit       string  `json:"unit,omitempty"`
+	Quality    string  `json:"quality,omitempty"`
+	Timestamp  string  `json:"timestamp,omitempty"`
+}
+
+// Reading is a validated reading to ingest.
+type Reading struct {
+	Time       time.Time
+	MachineID  uuid.UUID
+	MetricName string
+	Value      float64
+	Unit       string
+	Quality    string
+}
+
+type Alert struct {
+	ID              uuid.UUID          `json:"id"`
+	MachineID       uuid.UUID          `json:"machine_id"`
+	RuleID          *uuid.UUID         `json:"rule_id"`
+	RuleRevision    *int               `json:"rule_revision"`
+	Severity        string             `json:"severity"`
+	Message         string             `json:"message"`
+	State           string             `json:"state"`
+	Acknowledged    bool               `json:"acknowledged"`
+	AcknowledgedBy  *string            `json:"acknowledged_by"`
+	AcknowledgedAt  *time.Time         `json:"acknowledged_at"`
+	ClearedAt       *time.Time         `json:"cleared_at"`
+	ClosedAt        *time.Time         `json:"closed_at"`
+	ClosedBy        *string            `json:"closed_by"`
+	EvaluatedValues map[string]float64 `json:"evaluated_values"`
+	Suppressed      bool               `json:"suppressed"`
+	SuppressedBy    *string            `json:"suppressed_by"`
+	Fingerprint     *string            `json:"fingerprint"`
+	Occurrences     int                `json:"occurrences"`
+	LastValue       *float64           `json:"last_value"`
+	LastSeenAt      *time.Time         `json:"last_seen_at"`
+	CreatedAt       time.Time          `json:"created_at"`
+}
+
+// AlertFilter narrows an alert listing; zero fields match everything.
+type AlertFilter struct {
+	States       []string
+	Acknowledged *bool
+	Cleared      *bool
+	Severity     string
+	Suppressed   *bool
+	MachineID    *uuid.UUID
+}
+
+type Anomaly struct {
+	ID          uuid.UUID `json:"id"`
+	MachineID   uuid.UUID `json:"machine_id"`
+	MetricName  string    `json:"metric_name"`
+	DetectedAt  time.Time `json:"detected_at"`
+	Severity    string    `json:"severity"`
+	Description string    `json:"description"`
+}
+
+// RulesVersion is the rule version this instance evaluates next to the
+// latest one in the database; they differ while a reload is pending.
+type RulesVersion struct {
+	Version       int64     `json:"version"`
+	LoadedAt      time.Time `json:"loaded_at"`
+	Rules         int       `json:"rules"`
+	LatestVersion int64     `json:"latest_version"`
+	LatestAt      time.Time `json:"latest_at"`
+	Current       bool      `json:"current"`
+}
+
+type statusResponse struct {
+	Status string `json:"status"`
+	State  string `json:"state,omitempty"`
+}
+
+type createdResponse struct {
+	ID uuid.UUID `json:"id"`
+}
+
+type validationResult struct {
+	Valid    bool     `json:"valid"`
+	Problems []string `json:"problems"`
+}
@@ -12,9 +12,14 @@ type Config struct {
 	DBPassword   string
 	DBName       string
 	SMTPHost     string
+	SMTPPort     string
 	SMTPUser     string
 	SMTPPassword string
+	SMTPFrom     string
 	SlackWebhook string
+	GrafanaURL   string
+	Timezone     string
+	ExportDir    string
 }
 
 func Load() *Config {
@@ -25,9 +30,14 @@ func Load() *Config {
 		DBPassword:   getEnv("DB_PASSWORD", ""),
 		DBName:       getEnv("DB_NAME", "telemetry"),
 		SMTPHost:     os.Getenv("SMTP_HOST"),
+		SMTPPort:     getEnv("SMTP_PORT", "587"),
 		SMTPUser:     os.Getenv("SMTP_USER"),
 		SMTPPassword: os.Getenv("SMTP_PASSWORD"),
+		SMTPFrom:     getEnv("SMTP_FROM", "telemetry-alerts@localhost"),
 		SlackWebhook: os.Getenv("SLACK_WEBHOOK"),
+		GrafanaURL:   getEnv("GRAFANA_URL", "http://localhost:3000"),
+		Timezone:     getEnv("PLANT_TIMEZONE", "UTC"),
+		ExportDir:    getEnv("EXPORT_DIR", "/var/lib/telemetry/exports"),
 	}
 }
 
@@ -67,6 +67,418 @@ func Migrate(ctx context.Context, pool *pgxpool.Pool) error {
 			enabled BOOLEAN DEFAULT TRUE,
 			created_at TIMESTAMPTZ DEFAULT NOW()
 		)`,
+
+		`ALTER TABLE alert_rules ADD COLUMN IF NOT EXISTS expression TEXT`,
+		`ALTER TABLE alert_rules ADD COLUMN IF NOT EXISTS window_seconds INTEGER DEFAULT 60`,
+		`ALTER TABLE alerts ADD COLUMN IF NOT EXISTS evaluated_values JSONB`,
+
+		// Alert lifecycle. Rows that predate it were auto-resolved by writing
+		// acknowledged_by = 'system', which is undone here so only human
+		// acknowledgements remain.
+		`ALTER TABLE alerts ADD COLUMN IF NOT EXISTS state VARCHAR(20)`,
+		`ALTER TABLE alerts ADD COLUMN IF NOT EXISTS cleared_at TIMESTAMPTZ`,
+		`ALTER TABLE alerts ADD COLUMN IF NOT EXISTS closed_at TIMESTAMPTZ`,
+		`ALTER TABLE alerts ADD COLUMN IF NOT EXISTS closed_by VARCHAR(255)`,
+		`UPDATE alerts SET state = 'closed', cleared_at = acknowledged_at, closed_at = acknowledged_at, closed_by = 'system',
+			acknowledged = false, acknowledged_by = NULL, acknowledged_at = NULL
+		 WHERE state IS NULL AND acknowledged = true AND acknowledged_by = 'system'`,
+		`UPDATE alerts SET state = CASE WHEN acknowledged THEN 'acknowledged' ELSE 'active' END WHERE state IS NULL`,
+		`ALTER TABLE alerts ALTER COLUMN state SET DEFAULT 'active'`,
+		`ALTER TABLE alerts ALTER COLUMN state SET NOT NULL`,
+		`CREATE INDEX IF NOT EXISTS idx_alerts_state ON alerts(state, created_at DESC)`,
+
+		`CREATE TABLE IF NOT EXISTS notification_deliveries (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			alert_id UUID NOT NULL,
+			channel VARCHAR(50) NOT NULL,
+			target VARCHAR(255) NOT NULL,
+			event VARCHAR(20) NOT NULL,
+			status VARCHAR(20) NOT NULL,
+			attempts INTEGER NOT NULL,
+			error TEXT,
+			started_at TIMESTAMPTZ NOT NULL,
+			completed_at TIMESTAMPTZ DEFAULT NOW()
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_notification_deliveries_alert ON notification_deliveries(alert_id, started_at DESC)`,
+		`ALTER TABLE notification_deliveries ALTER COLUMN target TYPE TEXT`,
+
+		`CREATE TABLE IF NOT EXISTS email_recipients (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			address VARCHAR(255) NOT NULL,
+			severity VARCHAR(20),
+			location VARCHAR(255),
+			enabled BOOLEAN DEFAULT TRUE,
+			created_at TIMESTAMPTZ DEFAULT NOW()
+		)`,
+		// Addresses were once stored as given, display name and all, which
+		// RCPT TO rejects.
+		`UPDATE email_recipients SET address = substring(address FROM '<([^<>]+)>\s*$') WHERE address ~ '<[^<>]+>\s*$'`,
+
+		`CREATE TABLE IF NOT EXISTS webhook_channels (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			name VARCHAR(100) UNIQUE NOT NULL,
+			url TEXT NOT NULL,
+			secret TEXT,
+			payload_template TEXT,
+			severities TEXT[],
+			headers JSONB,
+			max_attempts INTEGER NOT NULL DEFAULT 5,
+			enabled BOOLEAN DEFAULT TRUE,
+			created_at TIMESTAMPTZ DEFAULT NOW()
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			channel_id UUID NOT NULL REFERENCES webhook_channels(id) ON DELETE CASCADE,
+			alert_id UUID NOT NULL,
+			event VARCHAR(20) NOT NULL,
+			payload TEXT NOT NULL,
+			attempts INTEGER NOT NULL,
+			last_error TEXT NOT NULL,
+			created_at TIMESTAMPTZ DEFAULT NOW(),
+			replayed_at TIMESTAMPTZ
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_webhook_dead_letters_pending ON webhook_dead_letters(created_at DESC) WHERE replayed_at IS NULL`,
+
+		`CREATE TABLE IF NOT EXISTS notification_routes (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			name VARCHAR(255) NOT NULL,
+			priority INTEGER NOT NULL DEFAULT 100,
+			severity VARCHAR(20),
+			location VARCHAR(255),
+			machine_type VARCHAR(100),
+			rule_id UUID,
+			channels TEXT[] NOT NULL,
+			continue_matching BOOLEAN DEFAULT FALSE,
+			enabled BOOLEAN DEFAULT TRUE,
+			created_at TIMESTAMPTZ DEFAULT NOW()
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS escalation_policies (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			name VARCHAR(255) NOT NULL,
+			priority INTEGER NOT NULL DEFAULT 100,
+			severity VARCHAR(20),
+			location VARCHAR(255),
+			machine_type VARCHAR(100),
+			rule_id UUID,
+			enabled BOOLEAN DEFAULT TRUE,
+			created_at TIMESTAMPTZ DEFAULT NOW()
+		)`,
+		`CREATE TABLE IF NOT EXISTS escalation_steps (
+			policy_id UUID NOT NULL REFERENCES escalation_policies(id) ON DELETE CASCADE,
+			level INTEGER NOT NULL,
+			delay_minutes INTEGER NOT NULL,
+			channels TEXT[],
+			emails TEXT[],
+			PRIMARY KEY (policy_id, level)
+		)`,
+		// As for email_recipients, keep only the address of "Name <address>".
+		`UPDATE escalation_steps SET emails = ARRAY(
+			SELECT COALESCE(substring(e FROM '<([^<>]+)>\s*$'), e) FROM unnest(emails) WITH ORDINALITY AS u(e, n) ORDER BY n)
+		 WHERE EXISTS (SELECT 1 FROM unnest(emails) AS e WHERE e ~ '<[^<>]+>\s*$')`,
+		`ALTER TABLE alerts ADD COLUMN IF NOT EXISTS escalation_level INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE alerts ADD COLUMN IF NOT EXISTS escalated_at TIMESTAMPTZ`,
+		`ALTER TABLE alerts ADD COLUMN IF NOT EXISTS triggered_at TIMESTAMPTZ`,
+
+		`CREATE TABLE IF NOT EXISTS oncall_teams (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			name VARCHAR(255) UNIQUE NOT NULL,
+			location VARCHAR(255) NOT NULL,
+			rotation_start TIMESTAMPTZ NOT NULL,
+			shift_hours INTEGER NOT NULL,
+			created_at TIMESTAMPTZ DEFAULT NOW()
+		)`,
+		`CREATE TABLE IF NOT EXISTS oncall_members (
+			team_id UUID NOT NULL REFERENCES oncall_teams(id) ON DELETE CASCADE,
+			position INTEGER NOT NULL,
+			name VARCHAR(255) NOT NULL,
+			email VARCHAR(255) NOT NULL,
+			phone VARCHAR(50),
+			PRIMARY KEY (team_id, position)
+		)`,
+		`CREATE TABLE IF NOT EXISTS oncall_overrides (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			team_id UUID NOT NULL REFERENCES oncall_teams(id) ON DELETE CASCADE,
+			name VARCHAR(255) NOT NULL,
+			email VARCHAR(255) NOT NULL,
+			starts_at TIMESTAMPTZ NOT NULL,
+			ends_at TIMESTAMPTZ NOT NULL,
+			reason TEXT,
+			created_at TIMESTAMPTZ DEFAULT NOW()
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_oncall_overrides_team ON oncall_overrides(team_id, starts_at)`,
+
+		`CREATE TABLE IF NOT EXISTS silences (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			machine_id UUID,
+			location VARCHAR(255),
+			rule_id UUID,
+			severity VARCHAR(20),
+			starts_at TIMESTAMPTZ NOT NULL,
+			ends_at TIMESTAMPTZ NOT NULL,
+			reason TEXT NOT NULL,
+			created_by VARCHAR(255) NOT NULL,
+			created_at TIMESTAMPTZ DEFAULT NOW()
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_silences_ends_at ON silences(ends_at)`,
+		`CREATE TABLE IF NOT EXISTS maintenance_windows (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			name VARCHAR(255) NOT NULL,
+			machine_id UUID,
+			location VARCHAR(255),
+			rule_id UUID,
+			severity VARCHAR(20),
+			days SMALLINT[] NOT NULL,
+			start_time TIME NOT NULL,
+			duration_minutes INTEGER NOT NULL,
+			enabled BOOLEAN DEFAULT TRUE,
+			created_at TIMESTAMPTZ DEFAULT NOW()
+		)`,
+		`ALTER TABLE alerts ADD COLUMN IF NOT EXISTS suppressed BOOLEAN NOT NULL DEFAULT FALSE`,
+		`ALTER TABLE alerts ADD COLUMN IF NOT EXISTS suppressed_by TEXT`,
+
+		`CREATE TABLE IF NOT EXISTS alarm_shelves (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			machine_id UUID NOT NULL,
+			rule_id UUID NOT NULL,
+			reason TEXT NOT NULL,
+			shelved_by VARCHAR(255) NOT NULL,
+			shelved_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			expires_at TIMESTAMPTZ NOT NULL,
+			unshelved_at TIMESTAMPTZ,
+			unshelved_by VARCHAR(255)
+		)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_alarm_shelves_open ON alarm_shelves(machine_id, rule_id) WHERE unshelved_at IS NULL`,
+
+		`CREATE TABLE IF NOT EXISTS alert_activations (
+			alert_id UUID NOT NULL,
+			machine_id UUID,
+			rule_id UUID,
+			severity VARCHAR(20) NOT NULL,
+			suppressed BOOLEAN NOT NULL DEFAULT FALSE,
+			activated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_alert_activations_time ON alert_activations(activated_at DESC)`,
+		`CREATE INDEX IF NOT EXISTS idx_alert_activations_alarm ON alert_activations(machine_id, rule_id, activated_at)`,
+		`INSERT INTO alert_activations (alert_id, machine_id, rule_id, severity, suppressed, activated_at)
+		 SELECT id, machine_id, rule_id, severity, suppressed, created_at FROM alerts
+		 WHERE NOT EXISTS (SELECT 1 FROM alert_activations)`,
+
+		`ALTER TABLE alert_rules ADD COLUMN IF NOT EXISTS revision INTEGER NOT NULL DEFAULT 1`,
+		`ALTER TABLE alert_rules ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ`,
+		`ALTER TABLE alert_rules ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ`,
+		// Deleting or disabling a rule closes its open alerts; close those
+		// left behind before it did.
+		`UPDATE alerts a SET state = 'closed', cleared_at = COALESCE(a.cleared_at, NOW()), closed_at = NOW(), closed_by = 'system'
+		 FROM alert_rules r
+		 WHERE r.id = a.rule_id AND a.state IN ('active', 'acknowledged') AND (r.deleted_at IS NOT NULL OR NOT r.enabled)`,
+		`ALTER TABLE alert_rules ADD COLUMN IF NOT EXISTS duration_seconds INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE alert_rules ADD COLUMN IF NOT EXISTS hysteresis DOUBLE PRECISION NOT NULL DEFAULT 0`,
+		`CREATE TABLE IF NOT EXISTS alert_rule_revisions (
+			rule_id UUID NOT NULL REFERENCES alert_rules(id),
+			revision INTEGER NOT NULL,
+			name VARCHAR(255) NOT NULL,
+			metric_name VARCHAR(100) NOT NULL,
+			condition_type VARCHAR(50) NOT NULL,
+			threshold_value DOUBLE PRECISION,
+			operator VARCHAR(10),
+			severity VARCHAR(20) NOT NULL,
+			enabled BOOLEAN NOT NULL,
+			expression TEXT,
+			window_seconds INTEGER,
+			change VARCHAR(20) NOT NULL,
+			changed_by VARCHAR(255) NOT NULL,
+			changed_at TIMESTAMPTZ DEFAULT NOW(),
+			PRIMARY KEY (rule_id, revision)
+		)`,
+		`ALTER TABLE alert_rule_revisions ADD COLUMN IF NOT EXISTS duration_seconds INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE alert_rule_revisions ADD COLUMN IF NOT EXISTS hysteresis DOUBLE PRECISION NOT NULL DEFAULT 0`,
+		`ALTER TABLE alerts ADD COLUMN IF NOT EXISTS rule_revision INTEGER`,
+
+		`CREATE TABLE IF NOT EXISTS alert_rules_version (
+			id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+			version BIGINT NOT NULL DEFAULT 0,
+			updated_at TIMESTAMPTZ DEFAULT NOW()
+		)`,
+		`INSERT INTO alert_rules_version (id) VALUES (TRUE) ON CONFLICT (id) DO NOTHING`,
+		`CREATE OR REPLACE FUNCTION alert_rules_changed() RETURNS trigger AS $$
+		DECLARE
+			v BIGINT;
+		BEGIN
+			UPDATE alert_rules_version SET version = version + 1, updated_at = NOW() RETURNING version INTO v;
+			PERFORM pg_notify('alert_rules_changed', v::text);
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql`,
+		`DROP TRIGGER IF EXISTS alert_rules_changed ON alert_rules`,
+		`CREATE TRIGGER alert_rules_changed AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON alert_rules
+			FOR EACH STATEMENT EXECUTE FUNCTION alert_rules_changed()`,
+
+		`CREATE TABLE IF NOT EXISTS incidents (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			title VARCHAR(255) NOT NULL,
+			location VARCHAR(255) NOT NULL DEFAULT '',
+			state VARCHAR(20) NOT NULL DEFAULT 'open',
+			severity VARCHAR(20) NOT NULL,
+			root_alert_id UUID NOT NULL REFERENCES alerts(id) ON DELETE CASCADE,
+			opened_at TIMESTAMPTZ DEFAULT NOW(),
+			last_activity_at TIMESTAMPTZ DEFAULT NOW(),
+			resolved_at TIMESTAMPTZ
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_incidents_open ON incidents(location, last_activity_at DESC) WHERE state = 'open'`,
+		`CREATE TABLE IF NOT EXISTS incident_alerts (
+			alert_id UUID PRIMARY KEY REFERENCES alerts(id) ON DELETE CASCADE,
+			incident_id UUID NOT NULL REFERENCES incidents(id) ON DELETE CASCADE,
+			notified BOOLEAN NOT NULL DEFAULT FALSE,
+			added_at TIMESTAMPTZ DEFAULT NOW()
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_incident_alerts_incident ON incident_alerts(incident_id)`,
+		`CREATE TABLE IF NOT EXISTS incident_events (
+			id BIGSERIAL PRIMARY KEY,
+			incident_id UUID NOT NULL REFERENCES incidents(id) ON DELETE CASCADE,
+			at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+			kind VARCHAR(50) NOT NULL,
+			alert_id UUID,
+			detail TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_incident_events_incident ON incident_events(incident_id, at)`,
+		`CREATE TABLE IF NOT EXISTS rule_relations (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			cause_rule_id UUID NOT NULL REFERENCES alert_rules(id) ON DELETE CASCADE,
+			effect_rule_id UUID NOT NULL REFERENCES alert_rules(id) ON DELETE CASCADE,
+			UNIQUE (cause_rule_id, effect_rule_id)
+		)`,
+
+		// An alert's fingerprint is the alarm it belongs to; the partial unique
+		// index allows one open alert per fingerprint however many readings
+		// trigger it at once. Older duplicates from before the index are closed.
+		`ALTER TABLE alerts ADD COLUMN IF NOT EXISTS fingerprint TEXT GENERATED ALWAYS AS (machine_id::text || ':' || rule_id::text) STORED`,
+		`ALTER TABLE alerts ADD COLUMN IF NOT EXISTS occurrences INTEGER NOT NULL DEFAULT 1`,
+		`ALTER TABLE alerts ADD COLUMN IF NOT EXISTS last_value DOUBLE PRECISION`,
+		`ALTER TABLE alerts ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMPTZ`,
+		`UPDATE alerts a SET state = 'closed', cleared_at = COALESCE(a.cleared_at, NOW()), closed_at = NOW(), closed_by = 'system'
+		 WHERE a.state <> 'closed' AND EXISTS (
+			SELECT 1 FROM alerts b
+			WHERE b.fingerprint = a.fingerprint AND b.state <> 'closed' AND (b.created_at, b.id) > (a.created_at, a.id)
+		 )`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_alerts_open_fingerprint ON alerts(fingerprint) WHERE state <> 'closed'`,
+
+		// Rules in a family share one alert per machine, so the fingerprint is
+		// set by the service instead of derived from the rule.
+		`ALTER TABLE alert_rules ADD COLUMN IF NOT EXISTS family VARCHAR(100)`,
+		`CREATE INDEX IF NOT EXISTS idx_alert_rules_family ON alert_rules(family) WHERE family IS NOT NULL`,
+		`ALTER TABLE alert_rule_revisions ADD COLUMN IF NOT EXISTS family VARCHAR(100)`,
+		`ALTER TABLE alerts ALTER COLUMN fingerprint DROP EXPRESSION IF EXISTS`,
+		`CREATE TABLE IF NOT EXISTS alert_severity_changes (
+			id BIGSERIAL PRIMARY KEY,
+			alert_id UUID NOT NULL REFERENCES alerts(id) ON DELETE CASCADE,
+			rule_id UUID REFERENCES alert_rules(id),
+			from_severity VARCHAR(20),
+			to_severity VARCHAR(20) NOT NULL,
+			value DOUBLE PRECISION,
+			changed_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_alert_severity_changes_alert ON alert_severity_changes(alert_id, changed_at)`,
+
+		`CREATE TABLE IF NOT EXISTS anomaly_detectors (
+			metric_name VARCHAR(100) PRIMARY KEY,
+			method VARCHAR(20) NOT NULL,
+			window_size INTEGER NOT NULL,
+			threshold DOUBLE PRECISION NOT NULL,
+			alpha DOUBLE PRECISION,
+			min_samples INTEGER NOT NULL,
+			min_spread DOUBLE PRECISION DEFAULT 0,
+			cooldown_seconds INTEGER DEFAULT 300,
+			enabled BOOLEAN DEFAULT TRUE,
+			updated_at TIMESTAMPTZ DEFAULT NOW()
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS anomaly_baselines (
+			machine_id UUID NOT NULL,
+			metric_name VARCHAR(100) NOT NULL,
+			operating_state SMALLINT NOT NULL,
+			day_of_week SMALLINT NOT NULL,
+			hour_of_day SMALLINT NOT NULL,
+			samples INTEGER NOT NULL,
+			mean DOUBLE PRECISION NOT NULL,
+			stddev DOUBLE PRECISION NOT NULL,
+			median DOUBLE PRECISION NOT NULL,
+			robust_spread DOUBLE PRECISION NOT NULL,
+			learned_from TIMESTAMPTZ,
+			learned_at TIMESTAMPTZ DEFAULT NOW(),
+			PRIMARY KEY (machine_id, metric_name, operating_state, day_of_week, hour_of_day)
+		)`,
+		// Databases seeded before seasonal baselines existed still carry the
+		// original ewma temperature detector; move it over unless it was retuned.
+		`UPDATE anomaly_detectors
+		 SET method = 'seasonal', window_size = 120, threshold = 4.0, alpha = NULL, min_samples = 200, min_spread = 0.5, updated_at = NOW()
+		 WHERE metric_name = 'temperature' AND method = 'ewma'
+		   AND window_size = 120 AND threshold = 4.0 AND alpha = 0.05 AND min_samples = 60 AND min_spread = 0.5`,
+
+		`CREATE TABLE IF NOT EXISTS health_models (
+			machine_id UUID PRIMARY KEY REFERENCES machines(id),
+			metrics TEXT[] NOT NULL,
+			mean JSONB NOT NULL,
+			covariance JSONB NOT NULL,
+			samples INTEGER NOT NULL,
+			threshold DOUBLE PRECISION NOT NULL,
+			trained_from TIMESTAMPTZ NOT NULL,
+			trained_to TIMESTAMPTZ NOT NULL,
+			trained_at TIMESTAMPTZ DEFAULT NOW()
+		)`,
+
+		`CREATE OR REPLACE FUNCTION alert_events() RETURNS trigger AS $$
+		DECLARE
+			event TEXT;
+		BEGIN
+			IF TG_OP = 'INSERT' THEN
+				event := 'raised';
+			ELSIF NEW.state IS DISTINCT FROM OLD.state THEN
+				event := CASE WHEN NEW.state = 'active' THEN 'reactivated' ELSE NEW.state END;
+			ELSIF NEW.severity IS DISTINCT FROM OLD.severity THEN
+				event := 'severity_changed';
+			ELSIF NEW.escalation_level > OLD.escalation_level THEN
+				event := 'escalated';
+			ELSIF NEW.suppressed IS DISTINCT FROM OLD.suppressed THEN
+				event := CASE WHEN NEW.suppressed THEN 'shelved' ELSE 'unshelved' END;
+			ELSE
+				RETURN NULL;
+			END IF;
+			PERFORM pg_notify('alert_events', json_build_object(
+				'id', NEW.id,
+				'event', event,
+				'machine_id', NEW.machine_id,
+				'location', COALESCE((SELECT location FROM machines WHERE id = NEW.machine_id), ''),
+				'rule_id', NEW.rule_id,
+				'metric_name', COALESCE((SELECT metric_name FROM alert_rules WHERE id = NEW.rule_id), ''),
+				'severity', NEW.severity,
+				'state', NEW.state,
+				'suppressed', NEW.suppressed,
+				'message', left(NEW.message, 1000),
+				'time', NOW()
+			)::text);
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql`,
+		`DROP TRIGGER IF EXISTS alert_events ON alerts`,
+		`CREATE TRIGGER alert_events AFTER INSERT OR UPDATE ON alerts
+			FOR EACH ROW EXECUTE FUNCTION alert_events()`,
+
+		`CREATE TABLE IF NOT EXISTS export_jobs (
+			id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+			state VARCHAR(20) NOT NULL DEFAULT 'queued',
+			format VARCHAR(20) NOT NULL,
+			query TEXT NOT NULL,
+			requested_by VARCHAR(255),
+			row_count BIGINT NOT NULL DEFAULT 0,
+			byte_count BIGINT NOT NULL DEFAULT 0,
+			error TEXT,
+			created_at TIMESTAMPTZ DEFAULT NOW(),
+			started_at TIMESTAMPTZ,
+			finished_at TIMESTAMPTZ
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_export_jobs_created ON export_jobs(created_at DESC)`,
 	}
 
 	for i, sql := range migrations {
@@ -91,38 +503,81 @@ func Migrate(ctx context.Context, pool *pgxpool.Pool) error {
 		logMigrationError("Failed to seed alert rules: %v", err)
 	}
 
+	if err := recordInitialRuleRevisions(ctx, pool); err != nil {
+		logMigrationError("Failed to record initial rule revisions: %v", err)
+	}
+
+	if err := seedRuleFamilies(ctx, pool); err != nil {
+		logMigrationError("Failed to seed rule families: %v", err)
+	}
+
+	if err := seedRuleRelations(ctx, pool); err != nil {
+		logMigrationError("Failed to seed rule relations: %v", err)
+	}
+
+	if err := seedAnomalyDetectors(ctx, pool); err != nil {
+		logMigrationError("Failed to seed anomaly detectors: %v", err)
+	}
+
 	return nil
 }
 
 func seedAlertRules(ctx context.Context, pool *pgxpool.Pool) error {
 	rules := []struct {
-		name, metricName, conditionType, operator, severity string
-		thresholdValue                                      float64
+		name, metricName, conditionType, operator, severity, family string
+		thresholdValue                                              float64
 	}{
 		// Temperature alerts - motor winding temp
-		{"Motor Temperature High", "temperature", "threshold", ">", "warning", 70},
-		{"Motor Temperature Critical", "temperature", "threshold", ">", "critical", 80},
+		{"Motor Temperature High", "temperature", "threshold", ">", "warning", "Motor Temperature", 70},
+		{"Motor Temperature Critical", "temperature", "threshold", ">", "critical", "Motor Temperature", 80},
 
 		// Vibration alerts - bearing health indicator
-		{"Vibration Warning", "vibration", "threshold", ">", "warning", 5.0},
-		{"Vibration Critical", "vibration", "threshold", ">", "critical", 7.0},
+		{"Vibration Warning", "vibration", "threshold", ">", "warning", "Vibration", 5.0},
+		{"Vibration Critical", "vibration", "threshold", ">", "critical", "Vibration", 7.0},
 
 		// Pressure alerts - discharge pressure
-		{"Discharge Pressure High", "pressure", "threshold", ">", "warning", 5.0},
-		{"Discharge Pressure Critical", "pressure", "threshold", ">", "critical", 5.5},
-		{"Discharge Pressure Low", "pressure", "threshold", "<", "warning", 2.0},
+		{"Discharge Pressure High", "pressure", "threshold", ">", "warning", "Discharge Pressure High", 5.0},
+		{"Discharge Pressure Critical", "pressure", "threshold", ">", "critical", "Discharge Pressure High", 5.5},
+		{"Discharge Pressure Low", "pressure", "threshold", "<", "warning", "", 2.0},
 
 		// Current alerts - motor load
-		{"Motor Current High", "current", "threshold", ">", "warning", 140},
-		{"Motor Current Critical", "current", "threshold", ">", "critical", 170},
+		{"Motor Current High", "current", "threshold", ">", "warning", "Motor Current", 140},
+		{"Motor Current Critical", "current", "threshold", ">", "critical", "Motor Current", 170},
 
 		// RPM alerts - motor speed
-		{"RPM Low", "rpm", "threshold", "<", "warning", 1700},
-		{"RPM High", "rpm", "threshold", ">", "warning", 1800},
+		{"RPM Low", "rpm", "threshold", "<", "warning", "", 1700},
+		{"RPM High", "rpm", "threshold", ">", "warning", "", 1800},
 
 		// Voltage alerts - power quality
-		{"Voltage Low", "voltage", "threshold", "<", "warning", 440},
-		{"Voltage High", "voltage", "threshold", ">", "critical", 480},
+		{"Voltage Low", "voltage", "threshold", "<", "warning", "", 440},
+		{"Voltage High", "voltage", "threshold", ">", "critical", "", 480},
+	}
+
+	// Composite rules - failure modes recognized by a combination of metrics
+	expressionRules := []struct {
+		name, metricName, expression, severity string
+		windowSeconds                          int
+	}{
+		{"Cavitation Suspected", "pressure", "pressure < 3 && vibration > 4 && current < 115", "critical", 60},
+	}
+
+	for _, rule := range expressionRules {
+		var exists bool
+		err := pool.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM alert_rules WHERE name = $1 AND metric_name = $2)", rule.name, rule.metricName).Scan(&exists)
+		if err != nil {
+			return fmt.Errorf("failed to check rule existence: %w", err)
+		}
+
+		if !exists {
+			_, err := pool.Exec(ctx,
+				"INSERT INTO alert_rules (name, metric_name, condition_type, expression, window_seconds, severity) VALUES ($1, $2, 'expression', $3, $4, $5)",
+				rule.name, rule.metricName, rule.expression, rule.windowSeconds, rule.severity,
+			)
+			if err != nil {
+				return fmt.Errorf("failed to insert rule %s: %w", rule.name, err)
+			}
+			fmt.Printf("Seeded alert rule: %s\n", rule.name)
+		}
 	}
 
 	for _, rule := range rules {
@@ -134,8 +589,8 @@ func seedAlertRules(ctx context.Context, pool *pgxpool.Pool) error {
 
 		if !exists {
 			_, err := pool.Exec(ctx,
-				"INSERT INTO alert_rules (name, metric_name, condition_type, threshold_value, operator, severity) VALUES ($1, $2, $3, $4, $5, $6)",
-				rule.name, rule.metricName, rule.conditionType, rule.thresholdValue, rule.operator, rule.severity,
+				"INSERT INTO alert_rules (name, metric_name, condition_type, threshold_value, operator, severity, family) VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''))",
+				rule.name, rule.metricName, rule.conditionType, rule.thresholdValue, rule.operator, rule.severity, rule.family,
 			)
 			if err != nil {
 				return fmt.Errorf("failed to insert rule %s: %w", rule.name, err)
@@ -147,6 +602,130 @@ func seedAlertRules(ctx context.Context, pool *pgxpool.Pool) error {
 	return nil
 }
 
+// recordInitialRuleRevisions gives rules that predate revision history, or
+// were seeded above, their first revision.
+func recordInitialRuleRevisions(ctx context.Context, pool *pgxpool.Pool) error {
+	_, err := pool.Exec(ctx,
+		`INSERT INTO alert_rule_revisions (rule_id, revision, name, metric_name, condition_type, threshold_value, operator, severity,
+		                                   enabled, expression, window_seconds, duration_seconds, hysteresis, family, change, changed_by, changed_at)
+		 SELECT id, revision, name, metric_name, condition_type, threshold_value, operator, severity,
+		        COALESCE(enabled, true), expression, window_seconds, duration_seconds, hysteresis, family, 'created', 'system', COALESCE(created_at, NOW())
+		 FROM alert_rules r
+		 WHERE NOT EXISTS (SELECT 1 FROM alert_rule_revisions rr WHERE rr.rule_id = r.id)`,
+	)
+	return err
+}
+
+// seedRuleFamilies groups the seeded warning and critical tiers of databases
+// created before rule families. It runs only while no rule has a family, so
+// families removed later are not put back.
+func seedRuleFamilies(ctx context.Context, pool *pgxpool.Pool) error {
+	families := map[string][]string{
+		"Motor Temperature":       {"Motor Temperature High", "Motor Temperature Critical"},
+		"Vibration":               {"Vibration Warning", "Vibration Critical"},
+		"Discharge Pressure High": {"Discharge Pressure High", "Discharge Pressure Critical"},
+		"Motor Current":           {"Motor Current High", "Motor Current Critical"},
+	}
+
+	var seeded bool
+	if err := pool.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM alert_rules WHERE family IS NOT NULL)").Scan(&seeded); err != nil {
+		return fmt.Errorf("failed to check rule families: %w", err)
+	}
+	if seeded {
+		return nil
+	}
+
+	for family, names := range families {
+		_, err := pool.Exec(ctx,
+			`WITH changed AS (
+				UPDATE alert_rules SET family = $1, revision = revision + 1, updated_at = NOW()
+				WHERE name = ANY($2) AND deleted_at IS NULL
+				RETURNING *
+			)
+			INSERT INTO alert_rule_revisions (rule_id, revision, name, metric_name, condition_type, threshold_value, operator, severity,
+			                                  enabled, expression, window_seconds, duration_seconds, hysteresis, family, change, changed_by)
+			SELECT id, revision, name, metric_name, condition_type, threshold_value, operator, severity,
+			       COALESCE(enabled, true), expression, window_seconds, duration_seconds, hysteresis, family, 'updated', 'system'
+			FROM changed`,
+			family, names,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to seed rule family %s: %w", family, err)
+		}
+	}
+	return nil
+}
+
+func seedRuleRelations(ctx context.Context, pool *pgxpool.Pool) error {
+	relations := []struct {
+		cause, effect string
+	}{
+		// A supply voltage dip makes motors draw more current and slow down
+		{"Voltage Low", "Motor Current High"},
+		{"Voltage Low", "Motor Current Critical"},
+		{"Voltage Low", "RPM Low"},
+
+		// Cavitation shows up as low discharge pressure and vibration
+		{"Cavitation Suspected", "Discharge Pressure Low"},
+		{"Cavitation Suspected", "Vibration Warning"},
+		{"Cavitation Suspected", "Vibration Critical"},
+	}
+
+	for _, r := range relations {
+		tag, err := pool.Exec(ctx,
+			`INSERT INTO rule_relations (cause_rule_id, effect_rule_id)
+			 SELECT c.id, e.id FROM alert_rules c, alert_rules e
+			 WHERE c.name = $1 AND e.name = $2 AND c.deleted_at IS NULL AND e.deleted_at IS NULL
+			 ON CONFLICT (cause_rule_id, effect_rule_id) DO NOTHING`,
+			r.cause, r.effect,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to insert rule relation %s -> %s: %w", r.cause, r.effect, err)
+		}
+		if tag.RowsAffected() > 0 {
+			fmt.Printf("Seeded rule relation: %s -> %s\n", r.cause, r.effect)
+		}
+	}
+
+	return nil
+}
+
+func seedAnomalyDetectors(ctx context.Context, pool *pgxpool.Pool) error {
+	detectors := []struct {
+		metricName, method          string
+		windowSize, minSamples      int
+		threshold, alpha, minSpread float64
+	}{
+		// Motor temperature follows duty cycle and time of day - seasonal baselines
+		{"temperature", "seasonal", 120, 200, 4.0, 0, 0.5},
+
+		// Vibration spikes - median/MAD ignores the occasional outlier
+		{"vibration", "mad", 300, 60, 5.0, 0, 0.1},
+
+		// Process values - rolling mean/stddev
+		{"pressure", "zscore", 300, 60, 4.0, 0, 0.05},
+		{"current", "zscore", 300, 60, 4.0, 0, 1.0},
+		{"voltage", "zscore", 300, 60, 4.0, 0, 2.0},
+	}
+
+	for _, d := range detectors {
+		tag, err := pool.Exec(ctx,
+			`INSERT INTO anomaly_detectors (metric_name, method, window_size, threshold, alpha, min_samples, min_spread)
+			 VALUES ($1, $2, $3, $4, NULLIF($5::float8, 0), $6, $7)
+			 ON CONFLICT (metric_name) DO NOTHING`,
+			d.metricName, d.method, d.windowSize, d.threshold, d.alpha, d.minSamples, d.minSpread,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to insert anomaly detector %s: %w", d.metricName, err)
+		}
+		if tag.RowsAffected() > 0 {
+			fmt.Printf("Seeded anomaly detector: %s (%s)\n", d.metricName, d.method)
+		}
+	}
+
+	return nil
+}
+
 func logMigrationError(format string, args ...interface{}) {
 	fmt.Printf("WARNING: "+format+"\n", args...)
 }
@@ -0,0 +1,58 @@
+package export
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"time"
+)
+
+// csvEncoder writes a header row and then one record per row. Times are
+// RFC 3339 in UTC and missing values are empty.
+type csvEncoder struct {
+	w       *csv.Writer
+	columns []Column
+	record  []string
+}
+
+func newCSVEncoder(w io.Writer, columns []Column) *csvEncoder {
+	e := &csvEncoder{w: csv.NewWriter(w), columns: columns, record: make([]string, len(columns))}
+	for i, c := range columns {
+		e.record[i] = c.Name
+	}
+	e.w.Write(e.record)
+	return e
+}
+
+func (e *csvEncoder) Write(row []interface{}) error {
+	for i, c := range e.columns {
+		switch v := row[i].(type) {
+		case time.Time:
+			if c.Kind != Time {
+				return mismatch(c, v)
+			}
+			e.record[i] = v.UTC().Format(time.RFC3339Nano)
+		case string:
+			if c.Kind != String {
+				return mismatch(c, v)
+			}
+			e.record[i] = v
+		case float64:
+			if c.Kind != Float {
+				return mismatch(c, v)
+			}
+			e.record[i] = strconv.FormatFloat(v, 'g', -1, 64)
+		default:
+			if v != nil || c.Kind != Float {
+				return mismatch(c, v)
+			}
+			e.record[i] = ""
+		}
+	}
+	return e.w.Write(e.record)
+}
+
+func (e *csvEncoder) Close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
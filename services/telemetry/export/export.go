@@ -0,0 +1,67 @@
+// Package export writes metric readings as CSV or Apache Parquet files a
+// row at a time, so exports of any size stream in bounded memory, and runs
+// large exports as background jobs that write to a local directory.
+package export
+
+import (
+	"fmt"
+	"io"
+)
+
+const (
+	FormatCSV     = "csv"
+	FormatParquet = "parquet"
+)
+
+var Formats = []string{FormatCSV, FormatParquet}
+
+// Kind is the type of a column's values.
+type Kind int
+
+const (
+	// Time values are time.Time.
+	Time Kind = iota
+	// String values are string.
+	String
+	// Float values are float64, or nil for a missing value.
+	Float
+)
+
+type Column struct {
+	Name string
+	Kind Kind
+}
+
+// Encoder writes rows of fixed columns in one file format. Each row holds
+// one value per column, of the column's Kind.
+type Encoder interface {
+	Write(row []interface{}) error
+	// Close finishes the file. It does not close the underlying writer.
+	Close() error
+}
+
+func NewEncoder(format string, w io.Writer, columns []Column) (Encoder, error) {
+	switch format {
+	case FormatCSV:
+		return newCSVEncoder(w, columns), nil
+	case FormatParquet:
+		return newParquetEncoder(w, columns), nil
+	}
+	return nil, fmt.Errorf("unknown export format %q", format)
+}
+
+func ContentType(format string) string {
+	if format == FormatParquet {
+		return "application/vnd.apache.parquet"
+	}
+	return "text/csv; charset=utf-8"
+}
+
+// Extension is the file name extension of a format, with the dot.
+func Extension(format string) string {
+	return "." + format
+}
+
+func mismatch(c Column, v interface{}) error {
+	return fmt.Errorf("column %s: unexpected value %v (%T)", c.Name, v, v)
+}
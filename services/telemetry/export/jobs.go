@@ -0,0 +1,233 @@
+package export
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Job states.
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// maxRunning is how many export jobs write at once; the rest wait queued.
+const maxRunning = 2
+
+var (
+	ErrJobNotFound   = errors.New("export job not found")
+	ErrJobNotReady   = errors.New("export job has no file to download")
+	ErrJobUnfinished = errors.New("export job has not finished")
+)
+
+// Job is an export written to the export directory in the background.
+// Query holds the export's parameters as they were requested.
+type Job struct {
+	ID          uuid.UUID  `json:"id"`
+	State       string     `json:"state"`
+	Format      string     `json:"format"`
+	Query       string     `json:"query"`
+	RequestedBy string     `json:"requested_by"`
+	Rows        int64      `json:"rows"`
+	Bytes       int64      `json:"bytes"`
+	Error       *string    `json:"error"`
+	CreatedAt   time.Time  `json:"created_at"`
+	StartedAt   *time.Time `json:"started_at"`
+	FinishedAt  *time.Time `json:"finished_at"`
+}
+
+// RunFunc writes an export to w and returns how many rows it wrote.
+type RunFunc func(ctx context.Context, w io.Writer) (int64, error)
+
+// Jobs runs export jobs, recording them in export_jobs and writing each to
+// a file named after its ID in dir.
+type Jobs struct {
+	db    *pgxpool.Pool
+	dir   string
+	slots chan struct{}
+}
+
+func NewJobs(pool *pgxpool.Pool, dir string) *Jobs {
+	return &Jobs{db: pool, dir: dir, slots: make(chan struct{}, maxRunning)}
+}
+
+// Recover fails the jobs a previous run of the service left unfinished and
+// removes their partial files. Call it at startup, before starting jobs.
+func (j *Jobs) Recover(ctx context.Context) error {
+	tag, err := j.db.Exec(ctx,
+		`UPDATE export_jobs SET state = 'failed', error = 'interrupted by a restart', finished_at = NOW()
+		 WHERE state IN ('queued', 'running')`)
+	if err != nil {
+		return err
+	}
+	if n := tag.RowsAffected(); n > 0 {
+		log.Printf("Failed %d export jobs interrupted by a restart", n)
+	}
+
+	partial, _ := filepath.Glob(filepath.Join(j.dir, "*.part"))
+	for _, path := range partial {
+		os.Remove(path)
+	}
+	return nil
+}
+
+const jobColumns = `id, state, format, query, COALESCE(requested_by, ''), row_count, byte_count, error,
+	created_at, started_at, finished_at`
+
+func scanJob(row pgx.Row) (Job, error) {
+	var job Job
+	err := row.Scan(&job.ID, &job.State, &job.Format, &job.Query, &job.RequestedBy, &job.Rows, &job.Bytes, &job.Error,
+		&job.CreatedAt, &job.StartedAt, &job.FinishedAt)
+	return job, err
+}
+
+// Start queues a job that writes run's output, and returns it right away.
+func (j *Jobs) Start(ctx context.Context, format, query, user string, run RunFunc) (Job, error) {
+	job, err := scanJob(j.db.QueryRow(ctx,
+		`INSERT INTO export_jobs (format, query, requested_by) VALUES ($1, $2, NULLIF($3, ''))
+		 RETURNING `+jobColumns,
+		format, query, user,
+	))
+	if err != nil {
+		return Job{}, err
+	}
+
+	go j.run(job, run)
+	return job, nil
+}
+
+func (j *Jobs) run(job Job, run RunFunc) {
+	j.slots <- struct{}{}
+	defer func() { <-j.slots }()
+
+	ctx := context.Background()
+	if _, err := j.db.Exec(ctx, "UPDATE export_jobs SET state = 'running', started_at = NOW() WHERE id = $1", job.ID); err != nil {
+		log.Printf("Failed to start export job %s: %v", job.ID, err)
+		return
+	}
+
+	rows, bytes, err := j.write(ctx, job, run)
+	state := JobSucceeded
+	var message *string
+	if err != nil {
+		log.Printf("Export job %s failed: %v", job.ID, err)
+		text := err.Error()
+		state, message = JobFailed, &text
+	}
+	_, err = j.db.Exec(ctx,
+		`UPDATE export_jobs SET state = $2, row_count = $3, byte_count = $4, error = $5, finished_at = NOW()
+		 WHERE id = $1`,
+		job.ID, state, rows, bytes, message,
+	)
+	if err != nil {
+		log.Printf("Failed to record the end of export job %s: %v", job.ID, err)
+	}
+}
+
+// write writes the export to a partial file that only takes its final name
+// once complete.
+func (j *Jobs) write(ctx context.Context, job Job, run RunFunc) (int64, int64, error) {
+	if err := os.MkdirAll(j.dir, 0o755); err != nil {
+		return 0, 0, err
+	}
+	path := j.path(job)
+	f, err := os.Create(path + ".part")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer os.Remove(path + ".part")
+	defer f.Close()
+
+	w := bufio.NewWriterSize(f, 1<<20)
+	rows, err := run(ctx, w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		return rows, 0, err
+	}
+
+	info, err := os.Stat(path + ".part")
+	if err != nil {
+		return rows, 0, err
+	}
+	return rows, info.Size(), os.Rename(path+".part", path)
+}
+
+func (j *Jobs) path(job Job) string {
+	return filepath.Join(j.dir, job.ID.String()+Extension(job.Format))
+}
+
+func (j *Jobs) Get(ctx context.Context, id uuid.UUID) (Job, error) {
+	job, err := scanJob(j.db.QueryRow(ctx, "SELECT "+jobColumns+" FROM export_jobs WHERE id = $1", id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Job{}, ErrJobNotFound
+	}
+	return job, err
+}
+
+// List returns the most recent jobs, newest first.
+func (j *Jobs) List(ctx context.Context) ([]Job, error) {
+	rows, err := j.db.Query(ctx, "SELECT "+jobColumns+" FROM export_jobs ORDER BY created_at DESC LIMIT 100")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// Open opens the file of a job that succeeded.
+func (j *Jobs) Open(ctx context.Context, id uuid.UUID) (*os.File, Job, error) {
+	job, err := j.Get(ctx, id)
+	if err != nil {
+		return nil, Job{}, err
+	}
+	if job.State != JobSucceeded {
+		return nil, job, ErrJobNotReady
+	}
+	f, err := os.Open(j.path(job))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, job, ErrJobNotReady
+	}
+	return f, job, err
+}
+
+// Delete removes a finished job and its file.
+func (j *Jobs) Delete(ctx context.Context, id uuid.UUID) error {
+	job, err := j.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if job.State == JobQueued || job.State == JobRunning {
+		return ErrJobUnfinished
+	}
+	if err := os.Remove(j.path(job)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	_, err = j.db.Exec(ctx, "DELETE FROM export_jobs WHERE id = $1", id)
+	return err
+}
@@ -0,0 +1,308 @@
+package export
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+)
+
+// rowGroupSize is how many bytes of values a Parquet encoder buffers before
+// writing them out as a row group, which bounds its memory.
+const rowGroupSize = 16 << 20
+
+const parquetMagic = "PAR1"
+
+// Parquet enum values, from parquet.thrift.
+const (
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetRequired = 0
+	parquetOptional = 1
+
+	parquetUTF8            = 0
+	parquetTimestampMicros = 10
+
+	parquetPlain = 0
+	parquetRLE   = 3
+
+	parquetDataPage     = 0
+	parquetUncompressed = 0
+)
+
+// parquetEncoder writes an uncompressed, PLAIN-encoded Parquet file with a
+// flat schema: times as UTC TIMESTAMP_MICROS, strings as UTF8 byte arrays
+// and floats as optional doubles. Each row group holds one data page per
+// column.
+type parquetEncoder struct {
+	w       io.Writer
+	offset  int64
+	columns []*parquetColumn
+	rows    int64
+	groups  []parquetRowGroup
+	// groupSize is rowGroupSize but for tests.
+	groupSize int
+	scratch   [8]byte
+}
+
+type parquetColumn struct {
+	Column
+	// values holds the PLAIN-encoded values buffered for the row group,
+	// and levels an optional column's definition levels: 1 for a value,
+	// 0 for a null.
+	values bytes.Buffer
+	levels []byte
+}
+
+type parquetRowGroup struct {
+	rows   int64
+	chunks []parquetChunk
+}
+
+type parquetChunk struct {
+	offset int64
+	size   int64
+}
+
+func newParquetEncoder(w io.Writer, columns []Column) *parquetEncoder {
+	e := &parquetEncoder{w: w, groupSize: rowGroupSize}
+	for _, c := range columns {
+		e.columns = append(e.columns, &parquetColumn{Column: c})
+	}
+	return e
+}
+
+func (e *parquetEncoder) write(b []byte) error {
+	n, err := e.w.Write(b)
+	e.offset += int64(n)
+	return err
+}
+
+func (e *parquetEncoder) Write(row []interface{}) error {
+	if e.offset == 0 {
+		if err := e.write([]byte(parquetMagic)); err != nil {
+			return err
+		}
+	}
+
+	buffered := 0
+	for i, c := range e.columns {
+		v := row[i]
+		switch c.Kind {
+		case Time:
+			t, ok := v.(time.Time)
+			if !ok {
+				return mismatch(c.Column, v)
+			}
+			binary.LittleEndian.PutUint64(e.scratch[:], uint64(t.UnixMicro()))
+			c.values.Write(e.scratch[:])
+		case String:
+			s, ok := v.(string)
+			if !ok {
+				return mismatch(c.Column, v)
+			}
+			binary.LittleEndian.PutUint32(e.scratch[:4], uint32(len(s)))
+			c.values.Write(e.scratch[:4])
+			c.values.WriteString(s)
+		case Float:
+			if v == nil {
+				c.levels = append(c.levels, 0)
+				break
+			}
+			f, ok := v.(float64)
+			if !ok {
+				return mismatch(c.Column, v)
+			}
+			c.levels = append(c.levels, 1)
+			binary.LittleEndian.PutUint64(e.scratch[:], math.Float64bits(f))
+			c.values.Write(e.scratch[:])
+		}
+		buffered += c.values.Len() + len(c.levels)
+	}
+	e.rows++
+
+	if buffered >= e.groupSize {
+		return e.flush()
+	}
+	return nil
+}
+
+// flush writes the buffered rows as a row group.
+func (e *parquetEncoder) flush() error {
+	group := parquetRowGroup{rows: e.rows}
+	for _, c := range e.columns {
+		var page bytes.Buffer
+		if c.Kind == Float {
+			writeLevels(&page, c.levels)
+		}
+		page.Write(c.values.Bytes())
+
+		var header compactWriter
+		header.beginStruct(0)
+		header.writeI32(1, parquetDataPage)
+		header.writeI32(2, int32(page.Len()))
+		header.writeI32(3, int32(page.Len()))
+		header.beginStruct(5)
+		header.writeI32(1, int32(e.rows))
+		header.writeI32(2, parquetPlain)
+		header.writeI32(3, parquetRLE)
+		header.writeI32(4, parquetRLE)
+		header.endStruct()
+		header.endStruct()
+
+		chunk := parquetChunk{offset: e.offset, size: int64(header.Len() + page.Len())}
+		if err := e.write(header.Bytes()); err != nil {
+			return err
+		}
+		if err := e.write(page.Bytes()); err != nil {
+			return err
+		}
+		group.chunks = append(group.chunks, chunk)
+
+		c.values.Reset()
+		c.levels = c.levels[:0]
+	}
+	e.groups = append(e.groups, group)
+	e.rows = 0
+	return nil
+}
+
+// writeLevels writes definition levels in the RLE/bit-packing hybrid
+// encoding, as runs of equal levels, behind their length as Parquet's v1
+// data pages expect.
+func writeLevels(page *bytes.Buffer, levels []byte) {
+	var runs []byte
+	for i := 0; i < len(levels); {
+		j := i + 1
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		runs = binary.AppendUvarint(runs, uint64(j-i)<<1)
+		runs = append(runs, levels[i])
+		i = j
+	}
+	page.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(runs))))
+	page.Write(runs)
+}
+
+// Close writes the last row group and the footer.
+func (e *parquetEncoder) Close() error {
+	if e.offset == 0 {
+		if err := e.write([]byte(parquetMagic)); err != nil {
+			return err
+		}
+	}
+	if e.rows > 0 {
+		if err := e.flush(); err != nil {
+			return err
+		}
+	}
+
+	footer := e.footer()
+	if err := e.write(footer); err != nil {
+		return err
+	}
+	if err := e.write(binary.LittleEndian.AppendUint32(nil, uint32(len(footer)))); err != nil {
+		return err
+	}
+	return e.write([]byte(parquetMagic))
+}
+
+// footer encodes the file's FileMetaData.
+func (e *parquetEncoder) footer() []byte {
+	var f compactWriter
+	f.beginStruct(0)
+	f.writeI32(1, 1)
+
+	f.writeList(2, compactStruct, len(e.columns)+1)
+	f.beginStruct(0)
+	f.writeString(4, "schema")
+	f.writeI32(5, int32(len(e.columns)))
+	f.endStruct()
+	for _, c := range e.columns {
+		f.beginStruct(0)
+		f.writeI32(1, c.physicalType())
+		if c.Kind == Float {
+			f.writeI32(3, parquetOptional)
+		} else {
+			f.writeI32(3, parquetRequired)
+		}
+		f.writeString(4, c.Name)
+		switch c.Kind {
+		case Time:
+			f.writeI32(6, parquetTimestampMicros)
+			// LogicalType TIMESTAMP(isAdjustedToUTC=true, unit=MICROS)
+			f.beginStruct(10)
+			f.beginStruct(8)
+			f.writeBool(1, true)
+			f.beginStruct(2)
+			f.beginStruct(2)
+			f.endStruct()
+			f.endStruct()
+			f.endStruct()
+			f.endStruct()
+		case String:
+			f.writeI32(6, parquetUTF8)
+			// LogicalType STRING
+			f.beginStruct(10)
+			f.beginStruct(1)
+			f.endStruct()
+			f.endStruct()
+		}
+		f.endStruct()
+	}
+
+	var rows int64
+	for _, g := range e.groups {
+		rows += g.rows
+	}
+	f.writeI64(3, rows)
+
+	f.writeList(4, compactStruct, len(e.groups))
+	for _, g := range e.groups {
+		var size int64
+		f.beginStruct(0)
+		f.writeList(1, compactStruct, len(g.chunks))
+		for i, chunk := range g.chunks {
+			c := e.columns[i]
+			size += chunk.size
+
+			f.beginStruct(0)
+			f.writeI64(2, chunk.offset)
+			f.beginStruct(3)
+			f.writeI32(1, c.physicalType())
+			f.writeList(2, compactI32, 2)
+			f.varint(parquetPlain)
+			f.varint(parquetRLE)
+			f.writeList(3, compactBinary, 1)
+			f.element(c.Name)
+			f.writeI32(4, parquetUncompressed)
+			f.writeI64(5, g.rows)
+			f.writeI64(6, chunk.size)
+			f.writeI64(7, chunk.size)
+			f.writeI64(9, chunk.offset)
+			f.endStruct()
+			f.endStruct()
+		}
+		f.writeI64(2, size)
+		f.writeI64(3, g.rows)
+		f.endStruct()
+	}
+
+	f.writeString(6, "telemetry")
+	f.endStruct()
+	return f.Bytes()
+}
+
+func (c *parquetColumn) physicalType() int32 {
+	switch c.Kind {
+	case Time:
+		return parquetInt64
+	case String:
+		return parquetByteArray
+	}
+	return parquetDouble
+}
@@ -0,0 +1,386 @@
+package export
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+// compactReader decodes Thrift compact protocol structs into maps of field
+// id to value, enough to check what compactWriter wrote.
+type compactReader struct {
+	t   *testing.T
+	b   []byte
+	pos int
+}
+
+type thriftStruct map[int16]interface{}
+
+func (r *compactReader) byte() byte {
+	if r.pos >= len(r.b) {
+		r.t.Fatalf("thrift: unexpected end of input at %d", r.pos)
+	}
+	c := r.b[r.pos]
+	r.pos++
+	return c
+}
+
+func (r *compactReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b[r.pos:])
+	if n <= 0 {
+		r.t.Fatalf("thrift: bad varint at %d", r.pos)
+	}
+	r.pos += n
+	return v
+}
+
+func (r *compactReader) varint() int64 {
+	v := r.uvarint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *compactReader) readStruct() thriftStruct {
+	s := thriftStruct{}
+	var last int16
+	for {
+		h := r.byte()
+		if h == 0 {
+			return s
+		}
+		typ := h & 0x0f
+		id := last + int16(h>>4)
+		if h>>4 == 0 {
+			id = int16(r.varint())
+		}
+		last = id
+		switch typ {
+		case compactTrue:
+			s[id] = true
+		case compactFalse:
+			s[id] = false
+		default:
+			s[id] = r.value(typ)
+		}
+	}
+}
+
+func (r *compactReader) value(typ byte) interface{} {
+	switch typ {
+	case compactI32, compactI64:
+		return r.varint()
+	case compactBinary:
+		n := int(r.uvarint())
+		if r.pos+n > len(r.b) {
+			r.t.Fatalf("thrift: string of %d bytes overruns input", n)
+		}
+		s := string(r.b[r.pos : r.pos+n])
+		r.pos += n
+		return s
+	case compactList:
+		h := r.byte()
+		n, elem := int(h>>4), h&0x0f
+		if n == 15 {
+			n = int(r.uvarint())
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			list[i] = r.value(elem)
+		}
+		return list
+	case compactStruct:
+		return r.readStruct()
+	}
+	r.t.Fatalf("thrift: unsupported type %d at %d", typ, r.pos)
+	return nil
+}
+
+func field[T any](t *testing.T, s thriftStruct, id int16) T {
+	t.Helper()
+	v, ok := s[id].(T)
+	if !ok {
+		t.Fatalf("field %d = %#v, want a %T", id, s[id], v)
+	}
+	return v
+}
+
+func structs(t *testing.T, s thriftStruct, id int16) []thriftStruct {
+	t.Helper()
+	var out []thriftStruct
+	for _, v := range field[[]interface{}](t, s, id) {
+		out = append(out, v.(thriftStruct))
+	}
+	return out
+}
+
+// readParquet checks a file's framing and decodes its footer.
+func readParquet(t *testing.T, file []byte) thriftStruct {
+	t.Helper()
+	if !bytes.HasPrefix(file, []byte(parquetMagic)) || !bytes.HasSuffix(file, []byte(parquetMagic)) {
+		t.Fatalf("file is not framed by %s", parquetMagic)
+	}
+	n := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	start := len(file) - 8 - n
+	if start < len(parquetMagic) {
+		t.Fatalf("footer length %d overruns the file", n)
+	}
+	r := &compactReader{t: t, b: file[start : len(file)-8]}
+	meta := r.readStruct()
+	if r.pos != n {
+		t.Fatalf("footer decoded %d of %d bytes", r.pos, n)
+	}
+	return meta
+}
+
+// readChunk decodes a column chunk's single PLAIN data page into its
+// definition levels, or nil for a required column, and its values.
+func readChunk(t *testing.T, file []byte, chunk thriftStruct, optional bool) ([]byte, []interface{}) {
+	t.Helper()
+	meta := field[thriftStruct](t, chunk, 3)
+	offset := field[int64](t, meta, 9)
+	size := field[int64](t, meta, 7)
+	if field[int64](t, chunk, 2) != offset {
+		t.Errorf("chunk file_offset %d, data_page_offset %d", field[int64](t, chunk, 2), offset)
+	}
+	if field[int64](t, meta, 6) != size {
+		t.Errorf("chunk uncompressed size %d, compressed size %d", field[int64](t, meta, 6), size)
+	}
+
+	r := &compactReader{t: t, b: file[offset : offset+size]}
+	header := r.readStruct()
+	if typ := field[int64](t, header, 1); typ != parquetDataPage {
+		t.Fatalf("page type = %d, want a data page", typ)
+	}
+	pageSize := field[int64](t, header, 3)
+	if int64(r.pos)+pageSize != size {
+		t.Fatalf("page header %d + page %d bytes, chunk is %d", r.pos, pageSize, size)
+	}
+	data := field[thriftStruct](t, header, 5)
+	count := int(field[int64](t, data, 1))
+	if count != int(field[int64](t, meta, 5)) {
+		t.Errorf("page holds %d values, chunk %d", count, field[int64](t, meta, 5))
+	}
+	if enc := field[int64](t, data, 2); enc != parquetPlain {
+		t.Errorf("page encoding = %d, want PLAIN", enc)
+	}
+	page := r.b[r.pos:]
+
+	var levels []byte
+	present := count
+	if optional {
+		n := int(binary.LittleEndian.Uint32(page))
+		runs := page[4 : 4+n]
+		page = page[4+n:]
+		for len(runs) > 0 {
+			h, k := binary.Uvarint(runs)
+			if k <= 0 || h&1 != 0 {
+				t.Fatalf("levels: want an RLE run, got header %#x", h)
+			}
+			for i := 0; i < int(h>>1); i++ {
+				levels = append(levels, runs[k])
+			}
+			runs = runs[k+1:]
+		}
+		if len(levels) != count {
+			t.Fatalf("%d levels for %d values", len(levels), count)
+		}
+		present = bytes.Count(levels, []byte{1})
+	}
+
+	typ := field[int64](t, meta, 1)
+	var values []interface{}
+	for i := 0; i < present; i++ {
+		switch typ {
+		case parquetInt64:
+			values = append(values, int64(binary.LittleEndian.Uint64(page)))
+			page = page[8:]
+		case parquetDouble:
+			values = append(values, math.Float64frombits(binary.LittleEndian.Uint64(page)))
+			page = page[8:]
+		case parquetByteArray:
+			n := binary.LittleEndian.Uint32(page)
+			values = append(values, string(page[4:4+n]))
+			page = page[4+n:]
+		default:
+			t.Fatalf("unexpected physical type %d", typ)
+		}
+	}
+	if len(page) > 0 {
+		t.Errorf("%d bytes left over in page", len(page))
+	}
+	return levels, values
+}
+
+func TestParquetRoundTrip(t *testing.T) {
+	columns := []Column{
+		{Name: "time", Kind: Time},
+		{Name: "machine_id", Kind: String},
+		{Name: "temperature", Kind: Float},
+	}
+	start := time.Date(2026, 3, 1, 8, 0, 0, 0, time.FixedZone("CET", 3600))
+	var rows [][]interface{}
+	for i := 0; i < 23; i++ {
+		var v interface{} = 20 + float64(i)/4
+		if i%4 == 0 || i == 5 || i == 22 {
+			v = nil
+		}
+		machine := "press-1"
+		if i%2 == 1 {
+			machine = "lathe-12"
+		}
+		rows = append(rows, []interface{}{start.Add(time.Duration(i) * 1500 * time.Microsecond), machine, v})
+	}
+
+	var buf bytes.Buffer
+	enc := newParquetEncoder(&buf, columns)
+	enc.groupSize = 100
+	for _, row := range rows {
+		if err := enc.Write(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := buf.Bytes()
+	meta := readParquet(t, file)
+
+	if v := field[int64](t, meta, 1); v != 1 {
+		t.Errorf("version = %d, want 1", v)
+	}
+	if n := field[int64](t, meta, 3); n != int64(len(rows)) {
+		t.Errorf("num_rows = %d, want %d", n, len(rows))
+	}
+
+	schema := structs(t, meta, 2)
+	if len(schema) != len(columns)+1 {
+		t.Fatalf("schema has %d elements, want %d", len(schema), len(columns)+1)
+	}
+	if n := field[int64](t, schema[0], 5); n != int64(len(columns)) {
+		t.Errorf("root num_children = %d, want %d", n, len(columns))
+	}
+	want := []struct {
+		typ, repetition int64
+		converted       interface{}
+		logical         int16
+	}{
+		{parquetInt64, parquetRequired, int64(parquetTimestampMicros), 8},
+		{parquetByteArray, parquetRequired, int64(parquetUTF8), 1},
+		{parquetDouble, parquetOptional, nil, 0},
+	}
+	for i, w := range want {
+		el := schema[i+1]
+		if name := field[string](t, el, 4); name != columns[i].Name {
+			t.Errorf("schema[%d] name = %q, want %q", i+1, name, columns[i].Name)
+		}
+		if typ := field[int64](t, el, 1); typ != w.typ {
+			t.Errorf("%s: type = %d, want %d", columns[i].Name, typ, w.typ)
+		}
+		if rep := field[int64](t, el, 3); rep != w.repetition {
+			t.Errorf("%s: repetition = %d, want %d", columns[i].Name, rep, w.repetition)
+		}
+		if el[6] != w.converted {
+			t.Errorf("%s: converted type = %v, want %v", columns[i].Name, el[6], w.converted)
+		}
+		if w.logical == 0 {
+			if _, ok := el[10]; ok {
+				t.Errorf("%s: unexpected logical type", columns[i].Name)
+			}
+			continue
+		}
+		if _, ok := field[thriftStruct](t, el, 10)[w.logical]; !ok {
+			t.Errorf("%s: logical type = %v, want field %d", columns[i].Name, el[10], w.logical)
+		}
+	}
+	timestamp := field[thriftStruct](t, field[thriftStruct](t, schema[1], 10), 8)
+	if !field[bool](t, timestamp, 1) {
+		t.Error("timestamp is not adjusted to UTC")
+	}
+	if _, ok := field[thriftStruct](t, timestamp, 2)[2]; !ok {
+		t.Errorf("timestamp unit = %v, want MICROS", timestamp[2])
+	}
+
+	groups := structs(t, meta, 4)
+	if len(groups) < 3 {
+		t.Fatalf("%d row groups, want several", len(groups))
+	}
+	var got [][]interface{}
+	for g, group := range groups {
+		n := int(field[int64](t, group, 3))
+		chunks := structs(t, group, 1)
+		if len(chunks) != len(columns) {
+			t.Fatalf("group %d has %d chunks, want %d", g, len(chunks), len(columns))
+		}
+		decoded := make([][]interface{}, n)
+		for i := range decoded {
+			decoded[i] = make([]interface{}, len(columns))
+		}
+		var total int64
+		for c, chunk := range chunks {
+			cm := field[thriftStruct](t, chunk, 3)
+			total += field[int64](t, cm, 7)
+			path := field[[]interface{}](t, cm, 3)
+			if len(path) != 1 || path[0] != columns[c].Name {
+				t.Errorf("group %d chunk %d path = %v, want [%s]", g, c, path, columns[c].Name)
+			}
+			levels, values := readChunk(t, file, chunk, columns[c].Kind == Float)
+			for i := range decoded {
+				if levels != nil && levels[i] == 0 {
+					continue
+				}
+				if len(values) == 0 {
+					t.Fatalf("group %d chunk %d: levels promise more values than the page holds", g, c)
+				}
+				decoded[i][c], values = values[0], values[1:]
+			}
+		}
+		if size := field[int64](t, group, 2); size != total {
+			t.Errorf("group %d total_byte_size = %d, chunks add up to %d", g, size, total)
+		}
+		got = append(got, decoded...)
+	}
+
+	if len(got) != len(rows) {
+		t.Fatalf("decoded %d rows, want %d", len(got), len(rows))
+	}
+	for i, row := range rows {
+		wantRow := []interface{}{row[0].(time.Time).UnixMicro(), row[1], row[2]}
+		for c := range wantRow {
+			if got[i][c] != wantRow[c] {
+				t.Errorf("row %d %s = %v, want %v", i, columns[c].Name, got[i][c], wantRow[c])
+			}
+		}
+	}
+}
+
+func TestParquetEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	enc := newParquetEncoder(&buf, []Column{{Name: "time", Kind: Time}, {Name: "value", Kind: Float}})
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	meta := readParquet(t, buf.Bytes())
+	if n := field[int64](t, meta, 3); n != 0 {
+		t.Errorf("num_rows = %d, want 0", n)
+	}
+	if groups := field[[]interface{}](t, meta, 4); len(groups) != 0 {
+		t.Errorf("%d row groups, want none", len(groups))
+	}
+}
+
+func TestParquetMismatch(t *testing.T) {
+	columns := []Column{{Name: "time", Kind: Time}, {Name: "machine_id", Kind: String}, {Name: "value", Kind: Float}}
+	now := time.Now()
+	for _, row := range [][]interface{}{
+		{"2026-03-01", "press-1", 1.0},
+		{now, 7, 1.0},
+		{now, "press-1", "1.0"},
+		{now, "press-1", int64(1)},
+	} {
+		enc := newParquetEncoder(&bytes.Buffer{}, columns)
+		if err := enc.Write(row); err == nil {
+			t.Errorf("Write(%v) succeeded", row)
+		}
+	}
+}
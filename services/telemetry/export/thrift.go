@@ -0,0 +1,105 @@
+package export
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Thrift compact protocol type codes.
+const (
+	compactTrue   = 1
+	compactFalse  = 2
+	compactI32    = 5
+	compactI64    = 6
+	compactBinary = 8
+	compactList   = 9
+	compactStruct = 12
+)
+
+// compactWriter encodes Thrift structs in the compact protocol, which
+// Parquet uses for its page headers and file footer. Only what those need
+// is implemented. Callers wrap the whole message in beginStruct(0) and
+// endStruct.
+type compactWriter struct {
+	bytes.Buffer
+	last    int16
+	parents []int16
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func (w *compactWriter) field(id int16, typ byte) {
+	if delta := id - w.last; delta > 0 && delta <= 15 {
+		w.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		w.WriteByte(typ)
+		w.varint(int64(id))
+	}
+	w.last = id
+}
+
+func (w *compactWriter) uvarint(v uint64) {
+	n := binary.PutUvarint(w.scratch[:], v)
+	w.Write(w.scratch[:n])
+}
+
+// varint writes a zigzag-encoded integer.
+func (w *compactWriter) varint(v int64) {
+	w.uvarint(uint64(v<<1) ^ uint64(v>>63))
+}
+
+func (w *compactWriter) writeI32(id int16, v int32) {
+	w.field(id, compactI32)
+	w.varint(int64(v))
+}
+
+func (w *compactWriter) writeI64(id int16, v int64) {
+	w.field(id, compactI64)
+	w.varint(v)
+}
+
+func (w *compactWriter) writeBool(id int16, v bool) {
+	if v {
+		w.field(id, compactTrue)
+	} else {
+		w.field(id, compactFalse)
+	}
+}
+
+func (w *compactWriter) writeString(id int16, s string) {
+	w.field(id, compactBinary)
+	w.element(s)
+}
+
+// writeList starts a list field of n elements, which follow as element or
+// varint calls, or as structs started with beginStruct(0).
+func (w *compactWriter) writeList(id int16, elem byte, n int) {
+	w.field(id, compactList)
+	if n < 15 {
+		w.WriteByte(byte(n)<<4 | elem)
+	} else {
+		w.WriteByte(0xf0 | elem)
+		w.uvarint(uint64(n))
+	}
+}
+
+// element writes a string list element.
+func (w *compactWriter) element(s string) {
+	w.uvarint(uint64(len(s)))
+	w.WriteString(s)
+}
+
+// beginStruct starts a struct field, or a struct without a field header
+// when id is 0: the message itself or a list element.
+func (w *compactWriter) beginStruct(id int16) {
+	if id != 0 {
+		w.field(id, compactStruct)
+	}
+	w.parents = append(w.parents, w.last)
+	w.last = 0
+}
+
+func (w *compactWriter) endStruct() {
+	w.WriteByte(0)
+	w.last = w.parents[len(w.parents)-1]
+	w.parents = w.parents[:len(w.parents)-1]
+}
@@ -5,7 +5,9 @@ go 1.21
 require (
 	github.com/google/uuid v1.5.0
 	github.com/gorilla/mux v1.8.1
+	github.com/gorilla/websocket v1.5.3
 	github.com/jackc/pgx/v5 v5.5.1
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
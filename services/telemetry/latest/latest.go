@@ -0,0 +1,116 @@
+// Package latest keeps the most recent reading of every machine metric in
+// memory so that current-value queries do not scan the metrics hypertable.
+package latest
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// WarmWindow is how far back Warm looks for readings. Metrics that have not
+// reported for longer stay out of the cache until they report again.
+const WarmWindow = 7 * 24 * time.Hour
+
+// Value is a metric's most recent reading.
+type Value struct {
+	MachineID  uuid.UUID `json:"machine_id"`
+	MetricName string    `json:"metric_name"`
+	Value      float64   `json:"value"`
+	Unit       string    `json:"unit"`
+	Quality    string    `json:"quality"`
+	Time       time.Time `json:"time"`
+}
+
+// Cache holds the latest Value per machine and metric. It is safe for
+// concurrent use.
+type Cache struct {
+	mu       sync.RWMutex
+	machines map[uuid.UUID]map[string]Value
+}
+
+func NewCache() *Cache {
+	return &Cache{machines: make(map[uuid.UUID]map[string]Value)}
+}
+
+// Update records a reading unless the cache already holds a newer one for
+// its metric, so late or replayed readings do not replace current values.
+func (c *Cache) Update(v Value) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	metrics, ok := c.machines[v.MachineID]
+	if !ok {
+		metrics = make(map[string]Value)
+		c.machines[v.MachineID] = metrics
+	}
+	if current, ok := metrics[v.MetricName]; ok && current.Time.After(v.Time) {
+		return
+	}
+	metrics[v.MetricName] = v
+}
+
+// Machine returns a machine's latest values ordered by metric.
+func (c *Cache) Machine(machineID uuid.UUID) []Value {
+	c.mu.RLock()
+	values := make([]Value, 0, len(c.machines[machineID]))
+	for _, v := range c.machines[machineID] {
+		values = append(values, v)
+	}
+	c.mu.RUnlock()
+
+	sort.Slice(values, func(i, j int) bool { return values[i].MetricName < values[j].MetricName })
+	return values
+}
+
+// All returns every latest value ordered by machine and metric.
+func (c *Cache) All() []Value {
+	c.mu.RLock()
+	var values []Value
+	for _, metrics := range c.machines {
+		for _, v := range metrics {
+			values = append(values, v)
+		}
+	}
+	c.mu.RUnlock()
+
+	sort.Slice(values, func(i, j int) bool {
+		if values[i].MachineID != values[j].MachineID {
+			return bytes.Compare(values[i].MachineID[:], values[j].MachineID[:]) < 0
+		}
+		return values[i].MetricName < values[j].MetricName
+	})
+	return values
+}
+
+// Warm loads the latest reading of every metric that reported within
+// WarmWindow and returns how many it loaded.
+func (c *Cache) Warm(ctx context.Context, pool *pgxpool.Pool) (int, error) {
+	rows, err := pool.Query(ctx,
+		`SELECT DISTINCT ON (machine_id, metric_name) machine_id, metric_name, value, COALESCE(unit, ''), COALESCE(quality, ''), time
+		 FROM metrics
+		 WHERE time > $1
+		 ORDER BY machine_id, metric_name, time DESC`,
+		time.Now().Add(-WarmWindow),
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		var v Value
+		if err := rows.Scan(&v.MachineID, &v.MetricName, &v.Value, &v.Unit, &v.Quality, &v.Time); err != nil {
+			return n, err
+		}
+		c.Update(v)
+		n++
+	}
+	return n, rows.Err()
+}
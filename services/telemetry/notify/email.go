@@ -0,0 +1,374 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type EmailChannel struct {
+	db         *pgxpool.Pool
+	host       string
+	port       string
+	user       string
+	password   string
+	from       string
+	grafanaURL string
+	// implicitTLS connects with TLS from the start, as port 465 expects,
+	// rather than upgrading with STARTTLS.
+	implicitTLS bool
+	// rootCAs verifies the server's certificate; nil uses the system roots.
+	rootCAs *x509.CertPool
+}
+
+func NewEmailChannel(pool *pgxpool.Pool, host, port, user, password, from, grafanaURL string) *EmailChannel {
+	return &EmailChannel{
+		db:          pool,
+		host:        host,
+		port:        port,
+		user:        user,
+		password:    password,
+		from:        from,
+		grafanaURL:  strings.TrimRight(grafanaURL, "/"),
+		implicitTLS: port == "465",
+	}
+}
+
+func (c *EmailChannel) Name() string { return "email" }
+
+func (c *EmailChannel) Target() string { return net.JoinHostPort(c.host, c.port) }
+
+// Recipients returns the addresses subscribed to the alert's severity and
+// location.
+func (c *EmailChannel) Recipients(ctx context.Context, alert Alert) ([]string, error) {
+	recipients, err := ListEmailRecipients(ctx, c.db)
+	if err != nil {
+		return nil, err
+	}
+	return recipientsFor(recipients, alert), nil
+}
+
+// recipientsFor returns the distinct addresses of the enabled recipients
+// that match the alert, in the order given.
+func recipientsFor(recipients []EmailRecipient, alert Alert) []string {
+	var addresses []string
+	seen := make(map[string]bool)
+	for _, r := range recipients {
+		if r.Enabled && r.Matches(alert) && !seen[r.Address] {
+			seen[r.Address] = true
+			addresses = append(addresses, r.Address)
+		}
+	}
+	return addresses
+}
+
+func (c *EmailChannel) Send(ctx context.Context, alert Alert) error {
+	to, err := c.Recipients(ctx, alert)
+	if err != nil {
+		return err
+	}
+	return c.send(ctx, alert, to)
+}
+
+func (c *EmailChannel) send(ctx context.Context, alert Alert, to []string) error {
+	if len(to) == 0 {
+		return nil
+	}
+
+	msg, err := c.render(alert, to)
+	if err != nil {
+		return Permanent(err)
+	}
+	return c.sendMail(ctx, to, msg)
+}
+
+// To returns a channel that mails the given addresses instead of the
+// subscribed recipients, for escalations that name people directly.
+func (c *EmailChannel) To(addresses []string) Channel {
+	return &directEmail{EmailChannel: c, to: addresses}
+}
+
+type directEmail struct {
+	*EmailChannel
+	to []string
+}
+
+func (c *directEmail) Recipients(ctx context.Context, alert Alert) ([]string, error) {
+	return c.to, nil
+}
+
+func (c *directEmail) Send(ctx context.Context, alert Alert) error {
+	return c.send(ctx, alert, c.to)
+}
+
+func (c *EmailChannel) sendMail(ctx context.Context, to []string, msg []byte) error {
+	addr := net.JoinHostPort(c.host, c.port)
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+
+	var conn net.Conn
+	var err error
+	if c.implicitTLS {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: c.tlsConfig()}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(time.Minute))
+	}
+
+	client, err := smtp.NewClient(conn, c.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(c.tlsConfig()); err != nil {
+			return err
+		}
+	}
+
+	// With credentials configured, mail goes out authenticated or not at
+	// all: a server that does not offer AUTH is misconfigured, or not the
+	// one we meant to reach, and retrying will not change that.
+	if c.user != "" {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return Permanent(fmt.Errorf("smtp server %s does not offer AUTH; refusing to send without the configured credentials", addr))
+		}
+		if err := client.Auth(smtp.PlainAuth("", c.user, c.password, c.host)); err != nil {
+			return smtpError(err)
+		}
+	}
+
+	if err := client.Mail(c.from); err != nil {
+		return smtpError(err)
+	}
+	for _, rcpt := range to {
+		if err := client.Rcpt(rcpt); err != nil {
+			return smtpError(err)
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return smtpError(err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return smtpError(err)
+	}
+	return client.Quit()
+}
+
+func (c *EmailChannel) tlsConfig() *tls.Config {
+	return &tls.Config{ServerName: c.host, RootCAs: c.rootCAs}
+}
+
+// smtpError marks 5xx replies as permanent; 4xx replies are transient by definition.
+func smtpError(err error) error {
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) && tpErr.Code >= 500 {
+		return Permanent(err)
+	}
+	return err
+}
+
+type emailData struct {
+	Alert
+	Pump         string
+	Resolved     bool
+	Escalated    bool
+	Raised       bool
+	DashboardURL string
+	ValueText    string
+	LimitText    string
+}
+
+var emailSubject = texttemplate.Must(texttemplate.New("subject").Funcs(texttemplate.FuncMap{"upper": strings.ToUpper}).Parse(
+	`{{if .Resolved}}[RESOLVED]{{else if .Escalated}}[ESCALATED {{.EscalationLevel}}] [{{upper .Severity}}]{{else if .Raised}}[RAISED] [{{upper .Severity}}]{{else}}[{{upper .Severity}}]{{end}} {{.RuleName}} - {{.Pump}}{{with .Location}} ({{.}}){{end}}`,
+))
+
+var emailText = texttemplate.Must(texttemplate.New("text").Parse(`{{if .Resolved}}RESOLVED: {{.RuleName}} has returned to normal.{{else if .Escalated}}ESCALATED: {{.RuleName}} has not been acknowledged.{{else if .Raised}}RAISED: {{.RuleName}} triggered, raising the alert from {{.PreviousSeverity}} to {{.Severity}}.{{else}}{{.RuleName}} triggered.{{end}}
+
+Pump:      {{.Pump}}
+Location:  {{.Location}}
+Severity:  {{.Severity}}
+Value:     {{.ValueText}}
+{{- with .LimitText}}
+Threshold: {{.}}{{end}}
+{{- with .Expression}}
+Condition: {{.}}{{end}}
+Time:      {{.Time.UTC.Format "2006-01-02 15:04:05 MST"}}
+
+{{.Message}}
+
+Pump dashboard: {{.DashboardURL}}
+`))
+
+var emailHTML = htmltemplate.Must(htmltemplate.New("html").Parse(`<!DOCTYPE html>
+<html><body style="font-family: Arial, sans-serif; color: #222;">
+{{if .Resolved}}<h2 style="color: #2e7d32;">Resolved: {{.RuleName}}</h2>
+<p>The condition has returned to normal.</p>
+{{else}}<h2 style="color: {{if eq .Severity "critical"}}#c62828{{else}}#ef6c00{{end}};">{{.Severity}}: {{.RuleName}}</h2>
+{{if .Escalated}}<p><b>Escalation level {{.EscalationLevel}}:</b> this alert has not been acknowledged.</p>
+{{end}}{{if .Raised}}<p><b>Raised from {{.PreviousSeverity}}:</b> the condition has worsened.</p>
+{{end}}{{end}}<table cellpadding="4" style="border-collapse: collapse;">
+<tr><td><b>Pump</b></td><td>{{.Pump}}</td></tr>
+<tr><td><b>Location</b></td><td>{{.Location}}</td></tr>
+<tr><td><b>Severity</b></td><td>{{.Severity}}</td></tr>
+<tr><td><b>Value</b></td><td>{{.ValueText}}</td></tr>
+{{with .LimitText}}<tr><td><b>Threshold</b></td><td>{{.}}</td></tr>{{end}}
+{{with .Expression}}<tr><td><b>Condition</b></td><td><code>{{.}}</code></td></tr>{{end}}
+<tr><td><b>Time</b></td><td>{{.Time.UTC.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+</table>
+<p>{{.Message}}</p>
+<p><a href="{{.DashboardURL}}">Open pump dashboard</a></p>
+</body></html>
+`))
+
+func (c *EmailChannel) render(alert Alert, to []string) ([]byte, error) {
+	data := emailData{
+		Alert:        alert,
+		Pump:         alert.MachineName,
+		Resolved:     alert.Event == EventResolved,
+		Escalated:    alert.Event == EventEscalated,
+		Raised:       alert.Event == EventSeverityRaised,
+		DashboardURL: PumpDashboardURL(c.grafanaURL, alert),
+		ValueText:    formatValue(alert),
+	}
+	if data.Pump == "" {
+		data.Pump = alert.MachineID.String()
+	}
+	if alert.Threshold != nil {
+		data.LimitText = fmt.Sprintf("%.2f", *alert.Threshold)
+	}
+
+	var subject, text, html bytes.Buffer
+	if err := emailSubject.Execute(&subject, data); err != nil {
+		return nil, err
+	}
+	if err := emailText.Execute(&text, data); err != nil {
+		return nil, err
+	}
+	if err := emailHTML.Execute(&html, data); err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", c.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject.String()))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@telemetry>\r\n", uuid.New())
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", parts.Boundary())
+
+	for _, part := range []struct {
+		contentType string
+		content     []byte
+	}{
+		{"text/plain; charset=utf-8", text.Bytes()},
+		{"text/html; charset=utf-8", html.Bytes()},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"8bit"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		w.Write(bytes.ReplaceAll(part.content, []byte("\n"), []byte("\r\n")))
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+var ErrRecipientNotFound = errors.New("recipient not found")
+
+// EmailRecipient subscribes an address to alerts of a severity and location.
+type EmailRecipient struct {
+	ID        uuid.UUID `json:"id"`
+	Address   string    `json:"address"`
+	Severity  *string   `json:"severity"`
+	Location  *string   `json:"location"`
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Matches reports whether the recipient subscribes to the alert. A recipient
+// with no severity or location matches any.
+func (r EmailRecipient) Matches(alert Alert) bool {
+	return (r.Severity == nil || *r.Severity == alert.Severity) && (r.Location == nil || *r.Location == alert.Location)
+}
+
+func ListEmailRecipients(ctx context.Context, pool *pgxpool.Pool) ([]EmailRecipient, error) {
+	rows, err := pool.Query(ctx,
+		"SELECT id, address, severity, location, enabled, created_at FROM email_recipients ORDER BY address")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var recipients []EmailRecipient
+	for rows.Next() {
+		var r EmailRecipient
+		if err := rows.Scan(&r.ID, &r.Address, &r.Severity, &r.Location, &r.Enabled, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, r)
+	}
+	return recipients, rows.Err()
+}
+
+// SaveEmailRecipient inserts the recipient, or replaces it when it has an ID.
+func SaveEmailRecipient(ctx context.Context, pool *pgxpool.Pool, r EmailRecipient) (uuid.UUID, error) {
+	if r.ID == uuid.Nil {
+		r.ID = uuid.New()
+	}
+	_, err := pool.Exec(ctx,
+		`INSERT INTO email_recipients (id, address, severity, location, enabled)
+		 VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), $5)
+		 ON CONFLICT (id) DO UPDATE SET
+			address = EXCLUDED.address, severity = EXCLUDED.severity, location = EXCLUDED.location, enabled = EXCLUDED.enabled`,
+		r.ID, r.Address, r.Severity, r.Location, r.Enabled,
+	)
+	return r.ID, err
+}
+
+func DeleteEmailRecipient(ctx context.Context, pool *pgxpool.Pool, id uuid.UUID) error {
+	tag, err := pool.Exec(ctx, "DELETE FROM email_recipients WHERE id = $1", id)
+	if err == nil && tag.RowsAffected() == 0 {
+		return ErrRecipientNotFound
+	}
+	return err
+}
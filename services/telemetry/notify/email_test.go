@@ -0,0 +1,565 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTP is an in-process SMTP server with just enough of the protocol for
+// the email channel: EHLO, optional implicit TLS, STARTTLS and AUTH PLAIN,
+// MAIL, RCPT and DATA. It records each message it accepts.
+type fakeSMTP struct {
+	ln   net.Listener
+	cert tls.Certificate
+	// roots trusts cert, for clients.
+	roots *x509.CertPool
+
+	startTLS bool
+	// implicitTLS speaks TLS from the first byte, as on port 465.
+	implicitTLS bool
+	auth        bool
+	user        string
+	password    string
+	// rejectRcpt maps recipients to the reply RCPT TO gets for them.
+	rejectRcpt map[string]string
+
+	accepting sync.Once
+	mu        sync.Mutex
+	sessions  []*smtpSession
+}
+
+// smtpSession is what one client connection did.
+type smtpSession struct {
+	tls      bool
+	authUser string
+	from     string
+	to       []string
+	data     string
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	// Borrow httptest's certificate, which is valid for 127.0.0.1.
+	tlsServer := httptest.NewTLSServer(nil)
+	cert := tlsServer.TLS.Certificates[0]
+	roots := x509.NewCertPool()
+	roots.AddCert(tlsServer.Certificate())
+	tlsServer.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTP{ln: ln, cert: cert, roots: roots, rejectRcpt: make(map[string]string)}
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+// channel returns an email channel for the server. The server starts
+// accepting connections then, once the test has configured it.
+func (s *fakeSMTP) channel(user, password string) *EmailChannel {
+	s.accepting.Do(func() {
+		go func() {
+			for {
+				conn, err := s.ln.Accept()
+				if err != nil {
+					return
+				}
+				go s.serve(conn)
+			}
+		}()
+	})
+	host, port, _ := net.SplitHostPort(s.ln.Addr().String())
+	c := NewEmailChannel(nil, host, port, user, password, "alerts@plant.example", "http://grafana.plant.example")
+	c.rootCAs = s.roots
+	c.implicitTLS = s.implicitTLS
+	return c
+}
+
+// session returns a copy of what the i-th connection did, or nil.
+func (s *fakeSMTP) session(i int) *smtpSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i >= len(s.sessions) {
+		return nil
+	}
+	session := *s.sessions[i]
+	return &session
+}
+
+// update changes a session under the lock tests read it with.
+func (s *fakeSMTP) update(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f()
+}
+
+// smtpPath returns the address in a MAIL FROM or RCPT TO argument such as
+// "FROM:<ops@plant.example> BODY=8BITMIME".
+func smtpPath(arg string) string {
+	_, path, _ := strings.Cut(arg, "<")
+	path, _, _ = strings.Cut(path, ">")
+	return path
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	session := &smtpSession{}
+	s.mu.Lock()
+	s.sessions = append(s.sessions, session)
+	s.mu.Unlock()
+
+	if s.implicitTLS {
+		tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{s.cert}})
+		if err := tlsConn.Handshake(); err != nil {
+			return
+		}
+		conn = tlsConn
+		s.update(func() { session.tls = true })
+	}
+
+	tp := textproto.NewConn(conn)
+	reply := func(format string, args ...interface{}) {
+		tp.PrintfLine(format, args...)
+	}
+	reply("220 fake.plant.example ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			lines := []string{"fake.plant.example"}
+			if s.startTLS && !session.tls {
+				lines = append(lines, "STARTTLS")
+			}
+			if s.auth {
+				lines = append(lines, "AUTH PLAIN")
+			}
+			lines = append(lines, "8BITMIME")
+			for i, l := range lines {
+				sep := "-"
+				if i == len(lines)-1 {
+					sep = " "
+				}
+				reply("250%s%s", sep, l)
+			}
+		case "STARTTLS":
+			reply("220 2.0.0 ready to start TLS")
+			tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{s.cert}})
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+			tp = textproto.NewConn(conn)
+			s.update(func() { session.tls = true })
+		case "AUTH":
+			mechanism, initial, _ := strings.Cut(arg, " ")
+			decoded, err := base64.StdEncoding.DecodeString(initial)
+			parts := strings.Split(string(decoded), "\x00")
+			if mechanism != "PLAIN" || err != nil || len(parts) != 3 || parts[1] != s.user || parts[2] != s.password {
+				reply("535 5.7.8 authentication credentials invalid")
+				continue
+			}
+			s.update(func() { session.authUser = parts[1] })
+			reply("235 2.7.0 authentication successful")
+		case "MAIL":
+			s.update(func() { session.from = smtpPath(arg) })
+			reply("250 2.1.0 ok")
+		case "RCPT":
+			to := smtpPath(arg)
+			if r, ok := s.rejectRcpt[to]; ok {
+				reply("%s", r)
+				continue
+			}
+			s.update(func() { session.to = append(session.to, to) })
+			reply("250 2.1.5 ok")
+		case "DATA":
+			reply("354 end data with <CR><LF>.<CR><LF>")
+			data, err := io.ReadAll(tp.DotReader())
+			if err != nil {
+				return
+			}
+			s.update(func() { session.data = string(data) })
+			reply("250 2.0.0 queued")
+		case "RSET", "NOOP":
+			reply("250 2.0.0 ok")
+		case "QUIT":
+			reply("221 2.0.0 bye")
+			return
+		default:
+			reply("502 5.5.2 command not recognized")
+		}
+	}
+}
+
+func TestEmailSendOverSMTP(t *testing.T) {
+	tests := []struct {
+		name         string
+		startTLS     bool
+		auth         bool
+		user         string
+		wantTLS      bool
+		wantAuthUser string
+	}{
+		{"plain", false, false, "", false, ""},
+		{"starttls", true, false, "", true, ""},
+		{"starttls and auth", true, true, "alerts", true, "alerts"},
+		// net/smtp only allows PLAIN without TLS to localhost.
+		{"auth without tls", false, true, "alerts", false, "alerts"},
+		{"no credentials", true, true, "", true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeSMTP(t)
+			server.startTLS, server.auth = tt.startTLS, tt.auth
+			server.user, server.password = "alerts", "s3cret"
+
+			to := []string{"ops@plant.example", "north@plant.example"}
+			err := server.channel(tt.user, "s3cret").send(context.Background(), testAlert(), to)
+			if err != nil {
+				t.Fatalf("send: %v", err)
+			}
+
+			session := server.session(0)
+			if session.tls != tt.wantTLS {
+				t.Errorf("TLS used = %v, want %v", session.tls, tt.wantTLS)
+			}
+			if session.authUser != tt.wantAuthUser {
+				t.Errorf("authenticated as %q, want %q", session.authUser, tt.wantAuthUser)
+			}
+			if session.from != "alerts@plant.example" {
+				t.Errorf("MAIL FROM %q", session.from)
+			}
+			if strings.Join(session.to, ",") != strings.Join(to, ",") {
+				t.Errorf("RCPT TO %v, want %v", session.to, to)
+			}
+			if session.data == "" {
+				t.Error("no message was sent")
+			}
+		})
+	}
+}
+
+func TestEmailImplicitTLS(t *testing.T) {
+	server := newFakeSMTP(t)
+	server.implicitTLS, server.auth = true, true
+	server.user, server.password = "alerts", "s3cret"
+
+	if err := server.channel("alerts", "s3cret").send(context.Background(), testAlert(), []string{"ops@plant.example"}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	session := server.session(0)
+	if !session.tls || session.authUser != "alerts" || session.data == "" {
+		t.Errorf("session = %+v, want an authenticated message over TLS", session)
+	}
+}
+
+func TestEmailAuthNotAdvertised(t *testing.T) {
+	for _, startTLS := range []bool{false, true} {
+		server := newFakeSMTP(t)
+		server.startTLS = startTLS
+
+		err := server.channel("alerts", "s3cret").send(context.Background(), testAlert(), []string{"ops@plant.example"})
+		var perm *permanentError
+		if err == nil || !errors.As(err, &perm) || !strings.Contains(err.Error(), "AUTH") {
+			t.Errorf("starttls %v: send error = %v, want a permanent error about AUTH", startTLS, err)
+		}
+		if s := server.session(0); s != nil && (s.from != "" || s.data != "") {
+			t.Errorf("starttls %v: mail was sent without authenticating: %+v", startTLS, s)
+		}
+	}
+}
+
+func TestEmailCancelDuringImplicitTLS(t *testing.T) {
+	// A server that accepts and then never answers the TLS handshake.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		var held []net.Conn
+		defer func() {
+			for _, conn := range held {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			held = append(held, conn)
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	c := NewEmailChannel(nil, host, port, "", "", "alerts@plant.example", "")
+	c.implicitTLS = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	err = c.send(ctx, testAlert(), []string{"ops@plant.example"})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("send error = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("send returned %v after cancellation", elapsed)
+	}
+}
+
+func TestEmailAuthRejected(t *testing.T) {
+	server := newFakeSMTP(t)
+	server.startTLS, server.auth = true, true
+	server.user, server.password = "alerts", "s3cret"
+
+	err := server.channel("alerts", "wrong").send(context.Background(), testAlert(), []string{"ops@plant.example"})
+	var perm *permanentError
+	if err == nil || !errors.As(err, &perm) || !strings.Contains(err.Error(), "535") {
+		t.Errorf("send error = %v, want a permanent 535", err)
+	}
+}
+
+func TestEmailUntrustedCertificate(t *testing.T) {
+	server := newFakeSMTP(t)
+	server.startTLS = true
+
+	c := server.channel("", "")
+	c.rootCAs = x509.NewCertPool()
+	err := c.send(context.Background(), testAlert(), []string{"ops@plant.example"})
+	if err == nil {
+		t.Fatal("send succeeded against an untrusted certificate")
+	}
+	if s := server.session(0); s != nil && s.data != "" {
+		t.Error("message was sent over an unverified connection")
+	}
+}
+
+func TestEmailReplies(t *testing.T) {
+	tests := []struct {
+		name          string
+		reply         string
+		wantPermanent bool
+	}{
+		{"unknown mailbox", "550 5.1.1 no such user", true},
+		{"policy rejection", "554 5.7.1 relay denied", true},
+		{"mailbox busy", "450 4.2.1 mailbox busy, try later", false},
+		{"server shutting down", "421 4.3.2 service not available", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeSMTP(t)
+			server.rejectRcpt["gone@plant.example"] = tt.reply
+
+			err := server.channel("", "").send(context.Background(), testAlert(), []string{"ops@plant.example", "gone@plant.example"})
+			if err == nil {
+				t.Fatal("send succeeded")
+			}
+			var perm *permanentError
+			if got := errors.As(err, &perm); got != tt.wantPermanent {
+				t.Errorf("send error %v permanent = %v, want %v", err, got, tt.wantPermanent)
+			}
+			if code := strings.Fields(tt.reply)[0]; !strings.Contains(err.Error(), code) {
+				t.Errorf("send error %q does not carry the %s reply", err, code)
+			}
+		})
+	}
+}
+
+func TestEmailPermanentFailureIsNotRetried(t *testing.T) {
+	server := newFakeSMTP(t)
+	server.rejectRcpt["gone@plant.example"] = "550 5.1.1 no such user"
+	d := &Dispatcher{retry: testRetryPolicy}
+
+	delivery, ok := d.attempt(context.Background(), server.channel("", "").To([]string{"gone@plant.example"}), testAlert())
+	if !ok {
+		t.Fatal("attempt skipped the delivery")
+	}
+	if delivery.Status != "failed" || delivery.Attempts != 1 {
+		t.Errorf("delivery %s after %d attempts, want failed after 1", delivery.Status, delivery.Attempts)
+	}
+	if delivery.Channel != "email" || delivery.Target != "gone@plant.example" {
+		t.Errorf("delivery channel %q target %q, want email gone@plant.example", delivery.Channel, delivery.Target)
+	}
+	if server.session(1) != nil {
+		t.Error("permanent failure was retried")
+	}
+}
+
+func TestEmailMessage(t *testing.T) {
+	server := newFakeSMTP(t)
+	alert := testAlert()
+	alert.Message = "Pressure <2.5 bar> & falling"
+
+	to := []string{"ops@plant.example", "north@plant.example"}
+	if err := server.channel("", "").send(context.Background(), alert, to); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(server.session(0).data))
+	if err != nil {
+		t.Fatalf("message does not parse: %v", err)
+	}
+	if got := msg.Header.Get("From"); got != "alerts@plant.example" {
+		t.Errorf("From %q", got)
+	}
+	if got := msg.Header.Get("To"); got != "ops@plant.example, north@plant.example" {
+		t.Errorf("To %q", got)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "[CRITICAL] Low discharge pressure - Pump P-101 (Station North)"; subject != want {
+		t.Errorf("Subject %q, want %q", subject, want)
+	}
+	if msg.Header.Get("Message-ID") == "" || msg.Header.Get("Date") == "" {
+		t.Error("Message-ID or Date missing")
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Content-Type %q (%v), want multipart/alternative", msg.Header.Get("Content-Type"), err)
+	}
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+
+	bodies := make(map[string]string)
+	var order []string
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		contentType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		content, _ := io.ReadAll(part)
+		bodies[contentType] = string(content)
+		order = append(order, contentType)
+	}
+	// Clients show the last alternative they understand, so HTML goes last.
+	if strings.Join(order, ",") != "text/plain,text/html" {
+		t.Fatalf("parts %v, want text/plain then text/html", order)
+	}
+
+	// The server's dot reader has already turned CRLF line endings into LF.
+	text := bodies["text/plain"]
+	for _, want := range []string{
+		"Low discharge pressure triggered.",
+		"Pump:      Pump P-101",
+		"Location:  Station North",
+		"Severity:  critical",
+		"Value:     2.41",
+		"Threshold: 3.00",
+		"Time:      2026-03-04 05:06:07 UTC",
+		"Pressure <2.5 bar> & falling",
+		"Pump dashboard: http://grafana.plant.example/d/maintenance-dashboard?var-machine=0b6f7c1a-2c4d-4e8f-9a1b-5c6d7e8f9a0b",
+	} {
+		if !strings.Contains(text, want+"\n") {
+			t.Errorf("text part lacks line %q:\n%s", want, text)
+		}
+	}
+
+	html := bodies["text/html"]
+	for _, want := range []string{
+		`critical: Low discharge pressure</h2>`,
+		`<td><b>Pump</b></td><td>Pump P-101</td>`,
+		`<td><b>Location</b></td><td>Station North</td>`,
+		`<td><b>Value</b></td><td>2.41</td>`,
+		`<p>Pressure &lt;2.5 bar&gt; &amp; falling</p>`,
+		`<a href="http://grafana.plant.example/d/maintenance-dashboard?var-machine=0b6f7c1a-2c4d-4e8f-9a1b-5c6d7e8f9a0b">`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("html part lacks %q:\n%s", want, html)
+		}
+	}
+}
+
+func TestEmailSubjects(t *testing.T) {
+	c := NewEmailChannel(nil, "127.0.0.1", "25", "", "", "alerts@plant.example", "")
+	tests := []struct {
+		modify func(*Alert)
+		want   string
+	}{
+		{func(a *Alert) { a.Event = EventResolved }, "[RESOLVED] Low discharge pressure - Pump P-101 (Station North)"},
+		{func(a *Alert) { a.Event, a.EscalationLevel = EventEscalated, 2 }, "[ESCALATED 2] [CRITICAL] Low discharge pressure - Pump P-101 (Station North)"},
+		{func(a *Alert) { a.Event, a.PreviousSeverity = EventSeverityRaised, "warning" }, "[RAISED] [CRITICAL] Low discharge pressure - Pump P-101 (Station North)"},
+		{func(a *Alert) { a.Location, a.Severity = "", "warning" }, "[WARNING] Low discharge pressure - Pump P-101"},
+	}
+	for _, tt := range tests {
+		alert := testAlert()
+		tt.modify(&alert)
+		raw, err := c.render(alert, []string{"ops@plant.example"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(string(raw))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+		if subject != tt.want {
+			t.Errorf("Subject %q, want %q", subject, tt.want)
+		}
+	}
+}
+
+func TestRecipientsFor(t *testing.T) {
+	critical, warning := "critical", "warning"
+	north, south := "Station North", "Station South"
+	recipients := []EmailRecipient{
+		{Address: "all@plant.example", Enabled: true},
+		{Address: "critical@plant.example", Severity: &critical, Enabled: true},
+		{Address: "north@plant.example", Location: &north, Enabled: true},
+		{Address: "north-critical@plant.example", Severity: &critical, Location: &north, Enabled: true},
+		{Address: "south@plant.example", Location: &south, Enabled: true},
+		{Address: "warning@plant.example", Severity: &warning, Enabled: true},
+		{Address: "disabled@plant.example", Enabled: false},
+		// The same address subscribed twice is mailed once.
+		{Address: "all@plant.example", Severity: &critical, Enabled: true},
+	}
+
+	tests := []struct {
+		severity, location string
+		want               []string
+	}{
+		{"critical", "Station North", []string{"all@plant.example", "critical@plant.example", "north@plant.example", "north-critical@plant.example"}},
+		{"critical", "Station South", []string{"all@plant.example", "critical@plant.example", "south@plant.example"}},
+		{"warning", "Station North", []string{"all@plant.example", "north@plant.example", "warning@plant.example"}},
+		{"info", "", []string{"all@plant.example"}},
+	}
+	for _, tt := range tests {
+		alert := testAlert()
+		alert.Severity, alert.Location = tt.severity, tt.location
+		got := recipientsFor(recipients, alert)
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s at %q: recipients %v, want %v", tt.severity, tt.location, got, tt.want)
+		}
+	}
+
+	if got := recipientsFor([]EmailRecipient{{Address: "disabled@plant.example"}}, testAlert()); len(got) != 0 {
+		t.Errorf("disabled recipient selected: %v", got)
+	}
+}
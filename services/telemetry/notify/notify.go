@@ -0,0 +1,229 @@
+package notify
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"telemetry/config"
+)
+
+const (
+	EventTriggered = "triggered"
+	EventResolved  = "resolved"
+	EventEscalated = "escalated"
+	// EventSeverityRaised is sent when a higher tier of a rule family takes
+	// over an open alert.
+	EventSeverityRaised = "severity_raised"
+)
+
+// Alert is everything a channel needs to describe an alert event to a person.
+type Alert struct {
+	ID          uuid.UUID `json:"id"`
+	Event       string    `json:"event"`
+	MachineID   uuid.UUID `json:"machine_id"`
+	MachineName string    `json:"machine_name"`
+	MachineType string    `json:"machine_type"`
+	Location    string    `json:"location"`
+	RuleID      uuid.UUID `json:"rule_id"`
+	RuleName    string    `json:"rule_name"`
+	MetricName  string    `json:"metric_name"`
+	Severity    string    `json:"severity"`
+	// PreviousSeverity is set for EventSeverityRaised.
+	PreviousSeverity string             `json:"previous_severity,omitempty"`
+	Message          string             `json:"message"`
+	Value            float64            `json:"value"`
+	Threshold        *float64           `json:"threshold,omitempty"`
+	Expression       string             `json:"expression,omitempty"`
+	Values           map[string]float64 `json:"values,omitempty"`
+	EscalationLevel  int                `json:"escalation_level,omitempty"`
+	Time             time.Time          `json:"time"`
+}
+
+// Channel delivers alert events to one destination.
+type Channel interface {
+	// Name identifies the channel type in the delivery log, e.g. "slack".
+	Name() string
+	// Target identifies the destination in the delivery log without secrets.
+	Target() string
+	Send(ctx context.Context, alert Alert) error
+}
+
+// recipientLister is implemented by channels whose destinations depend on
+// the alert, so the delivery log can name who was actually notified.
+type recipientLister interface {
+	Recipients(ctx context.Context, alert Alert) ([]string, error)
+}
+
+// filter is implemented by channels that only want some alerts.
+type filter interface {
+	Accepts(alert Alert) bool
+}
+
+// retrier is implemented by channels with their own retry budget.
+type retrier interface {
+	RetryPolicy() RetryPolicy
+}
+
+// deadLetterer is implemented by channels that keep events which exhausted
+// their retries for later replay.
+type deadLetterer interface {
+	DeadLetter(ctx context.Context, pool *pgxpool.Pool, alert Alert, attempts int, cause error) error
+}
+
+type Dispatcher struct {
+	db         *pgxpool.Pool
+	channels   []Channel
+	retry      RetryPolicy
+	grafanaURL string
+}
+
+func NewDispatcher(pool *pgxpool.Pool, cfg *config.Config) *Dispatcher {
+	d := &Dispatcher{db: pool, retry: DefaultRetryPolicy, grafanaURL: cfg.GrafanaURL}
+	if cfg.SlackWebhook != "" {
+		d.channels = append(d.channels, NewSlackChannel(cfg.SlackWebhook, cfg.GrafanaURL))
+	}
+	if cfg.SMTPHost != "" {
+		d.channels = append(d.channels, NewEmailChannel(pool, cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPUser, cfg.SMTPPassword, cfg.SMTPFrom, cfg.GrafanaURL))
+	}
+	return d
+}
+
+// Dispatch delivers the alert on every configured channel, retrying
+// transient failures, and records each outcome in notification_deliveries.
+// Routes and webhook channels are read from the database on each dispatch so
+// changes made through the API apply without a restart.
+func (d *Dispatcher) Dispatch(ctx context.Context, alert Alert) {
+	for _, ch := range d.route(ctx, alert, d.available(ctx)) {
+		if f, ok := ch.(filter); ok && !f.Accepts(alert) {
+			continue
+		}
+		d.deliver(ctx, ch, alert)
+	}
+}
+
+// available returns the configured channels plus the enabled webhooks.
+func (d *Dispatcher) available(ctx context.Context) []Channel {
+	channels := append([]Channel(nil), d.channels...)
+
+	configs, err := ListWebhooks(ctx, d.db, true)
+	if err != nil {
+		log.Printf("Failed to load webhook channels: %v", err)
+		return channels
+	}
+	for _, cfg := range configs {
+		ch, err := NewWebhookChannel(cfg, d.grafanaURL)
+		if err != nil {
+			log.Printf("Skipping webhook %s: %v", cfg.Name, err)
+			continue
+		}
+		channels = append(channels, ch)
+	}
+	return channels
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, ch Channel, alert Alert) {
+	delivery, ok := d.attempt(ctx, ch, alert)
+	if !ok {
+		return
+	}
+
+	_, err := d.db.Exec(context.Background(),
+		`INSERT INTO notification_deliveries (alert_id, channel, target, event, status, attempts, error, started_at, completed_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NOW())`,
+		delivery.AlertID, delivery.Channel, delivery.Target, delivery.Event, delivery.Status, delivery.Attempts, delivery.Error, delivery.StartedAt,
+	)
+	if err != nil {
+		log.Printf("Failed to record notification delivery: %v", err)
+	}
+}
+
+// attempt sends the alert on ch, retrying transient failures, and returns
+// the outcome as a delivery log row. It returns false when the channel has
+// no recipients for the alert.
+func (d *Dispatcher) attempt(ctx context.Context, ch Channel, alert Alert) (Delivery, bool) {
+	delivery := Delivery{
+		AlertID:   alert.ID,
+		Channel:   ch.Name(),
+		Target:    ch.Target(),
+		Event:     alert.Event,
+		StartedAt: time.Now(),
+	}
+
+	var err error
+	if rl, ok := ch.(recipientLister); ok {
+		var recipients []string
+		recipients, err = rl.Recipients(ctx, alert)
+		if err == nil && len(recipients) == 0 {
+			return delivery, false
+		}
+		delivery.Target = strings.Join(recipients, ",")
+	}
+	if err == nil {
+		policy := d.retry
+		if r, ok := ch.(retrier); ok {
+			policy = r.RetryPolicy()
+		}
+		delivery.Attempts, err = policy.Do(ctx, func() error {
+			return ch.Send(ctx, alert)
+		})
+	}
+
+	delivery.Status = "delivered"
+	if err != nil {
+		delivery.Status = "failed"
+		msg := err.Error()
+		delivery.Error = &msg
+		log.Printf("Failed to deliver %s notification for alert %s after %d attempts: %v", ch.Name(), alert.ID, delivery.Attempts, err)
+		if dl, ok := ch.(deadLetterer); ok {
+			if dlErr := dl.DeadLetter(context.Background(), d.db, alert, delivery.Attempts, err); dlErr != nil {
+				log.Printf("Failed to dead-letter %s notification for alert %s: %v", ch.Name(), alert.ID, dlErr)
+			}
+		}
+	} else {
+		log.Printf("Delivered %s notification for alert %s (%s)", ch.Name(), alert.ID, alert.Event)
+	}
+	return delivery, true
+}
+
+// Delivery is one row of the notification delivery log.
+type Delivery struct {
+	ID          uuid.UUID `json:"id"`
+	AlertID     uuid.UUID `json:"alert_id"`
+	Channel     string    `json:"channel"`
+	Target      string    `json:"target"`
+	Event       string    `json:"event"`
+	Status      string    `json:"status"`
+	Attempts    int       `json:"attempts"`
+	Error       *string   `json:"error"`
+	StartedAt   time.Time `json:"started_at"`
+	CompletedAt time.Time `json:"completed_at"`
+}
+
+func ListDeliveries(ctx context.Context, pool *pgxpool.Pool, alertID *uuid.UUID) ([]Delivery, error) {
+	rows, err := pool.Query(ctx,
+		`SELECT id, alert_id, channel, target, event, status, attempts, error, started_at, completed_at
+		 FROM notification_deliveries
+		 WHERE $1::uuid IS NULL OR alert_id = $1
+		 ORDER BY started_at DESC LIMIT 100`,
+		alertID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []Delivery
+	for rows.Next() {
+		var d Delivery
+		if err := rows.Scan(&d.ID, &d.AlertID, &d.Channel, &d.Target, &d.Event, &d.Status, &d.Attempts, &d.Error, &d.StartedAt, &d.CompletedAt); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
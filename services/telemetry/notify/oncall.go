@@ -0,0 +1,152 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"telemetry/oncall"
+)
+
+const onCallKey = "oncall"
+
+// OnCallChannel emails whoever is on call: for the alert's location, or for a
+// named team when routed as "oncall:<team>".
+type OnCallChannel struct {
+	db    *pgxpool.Pool
+	email *EmailChannel
+	team  string
+}
+
+func (c *OnCallChannel) Name() string { return onCallKey }
+
+func (c *OnCallChannel) Target() string {
+	if c.team == "" {
+		return "location"
+	}
+	return c.team
+}
+
+func (c *OnCallChannel) Recipients(ctx context.Context, alert Alert) ([]string, error) {
+	shift, err := c.shift(ctx, alert, time.Now())
+	if errors.Is(err, oncall.ErrTeamNotFound) {
+		log.Printf("No on-call team for alert %s (%s)", alert.ID, c.describe(alert))
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []string{shift.Email}, nil
+}
+
+func (c *OnCallChannel) Send(ctx context.Context, alert Alert) error {
+	to, err := c.Recipients(ctx, alert)
+	if err != nil {
+		return err
+	}
+	return c.email.send(ctx, alert, to)
+}
+
+func (c *OnCallChannel) shift(ctx context.Context, alert Alert, at time.Time) (oncall.Shift, error) {
+	if c.team != "" {
+		return oncall.ForTeam(ctx, c.db, c.team, at)
+	}
+	return oncall.ForLocation(ctx, c.db, alert.Location, at)
+}
+
+func (c *OnCallChannel) describe(alert Alert) string {
+	if c.team != "" {
+		return "team " + c.team
+	}
+	return "location " + orDash(alert.Location)
+}
+
+// onCallChannels builds the on-call channels named by keys. They exist only
+// when routed to explicitly, so the default broadcast never pages anyone.
+func (d *Dispatcher) onCallChannels(keys map[string]bool) []Channel {
+	var channels []Channel
+	for _, key := range sortedKeys(keys) {
+		if !isOnCallKey(key) {
+			continue
+		}
+		email := d.email()
+		if email == nil {
+			log.Printf("Route targets %s but SMTP is not configured", key)
+			continue
+		}
+		channels = append(channels, &OnCallChannel{db: d.db, email: email, team: onCallTeam(key)})
+	}
+	return channels
+}
+
+func isOnCallKey(key string) bool {
+	return key == onCallKey || strings.HasPrefix(key, onCallKey+":")
+}
+
+func onCallTeam(key string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(key, onCallKey), ":")
+}
+
+// Page is one on-call notification an alert caused, or would have caused.
+// Level is the escalation level, 0 for the initial notification.
+type Page struct {
+	Stage   string        `json:"stage"`
+	Level   int           `json:"level"`
+	Channel string        `json:"channel"`
+	At      time.Time     `json:"at"`
+	Shift   *oncall.Shift `json:"shift"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// PreviewPages works out who on call would be paged for an alert that
+// triggered at the given time, under the current routes and escalation
+// policies: on trigger, and at each escalation step had it gone unacknowledged.
+func (d *Dispatcher) PreviewPages(ctx context.Context, alert Alert, triggeredAt time.Time) ([]Page, error) {
+	var pages []Page
+
+	keys, _, err := d.routeKeys(ctx, alert)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range sortedKeys(keys) {
+		if isOnCallKey(key) {
+			pages = append(pages, d.previewPage(ctx, alert, key, "triggered", 0, triggeredAt))
+		}
+	}
+
+	policies, err := ListEscalationPolicies(ctx, d.db, true)
+	if err != nil {
+		return nil, err
+	}
+	for _, policy := range policies {
+		if !policy.Matches(alert) {
+			continue
+		}
+		for _, step := range policy.Steps {
+			at := triggeredAt.Add(time.Duration(step.DelayMinutes) * time.Minute)
+			for _, key := range step.Channels {
+				if isOnCallKey(key) {
+					pages = append(pages, d.previewPage(ctx, alert, key, "escalation: "+policy.Name, step.Level, at))
+				}
+			}
+		}
+		break
+	}
+	return pages, nil
+}
+
+func (d *Dispatcher) previewPage(ctx context.Context, alert Alert, key, stage string, level int, at time.Time) Page {
+	page := Page{Stage: stage, Level: level, Channel: key, At: at}
+	ch := &OnCallChannel{db: d.db, team: onCallTeam(key)}
+	shift, err := ch.shift(ctx, alert, at)
+	if err != nil {
+		page.Error = err.Error()
+		return page
+	}
+	page.Shift = &shift
+	return page
+}
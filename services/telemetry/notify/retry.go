@@ -0,0 +1,63 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: time.Second,
+	MaxBackoff:     30 * time.Second,
+}
+
+// permanentError marks a failure that retrying cannot fix, such as a
+// rejected payload or a revoked webhook.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// Do calls fn until it succeeds, returns a permanent error, or the policy's
+// attempts run out, doubling the wait (with jitter) between attempts.
+func (p RetryPolicy) Do(ctx context.Context, fn func() error) (int, error) {
+	backoff := p.InitialBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil {
+			return attempt, nil
+		}
+
+		var perm *permanentError
+		if errors.As(err, &perm) || attempt >= p.MaxAttempts {
+			return attempt, err
+		}
+
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		select {
+		case <-ctx.Done():
+			return attempt, ctx.Err()
+		case <-time.After(wait):
+		}
+
+		backoff *= 2
+		if backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
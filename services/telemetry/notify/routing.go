@@ -0,0 +1,389 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	ErrRouteNotFound  = errors.New("route not found")
+	ErrPolicyNotFound = errors.New("escalation policy not found")
+)
+
+// Matcher selects alerts by severity, location, machine type and rule. An
+// unset field matches any alert.
+type Matcher struct {
+	Severity    *string    `json:"severity"`
+	Location    *string    `json:"location"`
+	MachineType *string    `json:"machine_type"`
+	RuleID      *uuid.UUID `json:"rule_id"`
+}
+
+func (m Matcher) validate() error {
+	if m.Severity != nil && *m.Severity != "info" && *m.Severity != "warning" && *m.Severity != "critical" {
+		return fmt.Errorf("invalid severity: %s", *m.Severity)
+	}
+	return nil
+}
+
+func (m Matcher) Matches(alert Alert) bool {
+	return (m.Severity == nil || *m.Severity == alert.Severity) &&
+		(m.Location == nil || *m.Location == alert.Location) &&
+		(m.MachineType == nil || *m.MachineType == alert.MachineType) &&
+		(m.RuleID == nil || *m.RuleID == alert.RuleID)
+}
+
+// Route sends matching alerts to a set of channels. Routes are evaluated in
+// priority order and the first match wins unless it sets Continue.
+type Route struct {
+	ID       uuid.UUID `json:"id"`
+	Name     string    `json:"name"`
+	Priority int       `json:"priority"`
+	Matcher
+	Channels  []string  `json:"channels"`
+	Continue  bool      `json:"continue"`
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (r Route) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if len(r.Channels) == 0 {
+		return fmt.Errorf("at least one channel is required")
+	}
+	if err := validateChannelKeys(r.Channels); err != nil {
+		return err
+	}
+	return r.Matcher.validate()
+}
+
+// ChannelKey is how routes and escalation steps refer to a channel: "slack",
+// "email", "webhook:<name>" for a configured webhook, and "oncall" or
+// "oncall:<team>" for the on-call technician.
+func ChannelKey(ch Channel) string {
+	switch c := ch.(type) {
+	case *WebhookChannel:
+		return ch.Name() + ":" + ch.Target()
+	case *OnCallChannel:
+		if c.team != "" {
+			return onCallKey + ":" + c.team
+		}
+	}
+	return ch.Name()
+}
+
+// route picks the channels an alert goes to. With no routes configured, or
+// none matching, the alert goes to every channel as before.
+func (d *Dispatcher) route(ctx context.Context, alert Alert, channels []Channel) []Channel {
+	keys, matched, err := d.routeKeys(ctx, alert)
+	if err != nil {
+		log.Printf("Failed to load notification routes, sending to all channels: %v", err)
+		return channels
+	}
+	if !matched {
+		return channels
+	}
+	return append(selectChannels(channels, keys), d.onCallChannels(keys)...)
+}
+
+// routeKeys collects the channel keys of the routes matching an alert.
+func (d *Dispatcher) routeKeys(ctx context.Context, alert Alert) (map[string]bool, bool, error) {
+	routes, err := ListRoutes(ctx, d.db, true)
+	if err != nil {
+		return nil, false, err
+	}
+
+	keys := make(map[string]bool)
+	matched := false
+	for _, route := range routes {
+		if !route.Matches(alert) {
+			continue
+		}
+		matched = true
+		for _, key := range route.Channels {
+			keys[key] = true
+		}
+		if !route.Continue {
+			break
+		}
+	}
+	return keys, matched, nil
+}
+
+func sortedKeys(keys map[string]bool) []string {
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+func validateChannelKeys(keys []string) error {
+	for _, key := range keys {
+		if key == "slack" || key == "email" || key == onCallKey {
+			continue
+		}
+		if (!strings.HasPrefix(key, "webhook:") && !strings.HasPrefix(key, onCallKey+":")) || strings.HasSuffix(key, ":") {
+			return fmt.Errorf("invalid channel %q: use slack, email, webhook:<name>, oncall or oncall:<team>", key)
+		}
+	}
+	return nil
+}
+
+func selectChannels(channels []Channel, keys map[string]bool) []Channel {
+	var selected []Channel
+	for _, ch := range channels {
+		if keys[ChannelKey(ch)] {
+			selected = append(selected, ch)
+		}
+	}
+	return selected
+}
+
+func ListRoutes(ctx context.Context, pool *pgxpool.Pool, enabledOnly bool) ([]Route, error) {
+	rows, err := pool.Query(ctx,
+		`SELECT id, name, priority, severity, location, machine_type, rule_id, channels, continue_matching, enabled, created_at
+		 FROM notification_routes
+		 WHERE enabled OR NOT $1
+		 ORDER BY priority, name`,
+		enabledOnly,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var routes []Route
+	for rows.Next() {
+		var r Route
+		if err := rows.Scan(&r.ID, &r.Name, &r.Priority, &r.Severity, &r.Location, &r.MachineType, &r.RuleID, &r.Channels, &r.Continue, &r.Enabled, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		routes = append(routes, r)
+	}
+	return routes, rows.Err()
+}
+
+// SaveRoute inserts the route, or replaces it when it has an ID.
+func SaveRoute(ctx context.Context, pool *pgxpool.Pool, r Route) (uuid.UUID, error) {
+	if r.ID == uuid.Nil {
+		r.ID = uuid.New()
+	}
+	_, err := pool.Exec(ctx,
+		`INSERT INTO notification_routes (id, name, priority, severity, location, machine_type, rule_id, channels, continue_matching, enabled)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		 ON CONFLICT (id) DO UPDATE SET
+			name = EXCLUDED.name, priority = EXCLUDED.priority, severity = EXCLUDED.severity,
+			location = EXCLUDED.location, machine_type = EXCLUDED.machine_type, rule_id = EXCLUDED.rule_id,
+			channels = EXCLUDED.channels, continue_matching = EXCLUDED.continue_matching, enabled = EXCLUDED.enabled`,
+		r.ID, r.Name, r.Priority, r.Severity, r.Location, r.MachineType, r.RuleID, r.Channels, r.Continue, r.Enabled,
+	)
+	return r.ID, err
+}
+
+func DeleteRoute(ctx context.Context, pool *pgxpool.Pool, id uuid.UUID) error {
+	tag, err := pool.Exec(ctx, "DELETE FROM notification_routes WHERE id = $1", id)
+	if err == nil && tag.RowsAffected() == 0 {
+		return ErrRouteNotFound
+	}
+	return err
+}
+
+// EscalationPolicy pages further tiers while a matching alert stays
+// unacknowledged. Policies are evaluated in priority order and only the first
+// match applies.
+type EscalationPolicy struct {
+	ID       uuid.UUID `json:"id"`
+	Name     string    `json:"name"`
+	Priority int       `json:"priority"`
+	Matcher
+	Steps     []EscalationStep `json:"steps"`
+	Enabled   bool             `json:"enabled"`
+	CreatedAt time.Time        `json:"created_at"`
+}
+
+// EscalationStep fires DelayMinutes after the alert triggered, on the given
+// channels and to any extra email addresses.
+type EscalationStep struct {
+	Level        int      `json:"level"`
+	DelayMinutes int      `json:"delay_minutes"`
+	Channels     []string `json:"channels"`
+	Emails       []string `json:"emails"`
+}
+
+// Validate checks the policy and reduces each step's emails to the bare
+// address, since RCPT TO takes no display name.
+func (p *EscalationPolicy) Validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if len(p.Steps) == 0 {
+		return fmt.Errorf("at least one step is required")
+	}
+	for i, step := range p.Steps {
+		if step.Level != i+1 {
+			return fmt.Errorf("steps must be numbered 1..n in order")
+		}
+		if step.DelayMinutes < 1 {
+			return fmt.Errorf("step %d: delay_minutes must be positive", step.Level)
+		}
+		if i > 0 && step.DelayMinutes <= p.Steps[i-1].DelayMinutes {
+			return fmt.Errorf("step %d: delay_minutes must increase with each level", step.Level)
+		}
+		if len(step.Channels) == 0 && len(step.Emails) == 0 {
+			return fmt.Errorf("step %d: needs a channel or email", step.Level)
+		}
+		if err := validateChannelKeys(step.Channels); err != nil {
+			return fmt.Errorf("step %d: %w", step.Level, err)
+		}
+		for j, address := range step.Emails {
+			addr, err := mail.ParseAddress(address)
+			if err != nil {
+				return fmt.Errorf("step %d: invalid email %q", step.Level, address)
+			}
+			step.Emails[j] = addr.Address
+		}
+	}
+	return p.Matcher.validate()
+}
+
+// NextStep returns the lowest step above level that is due for an alert
+// triggered at since.
+func (p EscalationPolicy) NextStep(level int, since, now time.Time) (EscalationStep, bool) {
+	for _, step := range p.Steps {
+		if step.Level <= level {
+			continue
+		}
+		if now.Sub(since) >= time.Duration(step.DelayMinutes)*time.Minute {
+			return step, true
+		}
+		break
+	}
+	return EscalationStep{}, false
+}
+
+// Escalate delivers an escalation step: to the listed channels, ignoring
+// routes and channel filters, and by email to any listed addresses.
+func (d *Dispatcher) Escalate(ctx context.Context, alert Alert, step EscalationStep) {
+	keys := make(map[string]bool)
+	for _, key := range step.Channels {
+		keys[key] = true
+	}
+	channels := append(selectChannels(d.available(ctx), keys), d.onCallChannels(keys)...)
+
+	if len(step.Emails) > 0 {
+		if email := d.email(); email != nil {
+			channels = append(channels, email.To(step.Emails))
+		} else {
+			log.Printf("Escalation for alert %s lists email addresses but SMTP is not configured", alert.ID)
+		}
+	}
+
+	for _, ch := range channels {
+		d.deliver(ctx, ch, alert)
+	}
+}
+
+func (d *Dispatcher) email() *EmailChannel {
+	for _, ch := range d.channels {
+		if email, ok := ch.(*EmailChannel); ok {
+			return email
+		}
+	}
+	return nil
+}
+
+func ListEscalationPolicies(ctx context.Context, pool *pgxpool.Pool, enabledOnly bool) ([]EscalationPolicy, error) {
+	rows, err := pool.Query(ctx,
+		`SELECT p.id, p.name, p.priority, p.severity, p.location, p.machine_type, p.rule_id, p.enabled, p.created_at,
+		        s.level, s.delay_minutes, COALESCE(s.channels, '{}'), COALESCE(s.emails, '{}')
+		 FROM escalation_policies p
+		 JOIN escalation_steps s ON s.policy_id = p.id
+		 WHERE p.enabled OR NOT $1
+		 ORDER BY p.priority, p.name, s.level`,
+		enabledOnly,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var policies []EscalationPolicy
+	for rows.Next() {
+		var p EscalationPolicy
+		var s EscalationStep
+		if err := rows.Scan(&p.ID, &p.Name, &p.Priority, &p.Severity, &p.Location, &p.MachineType, &p.RuleID, &p.Enabled, &p.CreatedAt,
+			&s.Level, &s.DelayMinutes, &s.Channels, &s.Emails); err != nil {
+			return nil, err
+		}
+		if n := len(policies); n > 0 && policies[n-1].ID == p.ID {
+			policies[n-1].Steps = append(policies[n-1].Steps, s)
+			continue
+		}
+		p.Steps = []EscalationStep{s}
+		policies = append(policies, p)
+	}
+	return policies, rows.Err()
+}
+
+// SaveEscalationPolicy inserts the policy, or replaces it and its steps when
+// it has an ID.
+func SaveEscalationPolicy(ctx context.Context, pool *pgxpool.Pool, p EscalationPolicy) (uuid.UUID, error) {
+	if p.ID == uuid.Nil {
+		p.ID = uuid.New()
+	}
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return p.ID, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx,
+		`INSERT INTO escalation_policies (id, name, priority, severity, location, machine_type, rule_id, enabled)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		 ON CONFLICT (id) DO UPDATE SET
+			name = EXCLUDED.name, priority = EXCLUDED.priority, severity = EXCLUDED.severity,
+			location = EXCLUDED.location, machine_type = EXCLUDED.machine_type, rule_id = EXCLUDED.rule_id,
+			enabled = EXCLUDED.enabled`,
+		p.ID, p.Name, p.Priority, p.Severity, p.Location, p.MachineType, p.RuleID, p.Enabled,
+	)
+	if err != nil {
+		return p.ID, err
+	}
+
+	if _, err := tx.Exec(ctx, "DELETE FROM escalation_steps WHERE policy_id = $1", p.ID); err != nil {
+		return p.ID, err
+	}
+	for _, step := range p.Steps {
+		_, err := tx.Exec(ctx,
+			"INSERT INTO escalation_steps (policy_id, level, delay_minutes, channels, emails) VALUES ($1, $2, $3, $4, $5)",
+			p.ID, step.Level, step.DelayMinutes, step.Channels, step.Emails,
+		)
+		if err != nil {
+			return p.ID, err
+		}
+	}
+
+	return p.ID, tx.Commit(ctx)
+}
+
+func DeleteEscalationPolicy(ctx context.Context, pool *pgxpool.Pool, id uuid.UUID) error {
+	tag, err := pool.Exec(ctx, "DELETE FROM escalation_policies WHERE id = $1", id)
+	if err == nil && tag.RowsAffected() == 0 {
+		return ErrPolicyNotFound
+	}
+	return err
+}
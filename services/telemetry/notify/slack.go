@@ -0,0 +1,170 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+type SlackChannel struct {
+	webhookURL string
+	grafanaURL string
+	client     *http.Client
+}
+
+func NewSlackChannel(webhookURL, grafanaURL string) *SlackChannel {
+	return &SlackChannel{
+		webhookURL: webhookURL,
+		grafanaURL: strings.TrimRight(grafanaURL, "/"),
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (c *SlackChannel) Name() string { return "slack" }
+
+// Target returns the webhook host only; the path is the webhook secret.
+func (c *SlackChannel) Target() string {
+	u, err := url.Parse(c.webhookURL)
+	if err != nil {
+		return "slack"
+	}
+	return u.Host
+}
+
+func (c *SlackChannel) Send(ctx context.Context, alert Alert) error {
+	body, err := json.Marshal(SlackMessage(alert, c.grafanaURL))
+	if err != nil {
+		return Permanent(err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return checkResponse(resp)
+}
+
+// checkResponse treats 2xx as delivered, 429 and 5xx as retryable and any
+// other status as a permanent rejection.
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err := fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(detail)))
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return err
+	}
+	return Permanent(err)
+}
+
+// PumpDashboardURL links to the Grafana maintenance dashboard filtered to one pump.
+func PumpDashboardURL(grafanaURL string, alert Alert) string {
+	return fmt.Sprintf("%s/d/maintenance-dashboard?var-machine=%s", grafanaURL, alert.MachineID)
+}
+
+var severityEmoji = map[string]string{
+	"critical": ":red_circle:",
+	"warning":  ":large_orange_circle:",
+	"info":     ":large_blue_circle:",
+}
+
+// SlackMessage renders an alert event as a Block Kit message.
+func SlackMessage(alert Alert, grafanaURL string) map[string]interface{} {
+	pump := alert.MachineName
+	if pump == "" {
+		pump = alert.MachineID.String()
+	}
+
+	title := fmt.Sprintf("%s %s: %s", severityEmoji[alert.Severity], strings.ToUpper(alert.Severity), alert.RuleName)
+	switch alert.Event {
+	case EventResolved:
+		title = fmt.Sprintf(":white_check_mark: RESOLVED: %s", alert.RuleName)
+	case EventEscalated:
+		title = fmt.Sprintf(":rotating_light: ESCALATED (level %d): %s", alert.EscalationLevel, alert.RuleName)
+	case EventSeverityRaised:
+		title = fmt.Sprintf("%s RAISED TO %s (was %s): %s", severityEmoji[alert.Severity], strings.ToUpper(alert.Severity), alert.PreviousSeverity, alert.RuleName)
+	}
+
+	fields := []map[string]string{
+		{"type": "mrkdwn", "text": fmt.Sprintf("*Pump*\n%s", pump)},
+		{"type": "mrkdwn", "text": fmt.Sprintf("*Location*\n%s", orDash(alert.Location))},
+		{"type": "mrkdwn", "text": fmt.Sprintf("*Severity*\n%s", alert.Severity)},
+		{"type": "mrkdwn", "text": fmt.Sprintf("*Value*\n%s", formatValue(alert))},
+	}
+	if alert.Threshold != nil {
+		fields = append(fields, map[string]string{"type": "mrkdwn", "text": fmt.Sprintf("*Threshold*\n%.2f", *alert.Threshold)})
+	}
+	if alert.Expression != "" {
+		fields = append(fields, map[string]string{"type": "mrkdwn", "text": fmt.Sprintf("*Condition*\n`%s`", alert.Expression)})
+	}
+
+	return map[string]interface{}{
+		"text": fmt.Sprintf("%s on %s (%s)", title, pump, orDash(alert.Location)),
+		"blocks": []map[string]interface{}{
+			{
+				"type": "header",
+				"text": map[string]interface{}{"type": "plain_text", "text": title, "emoji": true},
+			},
+			{
+				"type":   "section",
+				"fields": fields,
+			},
+			{
+				"type": "context",
+				"elements": []map[string]string{
+					{"type": "mrkdwn", "text": fmt.Sprintf("%s · %s", alert.Message, alert.Time.UTC().Format(time.RFC1123))},
+				},
+			},
+			{
+				"type": "actions",
+				"elements": []map[string]interface{}{
+					{
+						"type": "button",
+						"text": map[string]string{"type": "plain_text", "text": "Open pump in Grafana"},
+						"url":  PumpDashboardURL(grafanaURL, alert),
+					},
+				},
+			},
+		},
+	}
+}
+
+func formatValue(alert Alert) string {
+	if len(alert.Values) <= 1 {
+		return fmt.Sprintf("%.2f", alert.Value)
+	}
+	names := make([]string, 0, len(alert.Values))
+	for name := range alert.Values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s=%.2f", name, alert.Values[name])
+	}
+	return strings.Join(parts, ", ")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
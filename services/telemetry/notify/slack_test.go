@@ -0,0 +1,364 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// testRetryPolicy retries quickly enough for tests while still backing off.
+var testRetryPolicy = RetryPolicy{MaxAttempts: 4, InitialBackoff: 20 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+
+// slackStandIn is a local stand-in for a Slack incoming webhook that answers
+// with the given statuses in turn, then 200, and keeps what it was sent.
+type slackStandIn struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	bodies   [][]byte
+	times    []time.Time
+	headers  []http.Header
+}
+
+func newSlackStandIn(t *testing.T, statuses ...int) *slackStandIn {
+	s := &slackStandIn{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		s.mu.Lock()
+		n := len(s.bodies)
+		s.bodies = append(s.bodies, body)
+		s.times = append(s.times, time.Now())
+		s.headers = append(s.headers, r.Header.Clone())
+		status := http.StatusOK
+		if n < len(s.statuses) {
+			status = s.statuses[n]
+		}
+		s.mu.Unlock()
+
+		if r.Method != http.MethodPost || r.URL.Path != "/services/T000/B000/secret" {
+			status = http.StatusNotFound
+		}
+		w.WriteHeader(status)
+		switch {
+		case status == http.StatusOK:
+			io.WriteString(w, "ok")
+		case status == http.StatusTooManyRequests:
+			io.WriteString(w, "rate_limited")
+		case status >= 500:
+			io.WriteString(w, "service_unavailable")
+		default:
+			io.WriteString(w, "invalid_payload")
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *slackStandIn) channel() *SlackChannel {
+	return NewSlackChannel(s.URL+"/services/T000/B000/secret", "http://grafana.plant.example/")
+}
+
+func (s *slackStandIn) requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.bodies)
+}
+
+func testAlert() Alert {
+	threshold := 3.0
+	return Alert{
+		ID:          uuid.MustParse("7a8e0f0e-8f53-4b4e-9d7c-3a0c2f1d9b11"),
+		Event:       EventTriggered,
+		MachineID:   uuid.MustParse("0b6f7c1a-2c4d-4e8f-9a1b-5c6d7e8f9a0b"),
+		MachineName: "Pump P-101",
+		Location:    "Station North",
+		RuleName:    "Low discharge pressure",
+		MetricName:  "pressure",
+		Severity:    "critical",
+		Message:     "Low discharge pressure - value: 2.41 (threshold: 3.00)",
+		Value:       2.41,
+		Threshold:   &threshold,
+		Time:        time.Date(2026, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+}
+
+type slackPayload struct {
+	Text   string `json:"text"`
+	Blocks []struct {
+		Type string `json:"type"`
+		Text struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"text"`
+		Fields []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"fields"`
+		Elements []struct {
+			Type string          `json:"type"`
+			Text json.RawMessage `json:"text"`
+			URL  string          `json:"url"`
+		} `json:"elements"`
+	} `json:"blocks"`
+}
+
+func decodeSlack(t *testing.T, body []byte) slackPayload {
+	t.Helper()
+	var p slackPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		t.Fatalf("payload is not JSON: %v\n%s", err, body)
+	}
+	if len(p.Blocks) != 4 {
+		t.Fatalf("payload has %d blocks, want header, section, context and actions:\n%s", len(p.Blocks), body)
+	}
+	for i, want := range []string{"header", "section", "context", "actions"} {
+		if p.Blocks[i].Type != want {
+			t.Fatalf("block %d is %q, want %q", i, p.Blocks[i].Type, want)
+		}
+	}
+	return p
+}
+
+func (p slackPayload) fields() []string {
+	var texts []string
+	for _, f := range p.Blocks[1].Fields {
+		texts = append(texts, f.Text)
+	}
+	return texts
+}
+
+func TestSlackSendBlockKitPayload(t *testing.T) {
+	slack := newSlackStandIn(t)
+	alert := testAlert()
+
+	if err := slack.channel().Send(context.Background(), alert); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if slack.requests() != 1 {
+		t.Fatalf("stand-in got %d requests, want 1", slack.requests())
+	}
+	if ct := slack.headers[0].Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type %q, want application/json", ct)
+	}
+
+	p := decodeSlack(t, slack.bodies[0])
+	if want := ":red_circle: CRITICAL: Low discharge pressure"; p.Blocks[0].Text.Text != want {
+		t.Errorf("header %q, want %q", p.Blocks[0].Text.Text, want)
+	}
+	if p.Blocks[0].Text.Type != "plain_text" {
+		t.Errorf("header text type %q, want plain_text", p.Blocks[0].Text.Type)
+	}
+	if want := ":red_circle: CRITICAL: Low discharge pressure on Pump P-101 (Station North)"; p.Text != want {
+		t.Errorf("fallback text %q, want %q", p.Text, want)
+	}
+
+	wantFields := []string{
+		"*Pump*\nPump P-101",
+		"*Location*\nStation North",
+		"*Severity*\ncritical",
+		"*Value*\n2.41",
+		"*Threshold*\n3.00",
+	}
+	if got := p.fields(); strings.Join(got, "|") != strings.Join(wantFields, "|") {
+		t.Errorf("fields %q, want %q", got, wantFields)
+	}
+	for _, f := range p.Blocks[1].Fields {
+		if f.Type != "mrkdwn" {
+			t.Errorf("field %q has type %q, want mrkdwn", f.Text, f.Type)
+		}
+	}
+
+	var footer string
+	json.Unmarshal(p.Blocks[2].Elements[0].Text, &footer)
+	if want := "Low discharge pressure - value: 2.41 (threshold: 3.00) · Wed, 04 Mar 2026 05:06:07 UTC"; footer != want {
+		t.Errorf("context %q, want %q", footer, want)
+	}
+
+	button := p.Blocks[3].Elements[0]
+	if button.Type != "button" {
+		t.Errorf("action is %q, want button", button.Type)
+	}
+	if want := "http://grafana.plant.example/d/maintenance-dashboard?var-machine=0b6f7c1a-2c4d-4e8f-9a1b-5c6d7e8f9a0b"; button.URL != want {
+		t.Errorf("Grafana link %q, want %q", button.URL, want)
+	}
+}
+
+func TestSlackMessageVariants(t *testing.T) {
+	tests := []struct {
+		name       string
+		modify     func(*Alert)
+		wantHeader string
+		wantFields []string
+	}{
+		{
+			name:       "resolved",
+			modify:     func(a *Alert) { a.Event = EventResolved },
+			wantHeader: ":white_check_mark: RESOLVED: Low discharge pressure",
+		},
+		{
+			name:       "escalated",
+			modify:     func(a *Alert) { a.Event, a.EscalationLevel = EventEscalated, 2 },
+			wantHeader: ":rotating_light: ESCALATED (level 2): Low discharge pressure",
+		},
+		{
+			name:       "severity raised",
+			modify:     func(a *Alert) { a.Event, a.PreviousSeverity = EventSeverityRaised, "warning" },
+			wantHeader: ":red_circle: RAISED TO CRITICAL (was warning): Low discharge pressure",
+		},
+		{
+			name: "unnamed pump without location",
+			modify: func(a *Alert) {
+				a.MachineName, a.Location, a.Severity = "", "", "warning"
+			},
+			wantHeader: ":large_orange_circle: WARNING: Low discharge pressure",
+			wantFields: []string{
+				"*Pump*\n0b6f7c1a-2c4d-4e8f-9a1b-5c6d7e8f9a0b",
+				"*Location*\n-",
+				"*Severity*\nwarning",
+				"*Value*\n2.41",
+				"*Threshold*\n3.00",
+			},
+		},
+		{
+			name: "expression",
+			modify: func(a *Alert) {
+				a.Threshold = nil
+				a.Expression = "pressure < 3 && vibration > 4"
+				a.Values = map[string]float64{"vibration": 4.5, "pressure": 2.41}
+			},
+			wantHeader: ":red_circle: CRITICAL: Low discharge pressure",
+			wantFields: []string{
+				"*Pump*\nPump P-101",
+				"*Location*\nStation North",
+				"*Severity*\ncritical",
+				"*Value*\npressure=2.41, vibration=4.50",
+				"*Condition*\n`pressure < 3 && vibration > 4`",
+			},
+		},
+	}
+	for _, tt := range tests {
+		alert := testAlert()
+		tt.modify(&alert)
+		body, err := json.Marshal(SlackMessage(alert, "http://grafana.plant.example"))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		p := decodeSlack(t, body)
+		if p.Blocks[0].Text.Text != tt.wantHeader {
+			t.Errorf("%s: header %q, want %q", tt.name, p.Blocks[0].Text.Text, tt.wantHeader)
+		}
+		if tt.wantFields != nil && strings.Join(p.fields(), "|") != strings.Join(tt.wantFields, "|") {
+			t.Errorf("%s: fields %q, want %q", tt.name, p.fields(), tt.wantFields)
+		}
+	}
+}
+
+func TestSlackTargetHidesWebhookSecret(t *testing.T) {
+	ch := NewSlackChannel("https://hooks.slack.com/services/T000/B000/secret", "")
+	if got := ch.Target(); got != "hooks.slack.com" {
+		t.Errorf("Target() = %q, want hooks.slack.com", got)
+	}
+}
+
+func TestSlackDeliveryRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantStatus   string
+		wantAttempts int
+		wantError    string
+	}{
+		{"delivered", nil, "delivered", 1, ""},
+		{"server errors then delivered", []int{500, 503}, "delivered", 3, ""},
+		{"rate limited then delivered", []int{429}, "delivered", 2, ""},
+		{"rejected payload", []int{400}, "failed", 1, "status 400: invalid_payload"},
+		{"revoked webhook", []int{503, 404}, "failed", 2, "status 404: invalid_payload"},
+		{"retries exhausted", []int{500, 502, 503, 429}, "failed", 4, "status 429: rate_limited"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slack := newSlackStandIn(t, tt.statuses...)
+			d := &Dispatcher{retry: testRetryPolicy}
+			alert := testAlert()
+
+			delivery, ok := d.attempt(context.Background(), slack.channel(), alert)
+			if !ok {
+				t.Fatal("attempt skipped the delivery")
+			}
+			if slack.requests() != tt.wantAttempts {
+				t.Errorf("stand-in got %d requests, want %d", slack.requests(), tt.wantAttempts)
+			}
+
+			// The delivery log row.
+			if delivery.AlertID != alert.ID || delivery.Channel != "slack" || delivery.Event != EventTriggered {
+				t.Errorf("delivery for alert %s channel %q event %q", delivery.AlertID, delivery.Channel, delivery.Event)
+			}
+			if want := strings.TrimPrefix(slack.URL, "http://"); delivery.Target != want {
+				t.Errorf("delivery target %q, want %q", delivery.Target, want)
+			}
+			if delivery.Status != tt.wantStatus || delivery.Attempts != tt.wantAttempts {
+				t.Errorf("delivery %s after %d attempts, want %s after %d", delivery.Status, delivery.Attempts, tt.wantStatus, tt.wantAttempts)
+			}
+			switch {
+			case tt.wantError == "" && delivery.Error != nil:
+				t.Errorf("delivery error %q, want none", *delivery.Error)
+			case tt.wantError != "" && (delivery.Error == nil || *delivery.Error != tt.wantError):
+				t.Errorf("delivery error %v, want %q", delivery.Error, tt.wantError)
+			}
+			if delivery.StartedAt.IsZero() || delivery.StartedAt.After(slack.times[0]) {
+				t.Errorf("delivery started at %v, after the first request at %v", delivery.StartedAt, slack.times[0])
+			}
+
+			// Every attempt sends the same message.
+			for i, body := range slack.bodies[1:] {
+				if string(body) != string(slack.bodies[0]) {
+					t.Errorf("attempt %d sent a different payload", i+2)
+				}
+			}
+		})
+	}
+}
+
+func TestSlackRetryBackoff(t *testing.T) {
+	slack := newSlackStandIn(t, 503, 503, 503)
+	d := &Dispatcher{retry: testRetryPolicy}
+
+	delivery, _ := d.attempt(context.Background(), slack.channel(), testAlert())
+	if delivery.Status != "delivered" || delivery.Attempts != 4 {
+		t.Fatalf("delivery %s after %d attempts, want delivered after 4", delivery.Status, delivery.Attempts)
+	}
+
+	// Waits are jittered between half and all of a backoff that doubles
+	// from 20ms and is capped at 50ms.
+	minWaits := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 25 * time.Millisecond}
+	for i, min := range minWaits {
+		if gap := slack.times[i+1].Sub(slack.times[i]); gap < min {
+			t.Errorf("wait before attempt %d was %v, want at least %v", i+2, gap, min)
+		}
+	}
+}
+
+func TestRetryStopsWhenCancelled(t *testing.T) {
+	slack := newSlackStandIn(t, 503, 503, 503)
+	d := &Dispatcher{retry: RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Hour, MaxBackoff: time.Hour}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	delivery, _ := d.attempt(ctx, slack.channel(), testAlert())
+	if delivery.Status != "failed" || delivery.Attempts != 1 || slack.requests() != 1 {
+		t.Errorf("delivery %s after %d attempts (%d requests), want failed after 1", delivery.Status, delivery.Attempts, slack.requests())
+	}
+	if delivery.Error == nil || *delivery.Error != context.DeadlineExceeded.Error() {
+		t.Errorf("delivery error %v, want %v", delivery.Error, context.DeadlineExceeded)
+	}
+}
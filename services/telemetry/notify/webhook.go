@@ -0,0 +1,344 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	ErrWebhookNotFound    = errors.New("webhook not found")
+	ErrDeadLetterNotFound = errors.New("dead letter not found")
+)
+
+// WebhookConfig is an outbound HTTP endpoint alerts are pushed to as JSON.
+type WebhookConfig struct {
+	ID              uuid.UUID         `json:"id"`
+	Name            string            `json:"name"`
+	URL             string            `json:"url"`
+	Secret          string            `json:"secret,omitempty"`
+	HasSecret       bool              `json:"has_secret"`
+	PayloadTemplate string            `json:"payload_template,omitempty"`
+	Severities      []string          `json:"severities,omitempty"`
+	Headers         map[string]string `json:"headers,omitempty"`
+	MaxAttempts     int               `json:"max_attempts"`
+	Enabled         bool              `json:"enabled"`
+	CreatedAt       time.Time         `json:"created_at"`
+}
+
+var payloadFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"upper": strings.ToUpper,
+	"rfc3339": func(t time.Time) string {
+		return t.UTC().Format(time.RFC3339)
+	},
+}
+
+// Validate checks the URL and that the payload template renders valid JSON.
+func (c WebhookConfig) Validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an absolute http(s) URL")
+	}
+	if c.MaxAttempts < 1 || c.MaxAttempts > 20 {
+		return fmt.Errorf("max_attempts must be between 1 and 20")
+	}
+
+	ch, err := NewWebhookChannel(c, "")
+	if err != nil {
+		return err
+	}
+	th := 80.0
+	sample := Alert{
+		ID: uuid.New(), Event: EventTriggered, MachineID: uuid.New(), MachineName: "PUMP-001",
+		Location: "Building A", RuleName: "Sample Rule", MetricName: "temperature", Severity: "critical",
+		Message: "Sample", Value: 85, Threshold: &th, Time: time.Now(),
+	}
+	if _, err := ch.Render(sample); err != nil {
+		return fmt.Errorf("invalid payload_template: %w", err)
+	}
+	return nil
+}
+
+type WebhookChannel struct {
+	cfg        WebhookConfig
+	tmpl       *template.Template
+	grafanaURL string
+	client     *http.Client
+}
+
+func NewWebhookChannel(cfg WebhookConfig, grafanaURL string) (*WebhookChannel, error) {
+	ch := &WebhookChannel{
+		cfg:        cfg,
+		grafanaURL: strings.TrimRight(grafanaURL, "/"),
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+	if cfg.PayloadTemplate != "" {
+		tmpl, err := template.New(cfg.Name).Funcs(payloadFuncs).Parse(cfg.PayloadTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid payload_template: %w", err)
+		}
+		ch.tmpl = tmpl
+	}
+	return ch, nil
+}
+
+func (c *WebhookChannel) Name() string { return "webhook" }
+
+func (c *WebhookChannel) Target() string { return c.cfg.Name }
+
+func (c *WebhookChannel) RetryPolicy() RetryPolicy {
+	policy := DefaultRetryPolicy
+	policy.MaxAttempts = c.cfg.MaxAttempts
+	return policy
+}
+
+// Accepts applies the channel's severity filter. Resolution events pass the
+// same filter as the alert they resolve.
+func (c *WebhookChannel) Accepts(alert Alert) bool {
+	if len(c.cfg.Severities) == 0 {
+		return true
+	}
+	for _, severity := range c.cfg.Severities {
+		if severity == alert.Severity {
+			return true
+		}
+	}
+	return false
+}
+
+// Render produces the request body: the payload template if one is set,
+// otherwise the alert itself with a dashboard link.
+func (c *WebhookChannel) Render(alert Alert) ([]byte, error) {
+	data := struct {
+		Alert
+		DashboardURL string `json:"dashboard_url"`
+	}{alert, PumpDashboardURL(c.grafanaURL, alert)}
+
+	if c.tmpl == nil {
+		return json.Marshal(data)
+	}
+
+	var buf bytes.Buffer
+	if err := c.tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("template did not produce valid JSON")
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *WebhookChannel) Send(ctx context.Context, alert Alert) error {
+	body, err := c.Render(alert)
+	if err != nil {
+		return Permanent(err)
+	}
+	return c.Post(ctx, alert.Event, body)
+}
+
+// Post sends a rendered payload. When the channel has a secret the request
+// carries X-Telemetry-Signature: sha256=HMAC(secret, timestamp + "." + body)
+// so receivers can verify origin and reject replays.
+func (c *WebhookChannel) Post(ctx context.Context, event string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return Permanent(err)
+	}
+	for k, v := range c.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Telemetry-Event", event)
+	req.Header.Set("X-Telemetry-Delivery", uuid.New().String())
+
+	if c.cfg.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Telemetry-Timestamp", timestamp)
+		req.Header.Set("X-Telemetry-Signature", "sha256="+Sign(c.cfg.Secret, timestamp, body))
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return checkResponse(resp)
+}
+
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// DeadLetter stores an event that exhausted its retries so it can be
+// inspected and replayed later.
+func (c *WebhookChannel) DeadLetter(ctx context.Context, pool *pgxpool.Pool, alert Alert, attempts int, cause error) error {
+	body, err := c.Render(alert)
+	if err != nil {
+		body, _ = json.Marshal(alert)
+	}
+	_, err = pool.Exec(ctx,
+		`INSERT INTO webhook_dead_letters (channel_id, alert_id, event, payload, attempts, last_error)
+		 VALUES ($1, $2, $3, $4, $5, $6)`,
+		c.cfg.ID, alert.ID, alert.Event, string(body), attempts, cause.Error(),
+	)
+	return err
+}
+
+func ListWebhooks(ctx context.Context, pool *pgxpool.Pool, enabledOnly bool) ([]WebhookConfig, error) {
+	rows, err := pool.Query(ctx,
+		`SELECT id, name, url, COALESCE(secret, ''), COALESCE(payload_template, ''), COALESCE(severities, '{}'),
+		        COALESCE(headers, '{}'), max_attempts, enabled, created_at
+		 FROM webhook_channels
+		 WHERE enabled OR NOT $1
+		 ORDER BY name`,
+		enabledOnly,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var webhooks []WebhookConfig
+	for rows.Next() {
+		var c WebhookConfig
+		if err := rows.Scan(&c.ID, &c.Name, &c.URL, &c.Secret, &c.PayloadTemplate, &c.Severities, &c.Headers, &c.MaxAttempts, &c.Enabled, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		c.HasSecret = c.Secret != ""
+		webhooks = append(webhooks, c)
+	}
+	return webhooks, rows.Err()
+}
+
+func CreateWebhook(ctx context.Context, pool *pgxpool.Pool, c WebhookConfig) (uuid.UUID, error) {
+	var id uuid.UUID
+	err := pool.QueryRow(ctx,
+		`INSERT INTO webhook_channels (name, url, secret, payload_template, severities, headers, max_attempts, enabled)
+		 VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), $5, $6, $7, $8) RETURNING id`,
+		c.Name, c.URL, c.Secret, c.PayloadTemplate, c.Severities, c.Headers, c.MaxAttempts, c.Enabled,
+	).Scan(&id)
+	return id, err
+}
+
+// UpdateWebhook replaces a webhook's configuration, secret included.
+func UpdateWebhook(ctx context.Context, pool *pgxpool.Pool, c WebhookConfig) error {
+	tag, err := pool.Exec(ctx,
+		`UPDATE webhook_channels SET
+			name = $2, url = $3, secret = NULLIF($4, ''), payload_template = NULLIF($5, ''), severities = $6,
+			headers = $7, max_attempts = $8, enabled = $9
+		 WHERE id = $1`,
+		c.ID, c.Name, c.URL, c.Secret, c.PayloadTemplate, c.Severities, c.Headers, c.MaxAttempts, c.Enabled,
+	)
+	if err == nil && tag.RowsAffected() == 0 {
+		return ErrWebhookNotFound
+	}
+	return err
+}
+
+func DeleteWebhook(ctx context.Context, pool *pgxpool.Pool, id uuid.UUID) error {
+	tag, err := pool.Exec(ctx, "DELETE FROM webhook_channels WHERE id = $1", id)
+	if err == nil && tag.RowsAffected() == 0 {
+		return ErrWebhookNotFound
+	}
+	return err
+}
+
+// DeadLetter is a webhook event that failed every delivery attempt.
+type DeadLetter struct {
+	ID         uuid.UUID  `json:"id"`
+	ChannelID  uuid.UUID  `json:"channel_id"`
+	AlertID    uuid.UUID  `json:"alert_id"`
+	Event      string     `json:"event"`
+	Payload    string     `json:"payload"`
+	Attempts   int        `json:"attempts"`
+	LastError  string     `json:"last_error"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ReplayedAt *time.Time `json:"replayed_at"`
+}
+
+func ListDeadLetters(ctx context.Context, pool *pgxpool.Pool, includeReplayed bool) ([]DeadLetter, error) {
+	rows, err := pool.Query(ctx,
+		`SELECT id, channel_id, alert_id, event, payload, attempts, last_error, created_at, replayed_at
+		 FROM webhook_dead_letters
+		 WHERE replayed_at IS NULL OR $1
+		 ORDER BY created_at DESC LIMIT 100`,
+		includeReplayed,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var letters []DeadLetter
+	for rows.Next() {
+		var d DeadLetter
+		if err := rows.Scan(&d.ID, &d.ChannelID, &d.AlertID, &d.Event, &d.Payload, &d.Attempts, &d.LastError, &d.CreatedAt, &d.ReplayedAt); err != nil {
+			return nil, err
+		}
+		letters = append(letters, d)
+	}
+	return letters, rows.Err()
+}
+
+// ReplayDeadLetter re-sends a dead-lettered payload once, freshly signed, and
+// marks it replayed on success.
+func ReplayDeadLetter(ctx context.Context, pool *pgxpool.Pool, id uuid.UUID) error {
+	var d DeadLetter
+	var cfg WebhookConfig
+	err := pool.QueryRow(ctx,
+		`SELECT d.event, d.payload, c.id, c.name, c.url, COALESCE(c.secret, ''), COALESCE(c.headers, '{}'), c.max_attempts
+		 FROM webhook_dead_letters d
+		 JOIN webhook_channels c ON c.id = d.channel_id
+		 WHERE d.id = $1`,
+		id,
+	).Scan(&d.Event, &d.Payload, &cfg.ID, &cfg.Name, &cfg.URL, &cfg.Secret, &cfg.Headers, &cfg.MaxAttempts)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrDeadLetterNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	// The stored payload is already rendered, so the channel's template is
+	// not needed to replay it.
+	ch, err := NewWebhookChannel(cfg, "")
+	if err != nil {
+		return err
+	}
+	if err := ch.Post(ctx, d.Event, []byte(d.Payload)); err != nil {
+		pool.Exec(ctx,
+			"UPDATE webhook_dead_letters SET attempts = attempts + 1, last_error = $2 WHERE id = $1",
+			id, err.Error())
+		return err
+	}
+
+	_, err = pool.Exec(ctx, "UPDATE webhook_dead_letters SET replayed_at = NOW() WHERE id = $1", id)
+	return err
+}
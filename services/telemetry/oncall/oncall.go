@@ -0,0 +1,337 @@
+package oncall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	ErrTeamNotFound     = errors.New("on-call team not found")
+	ErrOverrideNotFound = errors.New("on-call override not found")
+)
+
+// Team is a location's maintenance crew. Members take ShiftHours-long turns
+// in position order, starting with the first member at RotationStart.
+type Team struct {
+	ID            uuid.UUID `json:"id"`
+	Name          string    `json:"name"`
+	Location      string    `json:"location"`
+	RotationStart time.Time `json:"rotation_start"`
+	ShiftHours    int       `json:"shift_hours"`
+	Members       []Member  `json:"members"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type Member struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+	Phone string `json:"phone,omitempty"`
+}
+
+// Override puts someone on call for a team in place of the rotation, e.g. to
+// cover a sick day or a shift swap.
+type Override struct {
+	ID        uuid.UUID `json:"id"`
+	TeamID    uuid.UUID `json:"team_id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	StartsAt  time.Time `json:"starts_at"`
+	EndsAt    time.Time `json:"ends_at"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Shift is who is on call for a team over a period.
+type Shift struct {
+	TeamID   uuid.UUID `json:"team_id"`
+	Team     string    `json:"team"`
+	Location string    `json:"location"`
+	Member
+	StartsAt time.Time `json:"starts_at"`
+	EndsAt   time.Time `json:"ends_at"`
+	Override bool      `json:"override"`
+}
+
+// Validate checks the team and reduces member emails to the bare address, which
+// is what paging sends to.
+func (t *Team) Validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if t.ShiftHours < 1 {
+		return fmt.Errorf("shift_hours must be positive")
+	}
+	if t.RotationStart.IsZero() {
+		return fmt.Errorf("rotation_start is required")
+	}
+	if len(t.Members) == 0 {
+		return fmt.Errorf("at least one member is required")
+	}
+	for i, m := range t.Members {
+		if m.Name == "" {
+			return fmt.Errorf("member name is required")
+		}
+		addr, err := mail.ParseAddress(m.Email)
+		if err != nil {
+			return fmt.Errorf("member %s: invalid email", m.Name)
+		}
+		t.Members[i].Email = addr.Address
+	}
+	return nil
+}
+
+func (o *Override) Validate() error {
+	if o.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	addr, err := mail.ParseAddress(o.Email)
+	if err != nil {
+		return fmt.Errorf("invalid email")
+	}
+	o.Email = addr.Address
+	if !o.EndsAt.After(o.StartsAt) {
+		return fmt.Errorf("ends_at must be after starts_at")
+	}
+	return nil
+}
+
+// Scheduled returns the rotation's shift covering at, ignoring overrides.
+func (t Team) Scheduled(at time.Time) Shift {
+	shift := time.Duration(t.ShiftHours) * time.Hour
+	n := int64(at.Sub(t.RotationStart) / shift)
+	if at.Before(t.RotationStart) && at.Sub(t.RotationStart)%shift != 0 {
+		n--
+	}
+
+	idx := n % int64(len(t.Members))
+	if idx < 0 {
+		idx += int64(len(t.Members))
+	}
+	start := t.RotationStart.Add(time.Duration(n) * shift)
+
+	return Shift{
+		TeamID:   t.ID,
+		Team:     t.Name,
+		Location: t.Location,
+		Member:   t.Members[idx],
+		StartsAt: start,
+		EndsAt:   start.Add(shift),
+	}
+}
+
+// At returns who is on call at the given time: the most recently created
+// override covering it, otherwise the rotation.
+func (t Team) At(at time.Time, overrides []Override) Shift {
+	var chosen *Override
+	for i, o := range overrides {
+		if o.TeamID != t.ID || at.Before(o.StartsAt) || !at.Before(o.EndsAt) {
+			continue
+		}
+		if chosen == nil || o.CreatedAt.After(chosen.CreatedAt) {
+			chosen = &overrides[i]
+		}
+	}
+	if chosen == nil {
+		return t.Scheduled(at)
+	}
+
+	return Shift{
+		TeamID:   t.ID,
+		Team:     t.Name,
+		Location: t.Location,
+		Member:   Member{Name: chosen.Name, Email: chosen.Email},
+		StartsAt: chosen.StartsAt,
+		EndsAt:   chosen.EndsAt,
+		Override: true,
+	}
+}
+
+// ForTeam returns who was on call for the named team at the given time.
+func ForTeam(ctx context.Context, pool *pgxpool.Pool, name string, at time.Time) (Shift, error) {
+	return resolve(ctx, pool, "t.name = $1", name, at)
+}
+
+// ForLocation returns who was on call for the team covering a location at the
+// given time.
+func ForLocation(ctx context.Context, pool *pgxpool.Pool, location string, at time.Time) (Shift, error) {
+	return resolve(ctx, pool, "t.location = $1", location, at)
+}
+
+func resolve(ctx context.Context, pool *pgxpool.Pool, where string, arg string, at time.Time) (Shift, error) {
+	teams, err := listTeams(ctx, pool, where, arg)
+	if err != nil {
+		return Shift{}, err
+	}
+	if len(teams) == 0 {
+		return Shift{}, ErrTeamNotFound
+	}
+
+	team := teams[0]
+	overrides, err := ListOverrides(ctx, pool, &team.ID, at, at)
+	if err != nil {
+		return Shift{}, err
+	}
+	return team.At(at, overrides), nil
+}
+
+// Current returns who is on call for every team at the given time.
+func Current(ctx context.Context, pool *pgxpool.Pool, at time.Time) ([]Shift, error) {
+	teams, err := ListTeams(ctx, pool)
+	if err != nil {
+		return nil, err
+	}
+	overrides, err := ListOverrides(ctx, pool, nil, at, at)
+	if err != nil {
+		return nil, err
+	}
+
+	shifts := make([]Shift, 0, len(teams))
+	for _, team := range teams {
+		shifts = append(shifts, team.At(at, overrides))
+	}
+	return shifts, nil
+}
+
+func ListTeams(ctx context.Context, pool *pgxpool.Pool) ([]Team, error) {
+	return listTeams(ctx, pool, "$1::text IS NULL", nil)
+}
+
+func listTeams(ctx context.Context, pool *pgxpool.Pool, where string, arg interface{}) ([]Team, error) {
+	rows, err := pool.Query(ctx,
+		`SELECT t.id, t.name, t.location, t.rotation_start, t.shift_hours, t.created_at,
+		        m.name, m.email, COALESCE(m.phone, '')
+		 FROM oncall_teams t
+		 JOIN oncall_members m ON m.team_id = t.id
+		 WHERE `+where+`
+		 ORDER BY t.name, m.position`,
+		arg,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var teams []Team
+	for rows.Next() {
+		var t Team
+		var m Member
+		if err := rows.Scan(&t.ID, &t.Name, &t.Location, &t.RotationStart, &t.ShiftHours, &t.CreatedAt, &m.Name, &m.Email, &m.Phone); err != nil {
+			return nil, err
+		}
+		if n := len(teams); n > 0 && teams[n-1].ID == t.ID {
+			teams[n-1].Members = append(teams[n-1].Members, m)
+			continue
+		}
+		t.Members = []Member{m}
+		teams = append(teams, t)
+	}
+	return teams, rows.Err()
+}
+
+// SaveTeam inserts the team, or replaces it and its rotation when it has an ID.
+func SaveTeam(ctx context.Context, pool *pgxpool.Pool, t Team) (uuid.UUID, error) {
+	if t.ID == uuid.Nil {
+		t.ID = uuid.New()
+	}
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return t.ID, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx,
+		`INSERT INTO oncall_teams (id, name, location, rotation_start, shift_hours)
+		 VALUES ($1, $2, $3, $4, $5)
+		 ON CONFLICT (id) DO UPDATE SET
+			name = EXCLUDED.name, location = EXCLUDED.location,
+			rotation_start = EXCLUDED.rotation_start, shift_hours = EXCLUDED.shift_hours`,
+		t.ID, t.Name, t.Location, t.RotationStart, t.ShiftHours,
+	)
+	if err != nil {
+		return t.ID, err
+	}
+
+	if _, err := tx.Exec(ctx, "DELETE FROM oncall_members WHERE team_id = $1", t.ID); err != nil {
+		return t.ID, err
+	}
+	for i, m := range t.Members {
+		_, err := tx.Exec(ctx,
+			"INSERT INTO oncall_members (team_id, position, name, email, phone) VALUES ($1, $2, $3, $4, NULLIF($5, ''))",
+			t.ID, i, m.Name, m.Email, m.Phone,
+		)
+		if err != nil {
+			return t.ID, err
+		}
+	}
+
+	return t.ID, tx.Commit(ctx)
+}
+
+func DeleteTeam(ctx context.Context, pool *pgxpool.Pool, id uuid.UUID) error {
+	tag, err := pool.Exec(ctx, "DELETE FROM oncall_teams WHERE id = $1", id)
+	if err == nil && tag.RowsAffected() == 0 {
+		return ErrTeamNotFound
+	}
+	return err
+}
+
+// ListOverrides returns overrides overlapping [from, to], optionally for one team.
+func ListOverrides(ctx context.Context, pool *pgxpool.Pool, teamID *uuid.UUID, from, to time.Time) ([]Override, error) {
+	rows, err := pool.Query(ctx,
+		`SELECT id, team_id, name, email, starts_at, ends_at, COALESCE(reason, ''), created_at
+		 FROM oncall_overrides
+		 WHERE ($1::uuid IS NULL OR team_id = $1) AND starts_at <= $3 AND ends_at > $2
+		 ORDER BY starts_at`,
+		teamID, from, to,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var overrides []Override
+	for rows.Next() {
+		var o Override
+		if err := rows.Scan(&o.ID, &o.TeamID, &o.Name, &o.Email, &o.StartsAt, &o.EndsAt, &o.Reason, &o.CreatedAt); err != nil {
+			return nil, err
+		}
+		overrides = append(overrides, o)
+	}
+	return overrides, rows.Err()
+}
+
+func CreateOverride(ctx context.Context, pool *pgxpool.Pool, o Override) (uuid.UUID, error) {
+	var id uuid.UUID
+	err := pool.QueryRow(ctx,
+		`INSERT INTO oncall_overrides (team_id, name, email, starts_at, ends_at, reason)
+		 VALUES ($1, $2, $3, $4, $5, NULLIF($6, '')) RETURNING id`,
+		o.TeamID, o.Name, o.Email, o.StartsAt, o.EndsAt, o.Reason,
+	).Scan(&id)
+	return id, err
+}
+
+func DeleteOverride(ctx context.Context, pool *pgxpool.Pool, id uuid.UUID) error {
+	tag, err := pool.Exec(ctx, "DELETE FROM oncall_overrides WHERE id = $1", id)
+	if err == nil && tag.RowsAffected() == 0 {
+		return ErrOverrideNotFound
+	}
+	return err
+}
+
+// TeamExists reports whether a team with the given ID exists.
+func TeamExists(ctx context.Context, pool *pgxpool.Pool, id uuid.UUID) (bool, error) {
+	var found uuid.UUID
+	err := pool.QueryRow(ctx, "SELECT id FROM oncall_teams WHERE id = $1", id).Scan(&found)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -2,38 +2,153 @@ package processing
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 
 	"telemetry/config"
+	"telemetry/notify"
 )
 
 type AlertService struct {
-	db    *pgxpool.Pool
-	cfg   *config.Config
-	mu    sync.RWMutex
-	rules []AlertRule
+	db       *pgxpool.Pool
+	cfg      *config.Config
+	notifier *notify.Dispatcher
+	loc      *time.Location
+	delay    *onDelay
+	mu       sync.RWMutex
+	rules    []AlertRule
+
+	rulesVersion  int64
+	rulesLoadedAt time.Time
 }
 
 type AlertRule struct {
-	ID             uuid.UUID
-	Name           string
-	MetricName     string
-	ConditionType  string
-	ThresholdValue float64
-	Operator       string
-	Severity       string
-	Enabled        bool
+	ID             uuid.UUID `json:"id"`
+	Name           string    `json:"name"`
+	MetricName     string    `json:"metric_name"`
+	ConditionType  string    `json:"condition_type"`
+	ThresholdValue float64   `json:"threshold_value"`
+	Operator       string    `json:"operator"`
+	Severity       string    `json:"severity"`
+	Enabled        bool      `json:"enabled"`
+	Expression     string    `json:"expression"`
+	WindowSeconds  int       `json:"window_seconds"`
+	// DurationSeconds is how long the condition must hold before the alarm
+	// is raised. Hysteresis is how far a threshold alarm's value must come
+	// back past the threshold before it clears.
+	DurationSeconds int     `json:"duration_seconds"`
+	Hysteresis      float64 `json:"hysteresis"`
+	// Family groups tiers of one condition, such as a warning and a critical
+	// limit on the same metric, into one alert whose severity follows the
+	// highest tier in force.
+	Family    string     `json:"family"`
+	Revision  int        `json:"revision"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt *time.Time `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+
+	expr *Expression
+}
+
+const (
+	ConditionThreshold  = "threshold"
+	ConditionExpression = "expression"
+
+	defaultWindowSeconds = 60
+)
+
+var (
+	severities = []string{"info", "warning", "critical"}
+	operators  = []string{">", "<", ">=", "<="}
+)
+
+// ValidateRule checks a rule before it is stored. Expression rules are parsed
+// and, when no metric name is given, take the first metric they reference.
+func ValidateRule(rule *AlertRule) error {
+	if rule.DurationSeconds < 0 {
+		return fmt.Errorf("duration_seconds must not be negative")
+	}
+	if rule.Hysteresis < 0 {
+		return fmt.Errorf("hysteresis must not be negative")
+	}
+	if !contains(severities, rule.Severity) {
+		return fmt.Errorf("invalid severity %q: must be one of %s", rule.Severity, strings.Join(severities, ", "))
+	}
+	rule.Family = strings.TrimSpace(rule.Family)
+	if len(rule.Family) > 100 {
+		return fmt.Errorf("family must be at most 100 characters")
+	}
+
+	switch rule.ConditionType {
+	case ConditionThreshold:
+		if rule.MetricName == "" {
+			return fmt.Errorf("metric_name is required")
+		}
+		if !contains(operators, rule.Operator) {
+			return fmt.Errorf("invalid operator %q: must be one of %s", rule.Operator, strings.Join(operators, ", "))
+		}
+		return nil
+	case ConditionExpression:
+		if rule.Hysteresis != 0 {
+			return fmt.Errorf("hysteresis applies to threshold rules only")
+		}
+	default:
+		return fmt.Errorf("invalid condition_type %q: must be %s or %s", rule.ConditionType, ConditionThreshold, ConditionExpression)
+	}
+
+	expr, err := ParseExpression(rule.Expression)
+	if err != nil {
+		return fmt.Errorf("invalid expression: %w", err)
+	}
+	metrics := expr.Metrics()
+	if len(metrics) == 0 {
+		return fmt.Errorf("invalid expression: must reference at least one metric")
+	}
+	if rule.MetricName == "" {
+		rule.MetricName = metrics[0]
+	}
+	if rule.WindowSeconds < 0 {
+		return fmt.Errorf("window_seconds must not be negative")
+	}
+	if rule.WindowSeconds == 0 {
+		rule.WindowSeconds = defaultWindowSeconds
+	}
+	rule.expr = expr
+	return nil
+}
+
+func (r AlertRule) references(metricName string) bool {
+	if r.expr == nil {
+		return r.MetricName == metricName
+	}
+	for _, name := range r.expr.Metrics() {
+		if name == metricName {
+			return true
+		}
+	}
+	return false
 }
 
-func NewAlertService(pool *pgxpool.Pool, cfg *config.Config) *AlertService {
-	s := &AlertService{db: pool, cfg: cfg}
-	s.loadRules(context.Background())
+func NewAlertService(pool *pgxpool.Pool, cfg *config.Config, notifier *notify.Dispatcher) *AlertService {
+	loc, err := time.LoadLocation(cfg.Timezone)
+	if err != nil {
+		log.Printf("Unknown timezone %q, using UTC: %v", cfg.Timezone, err)
+		loc = time.UTC
+	}
+
+	s := &AlertService{db: pool, cfg: cfg, notifier: notifier, loc: loc, delay: newOnDelay()}
+	if err := s.loadRules(context.Background()); err != nil {
+		log.Printf("Failed to load alert rules: %v", err)
+	}
 	return s
 }
 
@@ -48,6 +163,9 @@ func (s *AlertService) StartBackgroundChecks(ctx context.Context) {
 			return
 		case <-ticker.C:
 			s.resolveAlerts(ctx)
+			s.expireShelves(ctx)
+			s.escalateAlerts(ctx)
+			s.resolveIncidents(ctx)
 		}
 	}
 }
@@ -69,13 +187,18 @@ func (s *AlertService) resolveAlerts(ctx context.Context) {
 			 WHERE machine_id = a.machine_id AND metric_name = r.metric_name 
 			 ORDER BY time DESC LIMIT 1
 		 ) m ON true
-		 WHERE a.acknowledged = false`,
+		 WHERE a.state IN ('active', 'acknowledged')`,
 	)
 	if err != nil {
 		return
 	}
-	defer rows.Close()
 
+	type openAlert struct {
+		alertID, machineID uuid.UUID
+		rule               AlertRule
+		currentValue       *float64
+	}
+	var open []openAlert
 	for rows.Next() {
 		var alertID, machineID, ruleID uuid.UUID
 		var currentValue *float64
@@ -84,117 +207,345 @@ func (s *AlertService) resolveAlerts(ctx context.Context) {
 		}
 
 		rule, ok := rules[ruleID]
-		if !ok || currentValue == nil {
+		if !ok {
+			continue
+		}
+		open = append(open, openAlert{alertID, machineID, rule, currentValue})
+	}
+	rows.Close()
+
+	for _, a := range open {
+		var detail string
+		var value float64
+		var values map[string]float64
+
+		if a.rule.expr != nil {
+			var err error
+			values, err = s.windowValues(ctx, a.machineID, a.rule)
+			if err != nil {
+				continue
+			}
+			detail = formatValues(values)
+			if missing := missingMetrics(a.rule, values); len(missing) > 0 {
+				detail = strings.TrimPrefix(detail+"; stale data, no recent value for "+strings.Join(missing, ", "), "; ")
+			}
+			value = values[a.rule.MetricName]
+		} else {
+			if a.currentValue == nil {
+				continue
+			}
+			detail = fmt.Sprintf("value now %.2f (threshold: %.2f)", *a.currentValue, a.rule.ThresholdValue)
+			value = *a.currentValue
+			values = map[string]float64{a.rule.MetricName: value}
+		}
+
+		cleared, err := a.rule.clears(value, values)
+		if err != nil || !cleared {
 			continue
 		}
 
-		stillTriggered := false
-		switch rule.Operator {
-		case ">":
-			stillTriggered = *currentValue > rule.ThresholdValue
-		case "<":
-			stillTriggered = *currentValue < rule.ThresholdValue
-		case ">=":
-			stillTriggered = *currentValue >= rule.ThresholdValue
-		case "<=":
-			stillTriggered = *currentValue <= rule.ThresholdValue
-		}
-
-		if !stillTriggered {
-			_, err := s.db.Exec(ctx,
-				"UPDATE alerts SET acknowledged = true, acknowledged_by = 'system', acknowledged_at = NOW() WHERE id = $1",
-				alertID,
-			)
-			if err == nil {
-				log.Printf("Auto-resolved alert %s for machine %s: value now %.2f (threshold: %.2f)",
-					alertID, machineID, *currentValue, rule.ThresholdValue)
+		// A family alert whose tier clears falls back to the highest lower
+		// tier still in force instead of resolving.
+		if lower, ok := s.lowerTier(a.rule, value, values); ok {
+			if err := s.lowerSeverity(ctx, a.alertID, a.rule, lower, value); err != nil {
+				log.Printf("Failed to lower severity of alert %s: %v", a.alertID, err)
+				continue
 			}
+			log.Printf("Alert %s for machine %s lowered from %s to %s (%s): %s", a.alertID, a.machineID, a.rule.Severity, lower.Severity, lower.Name, detail)
+			continue
+		}
+
+		var state string
+		err = s.db.QueryRow(ctx,
+			`UPDATE alerts SET
+				cleared_at = NOW(),
+				state = CASE WHEN state = 'acknowledged' THEN 'closed' ELSE 'resolved' END,
+				closed_at = CASE WHEN state = 'acknowledged' THEN NOW() END,
+				closed_by = CASE WHEN state = 'acknowledged' THEN 'system' END
+			 WHERE id = $1 AND state IN ('active', 'acknowledged')
+			 RETURNING state`,
+			a.alertID,
+		).Scan(&state)
+		if err == nil {
+			log.Printf("Alert %s for machine %s returned to normal (now %s): %s", a.alertID, a.machineID, state, detail)
+			go s.notify(a.alertID, a.rule, notify.EventResolved, value, values)
 		}
 	}
 }
 
-func (s *AlertService) loadRules(ctx context.Context) {
-	rows, err := s.db.Query(ctx, "SELECT id, name, metric_name, condition_type, threshold_value, operator, severity, enabled FROM alert_rules WHERE enabled = true")
+// loadRules replaces the in-memory rule set with the enabled rules in the
+// database, read in one snapshot with the rule version they correspond to. A
+// load that finishes after a newer one is discarded.
+func (s *AlertService) loadRules(ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
 	if err != nil {
-		log.Printf("Failed to load alert rules: %v", err)
-		return
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var version int64
+	if err := tx.QueryRow(ctx, "SELECT version FROM alert_rules_version").Scan(&version); err != nil {
+		return fmt.Errorf("failed to read rule version: %w", err)
+	}
+
+	rows, err := tx.Query(ctx, "SELECT "+ruleColumns+" FROM alert_rules WHERE enabled = true AND deleted_at IS NULL")
+	if err != nil {
+		return err
 	}
 	defer rows.Close()
 
 	var rules []AlertRule
 	for rows.Next() {
-		var r AlertRule
-		if err := rows.Scan(&r.ID, &r.Name, &r.MetricName, &r.ConditionType, &r.ThresholdValue, &r.Operator, &r.Severity, &r.Enabled); err != nil {
+		r, err := scanRule(rows)
+		if err != nil {
+			continue
+		}
+		if err := ValidateRule(&r); err != nil {
+			log.Printf("Skipping alert rule %s (%s): %v", r.Name, r.ID, err)
 			continue
 		}
 		rules = append(rules, r)
 	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
 	s.mu.Lock()
+	defer s.mu.Unlock()
+	if version < s.rulesVersion {
+		return nil
+	}
 	s.rules = rules
-	s.mu.Unlock()
-	log.Printf("Loaded %d alert rules", len(rules))
+	s.rulesVersion = version
+	s.rulesLoadedAt = time.Now()
+	log.Printf("Loaded %d alert rules (version %d)", len(rules), version)
+	return nil
 }
 
 func (s *AlertService) CheckMetric(machineID uuid.UUID, metricName string, value float64) {
 	s.mu.RLock()
-	defer s.mu.RUnlock()
+	rules := make([]AlertRule, len(s.rules))
+	copy(rules, s.rules)
+	s.mu.RUnlock()
+
+	for _, rule := range rules {
+		if !rule.references(metricName) {
+			continue
+		}
+
+		values := map[string]float64{metricName: value}
+		if rule.expr != nil {
+			var err error
+			values, err = s.windowValues(context.Background(), machineID, rule)
+			if err != nil {
+				log.Printf("Failed to load values for rule %s: %v", rule.Name, err)
+				continue
+			}
+			values[metricName] = value
+		}
 
-	for _, rule := range s.rules {
-		if rule.MetricName != metricName {
+		holds, err := rule.holds(value, values)
+		if err != nil {
+			// Typically a referenced metric has no reading inside the window yet.
 			continue
 		}
+		if s.delay.observe(alarmKey{machineID, rule.ID}, rule, time.Now(), holds) {
+			s.createAlert(machineID, rule, value, values)
+		}
+	}
+}
+
+// windowValues returns the latest value of every metric an expression rule
+// references, limited to readings inside the rule's time window.
+func (s *AlertService) windowValues(ctx context.Context, machineID uuid.UUID, rule AlertRule) (map[string]float64, error) {
+	window := rule.WindowSeconds
+	if window <= 0 {
+		window = defaultWindowSeconds
+	}
+
+	rows, err := s.db.Query(ctx,
+		`SELECT DISTINCT ON (metric_name) metric_name, value
+		 FROM metrics
+		 WHERE machine_id = $1 AND metric_name = ANY($2) AND time > NOW() - make_interval(secs => $3)
+		 ORDER BY metric_name, time DESC`,
+		machineID, rule.expr.Metrics(), window,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-		triggered := false
-		switch rule.Operator {
-		case ">":
-			triggered = value > rule.ThresholdValue
-		case "<":
-			triggered = value < rule.ThresholdValue
-		case ">=":
-			triggered = value >= rule.ThresholdValue
-		case "<=":
-			triggered = value <= rule.ThresholdValue
+	values := make(map[string]float64)
+	for rows.Next() {
+		var name string
+		var v float64
+		if err := rows.Scan(&name, &v); err != nil {
+			return nil, err
 		}
+		values[name] = v
+	}
+	return values, rows.Err()
+}
 
-		if triggered {
-			s.createAlert(machineID, rule, value)
+// missingMetrics lists the metrics an expression rule refers to that have no
+// value.
+func missingMetrics(rule AlertRule, values map[string]float64) []string {
+	var missing []string
+	for _, name := range rule.expr.Metrics() {
+		if _, ok := values[name]; !ok {
+			missing = append(missing, name)
 		}
 	}
+	return missing
 }
 
-func (s *AlertService) createAlert(machineID uuid.UUID, rule AlertRule, value float64) {
-	var existingID uuid.UUID
-	err := s.db.QueryRow(context.Background(),
-		"SELECT id FROM alerts WHERE machine_id = $1 AND rule_id = $2 AND acknowledged = false",
-		machineID, rule.ID,
-	).Scan(&existingID)
+func formatValues(values map[string]float64) string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-	if err == nil {
-		return
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s=%.2f", name, values[name])
 	}
+	return strings.Join(parts, ", ")
+}
 
+func (s *AlertService) createAlert(machineID uuid.UUID, rule AlertRule, value float64, values map[string]float64) {
 	message := rule.Name
 	if message == "" {
 		message = rule.MetricName
 	}
-	message += fmt.Sprintf(" - value: %.2f (threshold: %.2f)", value, rule.ThresholdValue)
+	if rule.expr != nil {
+		message += fmt.Sprintf(" - %s (condition: %s)", formatValues(values), rule.Expression)
+	} else {
+		message += fmt.Sprintf(" - value: %.2f (threshold: %.2f)", value, rule.ThresholdValue)
+	}
 
-	_, err = s.db.Exec(context.Background(),
-		"INSERT INTO alerts (machine_id, rule_id, severity, message) VALUES ($1, $2, $3, $4)",
-		machineID, rule.ID, rule.Severity, message,
-	)
+	evaluated, err := json.Marshal(values)
+	if err != nil {
+		log.Printf("Failed to encode evaluated values: %v", err)
+		return
+	}
+
+	// Alerts raised during a silence or maintenance window are recorded but
+	// flagged so they are neither notified nor escalated.
+	suppressedBy, err := s.suppression(context.Background(), machineID, rule.ID, rule.Severity)
+	if err != nil {
+		log.Printf("Failed to check silences for machine %s: %v", machineID, err)
+	}
+
+	r, err := s.raise(context.Background(), machineID, rule, message, evaluated, suppressedBy, value)
 	if err != nil {
 		log.Printf("Failed to create alert: %v", err)
 		return
 	}
+	alertID := r.alertID
+
+	switch r.outcome {
+	case raiseRepeated:
+		return
+	case raiseReactivated:
+		// Its notification is still subject to silences, checked in notify.
+		log.Printf("ALERT [%s] %s for machine %s re-entered alarm before acknowledgement", rule.Severity, rule.Name, machineID)
+		s.recordActivation(alertID)
+		go s.notify(alertID, rule, notify.EventTriggered, value, values)
+		return
+	case raiseSeverity:
+		log.Printf("ALERT [%s] %s for machine %s raised alert %s from %s", rule.Severity, rule.Name, machineID, alertID, r.previous)
+		s.recordActivation(alertID)
+		go s.notify(alertID, rule, notify.EventSeverityRaised, value, values)
+		return
+	}
 
+	s.recordActivation(alertID)
+
+	if suppressedBy != "" {
+		log.Printf("ALERT [%s] %s for machine %s suppressed by %s: %s", rule.Severity, rule.Name, machineID, suppressedBy, message)
+		return
+	}
 	log.Printf("ALERT [%s] %s for machine %s: %s", rule.Severity, rule.Name, machineID, message)
 
-	go s.sendNotifications(rule.Severity, message)
+	// Alerts joining an open incident ride on its first notification.
+	lead, err := s.correlate(context.Background(), alertID, machineID, rule)
+	if err != nil {
+		log.Printf("Failed to correlate alert %s into an incident: %v", alertID, err)
+	}
+	if !lead {
+		return
+	}
+
+	go s.notify(alertID, rule, notify.EventTriggered, value, values)
+}
+
+// recordActivation logs each time an alarm annunciates, including re-entries
+// of an existing alert, for the alarm-rate and chattering reports.
+func (s *AlertService) recordActivation(alertID uuid.UUID) {
+	_, err := s.db.Exec(context.Background(),
+		`INSERT INTO alert_activations (alert_id, machine_id, rule_id, severity, suppressed)
+		 SELECT id, machine_id, rule_id, severity, suppressed FROM alerts WHERE id = $1`,
+		alertID,
+	)
+	if err != nil {
+		log.Printf("Failed to record activation of alert %s: %v", alertID, err)
+	}
 }
 
-func (s *AlertService) sendNotifications(severity, message string) {
-	if s.cfg.SlackWebhook != "" {
-		log.Printf("Would send Slack notification: %s", message)
+// notify looks up the machine and alert details and hands the event to the
+// notification dispatcher.
+func (s *AlertService) notify(alertID uuid.UUID, rule AlertRule, event string, value float64, values map[string]float64) {
+	ctx := context.Background()
+
+	alert := notify.Alert{
+		ID:         alertID,
+		Event:      event,
+		RuleID:     rule.ID,
+		RuleName:   rule.Name,
+		MetricName: rule.MetricName,
+		Value:      value,
+		Values:     values,
+		Expression: rule.Expression,
+		Time:       time.Now(),
+	}
+	if rule.expr == nil {
+		threshold := rule.ThresholdValue
+		alert.Threshold = &threshold
+	}
+
+	var suppressed, grouped bool
+	err := s.db.QueryRow(ctx,
+		`SELECT a.machine_id, a.severity, a.message, a.suppressed, COALESCE(m.name, ''), COALESCE(m.type, ''), COALESCE(m.location, ''),
+		        EXISTS (SELECT 1 FROM incident_alerts ia WHERE ia.alert_id = a.id AND NOT ia.notified),
+		        COALESCE((SELECT c.from_severity FROM alert_severity_changes c WHERE c.alert_id = a.id ORDER BY c.id DESC LIMIT 1), '')
+		 FROM alerts a LEFT JOIN machines m ON m.id = a.machine_id
+		 WHERE a.id = $1`,
+		alertID,
+	).Scan(&alert.MachineID, &alert.Severity, &alert.Message, &suppressed, &alert.MachineName, &alert.MachineType, &alert.Location, &grouped,
+		&alert.PreviousSeverity)
+	if err != nil {
+		log.Printf("Failed to load alert %s for notification: %v", alertID, err)
+		return
+	}
+	if event != notify.EventSeverityRaised {
+		alert.PreviousSeverity = ""
+	}
+
+	// A suppressed alert stays quiet for its whole life, and any alert stays
+	// quiet while a silence covers it now. Alerts grouped under another
+	// alert's incident notification stay quiet too.
+	if suppressed || grouped {
+		return
+	}
+	suppressedBy, err := s.suppression(ctx, alert.MachineID, rule.ID, alert.Severity)
+	if err != nil {
+		log.Printf("Failed to check silences for alert %s: %v", alertID, err)
+	}
+	if suppressedBy != "" {
+		log.Printf("Not notifying %s of alert %s: suppressed by %s", event, alertID, suppressedBy)
+		return
 	}
+
+	s.notifier.Dispatch(ctx, alert)
 }
@@ -0,0 +1,257 @@
+package processing
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ISA-18.2 alarm performance limits. Each location has its own control-room
+// console, so location stands in for the operator position.
+const (
+	RateInterval = 10 * time.Minute
+	// FloodStart alarms in one interval start a flood; it lasts until an
+	// interval has fewer than FloodEnd.
+	FloodStart = 10
+	FloodEnd   = 5
+	// An alarm chatters when it annunciates ChatterCount times within ten
+	// minutes. The usual one-minute window is too short here because alarms
+	// only clear on the 30-second background check.
+	ChatterCount = 3
+
+	unassignedPosition = "unassigned"
+)
+
+// RateBucket is the number of alarms annunciated at a position in one
+// ten-minute interval. Suppressed and shelved alarms are not counted.
+type RateBucket struct {
+	Position string    `json:"position"`
+	Start    time.Time `json:"start"`
+	Alarms   int       `json:"alarms"`
+}
+
+// PositionRate summarises a position's alarm rate over the report range.
+type PositionRate struct {
+	Position        string  `json:"position"`
+	Alarms          int     `json:"alarms"`
+	AveragePer10Min float64 `json:"average_per_10_min"`
+	Peak            int     `json:"peak"`
+	// FloodPercent is the share of intervals at or above FloodStart.
+	FloodPercent float64 `json:"flood_percent"`
+}
+
+type RateReport struct {
+	From      time.Time      `json:"from"`
+	To        time.Time      `json:"to"`
+	Positions []PositionRate `json:"positions"`
+	Buckets   []RateBucket   `json:"buckets"`
+}
+
+// Flood is a period in which a position received alarms faster than an
+// operator can respond to them.
+type Flood struct {
+	Position string    `json:"position"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Alarms   int       `json:"alarms"`
+	Peak     int       `json:"peak"`
+}
+
+// BadActor is one of the rules contributing most alarms.
+type BadActor struct {
+	RuleID   uuid.UUID `json:"rule_id"`
+	RuleName string    `json:"rule_name"`
+	Severity string    `json:"severity"`
+	Alarms   int       `json:"alarms"`
+	Machines int       `json:"machines"`
+	Percent  float64   `json:"percent"`
+}
+
+// ChatteringAlarm is a rule on a machine that repeatedly annunciated in
+// quick succession.
+type ChatteringAlarm struct {
+	MachineID   uuid.UUID `json:"machine_id"`
+	MachineName string    `json:"machine_name"`
+	RuleID      uuid.UUID `json:"rule_id"`
+	RuleName    string    `json:"rule_name"`
+	Activations int       `json:"activations"`
+	MaxPer10Min int       `json:"max_per_10_min"`
+	// Chatter counts activations that were at least the ChatterCount-th
+	// within ten minutes.
+	Chatter int `json:"chatter"`
+}
+
+func AlarmRate(ctx context.Context, pool *pgxpool.Pool, from, to time.Time) (RateReport, error) {
+	report := RateReport{From: from, To: to, Positions: []PositionRate{}, Buckets: []RateBucket{}}
+
+	buckets, err := rateBuckets(ctx, pool, from, to)
+	if err != nil {
+		return report, err
+	}
+	report.Buckets = buckets
+
+	intervals := math.Ceil(float64(to.Sub(from)) / float64(RateInterval))
+	if intervals < 1 {
+		intervals = 1
+	}
+
+	var current *PositionRate
+	floods := 0
+	for _, b := range buckets {
+		if current == nil || current.Position != b.Position {
+			if current != nil {
+				current.FloodPercent = 100 * float64(floods) / intervals
+				report.Positions = append(report.Positions, *current)
+			}
+			current = &PositionRate{Position: b.Position}
+			floods = 0
+		}
+		current.Alarms += b.Alarms
+		if b.Alarms > current.Peak {
+			current.Peak = b.Alarms
+		}
+		if b.Alarms >= FloodStart {
+			floods++
+		}
+	}
+	if current != nil {
+		current.FloodPercent = 100 * float64(floods) / intervals
+		report.Positions = append(report.Positions, *current)
+	}
+	for i := range report.Positions {
+		report.Positions[i].AveragePer10Min = float64(report.Positions[i].Alarms) / intervals
+	}
+	return report, nil
+}
+
+func rateBuckets(ctx context.Context, pool *pgxpool.Pool, from, to time.Time) ([]RateBucket, error) {
+	rows, err := pool.Query(ctx,
+		`SELECT COALESCE(m.location, $3), time_bucket('10 minutes', a.activated_at) AS bucket, count(*)
+		 FROM alert_activations a
+		 LEFT JOIN machines m ON m.id = a.machine_id
+		 WHERE a.activated_at >= $1 AND a.activated_at < $2 AND NOT a.suppressed
+		 GROUP BY 1, 2
+		 ORDER BY 1, 2`,
+		from, to, unassignedPosition,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var buckets []RateBucket
+	for rows.Next() {
+		var b RateBucket
+		if err := rows.Scan(&b.Position, &b.Start, &b.Alarms); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
+
+// AlarmFloods finds flood periods per position: they start with an interval
+// of at least FloodStart alarms and end before the first interval with fewer
+// than FloodEnd.
+func AlarmFloods(ctx context.Context, pool *pgxpool.Pool, from, to time.Time) ([]Flood, error) {
+	buckets, err := rateBuckets(ctx, pool, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	floods := []Flood{}
+	var open *Flood
+	for _, b := range buckets {
+		// Intervals without alarms have no bucket, so a gap also ends a flood.
+		if open != nil && (open.Position != b.Position || !b.Start.Equal(open.End) || b.Alarms < FloodEnd) {
+			floods = append(floods, *open)
+			open = nil
+		}
+		if open == nil {
+			if b.Alarms < FloodStart {
+				continue
+			}
+			open = &Flood{Position: b.Position, Start: b.Start}
+		}
+		open.End = b.Start.Add(RateInterval)
+		open.Alarms += b.Alarms
+		if b.Alarms > open.Peak {
+			open.Peak = b.Alarms
+		}
+	}
+	if open != nil {
+		floods = append(floods, *open)
+	}
+	return floods, nil
+}
+
+// BadActors returns the ten rules that raised the most alarms, shelved and
+// suppressed ones included since they are the usual rationalization targets.
+func BadActors(ctx context.Context, pool *pgxpool.Pool, from, to time.Time) ([]BadActor, error) {
+	rows, err := pool.Query(ctx,
+		`SELECT a.rule_id, COALESCE(r.name, ''), COALESCE(r.severity, ''), count(*), count(DISTINCT a.machine_id),
+		        100.0 * count(*) / sum(count(*)) OVER ()
+		 FROM alert_activations a
+		 LEFT JOIN alert_rules r ON r.id = a.rule_id
+		 WHERE a.activated_at >= $1 AND a.activated_at < $2
+		 GROUP BY a.rule_id, r.name, r.severity
+		 ORDER BY count(*) DESC
+		 LIMIT 10`,
+		from, to,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	actors := []BadActor{}
+	for rows.Next() {
+		var b BadActor
+		if err := rows.Scan(&b.RuleID, &b.RuleName, &b.Severity, &b.Alarms, &b.Machines, &b.Percent); err != nil {
+			return nil, err
+		}
+		actors = append(actors, b)
+	}
+	return actors, rows.Err()
+}
+
+func ChatteringAlarms(ctx context.Context, pool *pgxpool.Pool, from, to time.Time) ([]ChatteringAlarm, error) {
+	rows, err := pool.Query(ctx,
+		`WITH windowed AS (
+			SELECT machine_id, rule_id,
+			       count(*) OVER (
+			           PARTITION BY machine_id, rule_id ORDER BY activated_at
+			           RANGE BETWEEN INTERVAL '10 minutes' PRECEDING AND CURRENT ROW
+			       ) AS recent
+			FROM alert_activations
+			WHERE activated_at >= $1 AND activated_at < $2
+		)
+		SELECT w.machine_id, COALESCE(m.name, ''), w.rule_id, COALESCE(r.name, ''),
+		       count(*), max(w.recent), count(*) FILTER (WHERE w.recent >= $3)
+		FROM windowed w
+		LEFT JOIN machines m ON m.id = w.machine_id
+		LEFT JOIN alert_rules r ON r.id = w.rule_id
+		GROUP BY w.machine_id, m.name, w.rule_id, r.name
+		HAVING max(w.recent) >= $3
+		ORDER BY count(*) FILTER (WHERE w.recent >= $3) DESC, count(*) DESC
+		LIMIT 50`,
+		from, to, ChatterCount,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	alarms := []ChatteringAlarm{}
+	for rows.Next() {
+		var c ChatteringAlarm
+		if err := rows.Scan(&c.MachineID, &c.MachineName, &c.RuleID, &c.RuleName, &c.Activations, &c.MaxPer10Min, &c.Chatter); err != nil {
+			return nil, err
+		}
+		alarms = append(alarms, c)
+	}
+	return alarms, rows.Err()
+}
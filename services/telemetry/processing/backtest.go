@@ -0,0 +1,241 @@
+package processing
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	MaxBacktestRange = 92 * 24 * time.Hour
+	// maxBacktestAlerts caps the alerts listed per rule; counts stay exact.
+	maxBacktestAlerts = 500
+)
+
+// BacktestAlert is an alert a rule would have raised, from the reading that
+// raised it to the one that cleared it. End is nil if it was still in force
+// at the end of the range.
+type BacktestAlert struct {
+	MachineID uuid.UUID          `json:"machine_id"`
+	Start     time.Time          `json:"start"`
+	End       *time.Time         `json:"end"`
+	Value     float64            `json:"value"`
+	Values    map[string]float64 `json:"values"`
+}
+
+type BacktestMachine struct {
+	MachineID   uuid.UUID `json:"machine_id"`
+	MachineName string    `json:"machine_name"`
+	Alerts      int       `json:"alerts"`
+	// AlarmSeconds is how long the machine spent in alarm under the rule.
+	AlarmSeconds float64 `json:"alarm_seconds"`
+}
+
+type BacktestResult struct {
+	Rule      AlertRule         `json:"rule"`
+	Total     int               `json:"total"`
+	Machines  []BacktestMachine `json:"machines"`
+	Alerts    []BacktestAlert   `json:"alerts"`
+	Truncated bool              `json:"truncated"`
+}
+
+// backtestRun replays readings through one rule, one machine at a time.
+type backtestRun struct {
+	rule   AlertRule
+	delay  *onDelay
+	end    time.Time
+	result BacktestResult
+
+	machine    uuid.UUID
+	active     *BacktestAlert
+	latest     map[string]float64
+	latestAt   map[string]time.Time
+	perMachine map[uuid.UUID]*BacktestMachine
+}
+
+func newBacktestRun(rule AlertRule, end time.Time) *backtestRun {
+	return &backtestRun{
+		rule:       rule,
+		delay:      newOnDelay(),
+		end:        end,
+		result:     BacktestResult{Rule: rule, Machines: []BacktestMachine{}, Alerts: []BacktestAlert{}},
+		perMachine: make(map[uuid.UUID]*BacktestMachine),
+	}
+}
+
+// observe feeds one reading to the rule. Live checking evaluates on every
+// reading but clears on the 30-second background check; a replay clears on
+// the first reading back to normal instead.
+func (b *backtestRun) observe(machineID uuid.UUID, at time.Time, metricName string, value float64) {
+	if machineID != b.machine {
+		b.finish()
+		b.machine = machineID
+		b.latest = make(map[string]float64)
+		b.latestAt = make(map[string]time.Time)
+	}
+	if !b.rule.references(metricName) {
+		return
+	}
+
+	values := map[string]float64{metricName: value}
+	if b.rule.expr != nil {
+		b.latest[metricName] = value
+		b.latestAt[metricName] = at
+		window := time.Duration(b.rule.WindowSeconds) * time.Second
+		values = make(map[string]float64, len(b.latest))
+		for name, v := range b.latest {
+			if at.Sub(b.latestAt[name]) < window {
+				values[name] = v
+			}
+		}
+	}
+
+	if b.active != nil {
+		cleared, err := b.rule.clears(value, values)
+		if err != nil || !cleared {
+			return
+		}
+		b.close(at)
+	}
+
+	holds, err := b.rule.holds(value, values)
+	if err != nil {
+		return
+	}
+	if b.delay.observe(alarmKey{machineID, b.rule.ID}, b.rule, at, holds) {
+		b.active = &BacktestAlert{MachineID: machineID, Start: at, Value: value, Values: values}
+	}
+}
+
+func (b *backtestRun) close(at time.Time) {
+	end := at
+	b.active.End = &end
+	b.record(at)
+}
+
+// finish records an alert still in force when the machine's readings end.
+func (b *backtestRun) finish() {
+	if b.active != nil {
+		b.record(b.end)
+	}
+}
+
+func (b *backtestRun) record(until time.Time) {
+	a := *b.active
+	b.active = nil
+
+	m, ok := b.perMachine[a.MachineID]
+	if !ok {
+		m = &BacktestMachine{MachineID: a.MachineID}
+		b.perMachine[a.MachineID] = m
+	}
+	m.Alerts++
+	m.AlarmSeconds += until.Sub(a.Start).Seconds()
+
+	b.result.Total++
+	if len(b.result.Alerts) < maxBacktestAlerts {
+		b.result.Alerts = append(b.result.Alerts, a)
+	} else {
+		b.result.Truncated = true
+	}
+}
+
+// Backtest replays the stored readings between from and to, for one machine
+// or all of them, through each rule and returns the alerts each would have
+// raised. Rules must have passed ValidateRule.
+func Backtest(ctx context.Context, pool *pgxpool.Pool, rules []AlertRule, from, to time.Time, machineID *uuid.UUID) ([]BacktestResult, error) {
+	if !to.After(from) {
+		return nil, fmt.Errorf("to must be after from")
+	}
+	if to.Sub(from) > MaxBacktestRange {
+		return nil, fmt.Errorf("range must not exceed %d days", int(MaxBacktestRange.Hours()/24))
+	}
+
+	runs := make([]*backtestRun, len(rules))
+	metricSet := make(map[string]bool)
+	for i, rule := range rules {
+		runs[i] = newBacktestRun(rule, to)
+		if rule.expr != nil {
+			for _, name := range rule.expr.Metrics() {
+				metricSet[name] = true
+			}
+		} else {
+			metricSet[rule.MetricName] = true
+		}
+	}
+	metrics := make([]string, 0, len(metricSet))
+	for name := range metricSet {
+		metrics = append(metrics, name)
+	}
+
+	rows, err := pool.Query(ctx,
+		`SELECT machine_id, time, metric_name, value
+		 FROM metrics
+		 WHERE metric_name = ANY($1) AND time >= $2 AND time < $3 AND ($4::uuid IS NULL OR machine_id = $4)
+		 ORDER BY machine_id, time`,
+		metrics, from, to, machineID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var machine uuid.UUID
+		var at time.Time
+		var name string
+		var value float64
+		if err := rows.Scan(&machine, &at, &name, &value); err != nil {
+			return nil, err
+		}
+		for _, run := range runs {
+			run.observe(machine, at, name, value)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	names, err := machineNames(ctx, pool)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]BacktestResult, len(runs))
+	for i, run := range runs {
+		run.finish()
+		for _, m := range run.perMachine {
+			m.MachineName = names[m.MachineID]
+			run.result.Machines = append(run.result.Machines, *m)
+		}
+		sort.Slice(run.result.Machines, func(a, b int) bool {
+			return run.result.Machines[a].Alerts > run.result.Machines[b].Alerts
+		})
+		results[i] = run.result
+	}
+	return results, nil
+}
+
+func machineNames(ctx context.Context, pool *pgxpool.Pool) (map[uuid.UUID]string, error) {
+	rows, err := pool.Query(ctx, "SELECT id, name FROM machines")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := make(map[uuid.UUID]string)
+	for rows.Next() {
+		var id uuid.UUID
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		names[id] = name
+	}
+	return names, rows.Err()
+}
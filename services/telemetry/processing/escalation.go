@@ -0,0 +1,147 @@
+package processing
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"telemetry/notify"
+)
+
+// escalateAlerts pages the next tier for active alerts that have gone
+// unacknowledged past their escalation policy's next step. Acknowledged and
+// resolved alerts stop escalating, as do those of disabled or deleted rules,
+// and alerts grouped into an incident escalate through the incident's
+// notified alerts.
+func (s *AlertService) escalateAlerts(ctx context.Context) {
+	policies, err := notify.ListEscalationPolicies(ctx, s.db, true)
+	if err != nil {
+		log.Printf("Failed to load escalation policies: %v", err)
+		return
+	}
+	if len(policies) == 0 {
+		return
+	}
+
+	rows, err := s.db.Query(ctx,
+		`SELECT a.id, a.machine_id, a.severity, a.message, a.escalation_level, COALESCE(a.triggered_at, a.created_at),
+		        COALESCE(m.name, ''), COALESCE(m.type, ''), COALESCE(m.location, ''),
+		        a.rule_id, COALESCE(r.name, ''), COALESCE(r.metric_name, ''), r.threshold_value, COALESCE(r.expression, ''),
+		        COALESCE((a.evaluated_values->>r.metric_name)::float8, 0), a.evaluated_values
+		 FROM alerts a
+		 LEFT JOIN machines m ON m.id = a.machine_id
+		 LEFT JOIN alert_rules r ON r.id = a.rule_id
+		 WHERE a.state = 'active' AND NOT a.suppressed
+		   AND (r.id IS NULL OR (r.enabled AND r.deleted_at IS NULL))
+		   AND NOT EXISTS (SELECT 1 FROM incident_alerts ia WHERE ia.alert_id = a.id AND NOT ia.notified)`,
+	)
+	if err != nil {
+		log.Printf("Failed to query alerts for escalation: %v", err)
+		return
+	}
+
+	type pending struct {
+		alert notify.Alert
+		level int
+		since time.Time
+	}
+	var candidates []pending
+	for rows.Next() {
+		var p pending
+		var ruleID *uuid.UUID
+		if err := rows.Scan(&p.alert.ID, &p.alert.MachineID, &p.alert.Severity, &p.alert.Message, &p.level, &p.since,
+			&p.alert.MachineName, &p.alert.MachineType, &p.alert.Location,
+			&ruleID, &p.alert.RuleName, &p.alert.MetricName, &p.alert.Threshold, &p.alert.Expression,
+			&p.alert.Value, &p.alert.Values); err != nil {
+			log.Printf("Failed to scan alert for escalation: %v", err)
+			continue
+		}
+		if ruleID != nil {
+			p.alert.RuleID = *ruleID
+		}
+		if p.alert.Expression != "" {
+			p.alert.Threshold = nil
+		}
+		candidates = append(candidates, p)
+	}
+	rows.Close()
+
+	now := time.Now()
+	for _, p := range candidates {
+		var policy *notify.EscalationPolicy
+		for i := range policies {
+			if policies[i].Matches(p.alert) {
+				policy = &policies[i]
+				break
+			}
+		}
+		if policy == nil {
+			continue
+		}
+
+		step, due := policy.NextStep(p.level, p.since, now)
+		if !due {
+			continue
+		}
+		if suppressedBy, err := s.suppression(ctx, p.alert.MachineID, p.alert.RuleID, p.alert.Severity); err != nil || suppressedBy != "" {
+			continue
+		}
+
+		// Guarding on the current level and state keeps a concurrent
+		// acknowledgement or a second instance from paging twice.
+		tag, err := s.db.Exec(ctx,
+			`UPDATE alerts SET escalation_level = $2, escalated_at = NOW()
+			 WHERE id = $1 AND escalation_level = $3 AND state = 'active'`,
+			p.alert.ID, step.Level, p.level,
+		)
+		if err != nil {
+			log.Printf("Failed to record escalation for alert %s: %v", p.alert.ID, err)
+			continue
+		}
+		if tag.RowsAffected() == 0 {
+			continue
+		}
+
+		log.Printf("ESCALATE alert %s to level %d of policy %q", p.alert.ID, step.Level, policy.Name)
+
+		alert := p.alert
+		alert.Event = notify.EventEscalated
+		alert.EscalationLevel = step.Level
+		alert.Time = now
+		go s.notifier.Escalate(context.Background(), alert, step)
+	}
+}
+
+// PreviewOnCall returns who on call was, or would have been, paged for an
+// alert under the current routes and escalation policies.
+func (s *AlertService) PreviewOnCall(ctx context.Context, alertID uuid.UUID) ([]notify.Page, error) {
+	alert := notify.Alert{ID: alertID, Event: notify.EventTriggered}
+	var triggeredAt time.Time
+	var ruleID *uuid.UUID
+	err := s.db.QueryRow(ctx,
+		`SELECT a.machine_id, a.severity, a.message, COALESCE(a.triggered_at, a.created_at), a.rule_id, COALESCE(r.name, ''),
+		        COALESCE(m.name, ''), COALESCE(m.type, ''), COALESCE(m.location, '')
+		 FROM alerts a
+		 LEFT JOIN machines m ON m.id = a.machine_id
+		 LEFT JOIN alert_rules r ON r.id = a.rule_id
+		 WHERE a.id = $1`,
+		alertID,
+	).Scan(&alert.MachineID, &alert.Severity, &alert.Message, &triggeredAt, &ruleID, &alert.RuleName,
+		&alert.MachineName, &alert.MachineType, &alert.Location)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrAlertNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ruleID != nil {
+		alert.RuleID = *ruleID
+	}
+	alert.Time = triggeredAt
+
+	return s.notifier.PreviewPages(ctx, alert, triggeredAt)
+}
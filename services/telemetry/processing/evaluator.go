@@ -0,0 +1,95 @@
+package processing
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The evaluation below is shared by live checking (CheckMetric and the
+// background clear check) and Backtest, so a replay behaves like production.
+
+func (r AlertRule) triggered(value float64) bool {
+	switch r.Operator {
+	case ">":
+		return value > r.ThresholdValue
+	case "<":
+		return value < r.ThresholdValue
+	case ">=":
+		return value >= r.ThresholdValue
+	case "<=":
+		return value <= r.ThresholdValue
+	}
+	return false
+}
+
+// holds reports whether the rule's condition is met. value is the reading
+// being checked; values holds the latest reading of each metric an expression
+// references.
+func (r AlertRule) holds(value float64, values map[string]float64) (bool, error) {
+	if r.expr != nil {
+		return r.expr.Evaluate(values)
+	}
+	return r.triggered(value), nil
+}
+
+// clears reports whether an alarm in force returns to normal. With hysteresis
+// a threshold alarm must come back past the threshold by that margin, so a
+// value hovering at the threshold does not chatter. An expression alarm also
+// clears once a metric it needs stops reporting: the condition can no longer
+// be shown to hold, and the alarm would otherwise stay active for good.
+func (r AlertRule) clears(value float64, values map[string]float64) (bool, error) {
+	if r.expr != nil {
+		held, err := r.expr.Evaluate(values)
+		if errors.Is(err, errNoValue) {
+			return true, nil
+		}
+		return !held, err
+	}
+
+	deadband := r
+	switch r.Operator {
+	case ">", ">=":
+		deadband.ThresholdValue -= r.Hysteresis
+	case "<", "<=":
+		deadband.ThresholdValue += r.Hysteresis
+	}
+	return !deadband.triggered(value), nil
+}
+
+// alarmKey identifies one alarm: a rule on a machine.
+type alarmKey struct {
+	machineID uuid.UUID
+	ruleID    uuid.UUID
+}
+
+// onDelay tracks since when each alarm's condition has held, so rules with a
+// duration are raised only once it has held that long.
+type onDelay struct {
+	mu    sync.Mutex
+	since map[alarmKey]time.Time
+}
+
+func newOnDelay() *onDelay {
+	return &onDelay{since: make(map[alarmKey]time.Time)}
+}
+
+// observe records whether the condition holds at `at` and reports whether
+// the alarm should be raised.
+func (d *onDelay) observe(key alarmKey, rule AlertRule, at time.Time, holds bool) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !holds {
+		delete(d.since, key)
+		return false
+	}
+	since, ok := d.since[key]
+	if !ok {
+		since = at
+		d.since[key] = at
+	}
+	return at.Sub(since) >= time.Duration(rule.DurationSeconds)*time.Second
+}
@@ -0,0 +1,234 @@
+package processing
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpressionEvaluate(t *testing.T) {
+	values := map[string]float64{"a": 2, "b": 5, "c": 0, "d": 10}
+
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		// && binds tighter than ||.
+		{"a < 3 && b > 4 || c", true},
+		{"c || a < 3 && b > 4", true},
+		{"a > 3 && b > 4 || c", false},
+		{"a < 3 && (b < 4 || c)", false},
+		{"(a < 3 || c) && b > 4", true},
+		// Comparison binds looser than arithmetic, * tighter than +.
+		{"a + b * 2 == 12", true},
+		{"(a + b) * 2 == 14", true},
+		{"d - a - b == 3", true},
+		{"d / a / b == 1", true},
+		// Unary minus and not.
+		{"-a == 0 - 2", true},
+		{"- -a == a", true},
+		{"-a * -b == 10", true},
+		{"b - -a == 7", true},
+		{"!c", true},
+		{"!(a < 3)", false},
+		{"!!a", true},
+		{"a <= 2 && a >= 2 && a != 3", true},
+		{"1.5 < a", true},
+	}
+	for _, tt := range tests {
+		expr, err := ParseExpression(tt.src)
+		if err != nil {
+			t.Errorf("ParseExpression(%q): %v", tt.src, err)
+			continue
+		}
+		got, err := expr.Evaluate(values)
+		if err != nil {
+			t.Errorf("Evaluate(%q): %v", tt.src, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Evaluate(%q) = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestExpressionMissingValues(t *testing.T) {
+	// Only pressure has a reading inside the window.
+	values := map[string]float64{"pressure": 2}
+
+	tests := []struct {
+		src     string
+		want    bool
+		wantErr string
+	}{
+		{"vibration > 4", false, `no value for metric "vibration"`},
+		{"pressure < 3 && vibration > 4", false, `no value for metric "vibration"`},
+		// The untaken side of a short circuit is never looked up.
+		{"pressure > 3 && vibration > 4", false, ""},
+		{"pressure < 3 || vibration > 4", true, ""},
+		{"pressure / 0 > 1", false, "division by zero"},
+	}
+	for _, tt := range tests {
+		expr, err := ParseExpression(tt.src)
+		if err != nil {
+			t.Fatalf("ParseExpression(%q): %v", tt.src, err)
+		}
+		got, err := expr.Evaluate(values)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Evaluate(%q) error = %v, want %q", tt.src, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Evaluate(%q): %v", tt.src, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Evaluate(%q) = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestExpressionRuleMetricDropsOut(t *testing.T) {
+	rule := AlertRule{ConditionType: ConditionExpression, Expression: "pressure < 3 && vibration > 4", Severity: "warning"}
+	if err := ValidateRule(&rule); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		values   map[string]float64
+		holds    bool
+		holdsErr bool
+		clears   bool
+		missing  []string
+	}{
+		{"in alarm", map[string]float64{"pressure": 2, "vibration": 5}, true, false, false, nil},
+		{"back to normal", map[string]float64{"pressure": 2, "vibration": 3}, false, false, true, nil},
+		{"vibration drops out", map[string]float64{"pressure": 2}, false, true, true, []string{"vibration"}},
+		{"every metric drops out", map[string]float64{}, false, true, true, []string{"pressure", "vibration"}},
+		// pressure alone settles it, so the missing vibration is not needed.
+		{"normal without vibration", map[string]float64{"pressure": 4}, false, false, true, []string{"vibration"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			holds, err := rule.holds(0, tt.values)
+			if (err != nil) != tt.holdsErr || holds != tt.holds {
+				t.Errorf("holds = %v, %v; want %v, error %v", holds, err, tt.holds, tt.holdsErr)
+			}
+			clears, err := rule.clears(0, tt.values)
+			if err != nil || clears != tt.clears {
+				t.Errorf("clears = %v, %v; want %v", clears, err, tt.clears)
+			}
+			if got := missingMetrics(rule, tt.values); !reflect.DeepEqual(got, tt.missing) {
+				t.Errorf("missing = %v, want %v", got, tt.missing)
+			}
+		})
+	}
+}
+
+func TestExpressionRuleClearError(t *testing.T) {
+	// Errors other than a missing metric still keep the alarm in force.
+	rule := AlertRule{ConditionType: ConditionExpression, Expression: "pressure / vibration > 4", Severity: "warning"}
+	if err := ValidateRule(&rule); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rule.clears(0, map[string]float64{"pressure": 2, "vibration": 0}); err == nil || !strings.Contains(err.Error(), "division by zero") {
+		t.Errorf("clears error = %v, want division by zero", err)
+	}
+}
+
+func TestExpressionMetrics(t *testing.T) {
+	expr, err := ParseExpression("vibration > 4 && (pressure < 3 || vibration / current > 0.1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"current", "pressure", "vibration"}
+	if got := expr.Metrics(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Metrics() = %v, want %v", got, want)
+	}
+}
+
+func TestParseExpressionErrors(t *testing.T) {
+	tests := []struct {
+		src     string
+		wantErr string
+	}{
+		{"", "expression is empty"},
+		{"   ", "expression is empty"},
+		{"a <", "unexpected end of expression"},
+		{"a < 3 &&", "unexpected end of expression"},
+		{"-", "unexpected end of expression"},
+		{"(a < 3", "missing closing parenthesis"},
+		{"((a)", "missing closing parenthesis"},
+		{"a < 3)", `unexpected ")"`},
+		{"()", `unexpected ")"`},
+		{"a b", `unexpected "b"`},
+		{"a < 3 4", `unexpected "4"`},
+		{"&& a", `unexpected "&&"`},
+		{"a < * 3", `unexpected "*"`},
+		{"1.2.3 > a", `invalid number "1.2.3"`},
+		{".", `invalid number "."`},
+		{"a & b", "unexpected character '&'"},
+		{"a = 3", "unexpected character '='"},
+		{"a < $3", "unexpected character '$'"},
+	}
+	for _, tt := range tests {
+		expr, err := ParseExpression(tt.src)
+		if err == nil {
+			t.Errorf("ParseExpression(%q) = %v, want error %q", tt.src, expr, tt.wantErr)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("ParseExpression(%q) error = %q, want %q", tt.src, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidateRuleExpression(t *testing.T) {
+	tests := []struct {
+		expression string
+		wantErr    string
+		wantMetric string
+	}{
+		{"pressure < 3 && vibration > 4", "", "pressure"},
+		{"1 < 2", "must reference at least one metric", ""},
+		{"pressure <", "invalid expression", ""},
+	}
+	for _, tt := range tests {
+		rule := AlertRule{ConditionType: ConditionExpression, Expression: tt.expression, Severity: "warning"}
+		err := ValidateRule(&rule)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ValidateRule(%q) error = %v, want %q", tt.expression, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ValidateRule(%q): %v", tt.expression, err)
+			continue
+		}
+		if rule.MetricName != tt.wantMetric {
+			t.Errorf("ValidateRule(%q) metric_name = %q, want %q", tt.expression, rule.MetricName, tt.wantMetric)
+		}
+		if rule.WindowSeconds != defaultWindowSeconds {
+			t.Errorf("ValidateRule(%q) window_seconds = %d, want %d", tt.expression, rule.WindowSeconds, defaultWindowSeconds)
+		}
+	}
+}
+
+// FuzzParseExpression checks that malformed input is rejected with an
+// error, never a panic.
+func FuzzParseExpression(f *testing.F) {
+	for _, src := range []string{"a < 3 && b > 4 || c", "-(a + 2) * !b", "((", "1..2", "a <= >= b"} {
+		f.Add(src)
+	}
+	f.Fuzz(func(t *testing.T, src string) {
+		expr, err := ParseExpression(src)
+		if err != nil {
+			return
+		}
+		expr.Evaluate(map[string]float64{"a": 1, "b": 0})
+	})
+}
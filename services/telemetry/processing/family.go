@@ -0,0 +1,238 @@
+package processing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// What raising an alert did to the open alert for its fingerprint.
+const (
+	raiseCreated     = "created"
+	raiseReactivated = "reactivated"
+	raiseSeverity    = "severity_raised"
+	raiseRepeated    = "repeated"
+)
+
+// raised is the alert a trigger landed on and what it did to it. previous
+// is the alert's severity before the trigger.
+type raised struct {
+	alertID  uuid.UUID
+	outcome  string
+	previous string
+}
+
+// SeverityChange is one step in an alert's severity history. From is nil
+// for the severity the alert was raised with.
+type SeverityChange struct {
+	RuleID    *uuid.UUID `json:"rule_id"`
+	RuleName  string     `json:"rule_name"`
+	From      *string    `json:"from_severity"`
+	To        string     `json:"to_severity"`
+	Value     *float64   `json:"value"`
+	ChangedAt time.Time  `json:"changed_at"`
+}
+
+// alertFingerprint identifies the alarm an alert belongs to. Every tier of a
+// rule family shares one alarm per machine.
+func alertFingerprint(machineID uuid.UUID, rule AlertRule) string {
+	if rule.Family != "" {
+		return fmt.Sprintf("%s:family:%s", machineID, rule.Family)
+	}
+	return fmt.Sprintf("%s:%s", machineID, rule.ID)
+}
+
+// raise records a rule triggering on a machine against the open alert for
+// its fingerprint. The partial unique index on open fingerprints means
+// readings checked in parallel cannot raise duplicates: the loser of an
+// insert race finds the winner's alert and updates it instead.
+func (s *AlertService) raise(ctx context.Context, machineID uuid.UUID, rule AlertRule, message string, evaluated []byte, suppressedBy string, value float64) (raised, error) {
+	fingerprint := alertFingerprint(machineID, rule)
+
+	// An open alert can close between the insert and the lookup; the second
+	// attempt then inserts.
+	for attempt := 0; attempt < 2; attempt++ {
+		r, err := s.raiseOnce(ctx, machineID, rule, fingerprint, message, evaluated, suppressedBy, value)
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return r, err
+		}
+	}
+	return raised{}, fmt.Errorf("alert %s kept closing while being raised", fingerprint)
+}
+
+func (s *AlertService) raiseOnce(ctx context.Context, machineID uuid.UUID, rule AlertRule, fingerprint, message string, evaluated []byte, suppressedBy string, value float64) (raised, error) {
+	r := raised{outcome: raiseRepeated}
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return r, err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(ctx,
+		`INSERT INTO alerts (machine_id, rule_id, rule_revision, severity, message, evaluated_values, suppressed, suppressed_by,
+		                     fingerprint, triggered_at, last_value, last_seen_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), $9, NOW(), $10, NOW())
+		 ON CONFLICT (fingerprint) WHERE state <> 'closed' DO NOTHING
+		 RETURNING id`,
+		machineID, rule.ID, rule.Revision, rule.Severity, message, evaluated, suppressedBy != "", suppressedBy, fingerprint, value,
+	).Scan(&r.alertID)
+	if err == nil {
+		r.outcome = raiseCreated
+		if err := recordSeverity(ctx, tx, r.alertID, rule, nil, value); err != nil {
+			return r, err
+		}
+		return r, tx.Commit(ctx)
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return r, err
+	}
+
+	var state string
+	err = tx.QueryRow(ctx,
+		"SELECT id, state, severity FROM alerts WHERE fingerprint = $1 AND state <> 'closed' FOR UPDATE",
+		fingerprint,
+	).Scan(&r.alertID, &state, &r.previous)
+	if err != nil {
+		return r, err
+	}
+
+	switch {
+	case state == AlertStateResolved:
+		// An alarm that returned to normal but was never acknowledged goes
+		// back into alarm, at the tier that triggered it.
+		r.outcome = raiseReactivated
+		_, err = tx.Exec(ctx,
+			`UPDATE alerts SET state = 'active', cleared_at = NULL, triggered_at = NOW(), escalation_level = 0, escalated_at = NULL,
+			        rule_id = $2, rule_revision = $3, severity = $4, message = $5, evaluated_values = $6,
+			        occurrences = occurrences + 1, last_value = $7, last_seen_at = NOW()
+			 WHERE id = $1`,
+			r.alertID, rule.ID, rule.Revision, rule.Severity, message, evaluated, value,
+		)
+	case severityRank[rule.Severity] > severityRank[r.previous]:
+		// A higher tier of the family takes the alert over.
+		r.outcome = raiseSeverity
+		_, err = tx.Exec(ctx,
+			`UPDATE alerts SET rule_id = $2, rule_revision = $3, severity = $4, message = $5, evaluated_values = $6,
+			        occurrences = occurrences + 1, last_value = $7, last_seen_at = NOW()
+			 WHERE id = $1`,
+			r.alertID, rule.ID, rule.Revision, rule.Severity, message, evaluated, value,
+		)
+	default:
+		_, err = tx.Exec(ctx,
+			"UPDATE alerts SET occurrences = occurrences + 1, last_value = $2, last_seen_at = NOW() WHERE id = $1",
+			r.alertID, value,
+		)
+	}
+	if err != nil {
+		return r, err
+	}
+	if r.previous != rule.Severity && r.outcome != raiseRepeated {
+		if err := recordSeverity(ctx, tx, r.alertID, rule, &r.previous, value); err != nil {
+			return r, err
+		}
+	}
+	return r, tx.Commit(ctx)
+}
+
+func recordSeverity(ctx context.Context, tx pgx.Tx, alertID uuid.UUID, rule AlertRule, from *string, value float64) error {
+	_, err := tx.Exec(ctx,
+		`INSERT INTO alert_severity_changes (alert_id, rule_id, from_severity, to_severity, value)
+		 VALUES ($1, $2, $3, $4, $5)`,
+		alertID, rule.ID, from, rule.Severity, value,
+	)
+	return err
+}
+
+// lowerTier returns the highest tier of the rule's family below it that
+// still holds, for an alert whose current tier has cleared.
+func (s *AlertService) lowerTier(rule AlertRule, value float64, values map[string]float64) (AlertRule, bool) {
+	if rule.Family == "" {
+		return AlertRule{}, false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var best AlertRule
+	found := false
+	for _, r := range s.rules {
+		if r.Family != rule.Family || r.ID == rule.ID || severityRank[r.Severity] >= severityRank[rule.Severity] {
+			continue
+		}
+		if found && severityRank[r.Severity] <= severityRank[best.Severity] {
+			continue
+		}
+		if holds, err := r.holds(value, values); err == nil && holds {
+			best, found = r, true
+		}
+	}
+	return best, found
+}
+
+// lowerSeverity hands an open alert to a lower tier of its family when the
+// tier it was at clears but the lower one still holds.
+func (s *AlertService) lowerSeverity(ctx context.Context, alertID uuid.UUID, from, to AlertRule, value float64) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx,
+		`UPDATE alerts SET rule_id = $3, rule_revision = $4, severity = $5, last_value = $6, last_seen_at = NOW()
+		 WHERE id = $1 AND rule_id = $2 AND state IN ('active', 'acknowledged')`,
+		alertID, from.ID, to.ID, to.Revision, to.Severity, value,
+	)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return nil
+	}
+	if err := recordSeverity(ctx, tx, alertID, to, &from.Severity, value); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// ListSeverityChanges returns an alert's severity history, oldest first.
+func ListSeverityChanges(ctx context.Context, pool *pgxpool.Pool, alertID uuid.UUID) ([]SeverityChange, error) {
+	rows, err := pool.Query(ctx,
+		`SELECT c.rule_id, COALESCE(r.name, ''), c.from_severity, c.to_severity, c.value, c.changed_at
+		 FROM alert_severity_changes c LEFT JOIN alert_rules r ON r.id = c.rule_id
+		 WHERE c.alert_id = $1
+		 ORDER BY c.changed_at, c.id`,
+		alertID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []SeverityChange
+	for rows.Next() {
+		var c SeverityChange
+		if err := rows.Scan(&c.RuleID, &c.RuleName, &c.From, &c.To, &c.Value, &c.ChangedAt); err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(changes) == 0 {
+		var exists bool
+		if err := pool.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM alerts WHERE id = $1)", alertID).Scan(&exists); err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, ErrAlertNotFound
+		}
+	}
+	return changes, nil
+}
@@ -0,0 +1,419 @@
+package processing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// CorrelationWindow is how long after its last alert an incident keeps
+// absorbing new alerts from the same location.
+const CorrelationWindow = 5 * time.Minute
+
+const (
+	IncidentStateOpen     = "open"
+	IncidentStateResolved = "resolved"
+)
+
+var (
+	ErrIncidentNotFound = errors.New("incident not found")
+	ErrRelationNotFound = errors.New("rule relation not found")
+)
+
+var severityRank = map[string]int{"info": 1, "warning": 2, "critical": 3}
+
+// Incident groups alerts from one location that fired together, such as every
+// pump in a building reacting to a power dip.
+type Incident struct {
+	ID             uuid.UUID  `json:"id"`
+	Title          string     `json:"title"`
+	Location       string     `json:"location"`
+	State          string     `json:"state"`
+	Severity       string     `json:"severity"`
+	RootAlertID    uuid.UUID  `json:"root_alert_id"`
+	RootRuleName   string     `json:"root_rule_name"`
+	AlertCount     int        `json:"alert_count"`
+	OpenedAt       time.Time  `json:"opened_at"`
+	LastActivityAt time.Time  `json:"last_activity_at"`
+	ResolvedAt     *time.Time `json:"resolved_at"`
+}
+
+type IncidentAlert struct {
+	AlertID     uuid.UUID `json:"alert_id"`
+	MachineID   uuid.UUID `json:"machine_id"`
+	MachineName string    `json:"machine_name"`
+	RuleName    string    `json:"rule_name"`
+	Severity    string    `json:"severity"`
+	State       string    `json:"state"`
+	Message     string    `json:"message"`
+	Notified    bool      `json:"notified"`
+	AddedAt     time.Time `json:"added_at"`
+}
+
+type IncidentEvent struct {
+	At      time.Time  `json:"at"`
+	Kind    string     `json:"kind"`
+	AlertID *uuid.UUID `json:"alert_id"`
+	Detail  string     `json:"detail"`
+}
+
+// IncidentDetail is an incident with its alerts and timeline.
+type IncidentDetail struct {
+	Incident
+	Alerts   []IncidentAlert `json:"alerts"`
+	Timeline []IncidentEvent `json:"timeline"`
+}
+
+// RuleRelation records that alerts from Cause commonly trigger alerts from
+// Effect, so Cause is preferred as an incident's root cause.
+type RuleRelation struct {
+	ID           uuid.UUID `json:"id"`
+	CauseRuleID  uuid.UUID `json:"cause_rule_id"`
+	CauseRule    string    `json:"cause_rule"`
+	EffectRuleID uuid.UUID `json:"effect_rule_id"`
+	EffectRule   string    `json:"effect_rule"`
+}
+
+// correlate files a new alert under an open incident for its location, or
+// opens one. It reports whether the alert should be notified on its own: the
+// alert opening an incident is, and so is one raising the incident's
+// severity; the rest are covered by the incident's first notification.
+// Machines with no location share nothing to correlate on, so their alerts
+// are left out of incidents and notified individually.
+func (s *AlertService) correlate(ctx context.Context, alertID, machineID uuid.UUID, rule AlertRule) (bool, error) {
+	var location string
+	err := s.db.QueryRow(ctx, "SELECT COALESCE(location, '') FROM machines WHERE id = $1", machineID).Scan(&location)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return true, err
+	}
+	if location == "" {
+		return true, nil
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return true, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Alerts from one location arrive concurrently; serialize them so they
+	// land in a single incident.
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext('incident:' || $1))", location); err != nil {
+		return true, err
+	}
+
+	var incidentID, rootAlertID uuid.UUID
+	var severity string
+	var rootRuleID *uuid.UUID
+	err = tx.QueryRow(ctx,
+		`SELECT i.id, i.severity, i.root_alert_id, a.rule_id
+		 FROM incidents i JOIN alerts a ON a.id = i.root_alert_id
+		 WHERE i.location = $1 AND i.state = 'open' AND i.last_activity_at >= NOW() - make_interval(secs => $2)
+		 ORDER BY i.last_activity_at DESC LIMIT 1`,
+		location, CorrelationWindow.Seconds(),
+	).Scan(&incidentID, &severity, &rootAlertID, &rootRuleID)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		title := incidentTitle(rule, location)
+		err = tx.QueryRow(ctx,
+			`INSERT INTO incidents (title, location, severity, root_alert_id) VALUES ($1, $2, $3, $4) RETURNING id`,
+			title, location, rule.Severity, alertID,
+		).Scan(&incidentID)
+		if err != nil {
+			return true, err
+		}
+		if err := addToIncident(ctx, tx, incidentID, alertID, true); err != nil {
+			return true, err
+		}
+		if err := incidentEvent(ctx, tx, incidentID, "opened", &alertID, title); err != nil {
+			return true, err
+		}
+		log.Printf("Opened incident %s: %s", incidentID, title)
+		return true, tx.Commit(ctx)
+	}
+	if err != nil {
+		return true, err
+	}
+
+	raised := severityRank[rule.Severity] > severityRank[severity]
+	if err := addToIncident(ctx, tx, incidentID, alertID, raised); err != nil {
+		return true, err
+	}
+	if err := incidentEvent(ctx, tx, incidentID, "alert_added", &alertID, rule.Name); err != nil {
+		return true, err
+	}
+	if raised {
+		_, err := tx.Exec(ctx, "UPDATE incidents SET severity = $2 WHERE id = $1", incidentID, rule.Severity)
+		if err != nil {
+			return true, err
+		}
+		if err := incidentEvent(ctx, tx, incidentID, "severity_raised", &alertID, severity+" -> "+rule.Severity); err != nil {
+			return true, err
+		}
+	}
+
+	if rootRuleID != nil {
+		var causes bool
+		err := tx.QueryRow(ctx,
+			"SELECT EXISTS (SELECT 1 FROM rule_relations WHERE cause_rule_id = $1 AND effect_rule_id = $2)",
+			rule.ID, *rootRuleID,
+		).Scan(&causes)
+		if err != nil {
+			return true, err
+		}
+		if causes {
+			title := incidentTitle(rule, location)
+			_, err := tx.Exec(ctx, "UPDATE incidents SET root_alert_id = $2, title = $3 WHERE id = $1", incidentID, alertID, title)
+			if err != nil {
+				return true, err
+			}
+			if err := incidentEvent(ctx, tx, incidentID, "root_cause_changed", &alertID, rule.Name); err != nil {
+				return true, err
+			}
+		}
+	}
+
+	_, err = tx.Exec(ctx, "UPDATE incidents SET last_activity_at = NOW() WHERE id = $1", incidentID)
+	if err != nil {
+		return true, err
+	}
+	return raised, tx.Commit(ctx)
+}
+
+func incidentTitle(rule AlertRule, location string) string {
+	if location == "" {
+		return rule.Name
+	}
+	return rule.Name + " at " + location
+}
+
+func addToIncident(ctx context.Context, tx pgx.Tx, incidentID, alertID uuid.UUID, notified bool) error {
+	_, err := tx.Exec(ctx,
+		"INSERT INTO incident_alerts (incident_id, alert_id, notified) VALUES ($1, $2, $3)",
+		incidentID, alertID, notified,
+	)
+	return err
+}
+
+func incidentEvent(ctx context.Context, tx pgx.Tx, incidentID uuid.UUID, kind string, alertID *uuid.UUID, detail string) error {
+	_, err := tx.Exec(ctx,
+		"INSERT INTO incident_events (incident_id, kind, alert_id, detail) VALUES ($1, $2, $3, $4)",
+		incidentID, kind, alertID, detail,
+	)
+	return err
+}
+
+// resolveIncidents closes incidents once none of their alerts is still in
+// alarm or awaiting acknowledgement.
+func (s *AlertService) resolveIncidents(ctx context.Context) {
+	rows, err := s.db.Query(ctx,
+		`UPDATE incidents i SET state = 'resolved', resolved_at = NOW()
+		 WHERE i.state = 'open' AND i.last_activity_at < NOW() - make_interval(secs => $1)
+		   AND NOT EXISTS (
+			 SELECT 1 FROM incident_alerts ia JOIN alerts a ON a.id = ia.alert_id
+			 WHERE ia.incident_id = i.id AND a.state IN ('active', 'acknowledged')
+		   )
+		 RETURNING i.id`,
+		CorrelationWindow.Seconds(),
+	)
+	if err != nil {
+		log.Printf("Failed to resolve incidents: %v", err)
+		return
+	}
+	var resolved []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err == nil {
+			resolved = append(resolved, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range resolved {
+		_, err := s.db.Exec(ctx,
+			"INSERT INTO incident_events (incident_id, kind, detail) VALUES ($1, 'resolved', 'all alerts cleared')", id)
+		if err != nil {
+			log.Printf("Failed to record resolution of incident %s: %v", id, err)
+		}
+		log.Printf("Incident %s resolved", id)
+	}
+}
+
+// AcknowledgeIncident acknowledges every open alert in the incident and
+// returns how many changed state.
+func (s *AlertService) AcknowledgeIncident(ctx context.Context, id uuid.UUID, user string) (int, error) {
+	detail, err := GetIncident(ctx, s.db, id)
+	if err != nil {
+		return 0, err
+	}
+
+	acknowledged := 0
+	for _, a := range detail.Alerts {
+		if a.State != AlertStateActive && a.State != AlertStateResolved {
+			continue
+		}
+		if _, err := s.Acknowledge(ctx, a.AlertID, user); err != nil {
+			if errors.Is(err, ErrInvalidTransition) {
+				continue
+			}
+			return acknowledged, err
+		}
+		acknowledged++
+	}
+
+	_, err = s.db.Exec(ctx,
+		"INSERT INTO incident_events (incident_id, kind, detail) VALUES ($1, 'acknowledged', $2)",
+		id, fmt.Sprintf("%s acknowledged %d alerts", user, acknowledged),
+	)
+	return acknowledged, err
+}
+
+const incidentColumns = `i.id, i.title, i.location, i.state, i.severity, i.root_alert_id, COALESCE(r.name, ''),
+	(SELECT count(*) FROM incident_alerts ia WHERE ia.incident_id = i.id),
+	i.opened_at, i.last_activity_at, i.resolved_at`
+
+func scanIncident(row pgx.Row) (Incident, error) {
+	var i Incident
+	err := row.Scan(&i.ID, &i.Title, &i.Location, &i.State, &i.Severity, &i.RootAlertID, &i.RootRuleName,
+		&i.AlertCount, &i.OpenedAt, &i.LastActivityAt, &i.ResolvedAt)
+	return i, err
+}
+
+func ListIncidents(ctx context.Context, pool *pgxpool.Pool, state string) ([]Incident, error) {
+	rows, err := pool.Query(ctx,
+		`SELECT `+incidentColumns+`
+		 FROM incidents i
+		 LEFT JOIN alerts a ON a.id = i.root_alert_id
+		 LEFT JOIN alert_rules r ON r.id = a.rule_id
+		 WHERE $1 = '' OR i.state = $1
+		 ORDER BY i.opened_at DESC LIMIT 100`,
+		state,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var incidents []Incident
+	for rows.Next() {
+		i, err := scanIncident(rows)
+		if err != nil {
+			return nil, err
+		}
+		incidents = append(incidents, i)
+	}
+	return incidents, rows.Err()
+}
+
+func GetIncident(ctx context.Context, pool *pgxpool.Pool, id uuid.UUID) (IncidentDetail, error) {
+	var detail IncidentDetail
+	incident, err := scanIncident(pool.QueryRow(ctx,
+		`SELECT `+incidentColumns+`
+		 FROM incidents i
+		 LEFT JOIN alerts a ON a.id = i.root_alert_id
+		 LEFT JOIN alert_rules r ON r.id = a.rule_id
+		 WHERE i.id = $1`,
+		id,
+	))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return detail, ErrIncidentNotFound
+	}
+	if err != nil {
+		return detail, err
+	}
+	detail.Incident = incident
+	detail.Alerts = []IncidentAlert{}
+	detail.Timeline = []IncidentEvent{}
+
+	rows, err := pool.Query(ctx,
+		`SELECT a.id, a.machine_id, COALESCE(m.name, ''), COALESCE(r.name, ''), a.severity, a.state, a.message, ia.notified, ia.added_at
+		 FROM incident_alerts ia
+		 JOIN alerts a ON a.id = ia.alert_id
+		 LEFT JOIN machines m ON m.id = a.machine_id
+		 LEFT JOIN alert_rules r ON r.id = a.rule_id
+		 WHERE ia.incident_id = $1
+		 ORDER BY ia.added_at`,
+		id,
+	)
+	if err != nil {
+		return detail, err
+	}
+	for rows.Next() {
+		var a IncidentAlert
+		if err := rows.Scan(&a.AlertID, &a.MachineID, &a.MachineName, &a.RuleName, &a.Severity, &a.State, &a.Message, &a.Notified, &a.AddedAt); err != nil {
+			rows.Close()
+			return detail, err
+		}
+		detail.Alerts = append(detail.Alerts, a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return detail, err
+	}
+
+	rows, err = pool.Query(ctx,
+		"SELECT at, kind, alert_id, detail FROM incident_events WHERE incident_id = $1 ORDER BY at, id",
+		id,
+	)
+	if err != nil {
+		return detail, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e IncidentEvent
+		if err := rows.Scan(&e.At, &e.Kind, &e.AlertID, &e.Detail); err != nil {
+			return detail, err
+		}
+		detail.Timeline = append(detail.Timeline, e)
+	}
+	return detail, rows.Err()
+}
+
+func ListRuleRelations(ctx context.Context, pool *pgxpool.Pool) ([]RuleRelation, error) {
+	rows, err := pool.Query(ctx,
+		`SELECT rr.id, rr.cause_rule_id, c.name, rr.effect_rule_id, e.name
+		 FROM rule_relations rr
+		 JOIN alert_rules c ON c.id = rr.cause_rule_id
+		 JOIN alert_rules e ON e.id = rr.effect_rule_id
+		 ORDER BY c.name, e.name`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var relations []RuleRelation
+	for rows.Next() {
+		var r RuleRelation
+		if err := rows.Scan(&r.ID, &r.CauseRuleID, &r.CauseRule, &r.EffectRuleID, &r.EffectRule); err != nil {
+			return nil, err
+		}
+		relations = append(relations, r)
+	}
+	return relations, rows.Err()
+}
+
+func CreateRuleRelation(ctx context.Context, pool *pgxpool.Pool, causeRuleID, effectRuleID uuid.UUID) (uuid.UUID, error) {
+	var id uuid.UUID
+	err := pool.QueryRow(ctx,
+		`INSERT INTO rule_relations (cause_rule_id, effect_rule_id) VALUES ($1, $2)
+		 ON CONFLICT (cause_rule_id, effect_rule_id) DO UPDATE SET cause_rule_id = EXCLUDED.cause_rule_id
+		 RETURNING id`,
+		causeRuleID, effectRuleID,
+	).Scan(&id)
+	return id, err
+}
+
+func DeleteRuleRelation(ctx context.Context, pool *pgxpool.Pool, id uuid.UUID) error {
+	tag, err := pool.Exec(ctx, "DELETE FROM rule_relations WHERE id = $1", id)
+	if err == nil && tag.RowsAffected() == 0 {
+		return ErrRelationNotFound
+	}
+	return err
+}
@@ -0,0 +1,91 @@
+package processing
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// Alert states follow ISA-18.2: an alarm is cleared by the process and
+// acknowledged by a person independently, and only closes once both happened.
+const (
+	// AlertStateActive is in alarm and not yet acknowledged.
+	AlertStateActive = "active"
+	// AlertStateAcknowledged is still in alarm but an operator has acknowledged it.
+	AlertStateAcknowledged = "acknowledged"
+	// AlertStateResolved has returned to normal without being acknowledged.
+	AlertStateResolved = "resolved"
+	// AlertStateClosed has returned to normal and been acknowledged, or was closed by an operator.
+	// Alerts the system auto-cleared before these states existed are closed but unacknowledged,
+	// so open alerts are found by state, never by the acknowledged flag.
+	AlertStateClosed = "closed"
+)
+
+var AlertStates = []string{AlertStateActive, AlertStateAcknowledged, AlertStateResolved, AlertStateClosed}
+
+var (
+	ErrAlertNotFound     = errors.New("alert not found")
+	ErrInvalidTransition = errors.New("alert cannot make that transition from its current state")
+)
+
+// Acknowledge records that user has seen the alert. An alert that already
+// returned to normal closes; one still in alarm moves to acknowledged.
+func (s *AlertService) Acknowledge(ctx context.Context, alertID uuid.UUID, user string) (string, error) {
+	var state string
+	err := s.db.QueryRow(ctx,
+		`UPDATE alerts SET
+			acknowledged = true, acknowledged_by = $2, acknowledged_at = NOW(),
+			state = CASE WHEN state = 'resolved' THEN 'closed' ELSE 'acknowledged' END,
+			closed_at = CASE WHEN state = 'resolved' THEN NOW() END,
+			closed_by = CASE WHEN state = 'resolved' THEN $2 END
+		 WHERE id = $1 AND state IN ('active', 'resolved')
+		 RETURNING state`,
+		alertID, user,
+	).Scan(&state)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", s.transitionError(ctx, alertID)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("Alert %s acknowledged by %s (now %s)", alertID, user, state)
+	return state, nil
+}
+
+// Close lets an operator close an alert regardless of whether it cleared,
+// e.g. for a sensor fault that will never return to normal on its own.
+func (s *AlertService) Close(ctx context.Context, alertID uuid.UUID, user string) error {
+	tag, err := s.db.Exec(ctx,
+		`UPDATE alerts SET
+			state = 'closed', closed_at = NOW(), closed_by = $2,
+			acknowledged = true,
+			acknowledged_by = COALESCE(acknowledged_by, $2),
+			acknowledged_at = COALESCE(acknowledged_at, NOW())
+		 WHERE id = $1 AND state <> 'closed'`,
+		alertID, user,
+	)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return s.transitionError(ctx, alertID)
+	}
+
+	log.Printf("Alert %s closed by %s", alertID, user)
+	return nil
+}
+
+func (s *AlertService) transitionError(ctx context.Context, alertID uuid.UUID) error {
+	var exists bool
+	if err := s.db.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM alerts WHERE id = $1)", alertID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrAlertNotFound
+	}
+	return ErrInvalidTransition
+}
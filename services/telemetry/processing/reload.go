@@ -0,0 +1,84 @@
+package processing
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+)
+
+// RulesChannel is the Postgres NOTIFY channel a trigger on alert_rules
+// signals, with the new rule version as payload, on every change.
+const RulesChannel = "alert_rules_changed"
+
+// RuleSetVersion describes the rule set an instance is evaluating.
+type RuleSetVersion struct {
+	Version  int64     `json:"version"`
+	LoadedAt time.Time `json:"loaded_at"`
+	Rules    int       `json:"rules"`
+}
+
+// ReloadRules reloads the rule set right away. API handlers call it after
+// writing a rule so the change applies before they respond; other instances
+// pick it up through ListenForRuleChanges.
+func (s *AlertService) ReloadRules(ctx context.Context) error {
+	return s.loadRules(ctx)
+}
+
+func (s *AlertService) RulesVersion() RuleSetVersion {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return RuleSetVersion{Version: s.rulesVersion, LoadedAt: s.rulesLoadedAt, Rules: len(s.rules)}
+}
+
+// ListenForRuleChanges reloads the rules whenever another writer changes
+// them. Notifications sent while the connection is down are lost, so the
+// rules are reloaded on every reconnect as well.
+func (s *AlertService) ListenForRuleChanges(ctx context.Context) {
+	log.Printf("Listening for alert rule changes on %s", RulesChannel)
+	for {
+		err := s.listenRules(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Alert rule listener disconnected, retrying: %v", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (s *AlertService) listenRules(ctx context.Context) error {
+	pooled, err := s.db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// A connection that was LISTENing must not go back to the pool.
+	conn := pooled.Hijack()
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+RulesChannel); err != nil {
+		return err
+	}
+	if err := s.loadRules(ctx); err != nil {
+		log.Printf("Failed to reload alert rules: %v", err)
+	}
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		version, err := strconv.ParseInt(n.Payload, 10, 64)
+		if err == nil && version <= s.RulesVersion().Version {
+			continue
+		}
+		if err := s.loadRules(ctx); err != nil {
+			log.Printf("Failed to reload alert rules: %v", err)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package processing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	ErrRuleNotFound = errors.New("rule not found")
+	// ErrRuleConflict is returned when an update names a revision that is no
+	// longer the rule's latest.
+	ErrRuleConflict = errors.New("rule was changed by someone else")
+	// ErrInvalidFamily is returned when a rule does not fit the family it
+	// names: tiers must watch the same metric and differ in severity.
+	ErrInvalidFamily = errors.New("invalid rule family")
+)
+
+const (
+	RuleCreated = "created"
+	RuleUpdated = "updated"
+	RuleDeleted = "deleted"
+)
+
+// RuleRevision is a snapshot of a rule as it was after one change. Alerts
+// record the revision that raised them.
+type RuleRevision struct {
+	RuleID          uuid.UUID `json:"rule_id"`
+	Revision        int       `json:"revision"`
+	Name            string    `json:"name"`
+	MetricName      string    `json:"metric_name"`
+	ConditionType   string    `json:"condition_type"`
+	ThresholdValue  *float64  `json:"threshold_value"`
+	Operator        *string   `json:"operator"`
+	Severity        string    `json:"severity"`
+	Enabled         bool      `json:"enabled"`
+	Expression      *string   `json:"expression"`
+	WindowSeconds   *int      `json:"window_seconds"`
+	DurationSeconds int       `json:"duration_seconds"`
+	Hysteresis      float64   `json:"hysteresis"`
+	Family          *string   `json:"family"`
+	Change          string    `json:"change"`
+	ChangedBy       string    `json:"changed_by"`
+	ChangedAt       time.Time `json:"changed_at"`
+}
+
+// RulePatch holds the fields a PATCH changes; nil fields are left as they are.
+type RulePatch struct {
+	Name            *string  `json:"name"`
+	MetricName      *string  `json:"metric_name"`
+	ConditionType   *string  `json:"condition_type"`
+	ThresholdValue  *float64 `json:"threshold_value"`
+	Operator        *string  `json:"operator"`
+	Severity        *string  `json:"severity"`
+	Enabled         *bool    `json:"enabled"`
+	Expression      *string  `json:"expression"`
+	WindowSeconds   *int     `json:"window_seconds"`
+	DurationSeconds *int     `json:"duration_seconds"`
+	Hysteresis      *float64 `json:"hysteresis"`
+	Family          *string  `json:"family"`
+	Revision        *int     `json:"revision"`
+}
+
+func (p RulePatch) Apply(rule *AlertRule) {
+	if p.Name != nil {
+		rule.Name = *p.Name
+	}
+	if p.MetricName != nil {
+		rule.MetricName = *p.MetricName
+	}
+	if p.ConditionType != nil {
+		rule.ConditionType = *p.ConditionType
+	}
+	if p.ThresholdValue != nil {
+		rule.ThresholdValue = *p.ThresholdValue
+	}
+	if p.Operator != nil {
+		rule.Operator = *p.Operator
+	}
+	if p.Severity != nil {
+		rule.Severity = *p.Severity
+	}
+	if p.Enabled != nil {
+		rule.Enabled = *p.Enabled
+	}
+	if p.Expression != nil {
+		rule.Expression = *p.Expression
+	}
+	if p.WindowSeconds != nil {
+		rule.WindowSeconds = *p.WindowSeconds
+	}
+	if p.DurationSeconds != nil {
+		rule.DurationSeconds = *p.DurationSeconds
+	}
+	if p.Hysteresis != nil {
+		rule.Hysteresis = *p.Hysteresis
+	}
+	if p.Family != nil {
+		rule.Family = *p.Family
+	}
+	if p.Revision != nil {
+		rule.Revision = *p.Revision
+	}
+}
+
+const ruleColumns = `id, name, metric_name, condition_type, COALESCE(threshold_value, 0), COALESCE(operator, ''), severity, enabled,
+	COALESCE(expression, ''), COALESCE(window_seconds, 0), duration_seconds, hysteresis, COALESCE(family, ''), revision, created_at, updated_at, deleted_at`
+
+func scanRule(row pgx.Row) (AlertRule, error) {
+	var r AlertRule
+	err := row.Scan(&r.ID, &r.Name, &r.MetricName, &r.ConditionType, &r.ThresholdValue, &r.Operator, &r.Severity, &r.Enabled,
+		&r.Expression, &r.WindowSeconds, &r.DurationSeconds, &r.Hysteresis, &r.Family, &r.Revision, &r.CreatedAt, &r.UpdatedAt, &r.DeletedAt)
+	return r, err
+}
+
+// ruleValues returns the condition columns as stored: threshold rules keep no
+// expression and expression rules no threshold or operator.
+func ruleValues(rule AlertRule) (threshold *float64, operator, expression *string) {
+	if rule.ConditionType == ConditionExpression {
+		return nil, nil, &rule.Expression
+	}
+	return &rule.ThresholdValue, &rule.Operator, nil
+}
+
+// ListRules returns the rules, including soft-deleted ones if includeDeleted.
+func ListRules(ctx context.Context, pool *pgxpool.Pool, includeDeleted bool) ([]AlertRule, error) {
+	rows, err := pool.Query(ctx,
+		"SELECT "+ruleColumns+" FROM alert_rules WHERE deleted_at IS NULL OR $1 ORDER BY name",
+		includeDeleted,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []AlertRule
+	for rows.Next() {
+		r, err := scanRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+func GetRule(ctx context.Context, pool *pgxpool.Pool, id uuid.UUID) (AlertRule, error) {
+	rule, err := scanRule(pool.QueryRow(ctx, "SELECT "+ruleColumns+" FROM alert_rules WHERE id = $1", id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return rule, ErrRuleNotFound
+	}
+	return rule, err
+}
+
+// CreateRule stores a validated rule as revision 1.
+func CreateRule(ctx context.Context, pool *pgxpool.Pool, rule AlertRule, user string) (AlertRule, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return rule, err
+	}
+	defer tx.Rollback(ctx)
+
+	if rule.WindowSeconds == 0 {
+		rule.WindowSeconds = defaultWindowSeconds
+	}
+	if err := checkFamily(ctx, tx, rule); err != nil {
+		return rule, err
+	}
+	threshold, operator, expression := ruleValues(rule)
+	err = tx.QueryRow(ctx,
+		`INSERT INTO alert_rules (name, metric_name, condition_type, threshold_value, operator, severity, enabled, expression, window_seconds,
+		                          duration_seconds, hysteresis, family)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, NULLIF($12, '')) RETURNING id`,
+		rule.Name, rule.MetricName, rule.ConditionType, threshold, operator, rule.Severity, rule.Enabled, expression, rule.WindowSeconds,
+		rule.DurationSeconds, rule.Hysteresis, rule.Family,
+	).Scan(&rule.ID)
+	if err != nil {
+		return rule, err
+	}
+	return commitRevision(ctx, tx, rule.ID, RuleCreated, user)
+}
+
+// UpdateRule replaces a rule and records a new revision. When rule.Revision
+// is set it must be the current revision, so concurrent edits are not lost.
+func UpdateRule(ctx context.Context, pool *pgxpool.Pool, rule AlertRule, user string) (AlertRule, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return rule, err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := checkFamily(ctx, tx, rule); err != nil {
+		return rule, err
+	}
+	threshold, operator, expression := ruleValues(rule)
+	tag, err := tx.Exec(ctx,
+		`UPDATE alert_rules SET
+			name = $2, metric_name = $3, condition_type = $4, threshold_value = $5, operator = $6, severity = $7,
+			enabled = $8, expression = $9, window_seconds = COALESCE(NULLIF($10, 0), window_seconds),
+			duration_seconds = $12, hysteresis = $13, family = NULLIF($14, ''), revision = revision + 1, updated_at = NOW()
+		 WHERE id = $1 AND deleted_at IS NULL AND ($11 = 0 OR revision = $11)`,
+		rule.ID, rule.Name, rule.MetricName, rule.ConditionType, threshold, operator, rule.Severity,
+		rule.Enabled, expression, rule.WindowSeconds, rule.Revision, rule.DurationSeconds, rule.Hysteresis, rule.Family,
+	)
+	if err != nil {
+		return rule, err
+	}
+	if tag.RowsAffected() == 0 {
+		return rule, ruleWriteError(ctx, tx, rule.ID)
+	}
+	if !rule.Enabled {
+		if err := closeRuleAlerts(ctx, tx, rule.ID, user); err != nil {
+			return rule, err
+		}
+	}
+	return commitRevision(ctx, tx, rule.ID, RuleUpdated, user)
+}
+
+// DeleteRule soft-deletes a rule: it stops evaluating but stays available
+// for the alerts and revisions that reference it. Its open alerts are closed.
+func DeleteRule(ctx context.Context, pool *pgxpool.Pool, id uuid.UUID, user string) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx,
+		`UPDATE alert_rules SET enabled = false, deleted_at = NOW(), updated_at = NOW(), revision = revision + 1
+		 WHERE id = $1 AND deleted_at IS NULL`,
+		id,
+	)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrRuleNotFound
+	}
+	if err := closeRuleAlerts(ctx, tx, id, user); err != nil {
+		return err
+	}
+	_, err = commitRevision(ctx, tx, id, RuleDeleted, user)
+	return err
+}
+
+// closeRuleAlerts closes the alerts still in alarm for a rule that stopped
+// evaluating. Nothing would ever clear them or stop their escalation.
+func closeRuleAlerts(ctx context.Context, tx pgx.Tx, id uuid.UUID, user string) error {
+	_, err := tx.Exec(ctx,
+		`UPDATE alerts SET state = 'closed', cleared_at = COALESCE(cleared_at, NOW()), closed_at = NOW(), closed_by = $2
+		 WHERE rule_id = $1 AND state IN ('active', 'acknowledged')`,
+		id, user,
+	)
+	return err
+}
+
+// checkFamily makes sure a rule can join the family it names: every tier
+// watches the same metric and no two share a severity.
+func checkFamily(ctx context.Context, tx pgx.Tx, rule AlertRule) error {
+	if rule.Family == "" {
+		return nil
+	}
+	rows, err := tx.Query(ctx,
+		`SELECT name, metric_name, severity FROM alert_rules
+		 WHERE family = $1 AND id <> $2 AND deleted_at IS NULL`,
+		rule.Family, rule.ID,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, metricName, severity string
+		if err := rows.Scan(&name, &metricName, &severity); err != nil {
+			return err
+		}
+		if metricName != rule.MetricName {
+			return fmt.Errorf("%w: %q watches %s, not %s", ErrInvalidFamily, name, metricName, rule.MetricName)
+		}
+		if severity == rule.Severity {
+			return fmt.Errorf("%w: %q is already the %s tier of %q", ErrInvalidFamily, name, severity, rule.Family)
+		}
+	}
+	return rows.Err()
+}
+
+func ruleWriteError(ctx context.Context, tx pgx.Tx, id uuid.UUID) error {
+	var deleted bool
+	err := tx.QueryRow(ctx, "SELECT deleted_at IS NOT NULL FROM alert_rules WHERE id = $1", id).Scan(&deleted)
+	if errors.Is(err, pgx.ErrNoRows) || deleted {
+		return ErrRuleNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return ErrRuleConflict
+}
+
+// commitRevision snapshots the rule's current row into its history and
+// commits the transaction.
+func commitRevision(ctx context.Context, tx pgx.Tx, id uuid.UUID, change, user string) (AlertRule, error) {
+	_, err := tx.Exec(ctx,
+		`INSERT INTO alert_rule_revisions (rule_id, revision, name, metric_name, condition_type, threshold_value, operator, severity,
+		                                   enabled, expression, window_seconds, duration_seconds, hysteresis, family, change, changed_by)
+		 SELECT id, revision, name, metric_name, condition_type, threshold_value, operator, severity,
+		        enabled, expression, window_seconds, duration_seconds, hysteresis, family, $2, $3
+		 FROM alert_rules WHERE id = $1`,
+		id, change, user,
+	)
+	if err != nil {
+		return AlertRule{}, err
+	}
+
+	rule, err := scanRule(tx.QueryRow(ctx, "SELECT "+ruleColumns+" FROM alert_rules WHERE id = $1", id))
+	if err != nil {
+		return rule, err
+	}
+	return rule, tx.Commit(ctx)
+}
+
+// ListRuleRevisions returns a rule's history, newest first.
+func ListRuleRevisions(ctx context.Context, pool *pgxpool.Pool, id uuid.UUID) ([]RuleRevision, error) {
+	rows, err := pool.Query(ctx,
+		`SELECT rule_id, revision, name, metric_name, condition_type, threshold_value, operator, severity, enabled,
+		        expression, window_seconds, duration_seconds, hysteresis, family, change, changed_by, changed_at
+		 FROM alert_rule_revisions
+		 WHERE rule_id = $1
+		 ORDER BY revision DESC`,
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []RuleRevision
+	for rows.Next() {
+		var r RuleRevision
+		if err := rows.Scan(&r.RuleID, &r.Revision, &r.Name, &r.MetricName, &r.ConditionType, &r.ThresholdValue, &r.Operator, &r.Severity, &r.Enabled,
+			&r.Expression, &r.WindowSeconds, &r.DurationSeconds, &r.Hysteresis, &r.Family, &r.Change, &r.ChangedBy, &r.ChangedAt); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(revisions) == 0 {
+		if _, err := GetRule(ctx, pool, id); err != nil {
+			return nil, err
+		}
+	}
+	return revisions, nil
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,214 @@
+package processing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"telemetry/notify"
+)
+
+const (
+	DefaultShelveDuration = 8 * time.Hour
+	MaxShelveDuration     = 12 * time.Hour
+)
+
+var (
+	ErrAlreadyShelved = errors.New("alarm is already shelved")
+	ErrNotShelved     = errors.New("alarm is not shelved")
+)
+
+// Shelf temporarily removes one alarm (a rule on a machine) from service, as
+// ISA-18.2 shelving. While shelved the alarm is recorded but suppressed; it
+// returns to service when unshelved or when the shelf expires.
+type Shelf struct {
+	ID          uuid.UUID  `json:"id"`
+	MachineID   uuid.UUID  `json:"machine_id"`
+	RuleID      uuid.UUID  `json:"rule_id"`
+	Reason      string     `json:"reason"`
+	ShelvedBy   string     `json:"shelved_by"`
+	ShelvedAt   time.Time  `json:"shelved_at"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	UnshelvedAt *time.Time `json:"unshelved_at"`
+	UnshelvedBy *string    `json:"unshelved_by"`
+}
+
+// Shelve shelves the alarm behind an alert for the given duration. The alert
+// itself is suppressed along with any raised while the shelf lasts.
+func (s *AlertService) Shelve(ctx context.Context, alertID uuid.UUID, user, reason string, duration time.Duration) (Shelf, error) {
+	if reason == "" {
+		return Shelf{}, fmt.Errorf("reason is required")
+	}
+	if duration < time.Minute || duration > MaxShelveDuration {
+		return Shelf{}, fmt.Errorf("duration must be between 1 minute and %s", MaxShelveDuration)
+	}
+
+	shelf := Shelf{Reason: reason, ShelvedBy: user}
+	err := s.db.QueryRow(ctx, "SELECT machine_id, rule_id FROM alerts WHERE id = $1", alertID).Scan(&shelf.MachineID, &shelf.RuleID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Shelf{}, ErrAlertNotFound
+	}
+	if err != nil {
+		return Shelf{}, err
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return Shelf{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	// The partial unique index on open shelves rejects a second shelf.
+	err = tx.QueryRow(ctx,
+		`INSERT INTO alarm_shelves (machine_id, rule_id, reason, shelved_by, expires_at)
+		 VALUES ($1, $2, $3, $4, NOW() + make_interval(secs => $5))
+		 ON CONFLICT DO NOTHING
+		 RETURNING id, shelved_at, expires_at`,
+		shelf.MachineID, shelf.RuleID, reason, user, duration.Seconds(),
+	).Scan(&shelf.ID, &shelf.ShelvedAt, &shelf.ExpiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Shelf{}, ErrAlreadyShelved
+	}
+	if err != nil {
+		return Shelf{}, err
+	}
+
+	_, err = tx.Exec(ctx,
+		`UPDATE alerts SET suppressed = true, suppressed_by = $3
+		 WHERE machine_id = $1 AND rule_id = $2 AND state <> 'closed' AND NOT suppressed`,
+		shelf.MachineID, shelf.RuleID, "shelved:"+shelf.ID.String(),
+	)
+	if err != nil {
+		return Shelf{}, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return Shelf{}, err
+	}
+
+	log.Printf("Alarm %s on machine %s shelved by %s until %s: %s", shelf.RuleID, shelf.MachineID, user, shelf.ExpiresAt.Format(time.RFC3339), reason)
+	return shelf, nil
+}
+
+// Unshelve returns the alarm behind an alert to service early.
+func (s *AlertService) Unshelve(ctx context.Context, alertID uuid.UUID, user string) error {
+	var shelfID uuid.UUID
+	err := s.db.QueryRow(ctx,
+		`UPDATE alarm_shelves sh SET unshelved_at = NOW(), unshelved_by = $2
+		 FROM alerts a
+		 WHERE a.id = $1 AND sh.machine_id = a.machine_id AND sh.rule_id = a.rule_id AND sh.unshelved_at IS NULL
+		 RETURNING sh.id`,
+		alertID, user,
+	).Scan(&shelfID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		var exists bool
+		if err := s.db.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM alerts WHERE id = $1)", alertID).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return ErrAlertNotFound
+		}
+		return ErrNotShelved
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Shelf %s removed by %s", shelfID, user)
+	s.returnToService(ctx, shelfID)
+	return nil
+}
+
+// expireShelves unshelves alarms whose shelf time has run out.
+func (s *AlertService) expireShelves(ctx context.Context) {
+	rows, err := s.db.Query(ctx,
+		`UPDATE alarm_shelves SET unshelved_at = NOW(), unshelved_by = 'system'
+		 WHERE unshelved_at IS NULL AND expires_at <= NOW()
+		 RETURNING id`,
+	)
+	if err != nil {
+		log.Printf("Failed to expire shelves: %v", err)
+		return
+	}
+	var expired []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err == nil {
+			expired = append(expired, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range expired {
+		log.Printf("Shelf %s expired", id)
+		s.returnToService(ctx, id)
+	}
+}
+
+// returnToService lifts the suppression a shelf placed on its alerts and
+// re-annunciates those still in alarm.
+func (s *AlertService) returnToService(ctx context.Context, shelfID uuid.UUID) {
+	rows, err := s.db.Query(ctx,
+		`UPDATE alerts SET suppressed = false, suppressed_by = NULL
+		 WHERE suppressed_by = $1 AND state <> 'closed'
+		 RETURNING id, rule_id, state, evaluated_values`,
+		"shelved:"+shelfID.String(),
+	)
+	if err != nil {
+		log.Printf("Failed to return shelf %s alerts to service: %v", shelfID, err)
+		return
+	}
+	defer rows.Close()
+
+	s.mu.RLock()
+	rules := make(map[uuid.UUID]AlertRule)
+	for _, r := range s.rules {
+		rules[r.ID] = r
+	}
+	s.mu.RUnlock()
+
+	for rows.Next() {
+		var alertID, ruleID uuid.UUID
+		var state string
+		var values map[string]float64
+		if err := rows.Scan(&alertID, &ruleID, &state, &values); err != nil {
+			continue
+		}
+		rule, ok := rules[ruleID]
+		if !ok || state != AlertStateActive {
+			continue
+		}
+		go s.notify(alertID, rule, notify.EventTriggered, values[rule.MetricName], values)
+	}
+}
+
+// ListShelves returns shelves, only those still in effect if activeOnly.
+func ListShelves(ctx context.Context, pool *pgxpool.Pool, activeOnly bool) ([]Shelf, error) {
+	rows, err := pool.Query(ctx,
+		`SELECT id, machine_id, rule_id, reason, shelved_by, shelved_at, expires_at, unshelved_at, unshelved_by
+		 FROM alarm_shelves
+		 WHERE NOT $1 OR unshelved_at IS NULL
+		 ORDER BY shelved_at DESC LIMIT 200`,
+		activeOnly,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var shelves []Shelf
+	for rows.Next() {
+		var sh Shelf
+		if err := rows.Scan(&sh.ID, &sh.MachineID, &sh.RuleID, &sh.Reason, &sh.ShelvedBy, &sh.ShelvedAt, &sh.ExpiresAt, &sh.UnshelvedAt, &sh.UnshelvedBy); err != nil {
+			return nil, err
+		}
+		shelves = append(shelves, sh)
+	}
+	return shelves, rows.Err()
+}
@@ -0,0 +1,281 @@
+package processing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	ErrSilenceNotFound = errors.New("silence not found")
+	ErrWindowNotFound  = errors.New("maintenance window not found")
+)
+
+// SilenceMatcher selects alerts by machine, location, rule and severity. An
+// unset field matches any alert, but at least one must be set.
+type SilenceMatcher struct {
+	MachineID *uuid.UUID `json:"machine_id"`
+	Location  *string    `json:"location"`
+	RuleID    *uuid.UUID `json:"rule_id"`
+	Severity  *string    `json:"severity"`
+}
+
+func (m SilenceMatcher) validate() error {
+	if m.MachineID == nil && m.Location == nil && m.RuleID == nil && m.Severity == nil {
+		return fmt.Errorf("at least one of machine_id, location, rule_id or severity is required")
+	}
+	if m.Severity != nil && *m.Severity != "info" && *m.Severity != "warning" && *m.Severity != "critical" {
+		return fmt.Errorf("invalid severity: %s", *m.Severity)
+	}
+	return nil
+}
+
+func (m SilenceMatcher) matches(t silenceTarget) bool {
+	return (m.MachineID == nil || *m.MachineID == t.machineID) &&
+		(m.Location == nil || *m.Location == t.location) &&
+		(m.RuleID == nil || *m.RuleID == t.ruleID) &&
+		(m.Severity == nil || *m.Severity == t.severity)
+}
+
+type silenceTarget struct {
+	machineID uuid.UUID
+	location  string
+	ruleID    uuid.UUID
+	severity  string
+}
+
+// Silence suppresses notifications for matching alerts between StartsAt and
+// EndsAt. Alerts are still recorded, flagged as suppressed.
+type Silence struct {
+	ID uuid.UUID `json:"id"`
+	SilenceMatcher
+	StartsAt  time.Time `json:"starts_at"`
+	EndsAt    time.Time `json:"ends_at"`
+	Reason    string    `json:"reason"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (s Silence) Validate() error {
+	if !s.EndsAt.After(s.StartsAt) {
+		return fmt.Errorf("ends_at must be after starts_at")
+	}
+	if s.Reason == "" {
+		return fmt.Errorf("reason is required")
+	}
+	return s.SilenceMatcher.validate()
+}
+
+// MaintenanceWindow is a weekly recurring silence: on each of Days (0 is
+// Sunday) from StartTime ("15:04", plant time) for DurationMinutes.
+type MaintenanceWindow struct {
+	ID   uuid.UUID `json:"id"`
+	Name string    `json:"name"`
+	SilenceMatcher
+	Days            []int     `json:"days"`
+	StartTime       string    `json:"start_time"`
+	DurationMinutes int       `json:"duration_minutes"`
+	Enabled         bool      `json:"enabled"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+func (w MaintenanceWindow) Validate() error {
+	if w.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if len(w.Days) == 0 {
+		return fmt.Errorf("at least one day is required")
+	}
+	for _, d := range w.Days {
+		if d < 0 || d > 6 {
+			return fmt.Errorf("days must be 0 (Sunday) to 6 (Saturday)")
+		}
+	}
+	if _, err := time.Parse("15:04", w.StartTime); err != nil {
+		return fmt.Errorf("start_time must be HH:MM")
+	}
+	if w.DurationMinutes < 1 || w.DurationMinutes > 7*24*60 {
+		return fmt.Errorf("duration_minutes must be between 1 and 10080")
+	}
+	return w.SilenceMatcher.validate()
+}
+
+// ActiveAt reports whether an occurrence of the window covers t. Occurrences
+// that started on earlier days are checked so windows can span midnight.
+func (w MaintenanceWindow) ActiveAt(t time.Time, loc *time.Location) bool {
+	start, err := time.Parse("15:04", w.StartTime)
+	if err != nil {
+		return false
+	}
+	duration := time.Duration(w.DurationMinutes) * time.Minute
+
+	local := t.In(loc)
+	for back := 0; back <= w.DurationMinutes/(24*60)+1; back++ {
+		day := local.AddDate(0, 0, -back)
+		if !containsDay(w.Days, int(day.Weekday())) {
+			continue
+		}
+		begin := time.Date(day.Year(), day.Month(), day.Day(), start.Hour(), start.Minute(), 0, 0, loc)
+		if !t.Before(begin) && t.Before(begin.Add(duration)) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsDay(days []int, d int) bool {
+	for _, day := range days {
+		if day == d {
+			return true
+		}
+	}
+	return false
+}
+
+// suppression returns what, if anything, silences alerts for the machine and
+// rule right now: "shelved:<id>", "silence:<id>" or "maintenance:<name>".
+func (s *AlertService) suppression(ctx context.Context, machineID, ruleID uuid.UUID, severity string) (string, error) {
+	var shelfID uuid.UUID
+	err := s.db.QueryRow(ctx,
+		`SELECT id FROM alarm_shelves
+		 WHERE machine_id = $1 AND rule_id = $2 AND unshelved_at IS NULL AND expires_at > NOW()`,
+		machineID, ruleID,
+	).Scan(&shelfID)
+	if err == nil {
+		return "shelved:" + shelfID.String(), nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return "", err
+	}
+
+	target := silenceTarget{machineID: machineID, ruleID: ruleID, severity: severity}
+	err = s.db.QueryRow(ctx, "SELECT COALESCE(location, '') FROM machines WHERE id = $1", machineID).Scan(&target.location)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return "", err
+	}
+
+	now := time.Now()
+	silences, err := ListSilences(ctx, s.db, true)
+	if err != nil {
+		return "", err
+	}
+	for _, silence := range silences {
+		if silence.matches(target) {
+			return "silence:" + silence.ID.String(), nil
+		}
+	}
+
+	windows, err := ListMaintenanceWindows(ctx, s.db, true)
+	if err != nil {
+		return "", err
+	}
+	for _, w := range windows {
+		if w.matches(target) && w.ActiveAt(now, s.loc) {
+			return "maintenance:" + w.Name, nil
+		}
+	}
+	return "", nil
+}
+
+// ListSilences returns silences, only those in effect now if activeOnly.
+func ListSilences(ctx context.Context, pool *pgxpool.Pool, activeOnly bool) ([]Silence, error) {
+	rows, err := pool.Query(ctx,
+		`SELECT id, machine_id, location, rule_id, severity, starts_at, ends_at, reason, created_by, created_at
+		 FROM silences
+		 WHERE NOT $1 OR (starts_at <= NOW() AND ends_at > NOW())
+		 ORDER BY starts_at DESC LIMIT 200`,
+		activeOnly,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var silences []Silence
+	for rows.Next() {
+		var s Silence
+		if err := rows.Scan(&s.ID, &s.MachineID, &s.Location, &s.RuleID, &s.Severity, &s.StartsAt, &s.EndsAt, &s.Reason, &s.CreatedBy, &s.CreatedAt); err != nil {
+			return nil, err
+		}
+		silences = append(silences, s)
+	}
+	return silences, rows.Err()
+}
+
+func CreateSilence(ctx context.Context, pool *pgxpool.Pool, s Silence) (uuid.UUID, error) {
+	var id uuid.UUID
+	err := pool.QueryRow(ctx,
+		`INSERT INTO silences (machine_id, location, rule_id, severity, starts_at, ends_at, reason, created_by)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`,
+		s.MachineID, s.Location, s.RuleID, s.Severity, s.StartsAt, s.EndsAt, s.Reason, s.CreatedBy,
+	).Scan(&id)
+	return id, err
+}
+
+// ExpireSilence ends a silence now, keeping it for the record.
+func ExpireSilence(ctx context.Context, pool *pgxpool.Pool, id uuid.UUID) error {
+	tag, err := pool.Exec(ctx,
+		"UPDATE silences SET ends_at = LEAST(ends_at, NOW()), starts_at = LEAST(starts_at, NOW()) WHERE id = $1", id)
+	if err == nil && tag.RowsAffected() == 0 {
+		return ErrSilenceNotFound
+	}
+	return err
+}
+
+func ListMaintenanceWindows(ctx context.Context, pool *pgxpool.Pool, enabledOnly bool) ([]MaintenanceWindow, error) {
+	rows, err := pool.Query(ctx,
+		`SELECT id, name, machine_id, location, rule_id, severity, days, to_char(start_time, 'HH24:MI'), duration_minutes, enabled, created_at
+		 FROM maintenance_windows
+		 WHERE enabled OR NOT $1
+		 ORDER BY name`,
+		enabledOnly,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var windows []MaintenanceWindow
+	for rows.Next() {
+		var w MaintenanceWindow
+		var days []int32
+		if err := rows.Scan(&w.ID, &w.Name, &w.MachineID, &w.Location, &w.RuleID, &w.Severity, &days, &w.StartTime, &w.DurationMinutes, &w.Enabled, &w.CreatedAt); err != nil {
+			return nil, err
+		}
+		for _, d := range days {
+			w.Days = append(w.Days, int(d))
+		}
+		windows = append(windows, w)
+	}
+	return windows, rows.Err()
+}
+
+// SaveMaintenanceWindow inserts the window, or replaces it when it has an ID.
+func SaveMaintenanceWindow(ctx context.Context, pool *pgxpool.Pool, w MaintenanceWindow) (uuid.UUID, error) {
+	if w.ID == uuid.Nil {
+		w.ID = uuid.New()
+	}
+	_, err := pool.Exec(ctx,
+		`INSERT INTO maintenance_windows (id, name, machine_id, location, rule_id, severity, days, start_time, duration_minutes, enabled)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8::time, $9, $10)
+		 ON CONFLICT (id) DO UPDATE SET
+			name = EXCLUDED.name, machine_id = EXCLUDED.machine_id, location = EXCLUDED.location,
+			rule_id = EXCLUDED.rule_id, severity = EXCLUDED.severity, days = EXCLUDED.days,
+			start_time = EXCLUDED.start_time, duration_minutes = EXCLUDED.duration_minutes, enabled = EXCLUDED.enabled`,
+		w.ID, w.Name, w.MachineID, w.Location, w.RuleID, w.Severity, w.Days, w.StartTime, w.DurationMinutes, w.Enabled,
+	)
+	return w.ID, err
+}
+
+func DeleteMaintenanceWindow(ctx context.Context, pool *pgxpool.Pool, id uuid.UUID) error {
+	tag, err := pool.Exec(ctx, "DELETE FROM maintenance_windows WHERE id = $1", id)
+	if err == nil && tag.RowsAffected() == 0 {
+		return ErrWindowNotFound
+	}
+	return err
+}
@@ -0,0 +1,551 @@
+package ruleset
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"telemetry/notify"
+	"telemetry/processing"
+)
+
+const (
+	ActionCreate = "create"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+)
+
+// Change is one difference between a document and the database, and what
+// applying the document does about it.
+type Change struct {
+	Kind   string        `json:"kind"`
+	Name   string        `json:"name"`
+	Action string        `json:"action"`
+	Fields []FieldChange `json:"fields,omitempty"`
+
+	apply func(ctx context.Context) error
+}
+
+type FieldChange struct {
+	Field string `json:"field"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+}
+
+type Plan struct {
+	Changes   []Change `json:"changes"`
+	Unchanged int      `json:"unchanged"`
+	// Unmanaged counts items in the database but not in the document, left
+	// alone because prune was not requested.
+	Unmanaged int `json:"unmanaged"`
+}
+
+// state is the database's configuration in document form, with the IDs
+// needed to change it.
+type state struct {
+	doc          Document
+	ruleIDs      map[string]uuid.UUID
+	webhookIDs   map[string]uuid.UUID
+	recipientIDs map[string]uuid.UUID
+	windowIDs    map[string]uuid.UUID
+	silenceIDs   map[string]uuid.UUID
+	machines     map[string]bool
+}
+
+// Export returns the database's rules, channels and silences as a document.
+// Silences that have already ended are left out.
+func Export(ctx context.Context, pool *pgxpool.Pool) (Document, error) {
+	st, err := load(ctx, pool)
+	if err != nil {
+		return Document{}, err
+	}
+	return st.doc, nil
+}
+
+func load(ctx context.Context, pool *pgxpool.Pool) (*state, error) {
+	st := &state{
+		ruleIDs:      make(map[string]uuid.UUID),
+		webhookIDs:   make(map[string]uuid.UUID),
+		recipientIDs: make(map[string]uuid.UUID),
+		windowIDs:    make(map[string]uuid.UUID),
+		silenceIDs:   make(map[string]uuid.UUID),
+		machines:     make(map[string]bool),
+	}
+
+	machineNames := make(map[uuid.UUID]string)
+	rows, err := pool.Query(ctx, "SELECT id, name FROM machines")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id uuid.UUID
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		machineNames[id] = name
+		st.machines[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rules, err := processing.ListRules(ctx, pool, false)
+	if err != nil {
+		return nil, err
+	}
+	ruleNames := make(map[uuid.UUID]string)
+	for _, r := range rules {
+		if _, dup := st.ruleIDs[r.Name]; dup {
+			return nil, fmt.Errorf("more than one rule is named %q; rename one before using rule sets", r.Name)
+		}
+		st.ruleIDs[r.Name] = r.ID
+		ruleNames[r.ID] = r.Name
+		st.doc.Rules = append(st.doc.Rules, fromAlertRule(r))
+	}
+
+	matcher := func(sm processing.SilenceMatcher) Matcher {
+		var m Matcher
+		if sm.MachineID != nil {
+			m.Machine = machineNames[*sm.MachineID]
+			if m.Machine == "" {
+				m.Machine = sm.MachineID.String()
+			}
+		}
+		if sm.RuleID != nil {
+			m.Rule = ruleNames[*sm.RuleID]
+			if m.Rule == "" {
+				m.Rule = sm.RuleID.String()
+			}
+		}
+		if sm.Location != nil {
+			m.Location = *sm.Location
+		}
+		if sm.Severity != nil {
+			m.Severity = *sm.Severity
+		}
+		return m
+	}
+
+	webhooks, err := notify.ListWebhooks(ctx, pool, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range webhooks {
+		st.webhookIDs[c.Name] = c.ID
+		st.doc.Webhooks = append(st.doc.Webhooks, fromWebhook(c))
+	}
+
+	recipients, err := notify.ListEmailRecipients(ctx, pool)
+	if err != nil {
+		return nil, err
+	}
+	for _, rec := range recipients {
+		r := fromEmailRecipient(rec)
+		st.recipientIDs[r.key()] = rec.ID
+		st.doc.EmailRecipients = append(st.doc.EmailRecipients, r)
+	}
+
+	windows, err := processing.ListMaintenanceWindows(ctx, pool, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range windows {
+		st.windowIDs[w.Name] = w.ID
+		st.doc.MaintenanceWindows = append(st.doc.MaintenanceWindows, MaintenanceWindow{
+			Name: w.Name, Matcher: matcher(w.SilenceMatcher), Days: w.Days, StartTime: w.StartTime,
+			DurationMinutes: w.DurationMinutes, Enabled: disabled(w.Enabled),
+		})
+	}
+
+	silences, err := processing.ListSilences(ctx, pool, false)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, s := range silences {
+		if !s.EndsAt.After(now) {
+			continue
+		}
+		silence := Silence{Matcher: matcher(s.SilenceMatcher), StartsAt: s.StartsAt.UTC(), EndsAt: s.EndsAt.UTC(), Reason: s.Reason, CreatedBy: s.CreatedBy}
+		st.silenceIDs[silence.key()] = s.ID
+		st.doc.Silences = append(st.doc.Silences, silence)
+	}
+	sort.Slice(st.doc.Silences, func(i, j int) bool { return st.doc.Silences[i].StartsAt.Before(st.doc.Silences[j].StartsAt) })
+
+	return st, nil
+}
+
+// field is one compared property of an item. Secret values are compared but
+// never shown.
+type field struct {
+	name   string
+	value  string
+	secret bool
+}
+
+type item interface {
+	key() string
+	fields() []field
+}
+
+func (r Rule) key() string { return r.Name }
+
+func (r Rule) fields() []field {
+	return []field{
+		{name: "metric_name", value: r.MetricName},
+		{name: "condition_type", value: r.ConditionType},
+		{name: "operator", value: r.Operator},
+		{name: "threshold_value", value: fmt.Sprint(r.ThresholdValue)},
+		{name: "expression", value: r.Expression},
+		{name: "window_seconds", value: fmt.Sprint(r.WindowSeconds)},
+		{name: "duration_seconds", value: fmt.Sprint(r.DurationSeconds)},
+		{name: "hysteresis", value: fmt.Sprint(r.Hysteresis)},
+		{name: "family", value: r.Family},
+		{name: "severity", value: r.Severity},
+		{name: "enabled", value: fmt.Sprint(enabled(r.Enabled))},
+	}
+}
+
+func (w Webhook) key() string { return w.Name }
+
+func (w Webhook) fields() []field {
+	c := w.config()
+	return []field{
+		{name: "url", value: c.URL},
+		{name: "secret", value: c.Secret, secret: true},
+		{name: "payload_template", value: c.PayloadTemplate},
+		{name: "severities", value: fmt.Sprint(c.Severities)},
+		{name: "headers", value: fmt.Sprint(c.Headers)},
+		{name: "max_attempts", value: fmt.Sprint(c.MaxAttempts)},
+		{name: "enabled", value: fmt.Sprint(c.Enabled)},
+	}
+}
+
+func (r EmailRecipient) fields() []field {
+	return []field{{name: "enabled", value: fmt.Sprint(enabled(r.Enabled))}}
+}
+
+func (w MaintenanceWindow) key() string { return w.Name }
+
+func (w MaintenanceWindow) fields() []field {
+	return []field{
+		{name: "matcher", value: w.Matcher.String()},
+		{name: "days", value: fmt.Sprint(w.Days)},
+		{name: "start_time", value: w.StartTime},
+		{name: "duration_minutes", value: fmt.Sprint(w.DurationMinutes)},
+		{name: "enabled", value: fmt.Sprint(enabled(w.Enabled))},
+	}
+}
+
+// Silences are identified by all their fields, so they are only ever
+// created or expired.
+func (s Silence) fields() []field { return nil }
+
+func fieldChanges(from, to []field) []FieldChange {
+	var changes []FieldChange
+	for i := range to {
+		var old string
+		if from != nil {
+			old = from[i].value
+		}
+		if from != nil && old == to[i].value {
+			continue
+		}
+		change := FieldChange{Field: to[i].name, From: old, To: to[i].value}
+		if to[i].secret {
+			change.From, change.To = mask(old), mask(to[i].value)
+			if from != nil && change.From == "(set)" && change.To == "(set)" {
+				change.To = "(changed)"
+			}
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+func mask(secret string) string {
+	if secret == "" {
+		return "(none)"
+	}
+	return "(set)"
+}
+
+// diff compares desired and existing items of one kind by key.
+func diff[T item](kind string, desired, existing []T, prune bool,
+	create func(T) func(context.Context) error,
+	update func(T) func(context.Context) error,
+	remove func(T) func(context.Context) error,
+) (changes []Change, unchanged, unmanaged int) {
+	current := make(map[string]T, len(existing))
+	for _, e := range existing {
+		current[e.key()] = e
+	}
+
+	wanted := make(map[string]bool, len(desired))
+	for _, d := range desired {
+		wanted[d.key()] = true
+		e, ok := current[d.key()]
+		if !ok {
+			changes = append(changes, Change{Kind: kind, Name: d.key(), Action: ActionCreate, Fields: fieldChanges(nil, d.fields()), apply: create(d)})
+			continue
+		}
+		fields := fieldChanges(e.fields(), d.fields())
+		if len(fields) == 0 {
+			unchanged++
+			continue
+		}
+		changes = append(changes, Change{Kind: kind, Name: d.key(), Action: ActionUpdate, Fields: fields, apply: update(d)})
+	}
+
+	for _, e := range existing {
+		if wanted[e.key()] {
+			continue
+		}
+		if !prune {
+			unmanaged++
+			continue
+		}
+		changes = append(changes, Change{Kind: kind, Name: e.key(), Action: ActionDelete, apply: remove(e)})
+	}
+	return changes, unchanged, unmanaged
+}
+
+// MakePlan validates the document and works out the changes that would make
+// the database match it. Items missing from the document are deleted only
+// when prune is set; rules are soft-deleted and silences expired.
+func MakePlan(ctx context.Context, pool *pgxpool.Pool, doc Document, prune bool, user string) (Plan, error) {
+	if err := doc.Validate(); err != nil {
+		return Plan{}, err
+	}
+	st, err := load(ctx, pool)
+	if err != nil {
+		return Plan{}, err
+	}
+	if err := st.checkReferences(doc, prune); err != nil {
+		return Plan{}, err
+	}
+
+	plan := Plan{Changes: []Change{}}
+	merge := func(changes []Change, unchanged, unmanaged int) {
+		plan.Changes = append(plan.Changes, changes...)
+		plan.Unchanged += unchanged
+		plan.Unmanaged += unmanaged
+	}
+
+	merge(diff("rule", doc.Rules, st.doc.Rules, prune,
+		func(r Rule) func(context.Context) error {
+			return func(ctx context.Context) error {
+				_, err := processing.CreateRule(ctx, pool, r.alertRule(), user)
+				return err
+			}
+		},
+		func(r Rule) func(context.Context) error {
+			return func(ctx context.Context) error {
+				rule := r.alertRule()
+				rule.ID = st.ruleIDs[r.Name]
+				_, err := processing.UpdateRule(ctx, pool, rule, user)
+				return err
+			}
+		},
+		func(r Rule) func(context.Context) error {
+			return func(ctx context.Context) error {
+				return processing.DeleteRule(ctx, pool, st.ruleIDs[r.Name], user)
+			}
+		},
+	))
+
+	merge(diff("webhook", doc.Webhooks, st.doc.Webhooks, prune,
+		func(w Webhook) func(context.Context) error {
+			return func(ctx context.Context) error {
+				_, err := notify.CreateWebhook(ctx, pool, w.config())
+				return err
+			}
+		},
+		func(w Webhook) func(context.Context) error {
+			return func(ctx context.Context) error {
+				c := w.config()
+				c.ID = st.webhookIDs[w.Name]
+				return notify.UpdateWebhook(ctx, pool, c)
+			}
+		},
+		func(w Webhook) func(context.Context) error {
+			return func(ctx context.Context) error {
+				return notify.DeleteWebhook(ctx, pool, st.webhookIDs[w.Name])
+			}
+		},
+	))
+
+	merge(diff("email_recipient", doc.EmailRecipients, st.doc.EmailRecipients, prune,
+		func(r EmailRecipient) func(context.Context) error {
+			return func(ctx context.Context) error {
+				_, err := notify.SaveEmailRecipient(ctx, pool, r.record())
+				return err
+			}
+		},
+		func(r EmailRecipient) func(context.Context) error {
+			return func(ctx context.Context) error {
+				rec := r.record()
+				rec.ID = st.recipientIDs[r.key()]
+				_, err := notify.SaveEmailRecipient(ctx, pool, rec)
+				return err
+			}
+		},
+		func(r EmailRecipient) func(context.Context) error {
+			return func(ctx context.Context) error {
+				return notify.DeleteEmailRecipient(ctx, pool, st.recipientIDs[r.key()])
+			}
+		},
+	))
+
+	saveWindow := func(w MaintenanceWindow) func(context.Context) error {
+		return func(ctx context.Context) error {
+			matcher, err := resolve(ctx, pool, w.Matcher)
+			if err != nil {
+				return err
+			}
+			_, err = processing.SaveMaintenanceWindow(ctx, pool, processing.MaintenanceWindow{
+				ID: st.windowIDs[w.Name], Name: w.Name, SilenceMatcher: matcher, Days: w.Days,
+				StartTime: w.StartTime, DurationMinutes: w.DurationMinutes, Enabled: enabled(w.Enabled),
+			})
+			return err
+		}
+	}
+	merge(diff("maintenance_window", doc.MaintenanceWindows, st.doc.MaintenanceWindows, prune,
+		saveWindow, saveWindow,
+		func(w MaintenanceWindow) func(context.Context) error {
+			return func(ctx context.Context) error {
+				return processing.DeleteMaintenanceWindow(ctx, pool, st.windowIDs[w.Name])
+			}
+		},
+	))
+
+	// Silences that have already ended have nothing left to apply.
+	now := time.Now()
+	var silences []Silence
+	for _, s := range doc.Silences {
+		if s.EndsAt.After(now) {
+			s.StartsAt, s.EndsAt = s.StartsAt.UTC(), s.EndsAt.UTC()
+			silences = append(silences, s)
+		}
+	}
+	merge(diff("silence", silences, st.doc.Silences, prune,
+		func(s Silence) func(context.Context) error {
+			return func(ctx context.Context) error {
+				matcher, err := resolve(ctx, pool, s.Matcher)
+				if err != nil {
+					return err
+				}
+				_, err = processing.CreateSilence(ctx, pool, processing.Silence{
+					SilenceMatcher: matcher, StartsAt: s.StartsAt, EndsAt: s.EndsAt, Reason: s.Reason, CreatedBy: s.CreatedBy,
+				})
+				return err
+			}
+		},
+		nil,
+		func(s Silence) func(context.Context) error {
+			return func(ctx context.Context) error {
+				return processing.ExpireSilence(ctx, pool, st.silenceIDs[s.key()])
+			}
+		},
+	))
+
+	return plan, nil
+}
+
+// checkReferences makes sure every machine and rule a matcher names exists,
+// or for rules will exist once the document is applied.
+func (st *state) checkReferences(doc Document, prune bool) error {
+	rules := make(map[string]bool)
+	for _, r := range doc.Rules {
+		rules[r.Name] = true
+	}
+	if !prune {
+		for name := range st.ruleIDs {
+			rules[name] = true
+		}
+	}
+
+	var problems []string
+	check := func(what string, m Matcher) {
+		if m.Machine != "" && !st.machines[m.Machine] {
+			if _, err := uuid.Parse(m.Machine); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: unknown machine %q", what, m.Machine))
+			}
+		}
+		if m.Rule != "" && !rules[m.Rule] {
+			problems = append(problems, fmt.Sprintf("%s: unknown rule %q", what, m.Rule))
+		}
+	}
+	for _, w := range doc.MaintenanceWindows {
+		check(fmt.Sprintf("maintenance window %q", w.Name), w.Matcher)
+	}
+	for i, s := range doc.Silences {
+		check(fmt.Sprintf("silences[%d]", i), s.Matcher)
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// resolve turns machine and rule names into IDs at apply time, after rules
+// created by the same document exist.
+func resolve(ctx context.Context, pool *pgxpool.Pool, m Matcher) (processing.SilenceMatcher, error) {
+	var sm processing.SilenceMatcher
+	if m.Machine != "" {
+		var id uuid.UUID
+		err := pool.QueryRow(ctx, "SELECT id FROM machines WHERE name = $1", m.Machine).Scan(&id)
+		if errors.Is(err, pgx.ErrNoRows) {
+			id, err = uuid.Parse(m.Machine)
+		}
+		if err != nil {
+			return sm, fmt.Errorf("machine %q: %w", m.Machine, err)
+		}
+		sm.MachineID = &id
+	}
+	if m.Rule != "" {
+		var id uuid.UUID
+		err := pool.QueryRow(ctx, "SELECT id FROM alert_rules WHERE name = $1 AND deleted_at IS NULL", m.Rule).Scan(&id)
+		if errors.Is(err, pgx.ErrNoRows) {
+			id, err = uuid.Parse(m.Rule)
+		}
+		if err != nil {
+			return sm, fmt.Errorf("rule %q: %w", m.Rule, err)
+		}
+		sm.RuleID = &id
+	}
+	if m.Location != "" {
+		sm.Location = &m.Location
+	}
+	if m.Severity != "" {
+		sm.Severity = &m.Severity
+	}
+	return sm, nil
+}
+
+// Apply makes the database match the document and returns the changes it
+// made. Changes are applied in order, rules first; if one fails the rest
+// are skipped, and applying the document again picks up where it stopped.
+func Apply(ctx context.Context, pool *pgxpool.Pool, doc Document, prune bool, user string) (Plan, error) {
+	plan, err := MakePlan(ctx, pool, doc, prune, user)
+	if err != nil {
+		return plan, err
+	}
+	for i, change := range plan.Changes {
+		if err := change.apply(ctx); err != nil {
+			plan.Changes = plan.Changes[:i]
+			return plan, fmt.Errorf("%s %s %q: %w", change.Action, change.Kind, change.Name, err)
+		}
+	}
+	return plan, nil
+}
@@ -0,0 +1,419 @@
+// Package ruleset expresses alert rules, notification channels and silences
+// as YAML so they can be exported from one plant, reviewed, and planned and
+// applied against another.
+package ruleset
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
+
+	"telemetry/notify"
+	"telemetry/processing"
+)
+
+// Document is one YAML rule set. Items are identified by name (rules,
+// webhooks, maintenance windows) or by all of their fields (email
+// recipients, silences), never by database ID, so a file applies to any
+// environment.
+type Document struct {
+	Rules              []Rule              `yaml:"rules,omitempty"`
+	Webhooks           []Webhook           `yaml:"webhooks,omitempty"`
+	EmailRecipients    []EmailRecipient    `yaml:"email_recipients,omitempty"`
+	MaintenanceWindows []MaintenanceWindow `yaml:"maintenance_windows,omitempty"`
+	Silences           []Silence           `yaml:"silences,omitempty"`
+}
+
+type Rule struct {
+	Name            string  `yaml:"name"`
+	MetricName      string  `yaml:"metric_name,omitempty"`
+	ConditionType   string  `yaml:"condition_type"`
+	Operator        string  `yaml:"operator,omitempty"`
+	ThresholdValue  float64 `yaml:"threshold_value,omitempty"`
+	Expression      string  `yaml:"expression,omitempty"`
+	WindowSeconds   int     `yaml:"window_seconds,omitempty"`
+	DurationSeconds int     `yaml:"duration_seconds,omitempty"`
+	Hysteresis      float64 `yaml:"hysteresis,omitempty"`
+	Family          string  `yaml:"family,omitempty"`
+	Severity        string  `yaml:"severity"`
+	Enabled         *bool   `yaml:"enabled,omitempty"`
+}
+
+// Webhook takes its signing secret from the environment variable SecretEnv
+// so files can be committed without secrets.
+type Webhook struct {
+	Name            string            `yaml:"name"`
+	URL             string            `yaml:"url"`
+	SecretEnv       string            `yaml:"secret_env,omitempty"`
+	PayloadTemplate string            `yaml:"payload_template,omitempty"`
+	Severities      []string          `yaml:"severities,omitempty"`
+	Headers         map[string]string `yaml:"headers,omitempty"`
+	MaxAttempts     int               `yaml:"max_attempts,omitempty"`
+	Enabled         *bool             `yaml:"enabled,omitempty"`
+
+	// secret is the stored secret of a webhook loaded from the database.
+	secret string
+}
+
+type EmailRecipient struct {
+	Address  string `yaml:"address"`
+	Severity string `yaml:"severity,omitempty"`
+	Location string `yaml:"location,omitempty"`
+	Enabled  *bool  `yaml:"enabled,omitempty"`
+}
+
+// Matcher selects alerts like processing.SilenceMatcher, naming the machine
+// and rule instead of giving their IDs.
+type Matcher struct {
+	Machine  string `yaml:"machine,omitempty"`
+	Location string `yaml:"location,omitempty"`
+	Rule     string `yaml:"rule,omitempty"`
+	Severity string `yaml:"severity,omitempty"`
+}
+
+type MaintenanceWindow struct {
+	Name            string `yaml:"name"`
+	Matcher         `yaml:",inline"`
+	Days            []int  `yaml:"days"`
+	StartTime       string `yaml:"start_time"`
+	DurationMinutes int    `yaml:"duration_minutes"`
+	Enabled         *bool  `yaml:"enabled,omitempty"`
+}
+
+type Silence struct {
+	Matcher   `yaml:",inline"`
+	StartsAt  time.Time `yaml:"starts_at"`
+	EndsAt    time.Time `yaml:"ends_at"`
+	Reason    string    `yaml:"reason"`
+	CreatedBy string    `yaml:"created_by"`
+}
+
+const defaultMaxAttempts = 5
+
+// Parse reads a rule set, rejecting unknown fields so typos are not
+// silently ignored.
+func Parse(r io.Reader) (Document, error) {
+	var doc Document
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	if err := dec.Decode(&doc); err != nil && err != io.EOF {
+		return doc, fmt.Errorf("invalid YAML: %w", err)
+	}
+	return doc, nil
+}
+
+func (d Document) Marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(d); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), enc.Close()
+}
+
+// ValidationError lists every problem found in a document.
+type ValidationError struct {
+	Problems []string `json:"problems"`
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid rule set: " + strings.Join(e.Problems, "; ")
+}
+
+// Validate checks each item as the API would and normalizes rules the way
+// they are stored, so they compare equal to their exported form.
+func (d *Document) Validate() error {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	rules := make(map[string]bool)
+	tiers := make(map[string]Rule)
+	for i := range d.Rules {
+		r := &d.Rules[i]
+		if r.Name == "" {
+			add("rules[%d]: name is required", i)
+			continue
+		}
+		if rules[r.Name] {
+			add("rule %q: defined more than once", r.Name)
+		}
+		rules[r.Name] = true
+
+		rule := r.alertRule()
+		if err := processing.ValidateRule(&rule); err != nil {
+			add("rule %q: %v", r.Name, err)
+			continue
+		}
+		r.normalize(rule)
+
+		if r.Family == "" {
+			continue
+		}
+		if other, ok := tiers[r.Family+"/"+r.Severity]; ok {
+			add("rule %q: %q is already the %s tier of family %q", r.Name, other.Name, r.Severity, r.Family)
+		}
+		if first, ok := tiers[r.Family]; ok && first.MetricName != r.MetricName {
+			add("rule %q: family %q watches %s, not %s", r.Name, r.Family, first.MetricName, r.MetricName)
+		}
+		tiers[r.Family+"/"+r.Severity] = *r
+		if _, ok := tiers[r.Family]; !ok {
+			tiers[r.Family] = *r
+		}
+	}
+
+	webhooks := make(map[string]bool)
+	for i, w := range d.Webhooks {
+		if webhooks[w.Name] {
+			add("webhook %q: defined more than once", w.Name)
+		}
+		webhooks[w.Name] = true
+
+		if w.SecretEnv != "" && os.Getenv(w.SecretEnv) == "" {
+			add("webhook %q: environment variable %s is not set", w.Name, w.SecretEnv)
+		}
+		if err := w.config().Validate(); err != nil {
+			add("webhooks[%d] %q: %v", i, w.Name, err)
+		}
+	}
+
+	recipients := make(map[string]bool)
+	for i := range d.EmailRecipients {
+		r := &d.EmailRecipients[i]
+		if addr, err := mail.ParseAddress(r.Address); err != nil {
+			add("email recipient %q: invalid address", r.Address)
+		} else {
+			// Store the bare address, as the API does; RCPT TO takes no display name.
+			r.Address = addr.Address
+		}
+		if r.Severity != "" && !validSeverity(r.Severity) {
+			add("email recipient %q: invalid severity %q", r.Address, r.Severity)
+		}
+		if recipients[r.key()] {
+			add("email recipient %q: defined more than once", r.Address)
+		}
+		recipients[r.key()] = true
+	}
+
+	windows := make(map[string]bool)
+	for i, w := range d.MaintenanceWindows {
+		if windows[w.Name] {
+			add("maintenance window %q: defined more than once", w.Name)
+		}
+		windows[w.Name] = true
+
+		mw := processing.MaintenanceWindow{Name: w.Name, SilenceMatcher: w.Matcher.placeholder(), Days: w.Days,
+			StartTime: w.StartTime, DurationMinutes: w.DurationMinutes}
+		if err := mw.Validate(); err != nil {
+			add("maintenance_windows[%d] %q: %v", i, w.Name, err)
+		}
+	}
+
+	for i, s := range d.Silences {
+		silence := processing.Silence{SilenceMatcher: s.Matcher.placeholder(), StartsAt: s.StartsAt, EndsAt: s.EndsAt, Reason: s.Reason}
+		if err := silence.Validate(); err != nil {
+			add("silences[%d]: %v", i, err)
+		}
+		if s.CreatedBy == "" {
+			add("silences[%d]: created_by is required", i)
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+func validSeverity(s string) bool {
+	return s == "info" || s == "warning" || s == "critical"
+}
+
+func enabled(b *bool) bool {
+	return b == nil || *b
+}
+
+// disabled returns the Enabled value exported for a flag: omitted unless
+// false, since items are enabled by default.
+func disabled(on bool) *bool {
+	if on {
+		return nil
+	}
+	off := false
+	return &off
+}
+
+func (r Rule) alertRule() processing.AlertRule {
+	return processing.AlertRule{
+		Name:            r.Name,
+		MetricName:      r.MetricName,
+		ConditionType:   r.ConditionType,
+		ThresholdValue:  r.ThresholdValue,
+		Operator:        r.Operator,
+		Severity:        r.Severity,
+		Enabled:         enabled(r.Enabled),
+		Expression:      r.Expression,
+		WindowSeconds:   r.WindowSeconds,
+		DurationSeconds: r.DurationSeconds,
+		Hysteresis:      r.Hysteresis,
+		Family:          r.Family,
+	}
+}
+
+// normalize drops the fields a rule's condition type does not use and takes
+// the defaults ValidateRule filled in.
+func (r *Rule) normalize(validated processing.AlertRule) {
+	r.MetricName = validated.MetricName
+	r.Family = validated.Family
+	if r.ConditionType == processing.ConditionExpression {
+		r.Operator = ""
+		r.ThresholdValue = 0
+		r.WindowSeconds = validated.WindowSeconds
+	} else {
+		r.Expression = ""
+		r.WindowSeconds = 0
+	}
+}
+
+func fromAlertRule(a processing.AlertRule) Rule {
+	r := Rule{
+		Name:            a.Name,
+		MetricName:      a.MetricName,
+		ConditionType:   a.ConditionType,
+		ThresholdValue:  a.ThresholdValue,
+		Operator:        a.Operator,
+		Expression:      a.Expression,
+		WindowSeconds:   a.WindowSeconds,
+		DurationSeconds: a.DurationSeconds,
+		Hysteresis:      a.Hysteresis,
+		Family:          a.Family,
+		Severity:        a.Severity,
+		Enabled:         disabled(a.Enabled),
+	}
+	if err := processing.ValidateRule(&a); err == nil {
+		r.normalize(a)
+	}
+	return r
+}
+
+func (w Webhook) config() notify.WebhookConfig {
+	c := notify.WebhookConfig{
+		Name:            w.Name,
+		URL:             w.URL,
+		PayloadTemplate: w.PayloadTemplate,
+		Severities:      w.Severities,
+		Headers:         w.Headers,
+		MaxAttempts:     w.MaxAttempts,
+		Enabled:         enabled(w.Enabled),
+	}
+	if w.secret != "" {
+		c.Secret = w.secret
+	} else if w.SecretEnv != "" {
+		c.Secret = os.Getenv(w.SecretEnv)
+	}
+	if c.MaxAttempts == 0 {
+		c.MaxAttempts = defaultMaxAttempts
+	}
+	return c
+}
+
+var nonAlphanumeric = regexp.MustCompile(`[^A-Z0-9]+`)
+
+// secretEnv is the variable an exported webhook's secret is expected in.
+func secretEnv(name string) string {
+	return "WEBHOOK_SECRET_" + strings.Trim(nonAlphanumeric.ReplaceAllString(strings.ToUpper(name), "_"), "_")
+}
+
+func fromWebhook(c notify.WebhookConfig) Webhook {
+	w := Webhook{
+		Name:            c.Name,
+		URL:             c.URL,
+		PayloadTemplate: c.PayloadTemplate,
+		Severities:      c.Severities,
+		Headers:         c.Headers,
+		Enabled:         disabled(c.Enabled),
+		secret:          c.Secret,
+	}
+	if c.HasSecret {
+		w.SecretEnv = secretEnv(c.Name)
+	}
+	if c.MaxAttempts != defaultMaxAttempts {
+		w.MaxAttempts = c.MaxAttempts
+	}
+	if len(w.Severities) == 0 {
+		w.Severities = nil
+	}
+	if len(w.Headers) == 0 {
+		w.Headers = nil
+	}
+	return w
+}
+
+func (r EmailRecipient) key() string {
+	return r.Address + "|" + r.Severity + "|" + r.Location
+}
+
+func (r EmailRecipient) record() notify.EmailRecipient {
+	rec := notify.EmailRecipient{Address: r.Address, Enabled: enabled(r.Enabled)}
+	if r.Severity != "" {
+		rec.Severity = &r.Severity
+	}
+	if r.Location != "" {
+		rec.Location = &r.Location
+	}
+	return rec
+}
+
+func fromEmailRecipient(rec notify.EmailRecipient) EmailRecipient {
+	r := EmailRecipient{Address: rec.Address, Enabled: disabled(rec.Enabled)}
+	if rec.Severity != nil {
+		r.Severity = *rec.Severity
+	}
+	if rec.Location != nil {
+		r.Location = *rec.Location
+	}
+	return r
+}
+
+// placeholder converts the matcher for validation only: named machines and
+// rules become nil IDs.
+func (m Matcher) placeholder() processing.SilenceMatcher {
+	var sm processing.SilenceMatcher
+	if m.Machine != "" {
+		sm.MachineID = &uuid.UUID{}
+	}
+	if m.Rule != "" {
+		sm.RuleID = &uuid.UUID{}
+	}
+	if m.Location != "" {
+		sm.Location = &m.Location
+	}
+	if m.Severity != "" {
+		sm.Severity = &m.Severity
+	}
+	return sm
+}
+
+func (m Matcher) String() string {
+	var parts []string
+	for _, p := range [][2]string{{"machine", m.Machine}, {"location", m.Location}, {"rule", m.Rule}, {"severity", m.Severity}} {
+		if p[1] != "" {
+			parts = append(parts, p[0]+"="+p[1])
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (s Silence) key() string {
+	return fmt.Sprintf("%s|%s|%s|%s|%s", s.Matcher, s.StartsAt.UTC().Format(time.RFC3339), s.EndsAt.UTC().Format(time.RFC3339), s.Reason, s.CreatedBy)
+}
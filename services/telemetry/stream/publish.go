@@ -0,0 +1,95 @@
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AlertsChannel is the Postgres NOTIFY channel a trigger on alerts signals,
+// with the lifecycle event as JSON payload, on every transition. Listening
+// rather than publishing from the alert service streams transitions made by
+// any instance and by background jobs alike.
+const AlertsChannel = "alert_events"
+
+// PublishReading streams a reading that was just ingested.
+func (h *Hub) PublishReading(ctx context.Context, r Reading) {
+	if h.subscribers() == 0 {
+		return
+	}
+	if r.Location == "" {
+		r.Location = h.location(ctx, r.MachineID)
+	}
+	h.publish(Event{Type: EventReading, Reading: &r})
+}
+
+// location looks up a machine's location once and caches it; machines do
+// not move.
+func (h *Hub) location(ctx context.Context, machineID uuid.UUID) string {
+	h.locMu.RLock()
+	location, ok := h.locations[machineID]
+	h.locMu.RUnlock()
+	if ok {
+		return location
+	}
+
+	err := h.db.QueryRow(ctx, "SELECT COALESCE(location, '') FROM machines WHERE id = $1", machineID).Scan(&location)
+	if err != nil {
+		log.Printf("Failed to look up location of machine %s: %v", machineID, err)
+		return ""
+	}
+	h.locMu.Lock()
+	h.locations[machineID] = location
+	h.locMu.Unlock()
+	return location
+}
+
+// ListenForAlerts streams alert lifecycle events until ctx is done.
+// Transitions made while the connection is down are not replayed.
+func (h *Hub) ListenForAlerts(ctx context.Context) {
+	log.Printf("Listening for alert events on %s", AlertsChannel)
+	for {
+		err := h.listenAlerts(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Alert event listener disconnected, retrying: %v", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (h *Hub) listenAlerts(ctx context.Context) error {
+	pooled, err := h.db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// A connection that was LISTENing must not go back to the pool.
+	conn := pooled.Hijack()
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+AlertsChannel); err != nil {
+		return err
+	}
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		var alert Alert
+		if err := json.Unmarshal([]byte(n.Payload), &alert); err != nil {
+			log.Printf("Ignoring malformed alert event %q: %v", n.Payload, err)
+			continue
+		}
+		h.publish(Event{Type: EventAlert, Alert: &alert})
+	}
+}
@@ -0,0 +1,220 @@
+// Package stream pushes readings and alert lifecycle events to live
+// subscribers such as the API's Server-Sent Events and WebSocket clients.
+// Each subscriber gets its own buffer; one that falls behind is evicted
+// rather than allowed to hold up ingest or the other subscribers.
+package stream
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// BufferSize is how many events a subscriber may fall behind by before it
+// is evicted as a slow consumer.
+const BufferSize = 256
+
+// Event types.
+const (
+	EventReading = "reading"
+	EventAlert   = "alert"
+)
+
+var EventTypes = []string{EventReading, EventAlert}
+
+var (
+	ErrSlowConsumer = errors.New("subscriber fell too far behind and was disconnected")
+	ErrClosed       = errors.New("stream is shutting down")
+)
+
+// Reading is a metric reading as it was ingested.
+type Reading struct {
+	MachineID  uuid.UUID `json:"machine_id"`
+	Location   string    `json:"location"`
+	MetricName string    `json:"metric_name"`
+	Value      float64   `json:"value"`
+	Unit       string    `json:"unit"`
+	Quality    string    `json:"quality"`
+	Time       time.Time `json:"time"`
+}
+
+// Alert is a change in an alert's lifecycle. Event is raised, reactivated,
+// acknowledged, resolved, closed, severity_changed, escalated, shelved or
+// unshelved.
+type Alert struct {
+	ID         uuid.UUID  `json:"id"`
+	Event      string     `json:"event"`
+	MachineID  uuid.UUID  `json:"machine_id"`
+	Location   string     `json:"location"`
+	RuleID     *uuid.UUID `json:"rule_id"`
+	MetricName string     `json:"metric_name"`
+	Severity   string     `json:"severity"`
+	State      string     `json:"state"`
+	Suppressed bool       `json:"suppressed"`
+	Message    string     `json:"message"`
+	Time       time.Time  `json:"time"`
+}
+
+// Event is one message to a subscriber. Exactly one of Reading and Alert is
+// set, according to Type.
+type Event struct {
+	Type    string   `json:"type"`
+	Reading *Reading `json:"reading,omitempty"`
+	Alert   *Alert   `json:"alert,omitempty"`
+}
+
+// Filter selects the events a subscriber receives. Empty fields match
+// everything; Severities only narrows alert events.
+type Filter struct {
+	Types      []string
+	Machines   []uuid.UUID
+	Metrics    []string
+	Locations  []string
+	Severities []string
+}
+
+func (f Filter) matches(e Event) bool {
+	if len(f.Types) > 0 && !contains(f.Types, e.Type) {
+		return false
+	}
+
+	var machineID uuid.UUID
+	var metricName, location string
+	switch e.Type {
+	case EventReading:
+		machineID, metricName, location = e.Reading.MachineID, e.Reading.MetricName, e.Reading.Location
+	case EventAlert:
+		if len(f.Severities) > 0 && !contains(f.Severities, e.Alert.Severity) {
+			return false
+		}
+		machineID, metricName, location = e.Alert.MachineID, e.Alert.MetricName, e.Alert.Location
+	}
+
+	if len(f.Machines) > 0 && !contains(f.Machines, machineID) {
+		return false
+	}
+	if len(f.Metrics) > 0 && !contains(f.Metrics, metricName) {
+		return false
+	}
+	return len(f.Locations) == 0 || contains(f.Locations, location)
+}
+
+func contains[T comparable](list []T, v T) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscription is one subscriber's buffered feed of events.
+type Subscription struct {
+	filter Filter
+	events chan Event
+	done   chan struct{}
+	err    error
+}
+
+// Events delivers the subscriber's events in the order they were published.
+func (s *Subscription) Events() <-chan Event { return s.events }
+
+// Done is closed when the hub ends the subscription; Err then says why.
+func (s *Subscription) Done() <-chan struct{} { return s.done }
+
+func (s *Subscription) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// Hub fans events out to its subscriptions. It is safe for concurrent use.
+type Hub struct {
+	db *pgxpool.Pool
+
+	mu     sync.Mutex
+	subs   map[*Subscription]struct{}
+	closed bool
+
+	// locations caches each machine's location for filtering readings,
+	// which do not carry it.
+	locMu     sync.RWMutex
+	locations map[uuid.UUID]string
+}
+
+func NewHub(pool *pgxpool.Pool) *Hub {
+	return &Hub{
+		db:        pool,
+		subs:      make(map[*Subscription]struct{}),
+		locations: make(map[uuid.UUID]string),
+	}
+}
+
+func (h *Hub) Subscribe(f Filter) (*Subscription, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, ErrClosed
+	}
+
+	s := &Subscription{filter: f, events: make(chan Event, BufferSize), done: make(chan struct{})}
+	h.subs[s] = struct{}{}
+	return s, nil
+}
+
+// Unsubscribe ends a subscription whose client went away.
+func (h *Hub) Unsubscribe(s *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.end(s, nil)
+}
+
+// Close ends every subscription with ErrClosed and refuses new ones, so that
+// streaming handlers return and the HTTP server can shut down.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for s := range h.subs {
+		h.end(s, ErrClosed)
+	}
+}
+
+// end must be called with mu held.
+func (h *Hub) end(s *Subscription, err error) {
+	if _, ok := h.subs[s]; !ok {
+		return
+	}
+	delete(h.subs, s)
+	s.err = err
+	close(s.done)
+}
+
+func (h *Hub) subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+// publish hands e to every matching subscription without blocking. A
+// subscription whose buffer is full is evicted with ErrSlowConsumer.
+func (h *Hub) publish(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subs {
+		if !s.filter.matches(e) {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+			h.end(s, ErrSlowConsumer)
+		}
+	}
+}